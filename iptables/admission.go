@@ -0,0 +1,223 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Operation describes a single change a handle is about to make.
+type Operation struct {
+	// Kind is the operation, one of "append", "insert", "replace",
+	// "delete", "new-chain", "clear-chain", "rename-chain", "delete-chain",
+	// "flush", "policy" or "zero"
+	Kind  string
+	Proto Protocol
+	Table string
+	// Chain is empty for operations on a whole table, e.g. flushing it
+	Chain string
+	// Pos is the rule number of insert, replace and delete by number
+	Pos      int
+	Rulespec []string
+	// Policy is the target of a policy operation
+	Policy string
+	// NewName is the new chain name of a rename-chain operation
+	NewName string
+}
+
+// Rule returns the rule the operation adds or deletes in parsed form.
+func (op Operation) Rule() (Rule, error) {
+	return ParseRulespec(op.Chain, op.Rulespec...)
+}
+
+func (op Operation) String() string {
+	s := fmt.Sprintf("%s %s/%s", op.Kind, op.Table, op.Chain)
+	if len(op.Rulespec) > 0 {
+		s += " " + strings.Join(quoteArgs(op.Rulespec), " ")
+	}
+	return s
+}
+
+// Admission decides whether the changes of a handle may be made, e.g. to
+// enforce organization-wide guardrails such as never accepting 0.0.0.0/0 on
+// INPUT. Admit is called before every mutation, including each line of the
+// payloads of Restore, RestoreAll and Transaction.Commit, and the mutation
+// is rejected if it returns an error.
+type Admission interface {
+	Admit(op Operation) error
+}
+
+// AdmissionFunc adapts an ordinary function to the Admission interface.
+type AdmissionFunc func(op Operation) error
+
+// Admit calls f(op).
+func (f AdmissionFunc) Admit(op Operation) error {
+	return f(op)
+}
+
+// AdmissionError is returned when an Admission rejects an operation.
+type AdmissionError struct {
+	Op  Operation
+	Err error
+}
+
+func (e *AdmissionError) Error() string {
+	return fmt.Sprintf("operation %s rejected: %v", e.Op, e.Err)
+}
+
+func (e *AdmissionError) Unwrap() error {
+	return e.Err
+}
+
+// AdmissionControl makes the handle pass every mutation through a before
+// running it.
+func AdmissionControl(a Admission) option {
+	return func(ipt *IPTables) {
+		ipt.admission = a
+	}
+}
+
+// mutations are the operation kinds subject to admission.
+var mutations = map[string]bool{
+	"append":       true,
+	"insert":       true,
+	"replace":      true,
+	"delete":       true,
+	"new-chain":    true,
+	"rename-chain": true,
+	"delete-chain": true,
+	"flush":        true,
+	"policy":       true,
+	"zero":         true,
+}
+
+// parseOperation returns the operation performed by an iptables command
+// line, without the binary, or false if it isn't a mutation.
+func parseOperation(proto Protocol, args []string) (Operation, bool) {
+	op := Operation{Proto: proto, Table: "filter"}
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-t" && i+1 < len(args) && op.Kind == "":
+			op.Table = args[i+1]
+			i++
+		case op.Kind == "" && execOperations[args[i]] != "":
+			op.Kind = execOperations[args[i]]
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	if !mutations[op.Kind] {
+		return op, false
+	}
+
+	if len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+		op.Chain, rest = rest[0], rest[1:]
+	}
+	switch op.Kind {
+	case "insert", "replace", "delete", "zero":
+		if len(rest) > 0 {
+			if pos, err := strconv.Atoi(rest[0]); err == nil {
+				op.Pos, rest = pos, rest[1:]
+			}
+		}
+	case "policy":
+		if len(rest) > 0 {
+			op.Policy, rest = rest[0], rest[1:]
+		}
+	case "rename-chain":
+		if len(rest) > 0 {
+			op.NewName, rest = rest[0], rest[1:]
+		}
+	}
+	if len(rest) > 0 {
+		op.Rulespec = rest
+	}
+	return op, true
+}
+
+// admit runs the iptables command line args through the handle's
+// Admission, if any.
+func (ipt *IPTables) admit(args []string) error {
+	if ipt.admission == nil {
+		return nil
+	}
+	op, ok := parseOperation(ipt.proto, args)
+	if !ok {
+		return nil
+	}
+	if err := ipt.admission.Admit(op); err != nil {
+		return &AdmissionError{op, err}
+	}
+	return nil
+}
+
+// admitPayload runs every change of an iptables-restore payload through
+// the handle's Admission, if any.
+func (ipt *IPTables) admitPayload(payload []byte) error {
+	if ipt.admission == nil {
+		return nil
+	}
+	ops, err := payloadOperations(ipt.proto, payload)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if err := ipt.admission.Admit(op); err != nil {
+			return &AdmissionError{op, err}
+		}
+	}
+	return nil
+}
+
+// payloadOperations returns the changes made by an iptables-restore
+// payload. Chain declarations are returned as clear-chain operations, or
+// policy operations for builtin chains.
+func payloadOperations(proto Protocol, payload []byte) ([]Operation, error) {
+	var ops []Operation
+	table := ""
+	scanner := bufio.NewScanner(bytes.NewReader(payload))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line == "COMMIT" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "*"):
+			table = line[1:]
+		case strings.HasPrefix(line, ":"):
+			m := chainDefRegex.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("invalid chain declaration %q", line)
+			}
+			op := Operation{Kind: "clear-chain", Proto: proto, Table: table, Chain: m[1]}
+			if m[2] != "-" {
+				op.Kind, op.Policy = "policy", m[2]
+			}
+			ops = append(ops, op)
+		default:
+			args, err := splitRuleLine(line)
+			if err != nil {
+				return nil, err
+			}
+			if op, ok := parseOperation(proto, append([]string{"-t", table}, args...)); ok {
+				ops = append(ops, op)
+			}
+		}
+	}
+	return ops, scanner.Err()
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseOperation(t *testing.T) {
+	testCases := []struct {
+		args     []string
+		expected Operation
+		ok       bool
+	}{
+		{
+			[]string{"-t", "nat", "-I", "PREROUTING", "2", "-p", "tcp", "-j", "DNAT", "--to-destination", "10.0.0.1"},
+			Operation{Kind: "insert", Table: "nat", Chain: "PREROUTING", Pos: 2, Rulespec: []string{"-p", "tcp", "-j", "DNAT", "--to-destination", "10.0.0.1"}},
+			true,
+		},
+		{
+			[]string{"-t", "filter", "-P", "INPUT", "DROP"},
+			Operation{Kind: "policy", Table: "filter", Chain: "INPUT", Policy: "DROP"},
+			true,
+		},
+		{
+			[]string{"-t", "filter", "-E", "OLD", "NEW"},
+			Operation{Kind: "rename-chain", Table: "filter", Chain: "OLD", NewName: "NEW"},
+			true,
+		},
+		{
+			[]string{"-F"},
+			Operation{Kind: "flush", Table: "filter"},
+			true,
+		},
+		{
+			[]string{"-t", "filter", "-C", "INPUT", "-j", "ACCEPT"},
+			Operation{},
+			false,
+		},
+	}
+
+	for _, tt := range testCases {
+		op, ok := parseOperation(ProtocolIPv4, tt.args)
+		if ok != tt.ok {
+			t.Fatalf("parseOperation(%v): expected ok %v, got %v", tt.args, tt.ok, ok)
+		}
+		if ok && !reflect.DeepEqual(op, tt.expected) {
+			t.Fatalf("parseOperation(%v) mismatch: \ngot  %#v \nneed %#v", tt.args, op, tt.expected)
+		}
+	}
+}
+
+func TestAdmitPayload(t *testing.T) {
+	denied := errors.New("no open INPUT")
+	var seen []string
+	ipt := &IPTables{admission: AdmissionFunc(func(op Operation) error {
+		seen = append(seen, op.String())
+		rule, err := op.Rule()
+		if err != nil {
+			return err
+		}
+		if op.Kind == "append" && op.Chain == "INPUT" && rule.Source == "" && rule.Target == "ACCEPT" {
+			return denied
+		}
+		return nil
+	})}
+
+	payload := []byte("*filter\n:INPUT DROP [0:0]\n:FOO - [0:0]\n-A FOO -m comment --comment \"a b\" -j RETURN\n-A INPUT -j ACCEPT\nCOMMIT\n")
+	err := ipt.admitPayload(payload)
+
+	var aerr *AdmissionError
+	if !errors.As(err, &aerr) || !errors.Is(err, denied) {
+		t.Fatalf("expected an AdmissionError wrapping %v, got %v", denied, err)
+	}
+	expected := []string{
+		"policy filter/INPUT",
+		"clear-chain filter/FOO",
+		"append filter/FOO -m comment --comment \"a b\" -j RETURN",
+		"append filter/INPUT -j ACCEPT",
+	}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Fatalf("admitted operations mismatch: \ngot  %#v \nneed %#v", seen, expected)
+	}
+}
+
+func TestRegoAdmission(t *testing.T) {
+	op := Operation{Kind: "append", Table: "filter", Chain: "INPUT", Rulespec: []string{"-p", "tcp", "-j", "ACCEPT"}}
+	testCases := []struct {
+		decision interface{}
+		allowed  bool
+	}{
+		{true, true},
+		{false, false},
+		{nil, false},
+		{map[string]interface{}{"allow": true}, true},
+		{map[string]interface{}{"allow": false}, false},
+		{map[string]interface{}{"deny": []interface{}{}}, true},
+		{map[string]interface{}{"allow": true, "deny": []interface{}{"no open INPUT"}}, false},
+		{map[string]interface{}{}, false},
+	}
+
+	for _, tt := range testCases {
+		var input map[string]interface{}
+		a := RegoAdmission(RegoEvaluatorFunc(func(ctx context.Context, in map[string]interface{}) (interface{}, error) {
+			input = in
+			return tt.decision, nil
+		}))
+		if err := a.Admit(op); (err == nil) != tt.allowed {
+			t.Fatalf("decision %#v: expected allowed %v, got %v", tt.decision, tt.allowed, err)
+		}
+		rule, _ := input["rule"].(map[string]interface{})
+		if input["family"] != "ipv4" || input["chain"] != "INPUT" || rule["target"] != "ACCEPT" {
+			t.Fatalf("unexpected policy input %#v", input)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrAnchorNotFound is wrapped by the errors of InsertBefore and
+// InsertAfter when no rule matches the anchor.
+var ErrAnchorNotFound = errors.New("anchor rule not found")
+
+// RuleAnchor locates the existing rule InsertBefore and InsertAfter insert
+// next to. Build one with AnchorSpec or AnchorComment.
+type RuleAnchor struct {
+	spec    []string
+	comment string
+}
+
+// AnchorSpec matches the rule with the given rulespec. Rules are compared
+// after normalization (see NormalizeRule), so that the rulespec doesn't
+// need to be written the way iptables -S prints it.
+func AnchorSpec(rulespec ...string) RuleAnchor {
+	return RuleAnchor{spec: rulespec}
+}
+
+// AnchorComment matches the rules whose comment contains substring, as
+// FindByComment does.
+func AnchorComment(substring string) RuleAnchor {
+	return RuleAnchor{comment: substring}
+}
+
+func (a RuleAnchor) String() string {
+	if a.spec != nil {
+		return fmt.Sprintf("rule %q", strings.Join(a.spec, " "))
+	}
+	return fmt.Sprintf("comment %q", a.comment)
+}
+
+// InsertBefore inserts rulespec into table/chain immediately before the
+// first rule matching anchor, returning an error wrapping ErrAnchorNotFound
+// if there is none. The position is computed from a listing of the chain,
+// so the insertion is only as safe as Insert against changes made by others
+// in between, but it no longer depends on hard-coded positions.
+func (ipt *IPTables) InsertBefore(table, chain string, anchor RuleAnchor, rulespec ...string) error {
+	first, _, err := ipt.locateAnchor(table, chain, anchor)
+	if err != nil {
+		return err
+	}
+	return ipt.Insert(table, chain, first, rulespec...)
+}
+
+// InsertAfter inserts rulespec into table/chain immediately after the last
+// rule matching anchor, returning an error wrapping ErrAnchorNotFound if
+// there is none. See InsertBefore.
+func (ipt *IPTables) InsertAfter(table, chain string, anchor RuleAnchor, rulespec ...string) error {
+	_, last, err := ipt.locateAnchor(table, chain, anchor)
+	if err != nil {
+		return err
+	}
+	return ipt.Insert(table, chain, last+1, rulespec...)
+}
+
+// locateAnchor returns the positions of the first and last rules of
+// table/chain matching anchor.
+func (ipt *IPTables) locateAnchor(table, chain string, anchor RuleAnchor) (int, int, error) {
+	rules, err := ipt.ListWithLineNumbers(table, chain)
+	if err != nil {
+		return 0, 0, err
+	}
+	matching, err := anchor.match(chain, rules)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(matching) == 0 {
+		return 0, 0, fmt.Errorf("%w: no %s in chain %s of table %s", ErrAnchorNotFound, anchor, chain, table)
+	}
+	return matching[0].Pos, matching[len(matching)-1].Pos, nil
+}
+
+// match returns the rules matching a, in order.
+func (a RuleAnchor) match(chain string, rules []NumberedRule) ([]NumberedRule, error) {
+	if a.spec == nil {
+		return filterByComment(rules, a.comment), nil
+	}
+	want, err := ParseRule(strings.Join(quoteArgs(append([]string{"-A", chain}, a.spec...)), " "))
+	if err != nil {
+		return nil, err
+	}
+	key := NormalizeRule(want).String()
+	var matching []NumberedRule
+	for _, r := range rules {
+		if NormalizeRule(r.Rule).String() == key {
+			matching = append(matching, r)
+		}
+	}
+	return matching, nil
+}
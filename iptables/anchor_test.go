@@ -0,0 +1,74 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInsertRelative(t *testing.T) {
+	var inserted []string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		switch args[3] {
+		case "-v":
+			io.WriteString(stdout, `-N AGENT
+-A AGENT -i lo -c 0 0 -j ACCEPT
+-A AGENT -p tcp -m tcp --dport 22 -m comment --comment "agent: ssh" -c 0 0 -j ACCEPT
+-A AGENT -p tcp -m tcp --dport 80 -m comment --comment "agent: http" -c 0 0 -j ACCEPT
+-A AGENT -c 0 0 -j DROP
+`)
+		case "-I":
+			inserted = append(inserted, strings.Join(args[4:len(args)-1], " "))
+		}
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	if err := ipt.InsertBefore("filter", "AGENT", AnchorSpec("-j", "DROP"), "-j", "LOG"); err != nil {
+		t.Fatalf("InsertBefore failed: %v", err)
+	}
+	// the anchor doesn't need the implicit "-m tcp"
+	if err := ipt.InsertAfter("filter", "AGENT", AnchorSpec("-p", "tcp", "--dport", "22", "-m", "comment", "--comment", "agent: ssh", "-j", "ACCEPT"), "-j", "RETURN"); err != nil {
+		t.Fatalf("InsertAfter failed: %v", err)
+	}
+	if err := ipt.InsertBefore("filter", "AGENT", AnchorComment("agent:"), "-j", "MARK", "--set-mark", "1"); err != nil {
+		t.Fatalf("InsertBefore failed: %v", err)
+	}
+	if err := ipt.InsertAfter("filter", "AGENT", AnchorComment("agent:"), "-j", "MARK", "--set-mark", "2"); err != nil {
+		t.Fatalf("InsertAfter failed: %v", err)
+	}
+	expected := []string{
+		"AGENT 4 -j LOG",
+		"AGENT 3 -j RETURN",
+		"AGENT 2 -j MARK --set-mark 1",
+		"AGENT 4 -j MARK --set-mark 2",
+	}
+	if !reflect.DeepEqual(inserted, expected) {
+		t.Fatalf("unexpected insertions:\ngot  %q\nneed %q", inserted, expected)
+	}
+
+	err = ipt.InsertAfter("filter", "AGENT", AnchorComment("missing"), "-j", "ACCEPT")
+	if !errors.Is(err, ErrAnchorNotFound) {
+		t.Fatalf("expected ErrAnchorNotFound, got %v", err)
+	}
+}
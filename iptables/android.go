@@ -0,0 +1,91 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+)
+
+// androidBinDirs are the directories holding the iptables binaries on
+// Android, which are usually not in the PATH of apps and Termux.
+var androidBinDirs = []string{"/system/bin", "/system/xbin", "/vendor/bin"}
+
+// Android adapts the handle to Android's iptables: the binaries are looked
+// up in the system directories before PATH, and as vendor kernels often
+// lack tables, the tables a handle may use should be checked with
+// TableAvailable or AvailableTables, failures to use them being reported
+// as ErrTableUnavailable.
+func Android() option {
+	return func(ipt *IPTables) {
+		ipt.android = true
+	}
+}
+
+// androidLookPath resolves name in the Android system directories, falling
+// back to lookPath.
+func (ipt *IPTables) androidLookPath(name string) (string, error) {
+	if ipt.runner == nil && !ipt.disabledProbes[ProbeLookPath] && filepath.Base(name) == name {
+		for _, dir := range androidBinDirs {
+			if path, err := ipt.lookPath(filepath.Join(dir, name)); err == nil {
+				return path, nil
+			}
+		}
+	}
+	return ipt.lookPath(name)
+}
+
+// ErrTableUnavailable is matched by errors.Is for the *Error of commands
+// using a table the kernel doesn't provide or the process may not access.
+var ErrTableUnavailable = errors.New("table unavailable")
+
+// tableUnavailableRegex matches the messages of iptables for a table it
+// cannot use, e.g.
+//
+//	iptables v1.8.7 (legacy): can't initialize iptables table `raw': Table does not exist (do you need to insmod?)
+//	iptables v1.8.7 (nf_tables): table 'security' does not exist
+var tableUnavailableRegex = regexp.MustCompile("can't initialize ip6?tables table `[^']+'|table '[^']+' does not exist")
+
+// IsTableUnavailable returns true if the error is due to the table not
+// being available.
+func (e *Error) IsTableUnavailable() bool {
+	return tableUnavailableRegex.MatchString(e.msg)
+}
+
+// TableAvailable reports whether table can be used, by listing it.
+func (ipt *IPTables) TableAvailable(table string) (bool, error) {
+	_, err := ipt.executeList([]string{"-t", table, "-S"})
+	if errors.Is(err, ErrTableUnavailable) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// AvailableTables returns which of the filter, nat, mangle, raw and
+// security tables can be used.
+func (ipt *IPTables) AvailableTables() ([]string, error) {
+	var tables []string
+	for _, table := range standardTables {
+		ok, err := ipt.TableAvailable(table)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			tables = append(tables, table)
+		}
+	}
+	return tables, nil
+}
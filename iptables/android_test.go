@@ -0,0 +1,57 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestAvailableTables(t *testing.T) {
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		switch args[2] {
+		case "raw":
+			io.WriteString(stderr, "iptables v1.6.1: can't initialize iptables table `raw': Table does not exist (do you need to insmod?)\n")
+			return 3, nil
+		case "security":
+			io.WriteString(stderr, "iptables v1.8.7 (nf_tables): table 'security' does not exist\n")
+			return 1, nil
+		}
+		return 0, nil
+	})
+	ipt, err := New(Android(), CommandRunner(runner), CompatibilityProfile("1.6.1"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	tables, err := ipt.AvailableTables()
+	if err != nil {
+		t.Fatalf("AvailableTables failed: %v", err)
+	}
+	if !reflect.DeepEqual(tables, []string{"filter", "nat", "mangle"}) {
+		t.Fatalf("unexpected tables %v", tables)
+	}
+
+	err = ipt.Append("raw", "PREROUTING", "-j", "NOTRACK")
+	if !errors.Is(fmt.Errorf("setting up: %w", err), ErrTableUnavailable) {
+		t.Fatalf("expected ErrTableUnavailable, got %v", err)
+	}
+	if errors.Is(NewError([]string{"iptables"}, 1, "iptables: Bad rule (does a matching rule exist in that chain?).\n"), ErrTableUnavailable) {
+		t.Fatalf("a missing rule reported as an unavailable table")
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"io"
+)
+
+// ApplySaveFormat applies iptables-save formatted input, such as a
+// rules.v4 file, with iptables-restore. The input is parsed first, so that
+// malformed input is rejected before anything is applied, and its changes
+// go through admission control like those of RestoreAll.
+//
+// Without options, each table of the input replaces the table as a whole.
+// With RestoreNoFlush, only the chains declared in the input are replaced
+// and the other chains are left alone; builtin chains are flushed
+// explicitly, as iptables-restore --noflush doesn't flush them. Either way
+// applying the same input twice leaves the same rules. RestoreTables
+// restricts the tables applied, RestoreAppendOnly appends to chains
+// instead of replacing them, and RestoreCounters restores the counters of
+// the input.
+func (ipt *IPTables) ApplySaveFormat(r io.Reader, opts ...RestoreOption) error {
+	var cfg restoreConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	rulesets, err := ParseSave(string(data))
+	if err != nil {
+		return err
+	}
+	payload := saveFormatPayload(rulesets, cfg)
+	if len(payload) == 0 {
+		return nil
+	}
+
+	ops, err := payloadOperations(ipt.proto, payload)
+	if err != nil {
+		return err
+	}
+	if err := checkDeprecatedOperations(ops...); err != nil {
+		return err
+	}
+	if err := ipt.admitPayload(payload); err != nil {
+		return err
+	}
+	defer ipt.beginRestore()()
+	if err := ipt.runRestore(bytes.NewReader(payload), opts...); err != nil {
+		return err
+	}
+	ipt.recorder.record(ops...)
+	return nil
+}
+
+// saveFormatPayload builds the iptables-restore input of ApplySaveFormat
+// from the parsed rulesets.
+func saveFormatPayload(rulesets []Ruleset, cfg restoreConfig) []byte {
+	var p restorePayload
+	for _, rs := range rulesets {
+		if cfg.tables != nil && !cfg.tables[rs.Table] {
+			continue
+		}
+		names := make([]string, len(rs.Chains))
+		for i, c := range rs.Chains {
+			names[i] = c.Name
+		}
+		flushed := cfg.flushed(rs.Table, names)
+		declared := map[string]bool{}
+		for _, name := range flushed {
+			declared[name] = true
+		}
+
+		p.raw("*%s", rs.Table)
+		for _, c := range rs.Chains {
+			if !declared[c.Name] {
+				continue
+			}
+			if cfg.counters {
+				p.raw(":%s %s [%d:%d]", c.Name, c.Policy, c.Packets, c.Bytes)
+			} else {
+				p.raw(":%s %s", c.Name, c.Policy)
+			}
+		}
+		if cfg.noflush {
+			for _, name := range flushed {
+				p.line("-F", name)
+			}
+		}
+		for _, c := range rs.Chains {
+			for _, r := range c.Rules {
+				if cfg.counters {
+					p.raw("[%d:%d] %s", r.Packets, r.Bytes, r)
+				} else {
+					p.raw("%s", r)
+				}
+			}
+		}
+		p.raw("COMMIT")
+	}
+	return p.Bytes()
+}
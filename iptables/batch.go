@@ -0,0 +1,179 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Batcher collects operations and applies them together, with a single
+// Transaction, at most once per window. This reduces the number of
+// iptables-restore invocations, and the dataplane churn they cause, under
+// rapid successive updates.
+//
+// The first operation queued after an apply starts a timer of window plus
+// a random delay of up to jitter; everything queued until it fires is
+// applied at once. Errors of background applies are passed to the onError
+// callback given to NewBatcher.
+//
+// The operations of an apply that fails are dropped, so that a bad
+// operation doesn't hold back the ones queued after it, and returned in a
+// *BatchError for the caller to fix or queue again.
+type Batcher struct {
+	ipt     *IPTables
+	window  time.Duration
+	jitter  time.Duration
+	onError func(error)
+
+	// flushMu serializes applies, so that they run in order without
+	// holding mu while iptables-restore runs
+	flushMu sync.Mutex
+
+	mu     sync.Mutex
+	tx     *Transaction
+	timer  *time.Timer
+	closed bool
+}
+
+// BatchError is returned, or passed to the onError callback, when an apply
+// of a Batcher fails. Ops are the operations of the apply, none of which
+// were kept queued.
+type BatchError struct {
+	Ops []Operation
+	Err error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("dropped %d batched operations: %v", len(e.Ops), e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// NewBatcher returns a Batcher applying operations to this handle. onError
+// may be nil.
+func (ipt *IPTables) NewBatcher(window, jitter time.Duration, onError func(error)) *Batcher {
+	return &Batcher{
+		ipt:     ipt,
+		window:  window,
+		jitter:  jitter,
+		onError: onError,
+		tx:      ipt.NewTransaction(),
+	}
+}
+
+// NewChain queues the creation of a new chain in the specified table.
+func (b *Batcher) NewChain(table, chain string) error {
+	return b.queue(func(tx *Transaction) { tx.NewChain(table, chain) })
+}
+
+// ClearChain queues flushing the specified table/chain, creating it if it
+// does not exist.
+func (b *Batcher) ClearChain(table, chain string) error {
+	return b.queue(func(tx *Transaction) { tx.ClearChain(table, chain) })
+}
+
+// DeleteChain queues the deletion of the chain in the specified table.
+func (b *Batcher) DeleteChain(table, chain string) error {
+	return b.queue(func(tx *Transaction) { tx.DeleteChain(table, chain) })
+}
+
+// Append queues appending rulespec to specified table/chain
+func (b *Batcher) Append(table, chain string, rulespec ...string) error {
+	return b.queue(func(tx *Transaction) { tx.Append(table, chain, rulespec...) })
+}
+
+// Insert queues inserting rulespec to specified table/chain (in specified pos)
+func (b *Batcher) Insert(table, chain string, pos int, rulespec ...string) error {
+	return b.queue(func(tx *Transaction) { tx.Insert(table, chain, pos, rulespec...) })
+}
+
+// Delete queues removing rulespec in specified table/chain
+func (b *Batcher) Delete(table, chain string, rulespec ...string) error {
+	return b.queue(func(tx *Transaction) { tx.Delete(table, chain, rulespec...) })
+}
+
+// Pending returns the operations queued since the last apply.
+func (b *Batcher) Pending() []Operation {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tx.operations()
+}
+
+// Flush applies the queued operations right away.
+func (b *Batcher) Flush() error {
+	return b.flush()
+}
+
+// Close applies the queued operations and stops the Batcher. Operations
+// queued afterwards are rejected.
+func (b *Batcher) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	return b.flush()
+}
+
+func (b *Batcher) queue(fn func(*Transaction)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return fmt.Errorf("batcher is closed")
+	}
+	fn(b.tx)
+	if b.timer == nil {
+		delay := b.window
+		if b.jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(b.jitter)))
+		}
+		b.timer = time.AfterFunc(delay, b.apply)
+	}
+	return nil
+}
+
+// apply is called by the timer.
+func (b *Batcher) apply() {
+	if err := b.flush(); err != nil && b.onError != nil {
+		b.onError(err)
+	}
+}
+
+// flush commits the pending transaction. On failure its operations are
+// dropped and returned in a *BatchError.
+func (b *Batcher) flush() error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	tx := b.tx
+	b.tx = b.ipt.NewTransaction()
+	b.mu.Unlock()
+
+	if tx.Len() == 0 {
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		return &BatchError{Ops: tx.operations(), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// restoreLog is a Runner recording iptables-restore payloads, failing
+// those jumping to BAD and calling during, if set, while one runs.
+type restoreLog struct {
+	mu       sync.Mutex
+	payloads []string
+	during   func()
+}
+
+func (r *restoreLog) Run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	data, _ := io.ReadAll(stdin)
+	if r.during != nil {
+		r.during()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if strings.Contains(string(data), "-j BAD") {
+		io.WriteString(stderr, "iptables-restore: line 2 failed\n")
+		return 1, nil
+	}
+	r.payloads = append(r.payloads, string(data))
+	return 0, nil
+}
+
+func (r *restoreLog) applied() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.payloads...)
+}
+
+func TestBatcherWindow(t *testing.T) {
+	r := &restoreLog{}
+	ipt, err := New(CommandRunner(r), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	errs := make(chan error, 1)
+	b := ipt.NewBatcher(20*time.Millisecond, 10*time.Millisecond, func(err error) { errs <- err })
+
+	for _, port := range []string{"22", "80", "443"} {
+		if err := b.Append("filter", "INPUT", "-p", "tcp", "--dport", port, "-j", "ACCEPT"); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.applied()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	applied := r.applied()
+	if len(applied) != 1 || strings.Count(applied[0], "-A INPUT") != 3 {
+		t.Fatalf("expected the operations to be applied in one restore, got %q", applied)
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("unexpected apply error: %v", err)
+	default:
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := b.Append("filter", "INPUT", "-j", "DROP"); err == nil {
+		t.Fatalf("expected Append after Close to fail")
+	}
+}
+
+func TestBatcherFailure(t *testing.T) {
+	r := &restoreLog{}
+	ipt, err := New(CommandRunner(r), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	errs := make(chan error, 1)
+	b := ipt.NewBatcher(10*time.Millisecond, 0, func(err error) { errs <- err })
+
+	// a bad operation is dropped with its batch
+	if err := b.Append("filter", "INPUT", "-j", "BAD"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	var berr *BatchError
+	var eerr *Error
+	if err := b.Flush(); !errors.As(err, &berr) || !errors.As(err, &eerr) {
+		t.Fatalf("expected Flush to fail with a *BatchError, got %v", err)
+	}
+	if len(berr.Ops) != 1 || berr.Ops[0].Kind != "append" || berr.Ops[0].Rulespec[1] != "BAD" {
+		t.Fatalf("unexpected dropped operations %+v", berr.Ops)
+	}
+	if len(b.Pending()) != 0 {
+		t.Fatalf("expected no pending operations, got %+v", b.Pending())
+	}
+
+	// and doesn't hold back the operations queued after it
+	if err := b.Append("filter", "INPUT", "-j", "BAD"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	select {
+	case err := <-errs:
+		if !errors.As(err, &berr) {
+			t.Fatalf("expected a *BatchError, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the bad operation was never applied")
+	}
+	if err := b.NewChain("filter", "AGENT"); err != nil {
+		t.Fatalf("NewChain failed: %v", err)
+	}
+	if err := b.Append("filter", "AGENT", "-j", "DROP"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.applied()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	applied := r.applied()
+	if len(applied) != 1 || !strings.Contains(applied[0], "-N AGENT\n-A AGENT -j DROP\n") || strings.Contains(applied[0], "BAD") {
+		t.Fatalf("expected only the good operations to be applied, got %q", applied)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+func TestBatcherQueueDuringApply(t *testing.T) {
+	r := &restoreLog{}
+	ipt, err := New(CommandRunner(r), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	b := ipt.NewBatcher(time.Hour, 0, nil)
+
+	// queueing must not wait for the running iptables-restore
+	queued := make(chan error, 1)
+	r.during = func() {
+		r.during = nil
+		go func() { queued <- b.Append("filter", "INPUT", "-j", "LOG") }()
+		select {
+		case err := <-queued:
+			queued <- err
+		case <-time.After(5 * time.Second):
+			t.Errorf("Append blocked while iptables-restore ran")
+		}
+	}
+	if err := b.Append("filter", "INPUT", "-j", "DROP"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if err := <-queued; err != nil {
+		t.Fatalf("Append during apply failed: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	applied := r.applied()
+	if len(applied) != 2 || !strings.Contains(applied[1], "-A INPUT -j LOG") {
+		t.Fatalf("expected the operation queued during the apply to be applied next, got %q", applied)
+	}
+}
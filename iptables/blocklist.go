@@ -0,0 +1,299 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blocklistComment tags the rules of a Blocklist; the expiry, if any,
+// follows as " expires=<unix time>".
+const blocklistComment = "blocklist"
+
+// BlocklistEntry is an address blocked by a Blocklist.
+type BlocklistEntry struct {
+	// Addr is the blocked address, e.g. "192.0.2.1/32"
+	Addr string
+	// Expires is when the address is unblocked, zero for never
+	Expires time.Time
+}
+
+// Blocklist maintains a dedicated chain of rules blocking addresses, each
+// for a limited time or for good, for fail2ban-style uses. The expiry of
+// each address is kept in the comment of its rule, so that a Blocklist
+// created on the same chain after a restart picks up where the previous
+// one left off. Expired addresses are unblocked by Expire, which Run
+// calls periodically. A Blocklist is safe for concurrent use, but a chain
+// should only be managed by a single one.
+type Blocklist struct {
+	ipt     *IPTables
+	table   string
+	chain   string
+	target  string
+	jumps   []string
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+// BlocklistOption configures a Blocklist.
+type BlocklistOption func(*Blocklist)
+
+// BlocklistTable makes the Blocklist use a chain of table instead of
+// filter.
+func BlocklistTable(table string) BlocklistOption {
+	return func(b *Blocklist) {
+		b.table = table
+	}
+}
+
+// BlocklistTarget makes the rules of the Blocklist jump to target, e.g.
+// REJECT, instead of DROP.
+func BlocklistTarget(target string) BlocklistOption {
+	return func(b *Blocklist) {
+		b.target = target
+	}
+}
+
+// BlocklistJumpFrom makes NewBlocklist insert a jump to the chain of the
+// Blocklist first in the given chains of its table, e.g. INPUT, unless
+// they have one. Without it, the chain has to be jumped to by the caller.
+func BlocklistJumpFrom(chains ...string) BlocklistOption {
+	return func(b *Blocklist) {
+		b.jumps = append(b.jumps, chains...)
+	}
+}
+
+// NewBlocklist returns a Blocklist managing chain, which it creates unless
+// it exists. The addresses blocked by the rules already in the chain are
+// loaded, together with their expiry; rules not made by a Blocklist are
+// left alone. An address blocked by several rules, as left behind by a
+// crash in the middle of Add, keeps its last rule and the others are
+// deleted.
+func (ipt *IPTables) NewBlocklist(chain string, opts ...BlocklistOption) (*Blocklist, error) {
+	b := &Blocklist{ipt: ipt, table: TableFilter, chain: chain, target: "DROP", entries: map[string]time.Time{}}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if _, err := ipt.EnsureChain(b.table, chain); err != nil {
+		return nil, err
+	}
+	rules, err := ipt.ListParsed(b.table, chain)
+	if err != nil {
+		return nil, err
+	}
+	specs := map[string][]string{}
+	var stale [][]string
+	for _, r := range rules {
+		addr, expires, ok := parseBlocklistRule(r)
+		if !ok {
+			continue
+		}
+		if spec, dup := specs[addr]; dup {
+			stale = append(stale, spec)
+		}
+		specs[addr] = r.Spec()
+		b.entries[addr] = expires
+	}
+	for _, spec := range stale {
+		if err := b.deleteRule(spec); err != nil {
+			return nil, err
+		}
+	}
+	for _, from := range b.jumps {
+		if err := ipt.InsertUnique(b.table, from, 1, "-j", chain); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// parseBlocklistRule returns the address blocked by a rule of a Blocklist
+// and its expiry, or false for other rules.
+func parseBlocklistRule(r Rule) (string, time.Time, bool) {
+	comment := ruleComment(r)
+	if r.Source == "" || strings.HasPrefix(r.Source, "!") || !strings.HasPrefix(comment, blocklistComment) {
+		return "", time.Time{}, false
+	}
+	var expires time.Time
+	switch rest := strings.TrimPrefix(comment, blocklistComment); {
+	case rest == "":
+	case strings.HasPrefix(rest, " expires="):
+		sec, err := strconv.ParseInt(strings.TrimPrefix(rest, " expires="), 10, 64)
+		if err != nil {
+			return "", time.Time{}, false
+		}
+		expires = time.Unix(sec, 0)
+	default:
+		return "", time.Time{}, false
+	}
+	return normalizeAddress(r.Source), expires, true
+}
+
+// blocklistAddr returns the address of ip as listed by iptables.
+func blocklistAddr(ip net.IP) (string, error) {
+	if ip == nil {
+		return "", fmt.Errorf("invalid address")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String() + "/32", nil
+	}
+	return ip.String() + "/128", nil
+}
+
+// rulespec returns the rule blocking addr until expires.
+func (b *Blocklist) rulespec(addr string, expires time.Time) []string {
+	comment := blocklistComment
+	if !expires.IsZero() {
+		comment += " expires=" + strconv.FormatInt(expires.Unix(), 10)
+	}
+	return []string{"-s", addr, "-m", "comment", "--comment", comment, "-j", b.target}
+}
+
+// Add blocks ip for ttl, or for good if ttl is 0. Adding a blocked address
+// again changes its expiry; the new rule is added before the old one is
+// deleted, so that the address remains blocked in between.
+func (b *Blocklist) Add(ip net.IP, ttl time.Duration) error {
+	return b.add(ip, ttl, time.Now())
+}
+
+func (b *Blocklist) add(ip net.IP, ttl time.Duration, now time.Time) error {
+	addr, err := blocklistAddr(ip)
+	if err != nil {
+		return err
+	}
+	var expires time.Time
+	if ttl > 0 {
+		expires = now.Add(ttl)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old, blocked := b.entries[addr]
+	if blocked && old.Unix() == expires.Unix() {
+		return nil
+	}
+	if err := b.ipt.Append(b.table, b.chain, b.rulespec(addr, expires)...); err != nil {
+		return err
+	}
+	b.entries[addr] = expires
+	if blocked {
+		return b.deleteRule(b.rulespec(addr, old))
+	}
+	return nil
+}
+
+// Remove unblocks ip. Removing an address that isn't blocked is not an
+// error.
+func (b *Blocklist) Remove(ip net.IP) error {
+	addr, err := blocklistAddr(ip)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.remove(addr)
+}
+
+// remove deletes the rule of addr; b.mu must be held.
+func (b *Blocklist) remove(addr string) error {
+	expires, blocked := b.entries[addr]
+	if !blocked {
+		return nil
+	}
+	if err := b.deleteRule(b.rulespec(addr, expires)); err != nil {
+		return err
+	}
+	delete(b.entries, addr)
+	return nil
+}
+
+// deleteRule deletes a rule of the chain. A rule deleted out of band is
+// gone already, which is not an error.
+func (b *Blocklist) deleteRule(rulespec []string) error {
+	err := b.ipt.Delete(b.table, b.chain, rulespec...)
+	var eerr *Error
+	if errors.As(err, &eerr) && eerr.IsNotExist() {
+		return nil
+	}
+	return err
+}
+
+// Entries returns the blocked addresses, sorted.
+func (b *Blocklist) Entries() []BlocklistEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entries := make([]BlocklistEntry, 0, len(b.entries))
+	for _, addr := range sortedKeys(b.entries) {
+		entries = append(entries, BlocklistEntry{Addr: addr, Expires: b.entries[addr]})
+	}
+	return entries
+}
+
+// Expire unblocks the addresses whose time is up, and returns how many
+// were unblocked. Failing addresses don't hold the others back; they are
+// reported together as a *MultiError, and retried by the next call.
+func (b *Blocklist) Expire() (int, error) {
+	return b.expire(time.Now())
+}
+
+func (b *Blocklist) expire(now time.Time) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var expired []string
+	for addr, expires := range b.entries {
+		if !expires.IsZero() && !expires.After(now) {
+			expired = append(expired, addr)
+		}
+	}
+	sort.Strings(expired)
+	var errs multiErrorBuilder
+	n := 0
+	for _, addr := range expired {
+		op := Operation{Kind: "delete", Proto: b.ipt.proto, Table: b.table, Chain: b.chain, Rulespec: b.rulespec(addr, b.entries[addr])}
+		if errs.add(op, b.remove(addr)) {
+			n++
+		}
+	}
+	return n, errs.err()
+}
+
+// Run calls Expire every interval until ctx is done, passing its errors to
+// onError, which may be nil. It returns an error right away if interval
+// isn't positive, and nil once ctx is done.
+func (b *Blocklist) Run(ctx context.Context, interval time.Duration, onError func(error)) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid interval %v", interval)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := b.Expire(); err != nil && onError != nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
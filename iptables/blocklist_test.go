@@ -0,0 +1,169 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blocklistChain is a runner keeping the rules of a single chain, which it
+// lists with counters like iptables -v -S.
+type blocklistChain struct {
+	rules []string
+	// fail makes the deletion of the rules containing it fail
+	fail string
+}
+
+func (bc *blocklistChain) Run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	args = args[:len(args)-1]
+	switch args[3] {
+	case "-v":
+		fmt.Fprintf(stdout, "-N %s\n", args[5])
+		for _, r := range bc.rules {
+			fmt.Fprintf(stdout, "-A %s %s -c 0 0\n", args[5], r)
+		}
+	case "-A":
+		bc.rules = append(bc.rules, strings.Join(quoteArgs(args[5:]), " "))
+	case "-D":
+		rule := strings.Join(quoteArgs(args[5:]), " ")
+		if bc.fail != "" && strings.Contains(rule, bc.fail) {
+			fmt.Fprintln(stderr, "iptables: Permission denied.")
+			return 4, nil
+		}
+		for i, r := range bc.rules {
+			if r == rule {
+				bc.rules = append(bc.rules[:i], bc.rules[i+1:]...)
+				return 0, nil
+			}
+		}
+		fmt.Fprintln(stderr, "iptables: Bad rule (does a matching rule exist in that chain?).")
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func TestBlocklist(t *testing.T) {
+	bc := &blocklistChain{rules: []string{"-s 10.0.0.9/32 -j ACCEPT"}}
+	ipt, err := New(CommandRunner(bc), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	b, err := ipt.NewBlocklist("BLOCK", BlocklistTarget("REJECT"))
+	if err != nil {
+		t.Fatalf("NewBlocklist failed: %v", err)
+	}
+	if entries := b.Entries(); len(entries) != 0 {
+		t.Fatalf("foreign rule loaded as %v", entries)
+	}
+
+	now := time.Unix(1000, 0)
+	if err := b.add(net.ParseIP("192.0.2.1"), time.Minute, now); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := b.add(net.ParseIP("2001:db8::1"), 0, now); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := b.add(net.ParseIP("192.0.2.1"), time.Hour, now); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	expected := []string{
+		"-s 10.0.0.9/32 -j ACCEPT",
+		`-s 2001:db8::1/128 -m comment --comment blocklist -j REJECT`,
+		`-s 192.0.2.1/32 -m comment --comment "blocklist expires=4600" -j REJECT`,
+	}
+	if !reflect.DeepEqual(bc.rules, expected) {
+		t.Fatalf("rules mismatch: \ngot  %q \nneed %q", bc.rules, expected)
+	}
+
+	// A new Blocklist picks up the addresses from the chain.
+	b, err = ipt.NewBlocklist("BLOCK", BlocklistTarget("REJECT"))
+	if err != nil {
+		t.Fatalf("NewBlocklist failed: %v", err)
+	}
+	entries := []BlocklistEntry{
+		{Addr: "192.0.2.1/32", Expires: time.Unix(4600, 0)},
+		{Addr: "2001:db8::1/128"},
+	}
+	if got := b.Entries(); !reflect.DeepEqual(got, entries) {
+		t.Fatalf("entries mismatch: \ngot  %v \nneed %v", got, entries)
+	}
+
+	if n, err := b.expire(time.Unix(4599, 0)); n != 0 || err != nil {
+		t.Fatalf("expected nothing to expire, got %d, %v", n, err)
+	}
+	if n, err := b.expire(time.Unix(4600, 0)); n != 1 || err != nil {
+		t.Fatalf("expected an expiry, got %d, %v", n, err)
+	}
+	if err := b.Remove(net.ParseIP("2001:db8::1")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := b.Remove(net.ParseIP("2001:db8::1")); err != nil {
+		t.Fatalf("Remove of an unblocked address failed: %v", err)
+	}
+	if !reflect.DeepEqual(bc.rules, expected[:1]) {
+		t.Fatalf("rules left: %q", bc.rules)
+	}
+}
+
+func TestBlocklistRecovery(t *testing.T) {
+	bc := &blocklistChain{rules: []string{
+		`-s 192.0.2.1/32 -m comment --comment "blocklist expires=100" -j DROP`,
+		`-s 192.0.2.1/32 -m comment --comment "blocklist expires=200" -j DROP`,
+		`-s 192.0.2.2/32 -m comment --comment "blocklist expires=200" -j DROP`,
+		`-s 192.0.2.3/32 -m comment --comment "blocklist expires=200" -j DROP`,
+	}}
+	ipt, err := New(CommandRunner(bc), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	b, err := ipt.NewBlocklist("BLOCK")
+	if err != nil {
+		t.Fatalf("NewBlocklist failed: %v", err)
+	}
+	// the rule of an interrupted Add is deleted on load
+	if len(bc.rules) != 3 || strings.Contains(bc.rules[0], "expires=100") {
+		t.Fatalf("expected the stale rule to be deleted, got %q", bc.rules)
+	}
+
+	// 192.0.2.1 was unblocked out of band, and 192.0.2.2 can't be
+	bc.rules = bc.rules[1:]
+	bc.fail = "192.0.2.2/32"
+	n, err := b.expire(time.Unix(200, 0))
+	merr, ok := err.(*MultiError)
+	if n != 2 || !ok || len(merr.Errors) != 1 || !strings.Contains(merr.Errors[0].Op.String(), "192.0.2.2/32") {
+		t.Fatalf("expected every other address to expire, got %d, %v", n, err)
+	}
+	if entries := b.Entries(); len(entries) != 1 || entries[0].Addr != "192.0.2.2/32" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+	bc.fail = ""
+	if n, err := b.expire(time.Unix(200, 0)); n != 1 || err != nil {
+		t.Fatalf("expected the failed address to be retried, got %d, %v", n, err)
+	}
+	if len(bc.rules) != 0 {
+		t.Fatalf("rules left: %q", bc.rules)
+	}
+
+	if err := b.Run(context.Background(), 0, nil); err == nil {
+		t.Fatalf("expected a zero interval to be refused")
+	}
+}
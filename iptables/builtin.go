@@ -0,0 +1,95 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The tables of iptables.
+const (
+	TableFilter   = "filter"
+	TableNAT      = "nat"
+	TableMangle   = "mangle"
+	TableRaw      = "raw"
+	TableSecurity = "security"
+)
+
+// The builtin chains, see BuiltinChains for the tables having them.
+const (
+	ChainPrerouting  = "PREROUTING"
+	ChainInput       = "INPUT"
+	ChainForward     = "FORWARD"
+	ChainOutput      = "OUTPUT"
+	ChainPostrouting = "POSTROUTING"
+)
+
+// builtinChains are the builtin chains of each table, in the order
+// iptables lists them.
+var builtinChains = map[string][]string{
+	TableFilter:   {ChainInput, ChainForward, ChainOutput},
+	TableNAT:      {ChainPrerouting, ChainInput, ChainOutput, ChainPostrouting},
+	TableMangle:   {ChainPrerouting, ChainInput, ChainForward, ChainOutput, ChainPostrouting},
+	TableRaw:      {ChainPrerouting, ChainOutput},
+	TableSecurity: {ChainInput, ChainForward, ChainOutput},
+}
+
+// BuiltinChains returns the builtin chains of table, or nil if the table
+// is unknown.
+func BuiltinChains(table string) []string {
+	return append([]string(nil), builtinChains[table]...)
+}
+
+// IsBuiltinChain reports whether chain is a builtin chain of table.
+func IsBuiltinChain(table, chain string) bool {
+	for _, c := range builtinChains[table] {
+		if c == chain {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrBuiltinChain matches the errors of the operations refused because
+// they target a builtin chain.
+var ErrBuiltinChain = errors.New("builtin chain")
+
+// BuiltinChainError is returned by DeleteChain and RenameChain for the
+// builtin chains, which cannot be deleted or renamed, and by RestoreChains,
+// which doesn't replace them, without running iptables.
+type BuiltinChainError struct {
+	// Op is the operation refused, e.g. "delete-chain"
+	Op    string
+	Table string
+	Chain string
+}
+
+func (e *BuiltinChainError) Error() string {
+	return fmt.Sprintf("cannot %s: %s is a builtin chain of table %s", e.Op, e.Chain, e.Table)
+}
+
+// Is makes errors.Is match ErrBuiltinChain.
+func (e *BuiltinChainError) Is(target error) bool {
+	return target == ErrBuiltinChain
+}
+
+// checkNotBuiltin returns a *BuiltinChainError if chain is builtin.
+func checkNotBuiltin(op, table, chain string) error {
+	if IsBuiltinChain(table, chain) {
+		return &BuiltinChainError{Op: op, Table: table, Chain: chain}
+	}
+	return nil
+}
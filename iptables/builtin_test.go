@@ -0,0 +1,56 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestBuiltinChains(t *testing.T) {
+	if !IsBuiltinChain(TableNAT, ChainPostrouting) || IsBuiltinChain(TableFilter, ChainPostrouting) || IsBuiltinChain(TableFilter, "AGENT") {
+		t.Fatalf("unexpected builtin chains")
+	}
+	chains := BuiltinChains(TableRaw)
+	chains[0] = "MODIFIED"
+	if BuiltinChains(TableRaw)[0] != ChainPrerouting {
+		t.Fatalf("BuiltinChains returned its own slice")
+	}
+
+	calls := 0
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls++
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	var berr *BuiltinChainError
+	if err := ipt.DeleteChain(TableFilter, ChainInput); !errors.As(err, &berr) || berr.Op != "delete-chain" {
+		t.Fatalf("expected a BuiltinChainError, got %v", err)
+	}
+	if err := ipt.RenameChain(TableMangle, ChainForward, "FWD"); !errors.Is(err, ErrBuiltinChain) {
+		t.Fatalf("expected ErrBuiltinChain, got %v", err)
+	}
+	if calls != 0 {
+		t.Fatalf("iptables was run %d times", calls)
+	}
+	if err := ipt.DeleteChain(TableFilter, "AGENT"); err != nil || calls != 1 {
+		t.Fatalf("DeleteChain of a user chain failed: %v", err)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Capabilities describes the iptables binary a handle drives: its version
+// and mode, and the features the library relies on.
+type Capabilities struct {
+	Major, Minor, Patch int
+	// Mode is the operating mode, "legacy" or "nf_tables"
+	Mode string
+	// Check is set if rules can be checked with -C
+	Check bool
+	// Wait is set if --wait is supported, WaitSeconds if it accepts a
+	// timeout
+	Wait        bool
+	WaitSeconds bool
+	// WaitInterval is set if --wait-interval is supported, see the
+	// WaitInterval option
+	WaitInterval bool
+	// RandomFully is set if --random-fully is supported
+	RandomFully bool
+	// RestoreWait is set if iptables-restore supports --wait
+	RestoreWait bool
+	// BusyBox is set for the iptables applet of BusyBox, whose rule
+	// listing is more limited than upstream's
+	BusyBox bool
+	// ListRules is set if -S is supported. It is only consulted for
+	// BusyBox, as every upstream release supports it.
+	ListRules bool
+}
+
+// Version returns the version as "major.minor.patch".
+func (c Capabilities) Version() string {
+	return fmt.Sprintf("%d.%d.%d", c.Major, c.Minor, c.Patch)
+}
+
+// AtLeast reports whether the version is major.minor.patch or later, for
+// callers adapting to features the library doesn't track.
+func (c Capabilities) AtLeast(major, minor, patch int) bool {
+	return !versionBefore(c.Major, c.Minor, c.Patch, [3]int{major, minor, patch})
+}
+
+// NFTables reports whether the binary is iptables-nft, which drives
+// nf_tables rather than the legacy xtables.
+func (c Capabilities) NFTables() bool {
+	return c.Mode == "nf_tables"
+}
+
+// CapabilitiesForVersion returns the capabilities of the given upstream
+// iptables version and mode.
+func CapabilitiesForVersion(major, minor, patch int, mode string) Capabilities {
+	check, wait, waitSeconds, randomFully := getIptablesCommandSupport(major, minor, patch)
+	return Capabilities{
+		Major:       major,
+		Minor:       minor,
+		Patch:       patch,
+		Mode:        mode,
+		Check:       check,
+		Wait:        wait,
+		WaitSeconds: waitSeconds,
+		// --wait-interval came with "--wait seconds" in 1.6.0
+		WaitInterval: waitSeconds,
+		RandomFully:  randomFully,
+		RestoreWait:  iptablesRestoreHasWait(major, minor, patch),
+		ListRules:    true,
+	}
+}
+
+// ProbeCommandFunc runs the iptables binary with args, the binary path
+// excluded, in the environment of the handle being created (runner,
+// network namespace, ...) and returns its standard output.
+type ProbeCommandFunc func(ctx context.Context, args ...string) (string, error)
+
+// CapabilityProber detects the capabilities of an iptables binary. New
+// uses VersionProber unless told otherwise with the Prober option.
+type CapabilityProber interface {
+	ProbeCapabilities(ctx context.Context, run ProbeCommandFunc) (Capabilities, error)
+}
+
+// Prober makes New detect the capabilities of the iptables binary with p,
+// e.g. BusyBoxProber{} for BusyBox-based systems or a custom prober for
+// vendored binaries with nonstandard --version output.
+func Prober(p CapabilityProber) option {
+	return func(ipt *IPTables) {
+		ipt.prober = p
+	}
+}
+
+// VersionProber derives the capabilities from the output of --version,
+// assuming an upstream iptables release. BusyBox is detected from its
+// banner and handed over to BusyBoxProber.
+type VersionProber struct{}
+
+// ProbeCapabilities implements CapabilityProber.
+func (VersionProber) ProbeCapabilities(ctx context.Context, run ProbeCommandFunc) (Capabilities, error) {
+	vstring, err := run(ctx, "--version")
+	if err != nil {
+		return Capabilities{}, fmt.Errorf("could not get iptables version: %v", err)
+	}
+	if strings.Contains(vstring, "BusyBox") {
+		return BusyBoxProber{}.ProbeCapabilities(ctx, run)
+	}
+	v1, v2, v3, mode, err := extractIptablesVersion(vstring)
+	if err != nil {
+		return Capabilities{}, fmt.Errorf("failed to extract iptables version from [%s]: %v", vstring, err)
+	}
+	return CapabilitiesForVersion(v1, v2, v3, mode), nil
+}
+
+// busyBoxVersionRegex matches the version line of iptables help output,
+// e.g. "iptables v1.4.21" or "ip6tables v1.8.7 (legacy)".
+var busyBoxVersionRegex = regexp.MustCompile(`ip6?tables(?:-\w+)? v([0-9]+)\.([0-9]+)\.([0-9]+)(?:\s+\((\w+))?`)
+
+// BusyBoxProber detects the capabilities of the iptables applet of
+// BusyBox, whose --version output is the BusyBox banner (or usage) rather
+// than the iptables version. It reads the usage printed by -h instead: the
+// version comes from its iptables banner if any, and the features (--wait,
+// -C, -S, ...) from the options it documents; the handle then avoids the
+// others. Binaries that do answer --version like upstream iptables are
+// handled as VersionProber does.
+type BusyBoxProber struct{}
+
+// ProbeCapabilities implements CapabilityProber.
+func (BusyBoxProber) ProbeCapabilities(ctx context.Context, run ProbeCommandFunc) (Capabilities, error) {
+	if vstring, err := run(ctx, "--version"); err == nil && !strings.Contains(vstring, "BusyBox") {
+		if v1, v2, v3, mode, err := extractIptablesVersion(vstring); err == nil {
+			return CapabilitiesForVersion(v1, v2, v3, mode), nil
+		}
+	}
+
+	help, err := run(ctx, "-h")
+	if err != nil {
+		// BusyBox applets exit with a non-zero status after printing
+		// their usage
+		e, ok := err.(*Error)
+		if !ok || e.msg == "" {
+			return Capabilities{}, fmt.Errorf("could not get iptables usage: %v", err)
+		}
+		help = e.msg
+	}
+	return parseUsageCapabilities(help), nil
+}
+
+// parseUsageCapabilities derives the capabilities of the BusyBox applet
+// from its usage output.
+func parseUsageCapabilities(help string) Capabilities {
+	caps := Capabilities{Mode: "legacy", BusyBox: true}
+	if m := busyBoxVersionRegex.FindStringSubmatch(help); m != nil {
+		caps.Major, _ = strconv.Atoi(m[1])
+		caps.Minor, _ = strconv.Atoi(m[2])
+		caps.Patch, _ = strconv.Atoi(m[3])
+		if m[4] != "" {
+			caps.Mode = m[4]
+		}
+	}
+	caps.Check = strings.Contains(help, "--check")
+	caps.Wait = strings.Contains(help, "--wait")
+	caps.WaitSeconds = strings.Contains(help, "--wait-interval")
+	caps.WaitInterval = caps.WaitSeconds
+	caps.RandomFully = strings.Contains(help, "--random-fully")
+	caps.ListRules = strings.Contains(help, "--list-rules")
+	return caps
+}
+
+// probeCommand is the ProbeCommandFunc of the handle.
+func (ipt *IPTables) probeCommand(ctx context.Context, args ...string) (string, error) {
+	var out bytes.Buffer
+	err := ipt.runCommandContext(ctx, append([]string{ipt.path}, args...), nil, &out)
+	return out.String(), err
+}
+
+// Capabilities returns the capabilities of the iptables binary, as probed
+// by New or derived from the CompatibilityProfile.
+func (ipt *IPTables) Capabilities() Capabilities {
+	return Capabilities{
+		Major:        ipt.v1,
+		Minor:        ipt.v2,
+		Patch:        ipt.v3,
+		Mode:         ipt.mode,
+		Check:        ipt.hasCheck,
+		Wait:         ipt.hasWait,
+		WaitSeconds:  ipt.waitSupportSecond,
+		WaitInterval: ipt.hasWaitInterval,
+		RandomFully:  ipt.hasRandomFully,
+		RestoreWait:  ipt.hasRestoreWait,
+		BusyBox:      ipt.quirks.busybox,
+		ListRules:    !ipt.quirks.noListRules,
+	}
+}
+
+// setCapabilities configures the handle for caps.
+func (ipt *IPTables) setCapabilities(caps Capabilities) {
+	ipt.v1, ipt.v2, ipt.v3 = caps.Major, caps.Minor, caps.Patch
+	ipt.mode = caps.Mode
+	ipt.hasCheck = caps.Check
+	ipt.hasWait = caps.Wait
+	ipt.waitSupportSecond = caps.WaitSeconds
+	ipt.hasWaitInterval = caps.WaitInterval
+	ipt.hasRandomFully = caps.RandomFully
+	ipt.hasRestoreWait = caps.RestoreWait
+	ipt.quirks = getQuirks(caps.Major, caps.Minor, caps.Patch, caps.Mode)
+	if caps.BusyBox {
+		ipt.quirks.busybox = true
+		ipt.quirks.noListRules = !caps.ListRules
+	}
+}
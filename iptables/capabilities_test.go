@@ -0,0 +1,157 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const busyBoxUsage = `iptables v1.4.21
+
+Usage: iptables -[ACD] chain rule-specification [options]
+Commands:
+  --append  -A chain		Append to chain
+  --check   -C chain		Check for the existence of a rule
+  --delete  -D chain		Delete matching rule from chain
+Options:
+  --wait	-w [seconds]	wait for the xtables lock
+`
+
+func TestBusyBoxProber(t *testing.T) {
+	run := func(ctx context.Context, args ...string) (string, error) {
+		if args[0] == "--version" {
+			return "BusyBox v1.36.1 (2023-11-07 18:53:09 UTC) multi-call binary.\n", nil
+		}
+		return "", NewError(append([]string{"iptables"}, args...), 1, busyBoxUsage)
+	}
+
+	expected := Capabilities{Major: 1, Minor: 4, Patch: 21, Mode: "legacy", Check: true, Wait: true, BusyBox: true}
+	for _, prober := range []CapabilityProber{VersionProber{}, BusyBoxProber{}} {
+		caps, err := prober.ProbeCapabilities(context.Background(), run)
+		if err != nil {
+			t.Fatalf("%T failed: %v", prober, err)
+		}
+		if !reflect.DeepEqual(caps, expected) {
+			t.Fatalf("%T capabilities mismatch: \ngot  %+v \nneed %+v", prober, caps, expected)
+		}
+	}
+
+	upstream := func(ctx context.Context, args ...string) (string, error) {
+		return "iptables v1.8.7 (nf_tables)\n", nil
+	}
+	caps, err := BusyBoxProber{}.ProbeCapabilities(context.Background(), upstream)
+	if err != nil {
+		t.Fatalf("BusyBoxProber failed: %v", err)
+	}
+	if !reflect.DeepEqual(caps, CapabilitiesForVersion(1, 8, 7, "nf_tables")) {
+		t.Fatalf("unexpected capabilities %+v", caps)
+	}
+}
+
+func TestProber(t *testing.T) {
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		io.WriteString(stdout, "vendor-iptables 2024.1\n")
+		return 0, nil
+	})
+	prober := probeFunc(func(ctx context.Context, run ProbeCommandFunc) (Capabilities, error) {
+		out, err := run(ctx, "--version")
+		if err != nil || out != "vendor-iptables 2024.1\n" {
+			t.Fatalf("unexpected probe result %q, %v", out, err)
+		}
+		return Capabilities{Major: 1, Minor: 6, Mode: "legacy", Wait: true}, nil
+	})
+
+	ipt, err := New(CommandRunner(runner), Prober(prober))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if caps := ipt.Capabilities(); caps.Minor != 6 || !caps.Wait || caps.Check {
+		t.Fatalf("unexpected capabilities %+v", caps)
+	}
+	if ipt.hasCheck || !ipt.hasWait {
+		t.Fatalf("capabilities not applied")
+	}
+}
+
+type probeFunc func(ctx context.Context, run ProbeCommandFunc) (Capabilities, error)
+
+func (f probeFunc) ProbeCapabilities(ctx context.Context, run ProbeCommandFunc) (Capabilities, error) {
+	return f(ctx, run)
+}
+
+func TestBusyBoxMode(t *testing.T) {
+	var calls [][]string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, args)
+		switch args[1] {
+		case "--version":
+			io.WriteString(stdout, "BusyBox v1.36.1 (2023-11-07 18:53:09 UTC) multi-call binary.\n")
+		case "-h":
+			io.WriteString(stdout, busyBoxUsage+"  --list-rules -S [chain]\tPrint the rules in a chain or all chains\n")
+		default:
+			io.WriteString(stdout, "-N AGENT\n-A AGENT -j RETURN\n")
+		}
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if caps := ipt.Capabilities(); !caps.BusyBox || !caps.ListRules || caps.WaitSeconds {
+		t.Fatalf("unexpected capabilities %+v", caps)
+	}
+
+	if exists, err := ipt.ChainExists("filter", "AGENT"); err != nil || !exists {
+		t.Fatalf("ChainExists returned %v, %v", exists, err)
+	}
+	if expected := []string{"iptables", "-t", "filter", "-S", "AGENT", "--wait"}; !reflect.DeepEqual(calls[len(calls)-1], expected) {
+		t.Fatalf("args mismatch: \ngot  %v \nneed %v", calls[len(calls)-1], expected)
+	}
+	if rule, err := ipt.ListById("filter", "AGENT", 1); err != nil || rule != "-A AGENT -j RETURN" {
+		t.Fatalf("ListById returned %q, %v", rule, err)
+	}
+	if _, err := ipt.ListById("filter", "AGENT", 2); err == nil {
+		t.Fatalf("expected an error for a missing rule")
+	}
+
+	ipt.quirks.noListRules = true
+	if _, err := ipt.List("filter", "AGENT"); err == nil || !strings.Contains(err.Error(), "-S is not supported") {
+		t.Fatalf("expected an unsupported listing error, got %v", err)
+	}
+}
+
+func TestCapabilitiesVersion(t *testing.T) {
+	caps := CapabilitiesForVersion(1, 8, 7, "nf_tables")
+	if caps.Version() != "1.8.7" || !caps.NFTables() {
+		t.Fatalf("unexpected version %s or mode %s", caps.Version(), caps.Mode)
+	}
+	for _, tc := range []struct {
+		v        [3]int
+		expected bool
+	}{
+		{[3]int{1, 8, 7}, true},
+		{[3]int{1, 6, 12}, true},
+		{[3]int{1, 8, 8}, false},
+		{[3]int{2, 0, 0}, false},
+	} {
+		if caps.AtLeast(tc.v[0], tc.v[1], tc.v[2]) != tc.expected {
+			t.Errorf("AtLeast(%v) should be %v", tc.v, tc.expected)
+		}
+	}
+}
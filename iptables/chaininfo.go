@@ -0,0 +1,142 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ChainInfo describes a chain as shown in the header of -L -v output.
+// Packets and Bytes are the policy counters, only maintained for builtin
+// chains; References is only known for user-defined chains.
+type ChainInfo struct {
+	Name       string `json:"name"`
+	Policy     string `json:"policy,omitempty"`
+	Packets    uint64 `json:"pkts"`
+	Bytes      uint64 `json:"bytes"`
+	References int    `json:"references"`
+	IsBuiltin  bool   `json:"builtin"`
+}
+
+// ListChainsWithInfo returns the chains of the specified table together
+// with their policy, policy counters and number of references.
+func (ipt *IPTables) ListChainsWithInfo(table string) ([]ChainInfo, error) {
+	lines, err := ipt.executeList([]string{"-t", table, "-L", "-n", "-v", "-x"})
+	if err != nil {
+		return nil, err
+	}
+	return parseChainHeaders(lines), nil
+}
+
+// chainHeaderRegex matches the chain headers of -L -v output, e.g.
+//
+//	Chain INPUT (policy ACCEPT 10 packets, 600 bytes)
+//	Chain KUBE-SERVICES (2 references)
+var chainHeaderRegex = regexp.MustCompile(`^Chain (\S+) \((?:policy (\S+)(?: ([0-9]+) packets, ([0-9]+) bytes)?|([0-9]+) references)\)`)
+
+// parseChainHeader parses a single chain header, returning false if line
+// isn't one.
+func parseChainHeader(line string) (ChainInfo, bool) {
+	m := chainHeaderRegex.FindStringSubmatch(line)
+	if m == nil {
+		return ChainInfo{}, false
+	}
+	info := ChainInfo{Name: m[1]}
+	if m[2] != "" {
+		info.IsBuiltin = true
+		info.Policy = m[2]
+		info.Packets, _ = strconv.ParseUint(m[3], 10, 64)
+		info.Bytes, _ = strconv.ParseUint(m[4], 10, 64)
+	} else {
+		info.References, _ = strconv.Atoi(m[5])
+	}
+	return info, true
+}
+
+// parseChainHeaders returns the ChainInfo of every chain header found in
+// -L -v output.
+func parseChainHeaders(lines []string) []ChainInfo {
+	chains := []ChainInfo{}
+	for _, line := range lines {
+		if info, ok := parseChainHeader(line); ok {
+			chains = append(chains, info)
+		}
+	}
+	return chains
+}
+
+// ChainCounters holds the counters of a chain: its policy counters, in
+// ChainInfo, and the sum of the counters of its rules.
+type ChainCounters struct {
+	ChainInfo
+	Rules       int    `json:"rules"`
+	RulePackets uint64 `json:"rulePkts"`
+	RuleBytes   uint64 `json:"ruleBytes"`
+}
+
+// GetChainCounters returns the policy counters of the specified
+// table/chain and the aggregate counters of its rules, with a single
+// invocation.
+func (ipt *IPTables) GetChainCounters(table, chain string) (ChainCounters, error) {
+	lines, err := ipt.executeList([]string{"-t", table, "-L", chain, "-n", "-v", "-x"})
+	if err != nil {
+		return ChainCounters{}, err
+	}
+	return parseChainCounters(lines)
+}
+
+// parseChainCounters sums the counters of the -L -v -x output of a chain.
+func parseChainCounters(lines []string) (ChainCounters, error) {
+	var counters ChainCounters
+	header := false
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0 || strings.HasPrefix(line, "#"):
+			continue
+		case !header:
+			info, ok := parseChainHeader(line)
+			if !ok {
+				return counters, fmt.Errorf("invalid chain header %q", line)
+			}
+			counters.ChainInfo = info
+			header = true
+		case fields[0] == "pkts":
+			continue
+		default:
+			if len(fields) < 2 {
+				return counters, fmt.Errorf("invalid rule line %q", line)
+			}
+			pkts, err := strconv.ParseUint(fields[0], 10, 64)
+			if err != nil {
+				return counters, fmt.Errorf("could not parse packets in %q: %v", line, err)
+			}
+			bytes, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return counters, fmt.Errorf("could not parse bytes in %q: %v", line, err)
+			}
+			counters.Rules++
+			counters.RulePackets += pkts
+			counters.RuleBytes += bytes
+		}
+	}
+	if !header {
+		return counters, fmt.Errorf("no chain header found")
+	}
+	return counters, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"sync"
+)
+
+// chainKey identifies a chain within the process.
+type chainKey struct {
+	proto Protocol
+	table string
+	chain string
+}
+
+// chainLock is a reference counted RWMutex, dropped from chainLocks once
+// nobody uses it anymore.
+type chainLock struct {
+	sync.RWMutex
+	refs int
+}
+
+// chainLocks holds the locks of all chains currently locked in the
+// process, shared by all handles.
+var chainLocks = struct {
+	sync.Mutex
+	m map[chainKey]*chainLock
+}{m: map[chainKey]*chainLock{}}
+
+// LockChain takes an exclusive in-process lock on the specified
+// table/chain and returns the function releasing it.
+//
+// These locks don't affect iptables itself: they let different components
+// of one program, using the same or different handles, coordinate their
+// accesses to a chain without serializing everything behind a single mutex.
+// Locks are per family, so an IPv4 and an IPv6 chain of the same name are
+// independent.
+func (ipt *IPTables) LockChain(table, chain string) (unlock func()) {
+	key, l := acquireChainLock(ipt.proto, table, chain)
+	l.Lock()
+	return func() {
+		l.Unlock()
+		releaseChainLock(key, l)
+	}
+}
+
+// RLockChain takes a shared in-process lock on the specified table/chain
+// and returns the function releasing it. See LockChain.
+func (ipt *IPTables) RLockChain(table, chain string) (unlock func()) {
+	key, l := acquireChainLock(ipt.proto, table, chain)
+	l.RLock()
+	return func() {
+		l.RUnlock()
+		releaseChainLock(key, l)
+	}
+}
+
+func acquireChainLock(proto Protocol, table, chain string) (chainKey, *chainLock) {
+	key := chainKey{proto, table, chain}
+	chainLocks.Lock()
+	defer chainLocks.Unlock()
+	l, ok := chainLocks.m[key]
+	if !ok {
+		l = &chainLock{}
+		chainLocks.m[key] = l
+	}
+	l.refs++
+	return key, l
+}
+
+func releaseChainLock(key chainKey, l *chainLock) {
+	chainLocks.Lock()
+	defer chainLocks.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(chainLocks.m, key)
+	}
+}
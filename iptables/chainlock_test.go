@@ -0,0 +1,105 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func newLockTest(t *testing.T, proto Protocol) *IPTables {
+	noop := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		return 0, nil
+	})
+	ipt, err := New(IPFamily(proto), CommandRunner(noop), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return ipt
+}
+
+// locked reports whether lock returns within a short delay. If it doesn't,
+// the lock is released as soon as it is taken.
+func locked(lock func() (unlock func())) bool {
+	done := make(chan func(), 1)
+	go func() { done <- lock() }()
+	select {
+	case unlock := <-done:
+		unlock()
+		return true
+	case <-time.After(50 * time.Millisecond):
+		go func() { (<-done)() }()
+		return false
+	}
+}
+
+func TestLockChain(t *testing.T) {
+	ipt, other := newLockTest(t, ProtocolIPv4), newLockTest(t, ProtocolIPv4)
+	ip6t := newLockTest(t, ProtocolIPv6)
+
+	unlock := ipt.LockChain("filter", "AGENT")
+	// the lock is shared by all handles of the family
+	if locked(func() func() { return other.LockChain("filter", "AGENT") }) {
+		t.Fatalf("LockChain of another handle didn't wait for the lock")
+	}
+	if locked(func() func() { return other.RLockChain("filter", "AGENT") }) {
+		t.Fatalf("RLockChain didn't wait for the exclusive lock")
+	}
+	// other chains, tables and families are independent
+	if !locked(func() func() { return ipt.LockChain("filter", "OTHER") }) {
+		t.Fatalf("LockChain of another chain waited")
+	}
+	if !locked(func() func() { return ipt.LockChain("nat", "AGENT") }) {
+		t.Fatalf("LockChain of another table waited")
+	}
+	if !locked(func() func() { return ip6t.LockChain("filter", "AGENT") }) {
+		t.Fatalf("LockChain of another family waited")
+	}
+	unlock()
+
+	if !locked(func() func() { return other.LockChain("filter", "AGENT") }) {
+		t.Fatalf("LockChain waited after the lock was released")
+	}
+}
+
+func TestRLockChain(t *testing.T) {
+	ipt := newLockTest(t, ProtocolIPv4)
+
+	unlock := ipt.RLockChain("filter", "AGENT")
+	if !locked(func() func() { return ipt.RLockChain("filter", "AGENT") }) {
+		t.Fatalf("RLockChain waited for another shared lock")
+	}
+	if locked(func() func() { return ipt.LockChain("filter", "AGENT") }) {
+		t.Fatalf("LockChain didn't wait for the shared lock")
+	}
+	unlock()
+
+	// released locks are dropped once nobody uses them
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		chainLocks.Lock()
+		n := len(chainLocks.m)
+		chainLocks.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d chain locks left", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// changeSetSeq numbers the change sets of the process.
+var changeSetSeq uint64
+
+// ChangeSet is a set of staged operations that is only applied once an
+// Approver accepted it, e.g. after a review by a human or a webhook. The
+// operations are applied together, as with Transaction.
+type ChangeSet struct {
+	// ID identifies the change set within the process
+	ID  string
+	seq uint64
+	tx  *Transaction
+}
+
+// NewChangeSet returns an empty ChangeSet applying to this handle.
+func (ipt *IPTables) NewChangeSet() *ChangeSet {
+	seq := atomic.AddUint64(&changeSetSeq, 1)
+	return &ChangeSet{
+		ID:  fmt.Sprintf("cs-%d", seq),
+		seq: seq,
+		tx:  ipt.NewTransaction(),
+	}
+}
+
+// NewChain stages the creation of a new chain in the specified table.
+func (cs *ChangeSet) NewChain(table, chain string) {
+	cs.tx.NewChain(table, chain)
+}
+
+// ClearChain stages flushing the specified table/chain, creating it if it
+// does not exist.
+func (cs *ChangeSet) ClearChain(table, chain string) {
+	cs.tx.ClearChain(table, chain)
+}
+
+// DeleteChain stages the deletion of the chain in the specified table.
+func (cs *ChangeSet) DeleteChain(table, chain string) {
+	cs.tx.DeleteChain(table, chain)
+}
+
+// Append stages appending rulespec to specified table/chain
+func (cs *ChangeSet) Append(table, chain string, rulespec ...string) {
+	cs.tx.Append(table, chain, rulespec...)
+}
+
+// Insert stages inserting rulespec to specified table/chain (in specified pos)
+func (cs *ChangeSet) Insert(table, chain string, pos int, rulespec ...string) {
+	cs.tx.Insert(table, chain, pos, rulespec...)
+}
+
+// Delete stages removing rulespec in specified table/chain
+func (cs *ChangeSet) Delete(table, chain string, rulespec ...string) {
+	cs.tx.Delete(table, chain, rulespec...)
+}
+
+// Operations returns the staged operations, for review.
+func (cs *ChangeSet) Operations() []Operation {
+	p, _ := cs.tx.payload()
+	// the payload is built from well-formed arguments and always parses
+	ops, _ := payloadOperations(cs.tx.ipt.proto, p.Bytes())
+	return ops
+}
+
+// Approver decides whether a ChangeSet may be applied. Approve may block,
+// e.g. while waiting for a human decision, until ctx is done; it returns
+// nil to approve the change set and the reason of the rejection otherwise.
+type Approver interface {
+	Approve(ctx context.Context, cs *ChangeSet) error
+}
+
+// ApproverFunc adapts an ordinary function to the Approver interface.
+type ApproverFunc func(ctx context.Context, cs *ChangeSet) error
+
+// Approve calls f(ctx, cs).
+func (f ApproverFunc) Approve(ctx context.Context, cs *ChangeSet) error {
+	return f(ctx, cs)
+}
+
+// RejectedError is returned for change sets an Approver did not approve.
+type RejectedError struct {
+	ID  string
+	Err error
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("change set %s rejected: %v", e.ID, e.Err)
+}
+
+func (e *RejectedError) Unwrap() error {
+	return e.Err
+}
+
+// Submit asks approver for approval of the change set in the background
+// and applies it once approved. The returned channel receives the outcome:
+// nil once applied, a *RejectedError if approval was refused or ctx was
+// done first, or the error of applying it. The change set must not be
+// modified after being submitted.
+func (cs *ChangeSet) Submit(ctx context.Context, approver Approver) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		if err := approver.Approve(ctx, cs); err != nil {
+			result <- &RejectedError{cs.ID, err}
+			return
+		}
+		if err := ctx.Err(); err != nil {
+			result <- &RejectedError{cs.ID, err}
+			return
+		}
+		result <- cs.tx.Commit()
+	}()
+	return result
+}
+
+// ManualApprover is an Approver holding change sets until Decide is
+// called for them, e.g. from an administration endpoint.
+type ManualApprover struct {
+	mu      sync.Mutex
+	pending map[string]*pendingChangeSet
+}
+
+type pendingChangeSet struct {
+	cs       *ChangeSet
+	decision chan error
+}
+
+// NewManualApprover returns a ManualApprover with no pending change sets.
+func NewManualApprover() *ManualApprover {
+	return &ManualApprover{pending: map[string]*pendingChangeSet{}}
+}
+
+// Approve implements Approver, waiting for a decision on cs.
+func (m *ManualApprover) Approve(ctx context.Context, cs *ChangeSet) error {
+	p := &pendingChangeSet{cs: cs, decision: make(chan error, 1)}
+	m.mu.Lock()
+	m.pending[cs.ID] = p
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.pending, cs.ID)
+		m.mu.Unlock()
+	}()
+
+	select {
+	case err := <-p.decision:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Pending returns the change sets waiting for a decision, oldest first.
+func (m *ManualApprover) Pending() []*ChangeSet {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sets []*ChangeSet
+	for _, p := range m.pending {
+		sets = append(sets, p.cs)
+	}
+	sort.Slice(sets, func(i, j int) bool { return sets[i].seq < sets[j].seq })
+	return sets
+}
+
+// Decide approves the pending change set with the given ID if reason is
+// nil, and rejects it with reason otherwise.
+func (m *ManualApprover) Decide(id string, reason error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.pending[id]
+	if !ok {
+		return fmt.Errorf("no pending change set %s", id)
+	}
+	delete(m.pending, id)
+	p.decision <- reason
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChangeSetRejected(t *testing.T) {
+	ipt := &IPTables{}
+	cs := ipt.NewChangeSet()
+	cs.NewChain("filter", "FOO")
+	cs.Append("filter", "FOO", "-s", "10.0.0.0/8", "-j", "ACCEPT")
+
+	expected := []Operation{
+		{Kind: "new-chain", Table: "filter", Chain: "FOO"},
+		{Kind: "append", Table: "filter", Chain: "FOO", Rulespec: []string{"-s", "10.0.0.0/8", "-j", "ACCEPT"}},
+	}
+	if ops := cs.Operations(); !reflect.DeepEqual(ops, expected) {
+		t.Fatalf("Operations mismatch: \ngot  %v \nneed %v", ops, expected)
+	}
+
+	approver := NewManualApprover()
+	result := cs.Submit(context.Background(), approver)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(approver.Pending()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("change set never became pending")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if pending := approver.Pending(); pending[0] != cs {
+		t.Fatalf("unexpected pending change sets %v", pending)
+	}
+
+	reason := errors.New("not during business hours")
+	if err := approver.Decide(cs.ID, reason); err != nil {
+		t.Fatalf("Decide failed: %v", err)
+	}
+	err := <-result
+	var rerr *RejectedError
+	if !errors.As(err, &rerr) || rerr.ID != cs.ID || !errors.Is(err, reason) {
+		t.Fatalf("expected rejection of %s because of %v, got %v", cs.ID, reason, err)
+	}
+	if err := approver.Decide(cs.ID, nil); err == nil {
+		t.Fatal("expected error deciding twice, got none")
+	}
+}
+
+func TestManualApproverPendingOrder(t *testing.T) {
+	ipt := &IPTables{}
+	approver := NewManualApprover()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// enough change sets for their IDs to sort differently as strings
+	var sets []*ChangeSet
+	for i := 0; i < 12; i++ {
+		cs := ipt.NewChangeSet()
+		sets = append(sets, cs)
+		cs.Submit(ctx, approver)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(approver.Pending()) < len(sets) {
+		if time.Now().After(deadline) {
+			t.Fatal("change sets never became pending")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if pending := approver.Pending(); !reflect.DeepEqual(pending, sets) {
+		var ids []string
+		for _, cs := range pending {
+			ids = append(ids, cs.ID)
+		}
+		t.Fatalf("expected the change sets in submission order, got %v", ids)
+	}
+}
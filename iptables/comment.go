@@ -0,0 +1,106 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxCommentLen is the length in bytes of the longest comment iptables
+// accepts, as the kernel stores comments in 256 bytes including the
+// terminating NUL.
+const MaxCommentLen = 255
+
+// Comment returns the rulespec fragment "-m comment --comment text". Any
+// printable text is accepted: spaces, quotes and non-ASCII characters are
+// passed to iptables as is, and parsed back from its listings as is, so
+// the rule compares equal once listed. Text that is empty, longer than
+// MaxCommentLen bytes or holding control characters, which would corrupt
+// the listings, is rejected; SanitizeComment makes arbitrary strings fit.
+func Comment(text string) ([]string, error) {
+	if text == "" {
+		return nil, fmt.Errorf("empty comment")
+	}
+	if len(text) > MaxCommentLen {
+		return nil, fmt.Errorf("comment is %d bytes long, the maximum is %d", len(text), MaxCommentLen)
+	}
+	if !utf8.ValidString(text) {
+		return nil, fmt.Errorf("comment %q is not valid UTF-8", text)
+	}
+	if strings.IndexFunc(text, unicode.IsControl) >= 0 {
+		return nil, fmt.Errorf("comment %q holds control characters", text)
+	}
+	return []string{"-m", "comment", "--comment", text}, nil
+}
+
+// SanitizeComment turns text into a comment accepted by Comment: control
+// characters and invalid UTF-8 are replaced with spaces, and the text is
+// truncated to MaxCommentLen bytes without splitting a character.
+func SanitizeComment(text string) string {
+	var b strings.Builder
+	for _, r := range strings.ToValidUTF8(text, " ") {
+		if unicode.IsControl(r) {
+			r = ' '
+		}
+		if b.Len()+utf8.RuneLen(r) > MaxCommentLen {
+			break
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// FindByComment returns the rules of the specified table/chain whose
+// comment ("-m comment --comment ...") contains substring, with their
+// positions and counters. An empty substring matches every commented rule.
+func (ipt *IPTables) FindByComment(table, chain, substring string) ([]NumberedRule, error) {
+	rules, err := ipt.ListWithLineNumbers(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	return filterByComment(rules, substring), nil
+}
+
+// DeleteByComment deletes the rules of the specified table/chain whose
+// comment contains substring, as found by FindByComment, and returns how
+// many were deleted. Rules are deleted by specification rather than by
+// position, so that rules inserted concurrently don't shift the wrong ones
+// into place. It stops at the first failure.
+func (ipt *IPTables) DeleteByComment(table, chain, substring string) (int, error) {
+	rules, err := ipt.FindByComment(table, chain, substring)
+	if err != nil {
+		return 0, err
+	}
+	for i, r := range rules {
+		if err := ipt.Delete(table, chain, r.Spec()...); err != nil {
+			return i, err
+		}
+	}
+	return len(rules), nil
+}
+
+// filterByComment keeps the rules whose comment contains substring.
+func filterByComment(rules []NumberedRule, substring string) []NumberedRule {
+	var matching []NumberedRule
+	for _, r := range rules {
+		if comment := ruleComment(r.Rule); comment != "" && strings.Contains(comment, substring) {
+			matching = append(matching, r)
+		}
+	}
+	return matching
+}
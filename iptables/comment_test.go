@@ -0,0 +1,115 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDeleteByComment(t *testing.T) {
+	var deleted [][]string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		if args[3] == "-D" {
+			deleted = append(deleted, args)
+			return 0, nil
+		}
+		io.WriteString(stdout, `-P INPUT ACCEPT -c 0 0
+-A INPUT -i lo -m comment --comment "owner=base" -c 0 0 -j ACCEPT
+-A INPUT -p tcp -m tcp --dport 80 -m comment --comment "owner=web,port=80" -c 7 420 -j ACCEPT
+-A INPUT -j DROP -c 0 0
+-A INPUT -p tcp -m tcp --dport 443 -m comment --comment "owner=web,port=443" -c 0 0 -j ACCEPT
+`)
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	rules, err := ipt.FindByComment("filter", "INPUT", "owner=web")
+	if err != nil {
+		t.Fatalf("FindByComment failed: %v", err)
+	}
+	if len(rules) != 2 || rules[0].Pos != 2 || rules[0].Packets != 7 || rules[1].Pos != 4 {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+	if all, _ := ipt.FindByComment("filter", "INPUT", ""); len(all) != 3 {
+		t.Fatalf("expected every commented rule, got %+v", all)
+	}
+
+	n, err := ipt.DeleteByComment("filter", "INPUT", "owner=web")
+	if err != nil || n != 2 {
+		t.Fatalf("DeleteByComment returned %d, %v", n, err)
+	}
+	expected := []string{"iptables", "-t", "filter", "-D", "INPUT", "-p", "tcp", "-m", "tcp", "--dport", "443", "-m", "comment", "--comment", "owner=web,port=443", "-j", "ACCEPT", "--wait"}
+	if !reflect.DeepEqual(deleted[1], expected) {
+		t.Fatalf("args mismatch: \ngot  %v \nneed %v", deleted[1], expected)
+	}
+}
+
+// saveString quotes s as xtables_save_string does in iptables -S output.
+func saveString(s string) string {
+	if strings.Trim(s, "_-0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ") == "" {
+		return s
+	}
+	return `"` + strings.NewReplacer(`"`, `\"`, `\`, `\\`, `'`, `\'`).Replace(s) + `"`
+}
+
+func TestComment(t *testing.T) {
+	for _, text := range []string{
+		"owner=web",
+		"allow web traffic",
+		`say "hi" it's C:\temp`,
+		"règle für Größe ✓",
+		strings.Repeat("x", MaxCommentLen),
+	} {
+		spec, err := Comment(text)
+		if err != nil {
+			t.Fatalf("Comment(%q) failed: %v", text, err)
+		}
+		line := "-A INPUT " + strings.Join(spec[:3], " ") + " " + saveString(spec[3]) + " -j ACCEPT"
+		rule, err := ParseRule(line)
+		if err != nil {
+			t.Fatalf("ParseRule(%q) failed: %v", line, err)
+		}
+		if comment := ruleComment(rule); comment != text {
+			t.Errorf("comment %q listed as %q", text, comment)
+		}
+	}
+
+	for _, text := range []string{"", strings.Repeat("x", MaxCommentLen+1), "two\nlines", "\xff"} {
+		if _, err := Comment(text); err == nil {
+			t.Errorf("Comment(%q) should have failed", text)
+		}
+	}
+}
+
+func TestSanitizeComment(t *testing.T) {
+	if s := SanitizeComment("two\nlines\xff"); s != "two lines " {
+		t.Errorf("unexpected sanitized comment %q", s)
+	}
+	long := strings.Repeat("é", MaxCommentLen)
+	s := SanitizeComment(long)
+	if len(s) != MaxCommentLen-1 || !strings.HasPrefix(long, s) {
+		t.Errorf("expected %d bytes of whole characters, got %d", MaxCommentLen-1, len(s))
+	}
+	if _, err := Comment(s); err != nil {
+		t.Errorf("sanitized comment rejected: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+)
+
+//go:embed corpus
+var corpus embed.FS
+
+// FormatChange is a change of the output format of iptables the parsers
+// of this package handle.
+type FormatChange struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Since is the first release printing the new format
+	Since string `json:"since"`
+
+	since [3]int
+	// old sets the quirk handling the format printed before Since
+	old func(*quirks)
+}
+
+// formatChanges drives getQuirks and CompatibilityMatrix.
+var formatChanges = []FormatChange{
+	{
+		Name:        "ipv6-blank-opt",
+		Description: `ip6tables -L -v prints the empty "opt" column as "--" instead of two spaces (6e41c2d874)`,
+		Since:       "1.8.9",
+		since:       [3]int{1, 8, 9},
+		old:         func(q *quirks) { q.ipv6BlankOpt = true },
+	},
+	{
+		Name:        "prot-number",
+		Description: `the "prot" column of -L shows "0" instead of "all" for rules matching any protocol (da8ecc62dd)`,
+		Since:       "1.8.9",
+		since:       [3]int{1, 8, 9},
+		old:         func(q *quirks) { q.protAll = true },
+	},
+}
+
+// versionBefore reports whether v1.v2.v3 is older than v.
+func versionBefore(v1, v2, v3 int, v [3]int) bool {
+	if v1 != v[0] {
+		return v1 < v[0]
+	}
+	if v2 != v[1] {
+		return v2 < v[1]
+	}
+	return v3 < v[2]
+}
+
+// CompatibilityEntry describes how well the library supports an iptables
+// release.
+type CompatibilityEntry struct {
+	Profile      string       `json:"profile"`
+	Capabilities Capabilities `json:"capabilities"`
+	// Quirks lists the FormatChanges the release predates, whose old
+	// format is handled specially
+	Quirks []string `json:"quirks"`
+	// Tested is set if the output of the release is part of the corpus
+	// the parsers are tested against
+	Tested bool `json:"tested"`
+	// Supported is set if the release is tested, or lies between two
+	// tested releases of the same mode
+	Supported bool `json:"supported"`
+}
+
+// CompatibilityMatrix returns the releases whose output the library is
+// tested against, oldest first.
+func CompatibilityMatrix() []CompatibilityEntry {
+	var matrix []CompatibilityEntry
+	for _, profile := range corpusProfiles() {
+		entry, _ := CheckCompatibility(profile)
+		matrix = append(matrix, entry)
+	}
+	return matrix
+}
+
+// CheckCompatibility returns the compatibility of the release identified
+// by profile, in the format of CompatibilityProfile.
+func CheckCompatibility(profile string) (CompatibilityEntry, error) {
+	v1, v2, v3, mode, err := parseCompatibilityProfile(profile)
+	if err != nil {
+		return CompatibilityEntry{}, err
+	}
+	entry := CompatibilityEntry{
+		Profile:      profileName(v1, v2, v3, mode),
+		Capabilities: CapabilitiesForVersion(v1, v2, v3, mode),
+		Quirks:       []string{},
+	}
+	for _, c := range formatChanges {
+		if versionBefore(v1, v2, v3, c.since) {
+			entry.Quirks = append(entry.Quirks, c.Name)
+		}
+	}
+
+	older, newer := false, false
+	for _, tested := range corpusProfiles() {
+		t1, t2, t3, tmode, _ := parseCompatibilityProfile(tested)
+		switch {
+		case tested == entry.Profile:
+			entry.Tested = true
+		case tmode != mode:
+		case versionBefore(t1, t2, t3, [3]int{v1, v2, v3}):
+			older = true
+		default:
+			newer = true
+		}
+	}
+	entry.Supported = entry.Tested || (older && newer)
+	return entry, nil
+}
+
+// Compatibility returns the compatibility of the iptables release the
+// handle drives.
+func (ipt *IPTables) Compatibility() CompatibilityEntry {
+	entry, _ := CheckCompatibility(ipt.Profile())
+	return entry
+}
+
+// profileName returns the canonical profile of a version and mode.
+func profileName(v1, v2, v3 int, mode string) string {
+	suffix := "legacy"
+	if mode == "nf_tables" {
+		suffix = "nft"
+	}
+	return fmt.Sprintf("%d.%d.%d-%s", v1, v2, v3, suffix)
+}
+
+// corpusProfiles returns the profiles of the corpus, oldest first.
+func corpusProfiles() []string {
+	entries, _ := corpus.ReadDir("corpus")
+	var profiles []string
+	for _, e := range entries {
+		if e.IsDir() {
+			profiles = append(profiles, e.Name())
+		}
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		a1, a2, a3, amode, _ := parseCompatibilityProfile(profiles[i])
+		b1, b2, b3, bmode, _ := parseCompatibilityProfile(profiles[j])
+		if [3]int{a1, a2, a3} == [3]int{b1, b2, b3} {
+			return amode < bmode
+		}
+		return versionBefore(a1, a2, a3, [3]int{b1, b2, b3})
+	})
+	return profiles
+}
+
+// corpusFile returns a file of the corpus of profile.
+func corpusFile(profile, name string) (string, error) {
+	data, err := corpus.ReadFile(path.Join("corpus", profile, name))
+	return string(data), err
+}
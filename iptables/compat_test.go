@@ -0,0 +1,155 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestCorpus checks the parsers against the output of every iptables
+// release of the corpus.
+func TestCorpus(t *testing.T) {
+	for _, profile := range corpusProfiles() {
+		profile := profile
+		t.Run(profile, func(t *testing.T) {
+			read := func(name string) string {
+				data, err := corpusFile(profile, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return data
+			}
+
+			for _, name := range []string{"version.txt", "version6.txt"} {
+				v1, v2, v3, mode, err := extractIptablesVersion(read(name))
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if got := profileName(v1, v2, v3, mode); got != profile {
+					t.Fatalf("%s: parsed as %s", name, got)
+				}
+			}
+
+			var rules []Rule
+			for _, line := range strings.Split(strings.TrimSpace(read("list-rules.txt")), "\n") {
+				if !strings.HasPrefix(line, "-A ") {
+					continue
+				}
+				r, err := ParseRule(line)
+				if err != nil {
+					t.Fatalf("ParseRule(%q): %v", line, err)
+				}
+				rules = append(rules, r)
+			}
+			if len(rules) != 2 || rules[0].Source != "10.0.0.0/8" || rules[1].InInterface != "lo" {
+				t.Fatalf("unexpected rules %+v", rules)
+			}
+
+			entry, err := CheckCompatibility(profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, tc := range []struct {
+				proto    Protocol
+				file     string
+				source   string
+				anyProto string
+				opt      string
+			}{
+				{ProtocolIPv4, "list-verbose.txt", "10.0.0.0/8", "all", "--"},
+				{ProtocolIPv6, "list-verbose6.txt", "2001:db8::/32", "all", "--"},
+			} {
+				if tc.proto == ProtocolIPv6 && contains(entry.Quirks, "ipv6-blank-opt") {
+					tc.opt = "  "
+				}
+				if !contains(entry.Quirks, "prot-number") {
+					tc.anyProto = "0"
+				}
+
+				output := read(tc.file)
+				runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+					io.WriteString(stdout, output)
+					return 0, nil
+				})
+				ipt, err := New(IPFamily(tc.proto), CommandRunner(runner), CompatibilityProfile(profile))
+				if err != nil {
+					t.Fatalf("New failed: %v", err)
+				}
+				rows, err := ipt.Stats("filter", "INPUT")
+				if err != nil {
+					t.Fatalf("%s: Stats failed: %v", tc.file, err)
+				}
+				if len(rows) != 2 {
+					t.Fatalf("%s: unexpected rows %q", tc.file, rows)
+				}
+				if rows[0][0] != "5" || rows[0][1] != "300" || rows[0][7] != tc.source || rows[0][9] != "tcp dpt:22 /* ssh from lan */" {
+					t.Fatalf("%s: unexpected first row %q", tc.file, rows[0])
+				}
+				if rows[1][3] != tc.anyProto || rows[1][4] != tc.opt || rows[1][5] != "lo" {
+					t.Fatalf("%s: unexpected second row %q", tc.file, rows[1])
+				}
+				if _, err := ipt.ParseStat(rows[1]); err != nil {
+					t.Fatalf("%s: ParseStat failed: %v", tc.file, err)
+				}
+			}
+
+			for _, msg := range strings.Split(strings.TrimSpace(read("not-exist.txt")), "\n") {
+				if !NewError([]string{"iptables"}, 1, msg+"\n").IsNotExist() {
+					t.Fatalf("%q is not recognized as IsNotExist", msg)
+				}
+			}
+		})
+	}
+}
+
+func TestCompatibilityMatrix(t *testing.T) {
+	matrix := CompatibilityMatrix()
+	if len(matrix) == 0 || matrix[0].Profile != "1.4.21-legacy" {
+		t.Fatalf("unexpected matrix %+v", matrix)
+	}
+	for _, entry := range matrix {
+		if !entry.Tested || !entry.Supported {
+			t.Fatalf("corpus entry %s not tested and supported", entry.Profile)
+		}
+	}
+
+	for _, tc := range []struct {
+		profile   string
+		quirks    []string
+		tested    bool
+		supported bool
+	}{
+		{"1.8.7-nft", []string{"ipv6-blank-opt", "prot-number"}, true, true},
+		{"v1.8.8-nf_tables", []string{"ipv6-blank-opt", "prot-number"}, false, true},
+		{"1.8.9-legacy", []string{}, false, false},
+		{"1.8.11-nft", []string{}, false, false},
+		{"1.2.0-legacy", []string{"ipv6-blank-opt", "prot-number"}, false, false},
+	} {
+		entry, err := CheckCompatibility(tc.profile)
+		if err != nil {
+			t.Fatalf("CheckCompatibility(%q): %v", tc.profile, err)
+		}
+		if !reflect.DeepEqual(entry.Quirks, tc.quirks) || entry.Tested != tc.tested || entry.Supported != tc.supported {
+			t.Fatalf("CheckCompatibility(%q) = %+v", tc.profile, entry)
+		}
+	}
+	if _, err := CheckCompatibility("1.8"); err == nil {
+		t.Fatalf("expected an error for an invalid profile")
+	}
+}
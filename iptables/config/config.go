@@ -0,0 +1,381 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config loads declarative descriptions of iptables rulesets, so
+// that simple firewall agents can be driven by a JSON or YAML file rather
+// than by Go code for every rule:
+//
+//	{
+//	  "family": "ipv4",
+//	  "tables": [{
+//	    "name": "filter",
+//	    "chains": [
+//	      {"name": "INPUT", "policy": "DROP", "rules": [
+//	        {"in": "lo", "target": "ACCEPT"},
+//	        {"states": ["RELATED", "ESTABLISHED"], "target": "ACCEPT"},
+//	        {"target": "SSH"}
+//	      ]},
+//	      {"name": "SSH", "rules": [
+//	        {"protocol": "tcp", "destinationPorts": ["22"], "source": "10.0.0.0/8",
+//	         "comment": "admin network", "target": "ACCEPT"}
+//	      ]}
+//	    ]
+//	  }]
+//	}
+//
+// The chains listed are brought to the described rules, in order, by an
+// iptables.Reconciler; other chains are left alone.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// Config is a declarative ruleset.
+type Config struct {
+	// Family is "ipv4" or "ipv6"; it is checked against the family of the
+	// handle the config is applied with if set
+	Family string  `json:"family,omitempty" yaml:"family,omitempty"`
+	Tables []Table `json:"tables" yaml:"tables"`
+}
+
+// Table is a table of a Config.
+type Table struct {
+	Name   string  `json:"name" yaml:"name"`
+	Chains []Chain `json:"chains" yaml:"chains"`
+}
+
+// Chain is a chain of a Table. Policy may only be set on builtin chains,
+// and leaves their policy alone when empty.
+type Chain struct {
+	Name   string `json:"name" yaml:"name"`
+	Policy string `json:"policy,omitempty" yaml:"policy,omitempty"`
+	Rules  []Rule `json:"rules" yaml:"rules"`
+}
+
+// Rule is a rule of a Chain, described by named fields. Ports are given
+// as "port" or "first:last" and require Protocol; several ports use the
+// multiport match. Args are added verbatim after the matches described by
+// the other fields, for the ones they don't cover.
+type Rule struct {
+	Protocol         string   `json:"protocol,omitempty" yaml:"protocol,omitempty"`
+	Source           string   `json:"source,omitempty" yaml:"source,omitempty"`
+	Destination      string   `json:"destination,omitempty" yaml:"destination,omitempty"`
+	InInterface      string   `json:"in,omitempty" yaml:"in,omitempty"`
+	OutInterface     string   `json:"out,omitempty" yaml:"out,omitempty"`
+	SourcePorts      []string `json:"sourcePorts,omitempty" yaml:"sourcePorts,omitempty"`
+	DestinationPorts []string `json:"destinationPorts,omitempty" yaml:"destinationPorts,omitempty"`
+	// States are conntrack states, e.g. "ESTABLISHED"
+	States        []string `json:"states,omitempty" yaml:"states,omitempty"`
+	Args          []string `json:"args,omitempty" yaml:"args,omitempty"`
+	Comment       string   `json:"comment,omitempty" yaml:"comment,omitempty"`
+	Target        string   `json:"target,omitempty" yaml:"target,omitempty"`
+	TargetOptions []string `json:"targetOptions,omitempty" yaml:"targetOptions,omitempty"`
+}
+
+// Load reads a JSON Config from r. Unknown fields are rejected, so that
+// typos don't go unnoticed.
+func Load(r io.Reader) (*Config, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var c Config
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// LoadWith reads a Config from r with unmarshal, which must honor either
+// the json or the yaml struct tags; this package doesn't depend on a YAML
+// library, pass e.g. the Unmarshal function of gopkg.in/yaml.v3 or
+// sigs.k8s.io/yaml to load YAML.
+func LoadWith(r io.Reader, unmarshal func([]byte, interface{}) error) (*Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Validate checks that c describes a valid ruleset, building every rule.
+func (c *Config) Validate() error {
+	switch c.Family {
+	case "", "ipv4", "ipv6":
+	default:
+		return fmt.Errorf("unknown family %q", c.Family)
+	}
+	_, err := c.Desired()
+	return err
+}
+
+// Desired returns the rulespecs of every chain of every table of c, as
+// taken by iptables.Reconciler.
+func (c *Config) Desired() (map[string]map[string][][]string, error) {
+	desired := map[string]map[string][][]string{}
+	for _, t := range c.Tables {
+		if t.Name == "" {
+			return nil, fmt.Errorf("table without a name")
+		}
+		if desired[t.Name] == nil {
+			desired[t.Name] = map[string][][]string{}
+		}
+		for _, ch := range t.Chains {
+			if ch.Name == "" {
+				return nil, fmt.Errorf("table %s: chain without a name", t.Name)
+			}
+			if _, dup := desired[t.Name][ch.Name]; dup {
+				return nil, fmt.Errorf("table %s: chain %s listed twice", t.Name, ch.Name)
+			}
+			if ch.Policy != "" && !iptables.IsBuiltinChain(t.Name, ch.Name) {
+				return nil, fmt.Errorf("table %s: policy of user-defined chain %s", t.Name, ch.Name)
+			}
+			specs := [][]string{}
+			for i, r := range ch.Rules {
+				spec, err := r.Spec()
+				if err != nil {
+					return nil, fmt.Errorf("table %s: chain %s: rule %d: %v", t.Name, ch.Name, i+1, err)
+				}
+				specs = append(specs, spec)
+			}
+			desired[t.Name][ch.Name] = specs
+		}
+	}
+	return desired, nil
+}
+
+// Spec returns the rulespec of r.
+func (r Rule) Spec() ([]string, error) {
+	var spec []string
+	criteria := func(opt, value string) {
+		if value == "" {
+			return
+		}
+		if strings.HasPrefix(value, "!") {
+			spec = append(spec, "!")
+			value = value[1:]
+		}
+		spec = append(spec, opt, value)
+	}
+	criteria("-s", r.Source)
+	criteria("-d", r.Destination)
+	criteria("-i", r.InInterface)
+	criteria("-o", r.OutInterface)
+
+	ports, err := r.portMatch()
+	if err != nil {
+		return nil, err
+	}
+	if ports == nil {
+		criteria("-p", r.Protocol)
+	}
+	spec = append(spec, ports...)
+
+	if len(r.States) > 0 {
+		m, err := iptables.ConntrackMatch(r.States...)
+		if err != nil {
+			return nil, err
+		}
+		spec = append(spec, m...)
+	}
+	spec = append(spec, r.Args...)
+	if r.Comment != "" {
+		m, err := iptables.Comment(r.Comment)
+		if err != nil {
+			return nil, err
+		}
+		spec = append(spec, m...)
+	}
+	if r.Target != "" {
+		spec = append(spec, "-j", r.Target)
+		spec = append(spec, r.TargetOptions...)
+	} else if len(r.TargetOptions) > 0 {
+		return nil, fmt.Errorf("target options without a target")
+	}
+	return spec, nil
+}
+
+// portMatch returns the match of the ports of r, or nil if it has none.
+func (r Rule) portMatch() ([]string, error) {
+	if len(r.SourcePorts) == 0 && len(r.DestinationPorts) == 0 {
+		return nil, nil
+	}
+	if r.Protocol == "" || strings.HasPrefix(r.Protocol, "!") {
+		return nil, fmt.Errorf("ports require a protocol")
+	}
+	sports, err := parsePorts(r.SourcePorts)
+	if err != nil {
+		return nil, err
+	}
+	dports, err := parsePorts(r.DestinationPorts)
+	if err != nil {
+		return nil, err
+	}
+
+	// a single port per direction uses the match of the protocol
+	if len(sports) <= 1 && len(dports) <= 1 && (r.Protocol == "tcp" || r.Protocol == "udp") {
+		var sport, dport iptables.PortRange
+		if len(sports) == 1 {
+			sport = sports[0]
+		}
+		if len(dports) == 1 {
+			dport = dports[0]
+		}
+		if r.Protocol == "tcp" {
+			return iptables.TCPMatch(sport, dport)
+		}
+		return iptables.UDPMatch(sport, dport)
+	}
+
+	var spec []string
+	for _, p := range []struct {
+		dir   iptables.PortDirection
+		ports []iptables.PortRange
+	}{{iptables.SourcePorts, sports}, {iptables.DestinationPorts, dports}} {
+		if len(p.ports) == 0 {
+			continue
+		}
+		m, err := iptables.MultiportMatch(r.Protocol, p.dir, p.ports...)
+		if err != nil {
+			return nil, err
+		}
+		if spec != nil {
+			// both directions share the -p of the first match
+			m = m[2:]
+		}
+		spec = append(spec, m...)
+	}
+	return spec, nil
+}
+
+// parsePorts parses ports given as "port" or "first:last".
+func parsePorts(ports []string) ([]iptables.PortRange, error) {
+	ranges := make([]iptables.PortRange, len(ports))
+	for i, p := range ports {
+		first, last := p, ""
+		if j := strings.IndexByte(p, ':'); j >= 0 {
+			first, last = p[:j], p[j+1:]
+		}
+		n, err := strconv.ParseUint(first, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		ranges[i].First = uint16(n)
+		if last != "" {
+			n, err := strconv.ParseUint(last, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %q", p)
+			}
+			ranges[i].Last = uint16(n)
+		}
+	}
+	return ranges, nil
+}
+
+// checkFamily returns an error if c is meant for another family than ipt.
+func (c *Config) checkFamily(ipt *iptables.IPTables) error {
+	family := "ipv4"
+	if ipt.Proto() == iptables.ProtocolIPv6 {
+		family = "ipv6"
+	}
+	if c.Family != "" && c.Family != family {
+		return fmt.Errorf("config for %s applied to an %s handle", c.Family, family)
+	}
+	return nil
+}
+
+// Plan returns the operations Apply would make with ipt, without making
+// them.
+func (c *Config) Plan(ipt *iptables.IPTables) ([]iptables.Operation, error) {
+	if err := c.checkFamily(ipt); err != nil {
+		return nil, err
+	}
+	desired, err := c.Desired()
+	if err != nil {
+		return nil, err
+	}
+	ops, err := ipt.NewReconciler().Plan(desired)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := c.policyChanges(ipt)
+	if err != nil {
+		return nil, err
+	}
+	return append(ops, policies...), nil
+}
+
+// Apply brings the chains of c to the described rules and policies with
+// ipt, and returns the operations made. The rules are changed with a
+// single Transaction, before the policies are set.
+func (c *Config) Apply(ipt *iptables.IPTables) ([]iptables.Operation, error) {
+	if err := c.checkFamily(ipt); err != nil {
+		return nil, err
+	}
+	desired, err := c.Desired()
+	if err != nil {
+		return nil, err
+	}
+	ops, err := ipt.NewReconciler().Apply(desired)
+	if err != nil {
+		return ops, err
+	}
+	policies, err := c.policyChanges(ipt)
+	if err != nil {
+		return ops, err
+	}
+	for _, op := range policies {
+		if err := ipt.SetPolicy(op.Table, op.Chain, op.Policy); err != nil {
+			return ops, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// policyChanges returns the policy operations needed to bring the builtin
+// chains to the policies of c.
+func (c *Config) policyChanges(ipt *iptables.IPTables) ([]iptables.Operation, error) {
+	var ops []iptables.Operation
+	for _, t := range c.Tables {
+		for _, ch := range t.Chains {
+			if ch.Policy == "" {
+				continue
+			}
+			current, err := ipt.ChainPolicy(t.Name, ch.Name)
+			if err != nil {
+				return nil, err
+			}
+			if current != ch.Policy {
+				ops = append(ops, iptables.Operation{Kind: "policy", Proto: ipt.Proto(), Table: t.Name, Chain: ch.Name, Policy: ch.Policy})
+			}
+		}
+	}
+	return ops, nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const testConfig = `{
+  "family": "ipv4",
+  "tables": [{
+    "name": "filter",
+    "chains": [
+      {"name": "INPUT", "policy": "DROP", "rules": [
+        {"in": "lo", "target": "ACCEPT"},
+        {"states": ["ESTABLISHED", "RELATED"], "target": "ACCEPT"},
+        {"target": "SSH"}
+      ]},
+      {"name": "SSH", "rules": [
+        {"protocol": "tcp", "destinationPorts": ["22"], "source": "10.0.0.0/8",
+         "comment": "admin network", "target": "ACCEPT"},
+        {"protocol": "udp", "destinationPorts": ["60000:61000", "500"], "target": "ACCEPT"}
+      ]}
+    ]
+  }]
+}`
+
+func TestDesired(t *testing.T) {
+	c, err := Load(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	desired, err := c.Desired()
+	if err != nil {
+		t.Fatalf("Desired failed: %v", err)
+	}
+	expected := map[string]map[string][][]string{
+		"filter": {
+			"INPUT": {
+				{"-i", "lo", "-j", "ACCEPT"},
+				{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+				{"-j", "SSH"},
+			},
+			"SSH": {
+				{"-s", "10.0.0.0/8", "-p", "tcp", "-m", "tcp", "--dport", "22", "-m", "comment", "--comment", "admin network", "-j", "ACCEPT"},
+				{"-p", "udp", "-m", "multiport", "--dports", "500,60000:61000", "-j", "ACCEPT"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(desired, expected) {
+		t.Fatalf("Desired mismatch: \ngot  %q \nneed %q", desired, expected)
+	}
+
+	// any unmarshal function honoring the struct tags will do
+	c2, err := LoadWith(strings.NewReader(testConfig), json.Unmarshal)
+	if err != nil || !reflect.DeepEqual(c, c2) {
+		t.Fatalf("LoadWith mismatch: %+v, %v", c2, err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		err    string
+	}{
+		{`{"tables": [{"name": "filter", "chain": []}]}`, `unknown field "chain"`},
+		{`{"family": "ipx", "tables": []}`, `unknown family "ipx"`},
+		{`{"tables": [{"name": "filter", "chains": [{"name": "FOO", "policy": "DROP"}]}]}`, "policy of user-defined chain FOO"},
+		{`{"tables": [{"name": "filter", "chains": [{"name": "FOO", "rules": [{"destinationPorts": ["22"]}]}]}]}`, "rule 1: ports require a protocol"},
+		{`{"tables": [{"name": "filter", "chains": [{"name": "FOO", "rules": [{"protocol": "tcp", "sourcePorts": ["http"]}]}]}]}`, `invalid port "http"`},
+		{`{"tables": [{"name": "filter", "chains": [{"name": "FOO", "rules": [{"states": ["BOGUS"]}]}]}]}`, "BOGUS"},
+	} {
+		_, err := Load(strings.NewReader(tc.config))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.config, tc.err, err)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	var payload bytes.Buffer
+	var changes []string
+	runner := iptables.RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		switch {
+		case stdin != nil:
+			payload.ReadFrom(stdin)
+		case args[3] == "-S":
+			io.WriteString(stdout, "-P INPUT ACCEPT\n-P FORWARD ACCEPT\n-P OUTPUT ACCEPT\n-A INPUT -i lo -j ACCEPT\n")
+		default:
+			changes = append(changes, strings.Join(args, " "))
+		}
+		return 0, nil
+	})
+	ipt, err := iptables.New(iptables.CommandRunner(runner), iptables.CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	c, err := Load(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	ops, err := c.Apply(ipt)
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	var applied []string
+	for _, op := range ops {
+		applied = append(applied, op.String())
+	}
+	expected := []string{
+		"append filter/INPUT -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		"append filter/INPUT -j SSH",
+		"new-chain filter/SSH",
+		`append filter/SSH -s 10.0.0.0/8 -p tcp -m tcp --dport 22 -m comment --comment "admin network" -j ACCEPT`,
+		"append filter/SSH -p udp -m multiport --dports 500,60000:61000 -j ACCEPT",
+		"policy filter/INPUT",
+	}
+	if !reflect.DeepEqual(applied, expected) {
+		t.Fatalf("Apply mismatch: \ngot  %q \nneed %q", applied, expected)
+	}
+	if !strings.Contains(payload.String(), "-A INPUT -j SSH\n") {
+		t.Fatalf("unexpected payload:\n%s", payload.String())
+	}
+	if !reflect.DeepEqual(changes, []string{"iptables -t filter -P INPUT DROP --wait"}) {
+		t.Fatalf("unexpected changes %q", changes)
+	}
+
+	ipt6, err := iptables.New(iptables.CommandRunner(runner), iptables.CompatibilityProfile("1.8.7-nft"), iptables.IPFamily(iptables.ProtocolIPv6))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, err := c.Apply(ipt6); err == nil {
+		t.Fatalf("expected an IPv4 config to be refused by an IPv6 handle")
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ConntrackFilter selects connection tracking entries by the original
+// direction of their connection. Unset fields match any value.
+type ConntrackFilter struct {
+	Protocol    string
+	Source      net.IP
+	Destination net.IP
+	SrcPort     uint16
+	DstPort     uint16
+}
+
+// isEmpty reports whether f selects every entry.
+func (f ConntrackFilter) isEmpty() bool {
+	return f.Protocol == "" && f.Source == nil && f.Destination == nil && f.SrcPort == 0 && f.DstPort == 0
+}
+
+// args returns the arguments of conntrack selecting the entries of f.
+func (f ConntrackFilter) args(proto Protocol) []string {
+	family := "ipv4"
+	if proto == ProtocolIPv6 {
+		family = "ipv6"
+	}
+	args := []string{"-f", family}
+	if f.Protocol != "" {
+		args = append(args, "-p", f.Protocol)
+	}
+	if f.Source != nil {
+		args = append(args, "-s", f.Source.String())
+	}
+	if f.Destination != nil {
+		args = append(args, "-d", f.Destination.String())
+	}
+	if f.SrcPort != 0 {
+		args = append(args, "--sport", strconv.Itoa(int(f.SrcPort)))
+	}
+	if f.DstPort != 0 {
+		args = append(args, "--dport", strconv.Itoa(int(f.DstPort)))
+	}
+	return args
+}
+
+// ConntrackFilterForRule derives from rule the filter of the connections
+// it applies to: its protocol, addresses and ports. It returns false if
+// they cannot be expressed exactly (negations, networks, port ranges or
+// lists) or if the rule has none, as flushing more entries than the rule
+// applies to would disrupt unrelated connections. Interfaces and other
+// matches are not taken into account.
+func ConntrackFilterForRule(rule Rule) (ConntrackFilter, bool) {
+	var f ConntrackFilter
+	if strings.HasPrefix(rule.Protocol, "!") {
+		return f, false
+	}
+	if p := normalizeProtocol(rule.Protocol); p != "" && p != "all" && p != "0" {
+		f.Protocol = p
+	}
+	for _, addr := range []struct {
+		value string
+		ip    *net.IP
+	}{{rule.Source, &f.Source}, {rule.Destination, &f.Destination}} {
+		if addr.value == "" {
+			continue
+		}
+		ip, n, err := net.ParseCIDR(normalizeAddress(addr.value))
+		if err != nil {
+			return f, false
+		}
+		if ones, bits := n.Mask.Size(); ones != bits {
+			return f, false
+		}
+		*addr.ip = ip
+	}
+
+	for _, m := range rule.Matches {
+		for i, opt := range m.Options {
+			var port *uint16
+			switch opt {
+			case "--sport", "--source-port":
+				port = &f.SrcPort
+			case "--dport", "--destination-port":
+				port = &f.DstPort
+			case "--sports", "--dports", "--source-ports", "--destination-ports", "--ports":
+				return f, false
+			default:
+				continue
+			}
+			if i > 0 && m.Options[i-1] == "!" || i+1 >= len(m.Options) {
+				return f, false
+			}
+			p, err := strconv.ParseUint(m.Options[i+1], 10, 16)
+			if err != nil {
+				// a range or a service name
+				return f, false
+			}
+			*port = uint16(p)
+		}
+	}
+	return f, !f.isEmpty()
+}
+
+// FlushConntrack deletes the connection tracking entries of the handle's
+// family selected by f with the conntrack tool, so that established
+// connections are subject to the rules again, e.g. after a DNAT or DROP
+// rule was deleted. At least one field of f must be set.
+func (ipt *IPTables) FlushConntrack(f ConntrackFilter) error {
+	if f.isEmpty() {
+		return fmt.Errorf("refusing to flush every conntrack entry")
+	}
+	path, err := ipt.lookPath("conntrack")
+	if err != nil {
+		return err
+	}
+	err = ipt.runCommand(append([]string{path, "-D"}, f.args(ipt.proto)...), nil, nil)
+	var eerr *Error
+	if errors.As(err, &eerr) && strings.Contains(eerr.msg, "0 flow entries") {
+		// nothing to delete
+		return nil
+	}
+	return err
+}
+
+// FlushConntrackOnDelete makes Delete flush the connection tracking
+// entries of the connections the deleted rule applied to, as derived by
+// ConntrackFilterForRule, once the rule is deleted. Rules whose
+// connections cannot be derived are deleted without flushing anything. A
+// failure to flush, e.g. as conntrack is missing, is returned as a
+// *ConntrackFlushError, as the rule is deleted nonetheless.
+func FlushConntrackOnDelete() option {
+	return func(ipt *IPTables) {
+		ipt.flushConntrack = true
+	}
+}
+
+// ConntrackFlushError is returned by Delete when the rule was deleted but
+// the conntrack entries of its connections could not be flushed, see
+// FlushConntrackOnDelete. Retrying the Delete would fail, as the rule is
+// gone; retry FlushConntrack with Filter instead.
+type ConntrackFlushError struct {
+	Filter ConntrackFilter
+	Err    error
+}
+
+func (e *ConntrackFlushError) Error() string {
+	return fmt.Sprintf("rule deleted, but flushing its conntrack entries failed: %v", e.Err)
+}
+
+func (e *ConntrackFlushError) Unwrap() error {
+	return e.Err
+}
+
+// flushConntrackFor flushes the entries of the connections rulespec
+// applied to, if the handle was created with FlushConntrackOnDelete.
+func (ipt *IPTables) flushConntrackFor(chain string, rulespec []string) error {
+	if !ipt.flushConntrack {
+		return nil
+	}
+	rule, err := ParseRulespec(chain, rulespec...)
+	if err != nil {
+		return nil
+	}
+	f, ok := ConntrackFilterForRule(rule)
+	if !ok {
+		return nil
+	}
+	if err := ipt.FlushConntrack(f); err != nil {
+		return &ConntrackFlushError{Filter: f, Err: err}
+	}
+	return nil
+}
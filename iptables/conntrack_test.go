@@ -0,0 +1,119 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConntrackFilterForRule(t *testing.T) {
+	for _, tc := range []struct {
+		spec     string
+		expected *ConntrackFilter
+	}{
+		{"-d 10.0.0.2/32 -p tcp -m tcp --dport 80 -j DROP",
+			&ConntrackFilter{Protocol: "tcp", Destination: net.ParseIP("10.0.0.2"), DstPort: 80}},
+		{"-i eth0 -p udp --sport 53 -s 192.168.1.1 -j DNAT --to-destination 10.0.0.1",
+			&ConntrackFilter{Protocol: "udp", Source: net.ParseIP("192.168.1.1").To4(), SrcPort: 53}},
+		{"-s 10.0.0.0/8 -j DROP", nil},
+		{"! -s 10.0.0.1 -j DROP", nil},
+		{"-p tcp -m tcp --dport 1000:2000 -j DROP", nil},
+		{"-p tcp -m tcp ! --dport 22 -j DROP", nil},
+		{"-p tcp -m multiport --dports 80,443 -j DROP", nil},
+		{"-i eth0 -j DROP", nil},
+	} {
+		args, _ := SplitRuleSpec(tc.spec)
+		rule, err := ParseRulespec("INPUT", args...)
+		if err != nil {
+			t.Fatalf("ParseRulespec(%q) failed: %v", tc.spec, err)
+		}
+		f, ok := ConntrackFilterForRule(rule)
+		if tc.expected == nil {
+			if ok {
+				t.Errorf("%q: expected no filter, got %+v", tc.spec, f)
+			}
+			continue
+		}
+		if !ok || !reflect.DeepEqual(f.args(ProtocolIPv4), tc.expected.args(ProtocolIPv4)) {
+			t.Errorf("%q: got %+v (%v), need %+v", tc.spec, f, ok, *tc.expected)
+		}
+	}
+}
+
+func TestFlushConntrackOnDelete(t *testing.T) {
+	var calls []string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, strings.Join(args, " "))
+		if args[0] == "conntrack" {
+			io.WriteString(stderr, "conntrack v1.4.6 (conntrack-tools): 0 flow entries have been deleted.\n")
+			return 1, nil
+		}
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"), FlushConntrackOnDelete())
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := ipt.Delete("nat", "PREROUTING", "-d", "203.0.113.1/32", "-p", "tcp", "-m", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.0.0.2:80"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := ipt.Delete("filter", "INPUT", "-s", "10.0.0.0/8", "-j", "DROP"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	expected := []string{
+		"iptables -t nat -D PREROUTING -d 203.0.113.1/32 -p tcp -m tcp --dport 8080 -j DNAT --to-destination 10.0.0.2:80 --wait",
+		"conntrack -D -f ipv4 -p tcp -d 203.0.113.1 --dport 8080",
+		"iptables -t filter -D INPUT -s 10.0.0.0/8 -j DROP --wait",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("got %q, need %q", calls, expected)
+	}
+
+	if err := ipt.FlushConntrack(ConntrackFilter{}); err == nil {
+		t.Fatalf("expected flushing everything to be refused")
+	}
+}
+
+func TestFlushConntrackOnDeleteFailure(t *testing.T) {
+	var calls []string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, args[0])
+		if args[0] == "conntrack" {
+			return -1, errors.New(`exec: "conntrack": executable file not found in $PATH`)
+		}
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"), FlushConntrackOnDelete())
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	err = ipt.Delete("filter", "INPUT", "-s", "192.0.2.1/32", "-p", "udp", "-m", "udp", "--dport", "53", "-j", "DROP")
+	var cerr *ConntrackFlushError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("expected a *ConntrackFlushError, got %v", err)
+	}
+	if cerr.Filter.Protocol != "udp" || cerr.Filter.DstPort != 53 || !cerr.Filter.Source.Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("unexpected filter %+v", cerr.Filter)
+	}
+	if !reflect.DeepEqual(calls, []string{"iptables", "conntrack"}) {
+		t.Fatalf("unexpected calls %q", calls)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxLoggedStderr is the number of bytes of stderr kept in a CommandEvent.
+const maxLoggedStderr = 1024
+
+// CommandEvent describes a command run by a handle, as passed to the
+// DebugLog callback.
+type CommandEvent struct {
+	// Args is the full command line, including the binary and any
+	// nsenter prefix
+	Args []string
+	// Operation is the operation name also used for metrics, e.g.
+	// "append" or "restore"
+	Operation string
+	Duration  time.Duration
+	// RateLimitWait is how long the command was held back by RateLimit
+	// before running; it isn't part of Duration
+	RateLimitWait time.Duration
+	// ExitStatus is -1 if the command could not be run at all
+	ExitStatus int
+	// Stderr is the error output of the command, truncated to 1KiB
+	Stderr string
+	Err    error
+}
+
+// String formats the event as a single log line.
+func (e CommandEvent) String() string {
+	s := fmt.Sprintf("%s (%s, exit status %d", strings.Join(quoteArgs(e.Args), " "), e.Duration, e.ExitStatus)
+	if e.RateLimitWait > 0 {
+		s += fmt.Sprintf(", rate limited for %s", e.RateLimitWait)
+	}
+	s += ")"
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		s += ": " + stderr
+	}
+	return s
+}
+
+// DebugLog makes the handle call fn after every command it runs, so that
+// what was actually executed and what iptables answered can be logged,
+// e.g. with
+//
+//	iptables.DebugLog(func(e iptables.CommandEvent) { log.Print(e) })
+//
+// fn is called synchronously and must be safe for concurrent use if the
+// handle is used concurrently.
+func DebugLog(fn func(CommandEvent)) option {
+	return func(ipt *IPTables) {
+		ipt.debugLog = fn
+	}
+}
+
+// logCommand reports the command args, run as cmdArgs after being held
+// back by the rate limit for throttled, to the DebugLog callback.
+func (ipt *IPTables) logCommand(args, cmdArgs []string, start time.Time, throttled time.Duration, err error, stderr string) {
+	if ipt.debugLog == nil {
+		return
+	}
+	if len(stderr) > maxLoggedStderr {
+		stderr = stderr[:maxLoggedStderr] + "..."
+	}
+	ipt.debugLog(CommandEvent{
+		Args:          cmdArgs,
+		Operation:     execOperation(args),
+		Duration:      time.Since(start),
+		RateLimitWait: throttled,
+		ExitStatus:    exitStatus(err),
+		Stderr:        stderr,
+		Err:           err,
+	})
+}
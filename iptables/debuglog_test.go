@@ -0,0 +1,47 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDebugLog(t *testing.T) {
+	var events []CommandEvent
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		io.WriteString(stderr, strings.Repeat("x", 2000))
+		return 4, nil
+	})
+	ipt := &IPTables{path: "/sbin/iptables", runner: runner}
+	DebugLog(func(e CommandEvent) { events = append(events, e) })(ipt)
+
+	err := ipt.runCommand([]string{"/sbin/iptables", "-t", "nat", "-A", "POSTROUTING", "-j", "MASQUERADE"}, nil, nil)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	e := events[0]
+	if e.Operation != "append" || e.ExitStatus != 4 || e.Err != err || len(e.Stderr) != maxLoggedStderr+3 {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if !strings.HasPrefix(e.String(), "/sbin/iptables -t nat -A POSTROUTING -j MASQUERADE (") {
+		t.Fatalf("unexpected event line %q", e.String())
+	}
+}
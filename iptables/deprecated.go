@@ -0,0 +1,78 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+)
+
+// DeprecatedTargetError is returned when a rule using a target that was
+// removed from Linux or iptables is about to be added, rather than letting
+// iptables fail with an obscure message, possibly in the middle of a
+// restore.
+type DeprecatedTargetError struct {
+	Target string
+	// Removed tells when the target went away
+	Removed string
+	// Replacement describes what to use instead
+	Replacement string
+}
+
+func (e *DeprecatedTargetError) Error() string {
+	return fmt.Sprintf("target %s is deprecated (%s), use %s instead", e.Target, e.Removed, e.Replacement)
+}
+
+// deprecatedTargets lists the targets CheckDeprecated refuses.
+var deprecatedTargets = map[string]DeprecatedTargetError{
+	"CLUSTERIP":     {Removed: "removed in Linux 6.3", Replacement: "the cluster match (-m cluster) with -j MARK"},
+	"ULOG":          {Removed: "removed in Linux 3.17", Replacement: "NFLOG"},
+	"SAME":          {Removed: "removed in Linux 2.6.25", Replacement: "SNAT or DNAT with --persistent"},
+	"MIRROR":        {Removed: "removed in Linux 2.6.24", Replacement: "an explicit DNAT rule"},
+	"IPV4OPTSSTRIP": {Removed: "removed from iptables 1.4", Replacement: "dropping packets with -m ipv4options"},
+}
+
+// CheckDeprecated returns a *DeprecatedTargetError if rulespec jumps (-j)
+// or goes (-g) to a deprecated target, e.g. CLUSTERIP or ULOG. Append,
+// Insert, Replace, the restore methods and Transactions check the rules
+// they add with it; deleting such rules remains possible.
+func CheckDeprecated(rulespec ...string) error {
+	for i := 0; i+1 < len(rulespec); i++ {
+		switch rulespec[i] {
+		case "-j", "--jump", "-g", "--goto":
+		default:
+			continue
+		}
+		if d, ok := deprecatedTargets[rulespec[i+1]]; ok {
+			d.Target = rulespec[i+1]
+			return &d
+		}
+	}
+	return nil
+}
+
+// checkDeprecatedOperations runs CheckDeprecated on the rules added by ops.
+func checkDeprecatedOperations(ops ...Operation) error {
+	for _, op := range ops {
+		switch op.Kind {
+		case "append", "insert", "replace":
+		default:
+			continue
+		}
+		if err := CheckDeprecated(op.Rulespec...); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestCheckDeprecated(t *testing.T) {
+	var derr *DeprecatedTargetError
+	err := CheckDeprecated("-d", "10.0.0.1", "-i", "eth0", "-j", "CLUSTERIP", "--new", "--hashmode", "sourceip")
+	if !errors.As(err, &derr) || derr.Target != "CLUSTERIP" {
+		t.Fatalf("expected a DeprecatedTargetError for CLUSTERIP, got %v", err)
+	}
+	if err := CheckDeprecated("-g", "ULOG"); err == nil {
+		t.Fatalf("expected an error for ULOG")
+	}
+	if err := CheckDeprecated("-m", "comment", "--comment", "ULOG", "-j", "NFLOG"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var calls int
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls++
+		if stdin != nil {
+			io.Copy(io.Discard, stdin)
+		}
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := ipt.Append("filter", "INPUT", "-j", "ULOG"); !errors.As(err, &derr) {
+		t.Fatalf("Append: expected a DeprecatedTargetError, got %v", err)
+	}
+	err = ipt.Restore("filter", map[string][][]string{"OLD": {{"-j", "ULOG"}}})
+	if !errors.As(err, &derr) {
+		t.Fatalf("Restore: expected a DeprecatedTargetError, got %v", err)
+	}
+	tx := ipt.NewTransaction()
+	tx.Insert("filter", "INPUT", 1, "-j", "CLUSTERIP")
+	if err := tx.Commit(); !errors.As(err, &derr) {
+		t.Fatalf("Commit: expected a DeprecatedTargetError, got %v", err)
+	}
+	if calls != 0 {
+		t.Fatalf("iptables ran %d times", calls)
+	}
+
+	// cleaning up old rules is still possible
+	if err := ipt.Delete("filter", "INPUT", "-j", "ULOG"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ChainDiff describes how a chain differs between two sets of rulesets.
+// Positions are 1-based.
+type ChainDiff struct {
+	Table string `json:"table"`
+	Chain string `json:"chain"`
+	// Created and Removed are set for chains only present in the desired,
+	// respectively current, rulesets
+	Created bool `json:"created,omitempty"`
+	Removed bool `json:"removed,omitempty"`
+	// OldPolicy and NewPolicy are only set when the policy changes
+	OldPolicy string `json:"oldPolicy,omitempty"`
+	NewPolicy string `json:"newPolicy,omitempty"`
+	// Additions and Deletions are the rules only present in the desired,
+	// respectively current, chain
+	Additions []RuleChange `json:"additions,omitempty"`
+	Deletions []RuleChange `json:"deletions,omitempty"`
+	// Reorders are the rules present in both chains that have to move
+	Reorders []RuleMove `json:"reorders,omitempty"`
+}
+
+// RuleChange is a rule added or deleted at the given position.
+type RuleChange struct {
+	Rule Rule `json:"rule"`
+	Pos  int  `json:"pos"`
+}
+
+// RuleMove is a rule moving from position From in the current chain to
+// position To in the desired one.
+type RuleMove struct {
+	Rule Rule `json:"rule"`
+	From int  `json:"from"`
+	To   int  `json:"to"`
+}
+
+// String formats the diff for review, in the style of a plan:
+//
+//	~ filter/INPUT
+//	  - -A INPUT -s 10.0.0.0/8 -j ACCEPT
+//	  + -A INPUT -s 10.0.0.0/16 -j ACCEPT
+func (d ChainDiff) String() string {
+	var b strings.Builder
+	switch {
+	case d.Created:
+		fmt.Fprintf(&b, "+ %s/%s\n", d.Table, d.Chain)
+	case d.Removed:
+		fmt.Fprintf(&b, "- %s/%s\n", d.Table, d.Chain)
+	default:
+		fmt.Fprintf(&b, "~ %s/%s\n", d.Table, d.Chain)
+	}
+	if d.OldPolicy != d.NewPolicy {
+		fmt.Fprintf(&b, "  ~ policy %s -> %s\n", d.OldPolicy, d.NewPolicy)
+	}
+	for _, c := range d.Deletions {
+		fmt.Fprintf(&b, "  - %s\n", c.Rule)
+	}
+	for _, c := range d.Additions {
+		fmt.Fprintf(&b, "  + %s\n", c.Rule)
+	}
+	for _, m := range d.Reorders {
+		fmt.Fprintf(&b, "  ~ %s (%d -> %d)\n", m.Rule, m.From, m.To)
+	}
+	return b.String()
+}
+
+// Diff compares the current and desired rulesets, e.g. as returned by
+// ParseSave, and returns the differences of every chain that changes,
+// sorted by table and chain. Rules are compared regardless of their
+// counters.
+func Diff(current, desired []Ruleset) []ChainDiff {
+	cur, des := rulesetChains(current), rulesetChains(desired)
+
+	keys := map[string]bool{}
+	for key := range cur {
+		keys[key] = true
+	}
+	for key := range des {
+		keys[key] = true
+	}
+
+	var diffs []ChainDiff
+	for _, key := range sortedKeys(keys) {
+		table := key[:strings.Index(key, "/")]
+		d := diffChain(table, cur[key], des[key])
+		if d.Created || d.Removed || d.OldPolicy != d.NewPolicy ||
+			len(d.Additions) > 0 || len(d.Deletions) > 0 || len(d.Reorders) > 0 {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs
+}
+
+// rulesetChains indexes the chains of rulesets by "table/chain".
+func rulesetChains(rulesets []Ruleset) map[string]*Chain {
+	chains := map[string]*Chain{}
+	for i := range rulesets {
+		for j := range rulesets[i].Chains {
+			chain := &rulesets[i].Chains[j]
+			chains[rulesets[i].Table+"/"+chain.Name] = chain
+		}
+	}
+	return chains
+}
+
+// diffChain compares two versions of a chain, either of which may be nil.
+// The longest common subsequence of rules stays in place; among the other
+// rules, those present in both chains are reorders.
+func diffChain(table string, cur, des *Chain) ChainDiff {
+	d := ChainDiff{Table: table}
+	var curRules, desRules []Rule
+	switch {
+	case cur == nil:
+		d.Chain, d.Created = des.Name, true
+		desRules = des.Rules
+	case des == nil:
+		d.Chain, d.Removed = cur.Name, true
+		curRules = cur.Rules
+	default:
+		d.Chain = cur.Name
+		curRules, desRules = cur.Rules, des.Rules
+		if cur.Policy != des.Policy {
+			d.OldPolicy, d.NewPolicy = cur.Policy, des.Policy
+		}
+	}
+
+	curKeys := make([]string, len(curRules))
+	for i, rule := range curRules {
+		curKeys[i] = ruleKey(rule)
+	}
+	desKeys := make([]string, len(desRules))
+	for i, rule := range desRules {
+		desKeys[i] = ruleKey(rule)
+	}
+	keepCur, keepDes := commonSubsequence(curKeys, desKeys)
+
+	// moved holds the positions of the current rules that aren't kept
+	// in place, per key
+	moved := map[string][]int{}
+	for i, key := range curKeys {
+		if !keepCur[i] {
+			moved[key] = append(moved[key], i)
+		}
+	}
+	for j, key := range desKeys {
+		if keepDes[j] {
+			continue
+		}
+		if from := moved[key]; len(from) > 0 {
+			d.Reorders = append(d.Reorders, RuleMove{desRules[j], from[0] + 1, j + 1})
+			keepCur[from[0]] = true
+			moved[key] = from[1:]
+		} else {
+			d.Additions = append(d.Additions, RuleChange{desRules[j], j + 1})
+		}
+	}
+	for i, rule := range curRules {
+		if !keepCur[i] {
+			d.Deletions = append(d.Deletions, RuleChange{rule, i + 1})
+		}
+	}
+	return d
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	current, err := ParseSave(`*filter
+:INPUT ACCEPT [10:600]
+:OLD - [0:0]
+:FOO - [0:0]
+[3:180] -A FOO -s 10.0.0.1/32 -j ACCEPT
+-A FOO -s 10.0.0.2/32 -j ACCEPT
+-A FOO -s 10.0.0.3/32 -j ACCEPT
+-A FOO -s 10.0.0.4/32 -j ACCEPT
+COMMIT
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired, err := ParseSave(`*filter
+:INPUT DROP [0:0]
+:FOO - [0:0]
+:NEW - [0:0]
+-A FOO -s 10.0.0.4/32 -j ACCEPT
+-A FOO -s 10.0.0.1/32 -j ACCEPT
+-A FOO -s 10.0.0.3/32 -j ACCEPT
+-A FOO -s 10.0.0.5/32 -j ACCEPT
+COMMIT
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule := func(addr string) Rule {
+		return Rule{Chain: "FOO", Source: addr, Target: "ACCEPT"}
+	}
+	expected := []ChainDiff{
+		{
+			Table:     "filter",
+			Chain:     "FOO",
+			Additions: []RuleChange{{rule("10.0.0.5/32"), 4}},
+			Deletions: []RuleChange{{rule("10.0.0.2/32"), 2}},
+			Reorders:  []RuleMove{{rule("10.0.0.4/32"), 4, 1}},
+		},
+		{Table: "filter", Chain: "INPUT", OldPolicy: "ACCEPT", NewPolicy: "DROP"},
+		{Table: "filter", Chain: "NEW", Created: true},
+		{Table: "filter", Chain: "OLD", Removed: true},
+	}
+
+	diffs := Diff(current, desired)
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Fatalf("Diff mismatch: \ngot  %#v \nneed %#v", diffs, expected)
+	}
+	if diffs := Diff(current, current); len(diffs) != 0 {
+		t.Fatalf("expected no differences, got %v", diffs)
+	}
+}
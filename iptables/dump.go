@@ -0,0 +1,130 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Dump is the structured form of the whole output of iptables-save: the
+// tables of a family, each with its chains, their policies and counters,
+// and their rules with their counters. It is the common model of diffing,
+// serialization and reconciliation.
+type Dump struct {
+	Tables []Ruleset `json:"tables"`
+}
+
+// ParseDump parses iptables-save output, with or without counters, read
+// from r.
+func ParseDump(r io.Reader) (*Dump, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := ParseSave(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if tables == nil {
+		tables = []Ruleset{}
+	}
+	return &Dump{Tables: tables}, nil
+}
+
+// Dump returns every table of the handle's family, including counters, as
+// a Dump.
+func (ipt *IPTables) Dump() (*Dump, error) {
+	var stdout bytes.Buffer
+	if err := ipt.runSave(&stdout, "-c"); err != nil {
+		return nil, err
+	}
+	return ParseDump(&stdout)
+}
+
+// Table returns the table with the given name, or nil if the dump has no
+// such table.
+func (d *Dump) Table(name string) *Ruleset {
+	for i := range d.Tables {
+		if d.Tables[i].Table == name {
+			return &d.Tables[i]
+		}
+	}
+	return nil
+}
+
+// TableNames returns the names of the tables of the dump, in order.
+func (d *Dump) TableNames() []string {
+	names := make([]string, len(d.Tables))
+	for i, rs := range d.Tables {
+		names[i] = rs.Table
+	}
+	return names
+}
+
+// MarshalSaveFormat renders d in iptables-save format, with counters, as
+// accepted by iptables-restore (with --counters to restore them): each
+// table declares its chains with their policies and counters, then lists
+// their rules, and ends with COMMIT. Parsing the output with ParseDump
+// gives d back.
+//
+// Rules with an empty Chain are rendered in the chain holding them; an
+// error is returned for rules of another chain, chains without a name or a
+// policy and tables without a name.
+func MarshalSaveFormat(d *Dump) ([]byte, error) {
+	var b strings.Builder
+	for _, rs := range d.Tables {
+		if rs.Table == "" {
+			return nil, fmt.Errorf("table without a name")
+		}
+		for _, c := range rs.Chains {
+			if c.Name == "" || c.Policy == "" {
+				return nil, fmt.Errorf("table %s: chain %q without a name or a policy", rs.Table, c.Name)
+			}
+			for _, r := range c.Rules {
+				if r.Chain != "" && r.Chain != c.Name {
+					return nil, fmt.Errorf("table %s: rule of chain %s in chain %s", rs.Table, r.Chain, c.Name)
+				}
+			}
+		}
+		writeSaveTable(&b, &rs, true)
+	}
+	return []byte(b.String()), nil
+}
+
+// writeSaveTable writes rs to b in iptables-save format, with or without
+// counters.
+func writeSaveTable(b *strings.Builder, rs *Ruleset, counters bool) {
+	fmt.Fprintf(b, "*%s\n", rs.Table)
+	for _, c := range rs.Chains {
+		if counters {
+			fmt.Fprintf(b, ":%s %s [%d:%d]\n", c.Name, c.Policy, c.Packets, c.Bytes)
+		} else {
+			fmt.Fprintf(b, ":%s %s\n", c.Name, c.Policy)
+		}
+	}
+	for _, c := range rs.Chains {
+		for _, r := range c.Rules {
+			r.Chain = c.Name
+			if counters {
+				fmt.Fprintf(b, "[%d:%d] ", r.Packets, r.Bytes)
+			}
+			b.WriteString(r.String() + "\n")
+		}
+	}
+	b.WriteString("COMMIT\n")
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	var args []string
+	runner := RunnerFunc(func(ctx context.Context, a []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		args = a
+		io.WriteString(stdout, testSave)
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	d, err := ipt.Dump()
+	if err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	if !reflect.DeepEqual(args, []string{"iptables-save", "-c"}) {
+		t.Fatalf("unexpected arguments %q", args)
+	}
+	if names := d.TableNames(); !reflect.DeepEqual(names, []string{"nat", "filter"}) {
+		t.Fatalf("unexpected tables %q", names)
+	}
+	nat := d.Table("nat")
+	if nat == nil || nat.FindChain("POSTROUTING").Packets != 3 || nat.FindChain("POSTROUTING").Rules[0].Bytes != 300 {
+		t.Fatalf("unexpected nat table %+v", nat)
+	}
+	if d.Table("raw") != nil {
+		t.Fatalf("expected no raw table")
+	}
+
+	d, err = ParseDump(strings.NewReader(""))
+	if err != nil || d.Tables == nil || len(d.Tables) != 0 {
+		t.Fatalf("expected an empty dump, got %+v, %v", d, err)
+	}
+	if _, err := ParseDump(strings.NewReader("*filter\n")); err == nil {
+		t.Fatalf("expected an uncommitted table to be rejected")
+	}
+}
+
+func TestMarshalSaveFormat(t *testing.T) {
+	d, err := ParseDump(strings.NewReader(testSave))
+	if err != nil {
+		t.Fatalf("ParseDump failed: %v", err)
+	}
+	d.Table("filter").FindChain("INPUT").Rules = append(d.Table("filter").FindChain("INPUT").Rules, Rule{Source: "192.0.2.0/24", Target: "DROP"})
+	out, err := MarshalSaveFormat(d)
+	if err != nil {
+		t.Fatalf("MarshalSaveFormat failed: %v", err)
+	}
+	expected := `*nat
+:PREROUTING ACCEPT [12:720]
+:POSTROUTING ACCEPT [3:180]
+:KUBE-MARK-MASQ - [0:0]
+[5:300] -A POSTROUTING -s 10.0.0.0/8 -o eth0 -j MASQUERADE
+[0:0] -A KUBE-MARK-MASQ -j MARK --set-xmark 0x4000/0x4000
+COMMIT
+*filter
+:INPUT DROP [0:0]
+[0:0] -A INPUT -p tcp -m tcp --dport 22 -m comment --comment "ssh access" -j ACCEPT
+[0:0] -A INPUT -s 192.0.2.0/24 -j DROP
+COMMIT
+`
+	if string(out) != expected {
+		t.Fatalf("MarshalSaveFormat mismatch: \ngot\n%s\nneed\n%s", out, expected)
+	}
+
+	// the rule added without a chain comes back with it
+	d.Table("filter").FindChain("INPUT").Rules[1].Chain = "INPUT"
+	parsed, err := ParseDump(strings.NewReader(string(out)))
+	if err != nil {
+		t.Fatalf("ParseDump failed: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, d) {
+		t.Fatalf("round trip mismatch: \ngot  %#v \nneed %#v", parsed, d)
+	}
+
+	d.Table("filter").FindChain("INPUT").Rules[1].Chain = "FORWARD"
+	if _, err := MarshalSaveFormat(d); err == nil {
+		t.Fatalf("expected a rule of another chain to be rejected")
+	}
+}
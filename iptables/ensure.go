@@ -0,0 +1,172 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"sort"
+)
+
+// RulePosition is the end of a chain EnsureRule keeps a rule at.
+type RulePosition string
+
+const (
+	// Prepend keeps the rule first in its chain
+	Prepend RulePosition = "-I"
+	// Append keeps the rule last in its chain
+	Append RulePosition = "-A"
+)
+
+// EnsureRule makes sure that rulespec is present in table/chain at the
+// given end of the chain, and reports whether it was there already. Unlike
+// AppendUnique and InsertUnique, a rule present elsewhere in the chain is
+// moved: it is added at the right end first, then its other copies are
+// deleted, so that it is never missing. Rules are compared after
+// normalization (see NormalizeRule).
+func (ipt *IPTables) EnsureRule(position RulePosition, table, chain string, rulespec ...string) (bool, error) {
+	rules, err := ipt.ListWithLineNumbers(table, chain)
+	if err != nil {
+		return false, err
+	}
+	matching, err := AnchorSpec(rulespec...).match(chain, rules)
+	if err != nil {
+		return false, err
+	}
+	if len(matching) == 0 {
+		if position == Prepend {
+			return false, ipt.Insert(table, chain, 1, rulespec...)
+		}
+		return false, ipt.Append(table, chain, rulespec...)
+	}
+
+	// stale holds the positions of the copies to delete once the rule is in
+	// place
+	var stale []int
+	if position == Prepend {
+		if matching[0].Pos == 1 {
+			matching = matching[1:]
+		} else if err := ipt.Insert(table, chain, 1, rulespec...); err != nil {
+			return true, err
+		} else {
+			// the insertion shifted every rule
+			for i := range matching {
+				matching[i].Pos++
+			}
+		}
+	} else {
+		if last := matching[len(matching)-1]; last.Pos == len(rules) {
+			matching = matching[:len(matching)-1]
+		} else if err := ipt.Append(table, chain, rulespec...); err != nil {
+			return true, err
+		}
+	}
+	for _, r := range matching {
+		stale = append(stale, r.Pos)
+	}
+
+	// delete from the end so that positions stay valid
+	sort.Sort(sort.Reverse(sort.IntSlice(stale)))
+	for _, pos := range stale {
+		if err := ipt.DeleteById(table, chain, pos); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// ChainResult tells what EnsureChain found.
+type ChainResult int
+
+const (
+	// ChainCreated means the chain did not exist and was created
+	ChainCreated ChainResult = iota
+	// ChainExisted means the chain, user-defined or builtin, existed
+	ChainExisted
+)
+
+func (r ChainResult) String() string {
+	if r == ChainExisted {
+		return "existed"
+	}
+	return "created"
+}
+
+// ChainOption configures EnsureChain.
+type ChainOption func(*chainConfig)
+
+type chainConfig struct {
+	policy string
+	flush  bool
+	zero   bool
+}
+
+// ChainWithPolicy sets the policy of the chain with -P, which only
+// builtin chains have.
+func ChainWithPolicy(policy string) ChainOption {
+	return func(c *chainConfig) {
+		c.policy = policy
+	}
+}
+
+// ChainFlush flushes the chain if it existed, as ClearChain does.
+func ChainFlush() ChainOption {
+	return func(c *chainConfig) {
+		c.flush = true
+	}
+}
+
+// ChainZeroCounters zeroes the counters of the chain and its rules.
+func ChainZeroCounters() ChainOption {
+	return func(c *chainConfig) {
+		c.zero = true
+	}
+}
+
+// EnsureChain creates the chain in the specified table unless it exists,
+// and reports which was the case, so that callers need neither treat every
+// error of NewChain as "already exists" nor flush the chain with
+// ClearChain just to make sure it's there. The options are applied to the
+// chain in either case.
+func (ipt *IPTables) EnsureChain(table, chain string, opts ...ChainOption) (ChainResult, error) {
+	var cfg chainConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	result := ChainCreated
+	if err := ipt.NewChain(table, chain); err != nil {
+		var eerr *Error
+		if !errors.As(err, &eerr) || !eerr.IsAlreadyExists() {
+			return result, err
+		}
+		result = ChainExisted
+	}
+	if cfg.flush && result == ChainExisted {
+		if err := ipt.run("-t", table, "-F", chain); err != nil {
+			return result, err
+		}
+	}
+	if cfg.policy != "" {
+		if err := ipt.SetPolicy(table, chain, cfg.policy); err != nil {
+			return result, err
+		}
+	}
+	if cfg.zero {
+		if err := ipt.run("-t", table, "-Z", chain); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
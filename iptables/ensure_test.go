@@ -0,0 +1,136 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnsureRule(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		position RulePosition
+		list     string
+		existed  bool
+		commands []string
+	}{
+		{
+			name:     "missing",
+			position: Prepend,
+			list:     "-N AGENT\n-A AGENT -c 0 0 -j DROP\n",
+			commands: []string{"-I AGENT 1 -i lo -j ACCEPT"},
+		},
+		{
+			name:     "already first",
+			position: Prepend,
+			list:     "-N AGENT\n-A AGENT -i lo -c 0 0 -j ACCEPT\n-A AGENT -c 0 0 -j DROP\n",
+			existed:  true,
+		},
+		{
+			name:     "moved first",
+			position: Prepend,
+			list:     "-N AGENT\n-A AGENT -c 0 0 -j DROP\n-A AGENT -i lo -c 0 0 -j ACCEPT\n",
+			existed:  true,
+			commands: []string{"-I AGENT 1 -i lo -j ACCEPT", "-D AGENT 3"},
+		},
+		{
+			name:     "already last",
+			position: Append,
+			list:     "-N AGENT\n-A AGENT -c 0 0 -j DROP\n-A AGENT -i lo -c 0 0 -j ACCEPT\n",
+			existed:  true,
+		},
+		{
+			name:     "moved last with duplicates",
+			position: Append,
+			list:     "-N AGENT\n-A AGENT -i lo -c 0 0 -j ACCEPT\n-A AGENT -i lo -c 0 0 -j ACCEPT\n-A AGENT -c 0 0 -j DROP\n",
+			existed:  true,
+			commands: []string{"-A AGENT -i lo -j ACCEPT", "-D AGENT 2", "-D AGENT 1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var commands []string
+			runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+				if args[3] == "-v" {
+					io.WriteString(stdout, tc.list)
+				} else {
+					commands = append(commands, strings.Join(args[3:len(args)-1], " "))
+				}
+				return 0, nil
+			})
+			ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			existed, err := ipt.EnsureRule(tc.position, "filter", "AGENT", "-i", "lo", "-j", "ACCEPT")
+			if err != nil {
+				t.Fatalf("EnsureRule failed: %v", err)
+			}
+			if existed != tc.existed || !reflect.DeepEqual(commands, tc.commands) {
+				t.Fatalf("EnsureRule = %v, ran %q; expected %v, %q", existed, commands, tc.existed, tc.commands)
+			}
+		})
+	}
+}
+
+func TestEnsureChain(t *testing.T) {
+	var calls []string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, strings.Join(args[3:len(args)-1], " "))
+		switch {
+		case args[3] == "-N" && (args[4] == "INPUT" || args[4] == "AGENT"):
+			io.WriteString(stderr, "iptables: Chain already exists.\n")
+			return 1, nil
+		case args[3] == "-N" && args[4] == "BROKEN":
+			io.WriteString(stderr, "iptables v1.8.7 (nf_tables): Couldn't load target `BROKEN'\n")
+			return 2, nil
+		}
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		chain    string
+		opts     []ChainOption
+		expected ChainResult
+		calls    []string
+	}{
+		{"NEW", []ChainOption{ChainFlush()}, ChainCreated, []string{"-N NEW"}},
+		{"AGENT", []ChainOption{ChainFlush(), ChainZeroCounters()}, ChainExisted, []string{"-N AGENT", "-F AGENT", "-Z AGENT"}},
+		{"INPUT", []ChainOption{ChainWithPolicy("DROP")}, ChainExisted, []string{"-N INPUT", "-P INPUT DROP"}},
+	} {
+		calls = nil
+		result, err := ipt.EnsureChain("filter", tc.chain, tc.opts...)
+		if err != nil {
+			t.Fatalf("EnsureChain(%s) failed: %v", tc.chain, err)
+		}
+		if result != tc.expected {
+			t.Errorf("%s: got %v, need %v", tc.chain, result, tc.expected)
+		}
+		if !reflect.DeepEqual(calls, tc.calls) {
+			t.Errorf("%s: got calls %q, need %q", tc.chain, calls, tc.calls)
+		}
+	}
+
+	if _, err := ipt.EnsureChain("filter", "BROKEN"); err == nil {
+		t.Fatalf("expected errors other than existence to be returned")
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+// XtablesLibDir sets XTABLES_LIBDIR in the environment of the commands,
+// the directory iptables loads its extensions from.
+func XtablesLibDir(dir string) option {
+	return Env("XTABLES_LIBDIR=" + dir)
+}
+
+// XtablesLockFile sets XTABLES_LOCKFILE in the environment of the
+// commands, the path of the xtables lock recent iptables versions take
+// instead of /run/xtables.lock. The lock the library takes itself for
+// iptables versions without --wait uses it as well.
+func XtablesLockFile(path string) option {
+	return func(ipt *IPTables) {
+		ipt.lockFile = path
+		Env("XTABLES_LOCKFILE=" + path)(ipt)
+	}
+}
+
+// Env adds environment variables, in the "KEY=value" form, to the
+// environment of the commands, which otherwise inherit the environment of
+// the process. With a CommandRunner, the commands are run through env(1) so
+// that the variables reach them wherever they run.
+func Env(vars ...string) option {
+	return func(ipt *IPTables) {
+		ipt.env = append(ipt.env, vars...)
+	}
+}
+
+// lockFilePath returns the path of the xtables lock.
+func (ipt *IPTables) lockFilePath() string {
+	if ipt.lockFile != "" {
+		return ipt.lockFile
+	}
+	return xtablesLockFilePath
+}
@@ -0,0 +1,72 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEnv(t *testing.T) {
+	var calls [][]string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, args)
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"),
+		XtablesLibDir("/opt/xtables"), XtablesLockFile("/tmp/xtables.lock"), Env("LC_ALL=C"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := ipt.ClearAll(); err != nil {
+		t.Fatalf("ClearAll failed: %v", err)
+	}
+	expected := []string{"env", "XTABLES_LIBDIR=/opt/xtables", "XTABLES_LOCKFILE=/tmp/xtables.lock", "LC_ALL=C", "iptables", "-F", "--wait"}
+	if !reflect.DeepEqual(calls[0], expected) {
+		t.Fatalf("args mismatch: \ngot  %v \nneed %v", calls[0], expected)
+	}
+	if path := ipt.lockFilePath(); path != "/tmp/xtables.lock" {
+		t.Fatalf("unexpected lock file %s", path)
+	}
+	if path := (&IPTables{}).lockFilePath(); path != xtablesLockFilePath {
+		t.Fatalf("unexpected default lock file %s", path)
+	}
+}
+
+func TestEnvExec(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	script := filepath.Join(t.TempDir(), "iptables")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"-P $XTABLES_LIBDIR ACCEPT\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ipt, err := New(Path(script), CompatibilityProfile("1.8.7-nft"), XtablesLibDir("/opt/xtables"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	rules, err := ipt.List("filter", "INPUT")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if !reflect.DeepEqual(rules, []string{"-P /opt/xtables ACCEPT"}) {
+		t.Fatalf("the variable didn't reach the command: %q", rules)
+	}
+}
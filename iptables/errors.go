@@ -0,0 +1,159 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Sentinel errors matched by errors.Is for the *Error of failed commands,
+// according to its classification methods, e.g.
+//
+//	if errors.Is(err, iptables.ErrNotExist) {
+var (
+	// ErrNotExist matches the errors for which IsNotExist is true
+	ErrNotExist = errors.New("chain, rule or table does not exist")
+	// ErrExists matches the errors for which IsAlreadyExists is true
+	ErrExists = errors.New("chain already exists")
+	// ErrLocked matches the errors for which IsLockHeld is true
+	ErrLocked = errors.New("xtables lock held by another process")
+	// ErrPermission matches the errors for which IsPermissionDenied is
+	// true
+	ErrPermission = errors.New("permission denied")
+)
+
+// Is makes errors.Is match the *Error of a failed command against the
+// sentinel errors of its classification: ErrNotExist, ErrExists,
+// ErrLocked, ErrPermission, ErrTableUnavailable and ErrModuleMissing.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotExist:
+		return e.IsNotExist()
+	case ErrExists:
+		return e.IsAlreadyExists()
+	case ErrLocked:
+		return e.IsLockHeld()
+	case ErrPermission:
+		return e.IsPermissionDenied()
+	case ErrTableUnavailable:
+		return e.IsTableUnavailable()
+	case ErrModuleMissing:
+		return e.MissingModule() != ""
+	}
+	return false
+}
+
+// Args returns the command line that failed, starting with the binary,
+// exactly as it was run, including the nsenter prefix of NetNS.
+func (e *Error) Args() []string {
+	return append([]string(nil), e.cmd.Args...)
+}
+
+// Message returns what the command printed on stderr, verbatim.
+func (e *Error) Message() string {
+	return e.msg
+}
+
+// Proto returns the family of the handle that ran the command.
+func (e *Error) Proto() Protocol {
+	return e.proto
+}
+
+// Mode returns the operating mode of the iptables binary of the handle
+// that ran the command, "legacy" or "nf_tables", or "" if unknown, e.g.
+// for the errors built with NewError.
+func (e *Error) Mode() string {
+	return e.mode
+}
+
+// containsAny reports whether s contains any of patterns.
+func containsAny(s string, patterns []string) bool {
+	for _, p := range patterns {
+		if strings.Contains(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+var isAlreadyExistsPatterns = []string{
+	"Chain already exists",
+	"File exists",
+}
+
+// IsAlreadyExists returns true if the error is due to the chain being
+// created existing already.
+func (e *Error) IsAlreadyExists() bool {
+	return containsAny(e.msg, isAlreadyExistsPatterns)
+}
+
+var isPermissionDeniedPatterns = []string{
+	"Permission denied",
+	"Operation not permitted",
+	"you must be root",
+}
+
+// IsPermissionDenied returns true if the error is due to the process
+// lacking the privileges (CAP_NET_ADMIN) to use iptables.
+func (e *Error) IsPermissionDenied() bool {
+	return containsAny(e.msg, isPermissionDeniedPatterns)
+}
+
+// IsLockHeld returns true if the error is due to another process holding
+// the xtables lock for longer than the handle waits, or at all without
+// --wait.
+func (e *Error) IsLockHeld() bool {
+	return strings.Contains(e.msg, "xtables lock")
+}
+
+// noSuchTableRegex matches the messages of iptables for a table the kernel
+// doesn't have, e.g.
+//
+//	iptables v1.8.7 (legacy): can't initialize iptables table `raw': Table does not exist (do you need to insmod?)
+//	iptables v1.8.7 (nf_tables): table 'security' does not exist
+var noSuchTableRegex = regexp.MustCompile("Table does not exist|table '[^']+' does not exist")
+
+// IsNoSuchTable returns true if the error is due to the table not existing
+// in the kernel. Unlike IsTableUnavailable, it is false when the table
+// exists but may not be accessed.
+func (e *Error) IsNoSuchTable() bool {
+	return noSuchTableRegex.MatchString(e.msg)
+}
+
+// isBadRulePatterns recognize the rejected command lines of runners that
+// don't report the exit status of iptables faithfully, e.g. remote ones.
+var isBadRulePatterns = []string{
+	"Bad argument",
+	"unknown option",
+	"Invalid argument",
+	"invalid port",
+	"host/network",
+	"Try `ip",
+}
+
+// IsBadRule returns true if the error is due to iptables rejecting the
+// command line, e.g. an unknown option or an invalid address, which
+// iptables reports with exit status 2. It is false for the "Bad rule (does
+// a matching rule exist in that chain?)" of deletions, see IsNotExist, and
+// for the extensions whose kernel module is missing, which iptables also
+// reports with exit status 2, see MissingModule.
+func (e *Error) IsBadRule() bool {
+	if e.MissingModule() != "" {
+		return false
+	}
+	return e.ExitStatus() == 2 || containsAny(e.msg, isBadRulePatterns)
+}
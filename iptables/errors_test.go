@@ -0,0 +1,109 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestErrorClassification(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		msg    string
+		class  string
+	}{
+		{1, "iptables: Chain already exists.\n", "exists"},
+		{1, "iptables v1.8.7 (nf_tables): Chain already exists\n", "exists"},
+		{4, "iptables v1.8.7 (legacy): can't initialize iptables table `filter': Permission denied (you must be root)\n", "permission"},
+		{4, "iptables v1.8.7 (nf_tables): Could not fetch rule set generation id: Permission denied (you must be root)\n", "permission"},
+		{4, "Another app is currently holding the xtables lock. Stopped waiting after 5s.\n", "lock"},
+		{4, "Another app is currently holding the xtables lock. Perhaps you want to use the -w option?\n", "lock"},
+		{3, "iptables v1.8.7 (legacy): can't initialize iptables table `raw': Table does not exist (do you need to insmod?)\n", "table"},
+		{1, "iptables v1.8.7 (nf_tables): table 'security' does not exist\n", "table"},
+		{2, "iptables v1.8.7 (nf_tables): unknown option \"--dprot\"\nTry `iptables -h' or 'iptables --help' for more information.\n", "bad"},
+		{2, "iptables v1.8.7 (legacy): host/network `10.0.0.256' not found\n", "bad"},
+		{1, "iptables: Bad rule (does a matching rule exist in that chain?).\n", "none"},
+		{2, "iptables v1.8.7 (nf_tables): Couldn't load match `conntrack':No such file or directory\n", "none"},
+		{2, "iptables v1.8.7 (nf_tables): Couldn't load target `MASQUERADE':No such file or directory\n", "none"},
+	} {
+		err := NewError([]string{"iptables"}, tc.status, tc.msg)
+		got := map[string]bool{
+			"exists":     err.IsAlreadyExists(),
+			"permission": err.IsPermissionDenied(),
+			"lock":       err.IsLockHeld(),
+			"table":      err.IsNoSuchTable(),
+			"bad":        err.IsBadRule(),
+		}
+		for class, ok := range got {
+			if ok != (class == tc.class) {
+				t.Errorf("%q: classified as %s: %v", tc.msg, class, ok)
+			}
+		}
+	}
+	// a missing extension is a missing module, not a bad rule
+	err := NewError([]string{"iptables"}, 2, "iptables v1.8.7 (nf_tables): Couldn't load match `conntrack':No such file or directory\n")
+	if !errors.Is(err, ErrModuleMissing) || err.IsBadRule() {
+		t.Errorf("%q: module missing %v, bad rule %v", err.Message(), errors.Is(err, ErrModuleMissing), err.IsBadRule())
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	for _, tc := range []struct {
+		msg      string
+		sentinel error
+	}{
+		{"iptables: Bad rule (does a matching rule exist in that chain?).\n", ErrNotExist},
+		{"iptables: Chain already exists.\n", ErrExists},
+		{"Another app is currently holding the xtables lock. Stopped waiting after 5s.\n", ErrLocked},
+		{"iptables v1.8.7 (legacy): can't initialize iptables table `filter': Permission denied (you must be root)\n", ErrPermission},
+	} {
+		err := fmt.Errorf("syncing: %w", NewError([]string{"iptables"}, 1, tc.msg))
+		for _, sentinel := range []error{ErrNotExist, ErrExists, ErrLocked, ErrPermission} {
+			if errors.Is(err, sentinel) != (sentinel == tc.sentinel) {
+				t.Errorf("errors.Is(%q, %v) = %v", tc.msg, sentinel, !(sentinel == tc.sentinel))
+			}
+		}
+	}
+}
+
+func TestErrorDetails(t *testing.T) {
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		io.WriteString(stderr, "iptables: Chain already exists.\n")
+		return 1, nil
+	})
+	ipt, err := New(IPFamily(ProtocolIPv6), CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	err = ipt.NewChain("filter", "AGENT")
+	var eerr *Error
+	if !errors.As(err, &eerr) {
+		t.Fatalf("expected an *Error, got %v", err)
+	}
+	if args := eerr.Args(); !reflect.DeepEqual(args, []string{"ip6tables", "-t", "filter", "-N", "AGENT", "--wait"}) {
+		t.Errorf("unexpected args %q", args)
+	}
+	if eerr.ExitStatus() != 1 || eerr.Message() != "iptables: Chain already exists.\n" {
+		t.Errorf("unexpected status %d or message %q", eerr.ExitStatus(), eerr.Message())
+	}
+	if eerr.Proto() != ProtocolIPv6 || eerr.Mode() != "nf_tables" {
+		t.Errorf("unexpected family %v or mode %q", eerr.Proto(), eerr.Mode())
+	}
+}
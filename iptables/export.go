@@ -0,0 +1,262 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExportDocument is the generic document describing an Ownership, as
+// produced by ExportJSON and ExportHCL. Rules keep the order in which they
+// were added; pending rules are left out.
+type ExportDocument struct {
+	Family string         `json:"family"`
+	Chains []OwnedChain   `json:"chains"`
+	Rules  []ExportedRule `json:"rules"`
+}
+
+// ExportedRule is an owned rule of an ExportDocument. Position is the
+// rank of the rule among the owned rules of its chain, starting at 1.
+type ExportedRule struct {
+	Table    string   `json:"table"`
+	Chain    string   `json:"chain"`
+	Position int      `json:"position"`
+	Spec     []string `json:"spec"`
+}
+
+// NewExportDocument returns the ExportDocument of the chains and rules of
+// o, e.g. Tracker.Owned(), for the given family.
+func NewExportDocument(o Ownership, proto Protocol) ExportDocument {
+	doc := ExportDocument{
+		Family: familyName(proto),
+		Chains: append([]OwnedChain{}, o.Chains...),
+		Rules:  []ExportedRule{},
+	}
+	positions := map[string]int{}
+	for _, r := range o.Rules {
+		if r.Pending {
+			continue
+		}
+		positions[r.Table+"/"+r.Chain]++
+		doc.Rules = append(doc.Rules, ExportedRule{
+			Table:    r.Table,
+			Chain:    r.Chain,
+			Position: positions[r.Table+"/"+r.Chain],
+			Spec:     append([]string{}, r.Spec...),
+		})
+	}
+	return doc
+}
+
+// ExportJSON renders the owned chains and rules of o as an indented JSON
+// ExportDocument.
+func ExportJSON(o Ownership, proto Protocol) ([]byte, error) {
+	return json.MarshalIndent(NewExportDocument(o, proto), "", "  ")
+}
+
+// ExportHCL renders the owned chains and rules of o as HCL, with one
+// iptables_chain block per chain and one iptables_rule block per rule,
+// ready to be included in or turned into IaC configuration.
+func ExportHCL(o Ownership, proto Protocol) string {
+	doc := NewExportDocument(o, proto)
+	var b strings.Builder
+	for _, c := range doc.Chains {
+		fmt.Fprintf(&b, "iptables_chain %s {\n", hclString(c.Table+"_"+c.Chain))
+		fmt.Fprintf(&b, "  family = %s\n", hclString(doc.Family))
+		fmt.Fprintf(&b, "  table  = %s\n", hclString(c.Table))
+		fmt.Fprintf(&b, "  chain  = %s\n", hclString(c.Chain))
+		b.WriteString("}\n\n")
+	}
+	for _, r := range doc.Rules {
+		spec := make([]string, len(r.Spec))
+		for i, arg := range r.Spec {
+			spec[i] = hclString(arg)
+		}
+		fmt.Fprintf(&b, "iptables_rule %s {\n", hclString(fmt.Sprintf("%s_%s_%d", r.Table, r.Chain, r.Position)))
+		fmt.Fprintf(&b, "  family   = %s\n", hclString(doc.Family))
+		fmt.Fprintf(&b, "  table    = %s\n", hclString(r.Table))
+		fmt.Fprintf(&b, "  chain    = %s\n", hclString(r.Chain))
+		fmt.Fprintf(&b, "  position = %d\n", r.Position)
+		fmt.Fprintf(&b, "  rulespec = [%s]\n", strings.Join(spec, ", "))
+		b.WriteString("}\n\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// hclString quotes s as an HCL string literal, escaping template
+// sequences.
+func hclString(s string) string {
+	s = strconv.Quote(s)
+	s = strings.ReplaceAll(s, "${", "$${")
+	return strings.ReplaceAll(s, "%{", "%%{")
+}
+
+// ExportAnsible renders the owned chains and rules of o as a YAML list of
+// tasks of the Ansible iptables module (ansible.builtin.iptables). Chains
+// are declared with chain_management, which needs Ansible 2.13 or later.
+//
+// The module only knows a subset of the iptables options; an error is
+// returned for rules using options it cannot express.
+func ExportAnsible(o Ownership, proto Protocol) (string, error) {
+	doc := NewExportDocument(o, proto)
+	var b strings.Builder
+	task := func(name string, params []ansibleParam) {
+		fmt.Fprintf(&b, "- name: %s\n", strconv.Quote(name))
+		b.WriteString("  ansible.builtin.iptables:\n")
+		for _, p := range params {
+			switch v := p.value.(type) {
+			case []string:
+				fmt.Fprintf(&b, "    %s:\n", p.key)
+				for _, s := range v {
+					fmt.Fprintf(&b, "      - %s\n", strconv.Quote(s))
+				}
+			case bool:
+				fmt.Fprintf(&b, "    %s: %t\n", p.key, v)
+			default:
+				fmt.Fprintf(&b, "    %s: %s\n", p.key, strconv.Quote(fmt.Sprint(v)))
+			}
+		}
+	}
+
+	for _, c := range doc.Chains {
+		task(fmt.Sprintf("create chain %s/%s", c.Table, c.Chain), []ansibleParam{
+			{"ip_version", doc.Family},
+			{"table", c.Table},
+			{"chain", c.Chain},
+			{"chain_management", true},
+		})
+	}
+	for _, r := range doc.Rules {
+		rule, err := ParseRulespec(r.Chain, r.Spec...)
+		if err != nil {
+			return "", err
+		}
+		params, err := ansibleRuleParams(rule)
+		if err != nil {
+			return "", fmt.Errorf("cannot export %s/%s rule %q: %v", r.Table, r.Chain, strings.Join(r.Spec, " "), err)
+		}
+		params = append([]ansibleParam{{"ip_version", doc.Family}, {"table", r.Table}, {"chain", r.Chain}}, params...)
+		task(fmt.Sprintf("%s/%s %s", r.Table, r.Chain, strings.Join(quoteArgs(r.Spec), " ")), params)
+	}
+	return b.String(), nil
+}
+
+// ansibleParam is a parameter of an Ansible iptables task; value is a
+// string, a bool or a []string.
+type ansibleParam struct {
+	key   string
+	value interface{}
+}
+
+// ansibleMatchParams maps the options of the match extensions to the
+// parameters of the Ansible iptables module, which adds the "-m" itself.
+var ansibleMatchParams = map[string]map[string]string{
+	"tcp":       {"--dport": "destination_port", "--sport": "source_port", "--destination-port": "destination_port", "--source-port": "source_port"},
+	"udp":       {"--dport": "destination_port", "--sport": "source_port", "--destination-port": "destination_port", "--source-port": "source_port"},
+	"multiport": {"--dports": "destination_ports", "--destination-ports": "destination_ports"},
+	"comment":   {"--comment": "comment"},
+	"conntrack": {"--ctstate": "ctstate"},
+	"state":     {"--state": "ctstate"},
+	"limit":     {"--limit": "limit", "--limit-burst": "limit_burst"},
+	"owner":     {"--uid-owner": "uid_owner"},
+	"icmp":      {"--icmp-type": "icmp_type"},
+	"icmp6":     {"--icmpv6-type": "icmp_type"},
+	"icmpv6":    {"--icmpv6-type": "icmp_type"},
+	"ipv6-icmp": {"--icmpv6-type": "icmp_type"},
+	"iprange":   {"--src-range": "src_range", "--dst-range": "dst_range"},
+}
+
+// ansibleTargetParams maps the target options to the parameters of the
+// Ansible iptables module.
+var ansibleTargetParams = map[string]string{
+	"--reject-with":    "reject_with",
+	"--log-prefix":     "log_prefix",
+	"--log-level":      "log_level",
+	"--to-destination": "to_destination",
+	"--to-source":      "to_source",
+	"--to-ports":       "to_ports",
+	"--set-dscp":       "set_dscp_mark",
+	"--set-dscp-class": "set_dscp_mark_class",
+}
+
+// ansibleListParams are the parameters taking a list of values.
+var ansibleListParams = map[string]bool{
+	"destination_ports": true,
+	"ctstate":           true,
+}
+
+// ansibleRuleParams returns the Ansible iptables module parameters
+// describing rule, apart from the family, table and chain.
+func ansibleRuleParams(rule Rule) ([]ansibleParam, error) {
+	var params []ansibleParam
+	criteria := func(key, value string) {
+		if value != "" {
+			params = append(params, ansibleParam{key, value})
+		}
+	}
+	criteria("protocol", rule.Protocol)
+	criteria("source", rule.Source)
+	criteria("destination", rule.Destination)
+	criteria("in_interface", rule.InInterface)
+	criteria("out_interface", rule.OutInterface)
+
+	options := func(opts []string, names map[string]string) error {
+		for i := 0; i < len(opts); i++ {
+			key, ok := names[opts[i]]
+			if !ok {
+				return fmt.Errorf("unsupported option %s", opts[i])
+			}
+			if i+1 >= len(opts) {
+				return fmt.Errorf("option %s requires a value", opts[i])
+			}
+			i++
+			if ansibleListParams[key] {
+				params = append(params, ansibleParam{key, strings.Split(opts[i], ",")})
+			} else {
+				params = append(params, ansibleParam{key, opts[i]})
+			}
+		}
+		return nil
+	}
+	for _, m := range rule.Matches {
+		name := m.Name
+		if name == "" {
+			// options of the match implied by the protocol
+			name = rule.Protocol
+		}
+		names, ok := ansibleMatchParams[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported match %q", name)
+		}
+		if err := options(m.Options, names); err != nil {
+			return nil, err
+		}
+	}
+
+	if rule.Target != "" {
+		key := "jump"
+		if rule.Goto {
+			key = "goto"
+		}
+		params = append(params, ansibleParam{key, rule.Target})
+	}
+	if err := options(rule.TargetOptions, ansibleTargetParams); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var exportOwnership = Ownership{
+	Chains: []OwnedChain{{"filter", "AGENT"}},
+	Rules: []OwnedRule{
+		{Table: "filter", Chain: "INPUT", Spec: []string{"-j", "AGENT"}},
+		{Table: "filter", Chain: "AGENT", Spec: []string{"-s", "10.0.0.0/8", "-p", "tcp", "-m", "tcp", "--dport", "22", "-m", "comment", "--comment", "ssh ${from} lan", "-j", "ACCEPT"}},
+		{Table: "filter", Chain: "AGENT", Spec: []string{"-m", "conntrack", "--ctstate", "INVALID,NEW", "-j", "REJECT", "--reject-with", "icmp-port-unreachable"}},
+		{Table: "filter", Chain: "AGENT", Spec: []string{"-j", "DROP"}, Pending: true},
+	},
+}
+
+func TestExportJSON(t *testing.T) {
+	data, err := ExportJSON(exportOwnership, ProtocolIPv4)
+	if err != nil {
+		t.Fatalf("ExportJSON failed: %v", err)
+	}
+	var doc ExportDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("could not decode %s: %v", data, err)
+	}
+	if doc.Family != "ipv4" || len(doc.Chains) != 1 || len(doc.Rules) != 3 {
+		t.Fatalf("unexpected document %+v", doc)
+	}
+	if doc.Rules[0].Position != 1 || doc.Rules[2].Position != 2 || doc.Rules[2].Chain != "AGENT" {
+		t.Fatalf("unexpected rule positions %+v", doc.Rules)
+	}
+}
+
+func TestExportHCL(t *testing.T) {
+	hcl := ExportHCL(exportOwnership, ProtocolIPv6)
+	for _, expected := range []string{
+		"iptables_chain \"filter_AGENT\" {\n  family = \"ipv6\"\n  table  = \"filter\"\n  chain  = \"AGENT\"\n}\n",
+		"iptables_rule \"filter_INPUT_1\" {\n  family   = \"ipv6\"\n  table    = \"filter\"\n  chain    = \"INPUT\"\n  position = 1\n  rulespec = [\"-j\", \"AGENT\"]\n}\n",
+		`"--comment", "ssh $${from} lan"`,
+		`iptables_rule "filter_AGENT_2"`,
+	} {
+		if !strings.Contains(hcl, expected) {
+			t.Fatalf("HCL output lacks %q:\n%s", expected, hcl)
+		}
+	}
+	if strings.Contains(hcl, "DROP") {
+		t.Fatalf("HCL output contains a pending rule:\n%s", hcl)
+	}
+}
+
+func TestExportAnsible(t *testing.T) {
+	yaml, err := ExportAnsible(exportOwnership, ProtocolIPv4)
+	if err != nil {
+		t.Fatalf("ExportAnsible failed: %v", err)
+	}
+	expected := `- name: "create chain filter/AGENT"
+  ansible.builtin.iptables:
+    ip_version: "ipv4"
+    table: "filter"
+    chain: "AGENT"
+    chain_management: true
+- name: "filter/INPUT -j AGENT"
+  ansible.builtin.iptables:
+    ip_version: "ipv4"
+    table: "filter"
+    chain: "INPUT"
+    jump: "AGENT"
+- name: "filter/AGENT -s 10.0.0.0/8 -p tcp -m tcp --dport 22 -m comment --comment \"ssh ${from} lan\" -j ACCEPT"
+  ansible.builtin.iptables:
+    ip_version: "ipv4"
+    table: "filter"
+    chain: "AGENT"
+    protocol: "tcp"
+    source: "10.0.0.0/8"
+    destination_port: "22"
+    comment: "ssh ${from} lan"
+    jump: "ACCEPT"
+- name: "filter/AGENT -m conntrack --ctstate INVALID,NEW -j REJECT --reject-with icmp-port-unreachable"
+  ansible.builtin.iptables:
+    ip_version: "ipv4"
+    table: "filter"
+    chain: "AGENT"
+    ctstate:
+      - "INVALID"
+      - "NEW"
+    jump: "REJECT"
+    reject_with: "icmp-port-unreachable"
+`
+	if yaml != expected {
+		t.Fatalf("ExportAnsible mismatch: \ngot\n%s\nneed\n%s", yaml, expected)
+	}
+
+	params, err := ansibleRuleParams(Rule{Protocol: "tcp", Matches: []Match{{Options: []string{"--dport", "80"}}}, Target: "ACCEPT"})
+	if err != nil {
+		t.Fatalf("implicit protocol match failed: %v", err)
+	}
+	if !reflect.DeepEqual(params, []ansibleParam{{"protocol", "tcp"}, {"destination_port", "80"}, {"jump", "ACCEPT"}}) {
+		t.Fatalf("unexpected params %v", params)
+	}
+
+	unsupported := Ownership{Rules: []OwnedRule{{Table: "mangle", Chain: "OUTPUT", Spec: []string{"-m", "mark", "--mark", "1", "-j", "ACCEPT"}}}}
+	if _, err := ExportAnsible(unsupported, ProtocolIPv4); err == nil || !strings.Contains(err.Error(), `unsupported match "mark"`) {
+		t.Fatalf("expected an unsupported match error, got %v", err)
+	}
+}
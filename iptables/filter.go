@@ -0,0 +1,157 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"net"
+	"strings"
+)
+
+// RuleFilter selects rules for ListWhere and DeleteAllMatching. Filters
+// are built with the Filter functions and combined with AllOf, AnyOf and
+// Not.
+type RuleFilter func(Rule) bool
+
+// ListWhere returns the rules of the specified table/chain selected by
+// filter, with their positions and counters.
+func (ipt *IPTables) ListWhere(table, chain string, filter RuleFilter) ([]NumberedRule, error) {
+	rules, err := ipt.ListWithLineNumbers(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	var matching []NumberedRule
+	for _, r := range rules {
+		if filter(r.Rule) {
+			matching = append(matching, r)
+		}
+	}
+	return matching, nil
+}
+
+// AllOf selects the rules selected by every filter.
+func AllOf(filters ...RuleFilter) RuleFilter {
+	return func(r Rule) bool {
+		for _, f := range filters {
+			if !f(r) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// AnyOf selects the rules selected by at least one filter.
+func AnyOf(filters ...RuleFilter) RuleFilter {
+	return func(r Rule) bool {
+		for _, f := range filters {
+			if f(r) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not selects the rules filter doesn't select.
+func Not(filter RuleFilter) RuleFilter {
+	return func(r Rule) bool {
+		return !filter(r)
+	}
+}
+
+// FilterTarget selects the rules jumping or going to target.
+func FilterTarget(target string) RuleFilter {
+	return func(r Rule) bool {
+		return r.Target == target
+	}
+}
+
+// FilterSource selects the rules whose source lies within prefix, e.g.
+// "10.0.0.0/8" selects "-s 10.1.2.3/32". Negated sources are not selected.
+func FilterSource(prefix string) RuleFilter {
+	within := prefixFilter(prefix)
+	return func(r Rule) bool {
+		return within(r.Source)
+	}
+}
+
+// FilterDestination selects the rules whose destination lies within
+// prefix. See FilterSource.
+func FilterDestination(prefix string) RuleFilter {
+	within := prefixFilter(prefix)
+	return func(r Rule) bool {
+		return within(r.Destination)
+	}
+}
+
+// prefixFilter returns a function telling whether an address of a rule
+// lies within prefix. Every address lies within 0.0.0.0/0 and ::/0, even
+// the empty one; prefixes that aren't addresses, such as hostnames, are
+// compared as is.
+func prefixFilter(prefix string) func(addr string) bool {
+	norm := normalizeAddress(prefix)
+	_, network, err := net.ParseCIDR(norm)
+	return func(addr string) bool {
+		switch {
+		case strings.HasPrefix(addr, "!"):
+			return false
+		case norm == "":
+			return true
+		case err != nil:
+			return addr == prefix
+		}
+		ip, rnet, err := net.ParseCIDR(normalizeAddress(addr))
+		if err != nil {
+			return false
+		}
+		ones, _ := rnet.Mask.Size()
+		prefixOnes, _ := network.Mask.Size()
+		return network.Contains(ip) && ones >= prefixOnes
+	}
+}
+
+// FilterInInterface selects the rules matching packets received on iface,
+// as given to -i, e.g. "eth+".
+func FilterInInterface(iface string) RuleFilter {
+	return func(r Rule) bool {
+		return r.InInterface == iface
+	}
+}
+
+// FilterOutInterface selects the rules matching packets sent on iface, as
+// given to -o.
+func FilterOutInterface(iface string) RuleFilter {
+	return func(r Rule) bool {
+		return r.OutInterface == iface
+	}
+}
+
+// FilterComment selects the rules whose comment contains substring, as
+// FindByComment does.
+func FilterComment(substring string) RuleFilter {
+	return func(r Rule) bool {
+		comment := ruleComment(r)
+		return comment != "" && strings.Contains(comment, substring)
+	}
+}
+
+// FilterProtocol selects the rules matching protocol, by name or number,
+// e.g. "tcp" or "6".
+func FilterProtocol(protocol string) RuleFilter {
+	protocol = normalizeProtocol(protocol)
+	return func(r Rule) bool {
+		return normalizeProtocol(r.Protocol) == protocol
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+func TestRuleFilters(t *testing.T) {
+	rule := func(line string) Rule {
+		r, err := ParseRule(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	r := rule(`-A FORWARD -s 10.1.2.3/32 -d 192.168.0.0/24 -i eth0 -p tcp -m comment --comment "app=web" -j MY-CHAIN`)
+	for _, tc := range []struct {
+		name   string
+		filter RuleFilter
+		match  bool
+	}{
+		{"target", FilterTarget("MY-CHAIN"), true},
+		{"other target", FilterTarget("ACCEPT"), false},
+		{"source within", FilterSource("10.0.0.0/8"), true},
+		{"source host", FilterSource("10.1.2.3"), true},
+		{"source outside", FilterSource("10.2.0.0/16"), false},
+		{"source anywhere", FilterSource("0.0.0.0/0"), true},
+		{"destination wider", FilterDestination("192.168.0.0/25"), false},
+		{"destination within", FilterDestination("192.168.0.0/16"), true},
+		{"in interface", FilterInInterface("eth0"), true},
+		{"out interface", FilterOutInterface("eth0"), false},
+		{"comment", FilterComment("app="), true},
+		{"protocol number", FilterProtocol("6"), true},
+		{"all", AllOf(FilterTarget("MY-CHAIN"), FilterProtocol("tcp")), true},
+		{"not all", AllOf(FilterTarget("MY-CHAIN"), FilterProtocol("udp")), false},
+		{"any", AnyOf(FilterProtocol("udp"), FilterInInterface("eth0")), true},
+		{"not", Not(FilterTarget("MY-CHAIN")), false},
+	} {
+		if got := tc.filter(r); got != tc.match {
+			t.Errorf("%s: got %v, expected %v", tc.name, got, tc.match)
+		}
+	}
+	if FilterSource("10.0.0.0/8")(rule("-A INPUT ! -s 10.0.0.1/32 -j DROP")) {
+		t.Errorf("negated source selected")
+	}
+}
+
+func TestListWhere(t *testing.T) {
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		io.WriteString(stdout, `-P FORWARD ACCEPT
+-A FORWARD -i docker0 -c 0 0 -j DOCKER
+-A FORWARD -c 5 300 -j MY-CHAIN
+-A FORWARD -i eth0 -c 0 0 -j MY-CHAIN
+`)
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	rules, err := ipt.ListWhere("filter", "FORWARD", FilterTarget("MY-CHAIN"))
+	if err != nil {
+		t.Fatalf("ListWhere failed: %v", err)
+	}
+	if len(rules) != 2 || rules[0].Pos != 2 || rules[0].Packets != 5 || rules[1].Pos != 3 {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+}
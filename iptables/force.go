@@ -0,0 +1,77 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import "fmt"
+
+// ForceVersion makes the handle assume the iptables binary is version
+// v1.v2.v3 instead of probing it with --version, which wrapper scripts
+// may answer for another binary or not at all. The mode is legacy unless
+// set with ForceMode. It takes precedence over CompatibilityProfile.
+func ForceVersion(v1, v2, v3 int) option {
+	return func(ipt *IPTables) {
+		ipt.forceVersion = &[3]int{v1, v2, v3}
+	}
+}
+
+// ForceMode overrides the operating mode of the iptables binary, "legacy"
+// or "nf_tables" ("nft" is accepted too), whether the version was probed
+// or pinned.
+func ForceMode(mode string) option {
+	return func(ipt *IPTables) {
+		ipt.forceMode = mode
+	}
+}
+
+// ForceCheck overrides whether the binary supports checking rules with
+// -C. Without it, Exists falls back to listing the chain.
+func ForceCheck(enabled bool) option {
+	return func(ipt *IPTables) {
+		ipt.forceCheck = &enabled
+	}
+}
+
+// ForceWait overrides whether the binary supports --wait. Disabling it
+// also disables "--wait seconds" and --wait-interval; enabling it keeps
+// their support as derived from the version.
+func ForceWait(enabled bool) option {
+	return func(ipt *IPTables) {
+		ipt.forceWait = &enabled
+	}
+}
+
+// forcedCapabilities applies the Force* options of the handle to caps.
+func (ipt *IPTables) forcedCapabilities(caps Capabilities) (Capabilities, error) {
+	switch ipt.forceMode {
+	case "":
+	case "legacy":
+		caps.Mode = "legacy"
+	case "nft", "nf_tables":
+		caps.Mode = "nf_tables"
+	default:
+		return caps, fmt.Errorf("invalid iptables mode %q, want legacy or nf_tables", ipt.forceMode)
+	}
+	if ipt.forceCheck != nil {
+		caps.Check = *ipt.forceCheck
+	}
+	if ipt.forceWait != nil {
+		caps.Wait = *ipt.forceWait
+		if !caps.Wait {
+			caps.WaitSeconds = false
+			caps.WaitInterval = false
+		}
+	}
+	return caps, nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestForceVersion(t *testing.T) {
+	var calls [][]string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, args)
+		if args[1] == "--version" {
+			io.WriteString(stdout, "iptables v1.4.7\n")
+		}
+		return 0, nil
+	})
+
+	ipt, err := New(CommandRunner(runner), ForceVersion(1, 8, 7), ForceMode("nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if len(calls) != 0 {
+		t.Fatalf("expected no probe, got %q", calls)
+	}
+	if caps := ipt.Capabilities(); caps.Major != 1 || caps.Minor != 8 || caps.Patch != 7 || caps.Mode != "nf_tables" || !caps.Check || !caps.WaitSeconds {
+		t.Fatalf("unexpected capabilities %+v", caps)
+	}
+
+	// the probed version is kept, the flags are pinned
+	ipt, err = New(CommandRunner(runner), ForceMode("legacy"), ForceCheck(true), ForceWait(false))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if caps := ipt.Capabilities(); caps.Minor != 4 || caps.Patch != 7 || caps.Mode != "legacy" || !caps.Check || caps.Wait {
+		t.Fatalf("unexpected capabilities %+v", caps)
+	}
+	calls = nil
+	if _, err := ipt.Exists("filter", "INPUT", "-j", "ACCEPT"); err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+	expected := []string{"iptables", "-t", "filter", "-C", "INPUT", "-j", "ACCEPT"}
+	if !reflect.DeepEqual(calls[0], expected) {
+		t.Fatalf("args mismatch: \ngot  %v \nneed %v", calls[0], expected)
+	}
+
+	if _, err := New(CommandRunner(runner), ForceMode("iptables-nft")); err == nil || !strings.Contains(err.Error(), "invalid iptables mode") {
+		t.Fatalf("expected an invalid mode error, got %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// FormatStyle controls the output of FormatRuleset and FormatSideBySide.
+type FormatStyle struct {
+	// Color highlights chains, targets, comments and changes with ANSI
+	// escape sequences
+	Color bool
+	// Counters shows the packet and byte counters of policies and rules
+	Counters bool
+	// Width is the width of each side of FormatSideBySide, 60 if unset
+	Width int
+}
+
+// ANSI escape sequences used by the formatters.
+const (
+	ansiReset = "\x1b[0m"
+	ansiBold  = "\x1b[1m"
+	ansiDim   = "\x1b[2m"
+	ansiRed   = "\x1b[31m"
+	ansiGreen = "\x1b[32m"
+	ansiCyan  = "\x1b[36m"
+)
+
+// paint wraps s in the given escape sequence if the style is colorized.
+func (style FormatStyle) paint(code, s string) string {
+	if !style.Color || s == "" {
+		return s
+	}
+	return code + s + ansiReset
+}
+
+// FormatRuleset renders rs for human review: chains are separated by blank
+// lines, rules are numbered and their criteria, matches and targets are
+// aligned in columns, and comments are moved to the end of the line. The
+// output is not meant to be parsed; use Ruleset's JSON form or
+// iptables-save output for that.
+func FormatRuleset(rs *Ruleset, style FormatStyle) string {
+	var b strings.Builder
+	b.WriteString(style.paint(ansiBold, "*"+rs.Table) + "\n")
+	for _, c := range rs.Chains {
+		b.WriteString("\n" + style.paint(ansiBold, formatChainHeader(c, style)) + "\n")
+
+		rows := make([][]string, len(c.Rules))
+		for i, r := range c.Rules {
+			rows[i] = formatRuleColumns(i+1, r, style)
+		}
+		widths := columnWidths(rows)
+		for i, row := range rows {
+			var line strings.Builder
+			for j, col := range row {
+				if j > 0 {
+					line.WriteString("  ")
+				}
+				switch j {
+				case len(row) - 2:
+					line.WriteString(style.paint(targetColor(c.Rules[i].Target), col))
+				case len(row) - 1:
+					line.WriteString(style.paint(ansiDim, col))
+				default:
+					line.WriteString(col)
+				}
+				if j < len(row)-1 {
+					line.WriteString(strings.Repeat(" ", widths[j]-utf8.RuneCountInString(col)))
+				}
+			}
+			b.WriteString(strings.TrimRight(line.String(), " ") + "\n")
+		}
+	}
+	return b.String()
+}
+
+// formatChainHeader returns the chain declaration, as in iptables-save
+// output.
+func formatChainHeader(c Chain, style FormatStyle) string {
+	header := ":" + c.Name + " " + c.Policy
+	if style.Counters && c.Policy != "-" {
+		header += fmt.Sprintf(" [%d:%d]", c.Packets, c.Bytes)
+	}
+	return header
+}
+
+// formatRuleColumns splits a rule into the columns of FormatRuleset: its
+// position, counters if enabled, builtin criteria, matches, target and
+// comment.
+func formatRuleColumns(pos int, r Rule, style FormatStyle) []string {
+	cols := []string{fmt.Sprintf("%3d", pos)}
+	if style.Counters {
+		cols = append(cols, fmt.Sprintf("[%d:%d]", r.Packets, r.Bytes))
+	}
+	criteria := Rule{Protocol: r.Protocol, Source: r.Source, Destination: r.Destination, InInterface: r.InInterface, OutInterface: r.OutInterface}
+	var matches []Match
+	for _, m := range r.Matches {
+		if m.Name != "comment" {
+			matches = append(matches, m)
+		}
+	}
+	comment := ruleComment(r)
+	if comment != "" {
+		comment = "# " + comment
+	}
+	return append(cols,
+		strings.Join(quoteArgs(criteria.Spec()), " "),
+		strings.Join(quoteArgs(Rule{Matches: matches}.Spec()), " "),
+		strings.Join(quoteArgs(Rule{Target: r.Target, Goto: r.Goto, TargetOptions: r.TargetOptions}.Spec()), " "),
+		comment,
+	)
+}
+
+// columnWidths returns the width of the widest cell of every column.
+func columnWidths(rows [][]string) []int {
+	var widths []int
+	for _, row := range rows {
+		for j, col := range row {
+			if j >= len(widths) {
+				widths = append(widths, 0)
+			}
+			if n := utf8.RuneCountInString(col); n > widths[j] {
+				widths[j] = n
+			}
+		}
+	}
+	return widths
+}
+
+// targetColor returns the color of a target: green for ACCEPT, red for
+// DROP and REJECT and cyan for anything else, e.g. user-defined chains.
+func targetColor(target string) string {
+	switch target {
+	case "ACCEPT":
+		return ansiGreen
+	case "DROP", "REJECT":
+		return ansiRed
+	}
+	return ansiCyan
+}
+
+// FormatSideBySide renders current and desired, two versions of the same
+// table, next to each other for review. Rules are paired up like Diff
+// does: unchanged rules face each other, rules only found on the left are
+// marked with "<", rules only found on the right with ">", and chain
+// declarations differing in policy with "|". Long rules are truncated to
+// the width of their side.
+func FormatSideBySide(current, desired *Ruleset, style FormatStyle) string {
+	width := style.Width
+	if width <= 0 {
+		width = 60
+	}
+	var b strings.Builder
+	row := func(left, marker, right string) {
+		left = truncateText(left, width)
+		padded := left + strings.Repeat(" ", width-utf8.RuneCountInString(left))
+		right = truncateText(right, width)
+		switch marker {
+		case "<":
+			padded = style.paint(ansiRed, padded)
+		case ">":
+			right = style.paint(ansiGreen, right)
+		case "|":
+			padded, right = style.paint(ansiCyan, padded), style.paint(ansiCyan, right)
+		}
+		b.WriteString(strings.TrimRight(padded+" "+marker+" "+right, " ") + "\n")
+	}
+
+	row("*"+current.Table, " ", "*"+desired.Table)
+	names := []string{}
+	for _, c := range current.Chains {
+		names = append(names, c.Name)
+	}
+	for _, c := range desired.Chains {
+		if current.FindChain(c.Name) == nil {
+			names = append(names, c.Name)
+		}
+	}
+
+	for _, name := range names {
+		oldChain, newChain := current.FindChain(name), desired.FindChain(name)
+		var oldRules, newRules []Rule
+		left, right, marker := "", "", "|"
+		if oldChain != nil {
+			oldRules, left = oldChain.Rules, formatChainHeader(*oldChain, style)
+		}
+		if newChain != nil {
+			newRules, right = newChain.Rules, formatChainHeader(*newChain, style)
+		}
+		switch {
+		case oldChain == nil:
+			marker = ">"
+		case newChain == nil:
+			marker = "<"
+		case left == right:
+			marker = " "
+		}
+		row("", " ", "")
+		row(left, marker, right)
+
+		oldKeys, newKeys := make([]string, len(oldRules)), make([]string, len(newRules))
+		for i, r := range oldRules {
+			oldKeys[i] = ruleKey(r)
+		}
+		for i, r := range newRules {
+			newKeys[i] = ruleKey(r)
+		}
+		keptOld, keptNew := commonSubsequence(oldKeys, newKeys)
+		spec := func(r Rule) string {
+			return strings.Join(quoteArgs(r.Spec()), " ")
+		}
+		i, j := 0, 0
+		for i < len(oldRules) || j < len(newRules) {
+			switch {
+			case i < len(oldRules) && !keptOld[i]:
+				row(spec(oldRules[i]), "<", "")
+				i++
+			case j < len(newRules) && !keptNew[j]:
+				row("", ">", spec(newRules[j]))
+				j++
+			default:
+				row(spec(oldRules[i]), " ", spec(newRules[j]))
+				i++
+				j++
+			}
+		}
+	}
+	return b.String()
+}
+
+// truncateText shortens s to at most width runes, ending it with "..." if
+// it was cut.
+func truncateText(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	if width <= 3 {
+		return string([]rune(s)[:width])
+	}
+	return string([]rune(s)[:width-3]) + "..."
+}
@@ -0,0 +1,92 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"strings"
+	"testing"
+)
+
+func mustParseSave(t *testing.T, data string) *Ruleset {
+	rulesets, err := ParseSave(data)
+	if err != nil {
+		t.Fatalf("ParseSave failed: %v", err)
+	}
+	return &rulesets[0]
+}
+
+func TestFormatRuleset(t *testing.T) {
+	rs := mustParseSave(t, `*filter
+:INPUT DROP [10:600]
+:AGENT - [0:0]
+-A INPUT -i lo -j ACCEPT
+-A INPUT -s 10.0.0.0/8 -p tcp -m tcp --dport 22 -m comment --comment "ssh from lan" -j ACCEPT
+-A INPUT -j AGENT
+COMMIT
+`)
+	expected := `*filter
+
+:INPUT DROP [10:600]
+  1  [0:0]  -i lo                                    -j ACCEPT
+  2  [0:0]  -s 10.0.0.0/8 -p tcp  -m tcp --dport 22  -j ACCEPT  # ssh from lan
+  3  [0:0]                                           -j AGENT
+
+:AGENT -
+`
+	if actual := FormatRuleset(rs, FormatStyle{Counters: true}); actual != expected {
+		t.Fatalf("FormatRuleset mismatch: \ngot\n%s\nneed\n%s", actual, expected)
+	}
+
+	colored := FormatRuleset(rs, FormatStyle{Color: true})
+	for _, expected := range []string{ansiBold + ":INPUT DROP" + ansiReset, ansiGreen + "-j ACCEPT" + ansiReset, ansiDim + "# ssh from lan" + ansiReset, ansiCyan + "-j AGENT" + ansiReset} {
+		if !strings.Contains(colored, expected) {
+			t.Fatalf("colorized output lacks %q:\n%s", expected, colored)
+		}
+	}
+}
+
+func TestFormatSideBySide(t *testing.T) {
+	current := mustParseSave(t, `*filter
+:INPUT ACCEPT [0:0]
+:OLD - [0:0]
+-A INPUT -i lo -j ACCEPT
+-A INPUT -p tcp -m tcp --dport 23 -j ACCEPT
+-A INPUT -j DROP
+COMMIT
+`)
+	desired := mustParseSave(t, `*filter
+:INPUT DROP [0:0]
+:NEW - [0:0]
+-A INPUT -i lo -j ACCEPT
+-A INPUT -p tcp -m tcp --dport 22 -m comment --comment "a rather long comment" -j ACCEPT
+-A INPUT -j DROP
+COMMIT
+`)
+	expected := `*filter                        *filter
+
+:INPUT ACCEPT                | :INPUT DROP
+-i lo -j ACCEPT                -i lo -j ACCEPT
+-p tcp -m tcp --dport 23 ... <
+                             > -p tcp -m tcp --dport 22 ...
+-j DROP                        -j DROP
+
+:OLD -                       <
+
+                             > :NEW -
+`
+	if actual := FormatSideBySide(current, desired, FormatStyle{Width: 28}); actual != expected {
+		t.Fatalf("FormatSideBySide mismatch: \ngot\n%s\nneed\n%s", actual, expected)
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// rulesetBuilder assembles Rulesets from rules found in formats other than
+// iptables-save output, declaring tables and chains as they are seen.
+type rulesetBuilder struct {
+	rulesets []Ruleset
+}
+
+// chain returns the chain of table, adding both if needed. Builtin chains
+// get an ACCEPT policy.
+func (b *rulesetBuilder) chain(table, name string) *Chain {
+	var rs *Ruleset
+	for i := range b.rulesets {
+		if b.rulesets[i].Table == table {
+			rs = &b.rulesets[i]
+		}
+	}
+	if rs == nil {
+		b.rulesets = append(b.rulesets, Ruleset{Table: table, Chains: []Chain{}})
+		rs = &b.rulesets[len(b.rulesets)-1]
+	}
+	if c := rs.FindChain(name); c != nil {
+		return c
+	}
+	policy := "-"
+	if IsBuiltinChain(table, name) {
+		policy = "ACCEPT"
+	}
+	rs.Chains = append(rs.Chains, Chain{Name: name, Policy: policy, Rules: []Rule{}})
+	return &rs.Chains[len(rs.Chains)-1]
+}
+
+// ImportUFW parses a ufw user rules file (/etc/ufw/user.rules or
+// user6.rules). Each rule ufw generated is preceded by a "### tuple ###"
+// line describing the ufw rule it implements; that description is kept as
+// a comment match ("ufw: allow tcp 22 0.0.0.0/0 any 0.0.0.0/0 in"), unless
+// the rule already has a comment, so that imported rules can still be
+// traced back to the ufw configuration.
+func ImportUFW(data string) ([]Ruleset, error) {
+	var (
+		lines []string
+		tuple string
+	)
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "### tuple ###"):
+			tuple = strings.TrimSpace(strings.TrimPrefix(line, "### tuple ###"))
+			continue
+		case strings.HasPrefix(line, "-A ") && tuple != "":
+			rule, err := ParseRule(line)
+			if err != nil {
+				return nil, err
+			}
+			if ruleComment(rule) == "" {
+				rule.Matches = append(rule.Matches, Match{Name: "comment", Options: []string{"--comment", "ufw: " + tuple}})
+				line = rule.String()
+			}
+		case strings.HasPrefix(line, "-A "):
+		default:
+			tuple = ""
+		}
+		lines = append(lines, line)
+	}
+	return ParseSave(strings.Join(lines, "\n"))
+}
+
+// firewalldDirect is the content of /etc/firewalld/direct.xml.
+type firewalldDirect struct {
+	Chains []struct {
+		IPV   string `xml:"ipv,attr"`
+		Table string `xml:"table,attr"`
+		Chain string `xml:"chain,attr"`
+	} `xml:"chain"`
+	Rules []struct {
+		IPV      string `xml:"ipv,attr"`
+		Table    string `xml:"table,attr"`
+		Chain    string `xml:"chain,attr"`
+		Priority int    `xml:"priority,attr"`
+		Args     string `xml:",chardata"`
+	} `xml:"rule"`
+	Passthroughs []struct {
+		IPV  string `xml:"ipv,attr"`
+		Args string `xml:",chardata"`
+	} `xml:"passthrough"`
+}
+
+// ImportFirewalldDirect parses the firewalld direct configuration
+// (/etc/firewalld/direct.xml), keeping the chains, rules and passthroughs
+// of the given family. Rules are ordered by priority as firewalld does,
+// and passthroughs, which may only append, insert or declare chains, are
+// applied in order after them.
+func ImportFirewalldDirect(data []byte, proto Protocol) ([]Ruleset, error) {
+	var direct firewalldDirect
+	if err := xml.Unmarshal(data, &direct); err != nil {
+		return nil, err
+	}
+	ipv := familyName(proto)
+
+	b := &rulesetBuilder{}
+	for _, c := range direct.Chains {
+		if c.IPV == ipv {
+			b.chain(c.Table, c.Chain)
+		}
+	}
+
+	rules := direct.Rules
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority < rules[j].Priority
+	})
+	for _, r := range rules {
+		if r.IPV != ipv {
+			continue
+		}
+		args, err := splitRuleLine(strings.TrimSpace(r.Args))
+		if err != nil {
+			return nil, err
+		}
+		rule, err := ParseRulespec(r.Chain, args...)
+		if err != nil {
+			return nil, err
+		}
+		chain := b.chain(r.Table, r.Chain)
+		chain.Rules = append(chain.Rules, rule)
+	}
+
+	for _, p := range direct.Passthroughs {
+		if p.IPV != ipv {
+			continue
+		}
+		if err := b.passthrough(strings.TrimSpace(p.Args)); err != nil {
+			return nil, err
+		}
+	}
+	return b.rulesets, nil
+}
+
+// passthrough applies a firewalld passthrough, i.e. the arguments of an
+// iptables command.
+func (b *rulesetBuilder) passthrough(line string) error {
+	args, err := splitRuleLine(line)
+	if err != nil {
+		return err
+	}
+	table := "filter"
+	if len(args) >= 2 && (args[0] == "-t" || args[0] == "--table") {
+		table = args[1]
+		args = args[2:]
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("unsupported passthrough %q", line)
+	}
+	switch args[0] {
+	case "-N", "--new-chain":
+		b.chain(table, args[1])
+		return nil
+	case "-A", "--append", "-I", "--insert":
+		spec := args[2:]
+		pos := 0
+		if args[0] == "-I" || args[0] == "--insert" {
+			pos = 1
+			if len(spec) > 0 {
+				if n, err := strconv.Atoi(spec[0]); err == nil {
+					pos = n
+					spec = spec[1:]
+				}
+			}
+		}
+		rule, err := ParseRulespec(args[1], spec...)
+		if err != nil {
+			return err
+		}
+		chain := b.chain(table, args[1])
+		if pos == 0 || pos > len(chain.Rules) {
+			chain.Rules = append(chain.Rules, rule)
+		} else {
+			chain.Rules = append(chain.Rules[:pos-1], append([]Rule{rule}, chain.Rules[pos-1:]...)...)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported passthrough %q", line)
+}
+
+// ImportDocker extracts the rules managed by the docker daemon from
+// iptables-save output: its DOCKER* chains, the rules of other chains
+// jumping to them, and the rules matching docker bridge interfaces
+// (docker0 and br-*), such as its MASQUERADE rules. Tables without any
+// such rule are left out.
+func ImportDocker(data string) ([]Ruleset, error) {
+	rulesets, err := ParseSave(data)
+	if err != nil {
+		return nil, err
+	}
+	var imported []Ruleset
+	for _, rs := range rulesets {
+		kept := Ruleset{Table: rs.Table, Chains: []Chain{}}
+		for _, c := range rs.Chains {
+			docker := isDockerChain(c.Name)
+			chain := Chain{Name: c.Name, Policy: c.Policy, Packets: c.Packets, Bytes: c.Bytes, Rules: []Rule{}}
+			for _, r := range c.Rules {
+				if docker || isDockerRule(r) {
+					chain.Rules = append(chain.Rules, r)
+				}
+			}
+			if docker || len(chain.Rules) > 0 {
+				kept.Chains = append(kept.Chains, chain)
+			}
+		}
+		if len(kept.Chains) > 0 {
+			imported = append(imported, kept)
+		}
+	}
+	return imported, nil
+}
+
+// isDockerChain reports whether chain is one of the chains docker creates,
+// e.g. DOCKER, DOCKER-USER or DOCKER-ISOLATION-STAGE-1.
+func isDockerChain(chain string) bool {
+	return chain == "DOCKER" || strings.HasPrefix(chain, "DOCKER-")
+}
+
+// isDockerRule reports whether rule, of a chain docker doesn't own, was
+// added by docker.
+func isDockerRule(rule Rule) bool {
+	if isDockerChain(rule.Target) {
+		return true
+	}
+	for _, iface := range []string{rule.InInterface, rule.OutInterface} {
+		iface = strings.TrimPrefix(iface, "!")
+		if iface == "docker0" || strings.HasPrefix(iface, "br-") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func rulesetLines(rulesets []Ruleset) map[string][]string {
+	lines := map[string][]string{}
+	for _, rs := range rulesets {
+		for _, c := range rs.Chains {
+			lines[rs.Table] = append(lines[rs.Table], ":"+c.Name+" "+c.Policy)
+			for _, r := range c.Rules {
+				lines[rs.Table] = append(lines[rs.Table], r.String())
+			}
+		}
+	}
+	return lines
+}
+
+func TestImportUFW(t *testing.T) {
+	data := `*filter
+:ufw-user-input - [0:0]
+:ufw-user-output - [0:0]
+### RULES ###
+
+### tuple ### allow tcp 22 0.0.0.0/0 any 0.0.0.0/0 in
+-A ufw-user-input -p tcp --dport 22 -j ACCEPT
+
+### END RULES ###
+-A ufw-user-output -j RETURN
+COMMIT
+`
+	rulesets, err := ImportUFW(data)
+	if err != nil {
+		t.Fatalf("ImportUFW failed: %v", err)
+	}
+	expected := map[string][]string{
+		"filter": {
+			":ufw-user-input -",
+			`-A ufw-user-input -p tcp --dport 22 -m comment --comment "ufw: allow tcp 22 0.0.0.0/0 any 0.0.0.0/0 in" -j ACCEPT`,
+			":ufw-user-output -",
+			"-A ufw-user-output -j RETURN",
+		},
+	}
+	if actual := rulesetLines(rulesets); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("ImportUFW mismatch: \ngot  %v \nneed %v", actual, expected)
+	}
+}
+
+func TestImportFirewalldDirect(t *testing.T) {
+	data := []byte(`<?xml version="1.0" encoding="utf-8"?>
+<direct>
+  <chain ipv="ipv4" table="filter" chain="blacklist"/>
+  <rule ipv="ipv4" table="filter" chain="INPUT" priority="1">-j blacklist</rule>
+  <rule ipv="ipv4" table="filter" chain="INPUT" priority="0">-p tcp --dport 22 -j ACCEPT</rule>
+  <rule ipv="ipv6" table="filter" chain="INPUT" priority="0">-p tcp --dport 22 -j ACCEPT</rule>
+  <rule ipv="ipv4" table="filter" chain="blacklist" priority="0">-s 192.0.2.0/24 -j DROP</rule>
+  <passthrough ipv="ipv4">-t nat -A POSTROUTING -o eth0 -j MASQUERADE</passthrough>
+  <passthrough ipv="ipv4">-I INPUT 1 -i lo -j ACCEPT</passthrough>
+</direct>
+`)
+	rulesets, err := ImportFirewalldDirect(data, ProtocolIPv4)
+	if err != nil {
+		t.Fatalf("ImportFirewalldDirect failed: %v", err)
+	}
+	expected := map[string][]string{
+		"filter": {
+			":blacklist -",
+			"-A blacklist -s 192.0.2.0/24 -j DROP",
+			":INPUT ACCEPT",
+			"-A INPUT -i lo -j ACCEPT",
+			"-A INPUT -p tcp --dport 22 -j ACCEPT",
+			"-A INPUT -j blacklist",
+		},
+		"nat": {
+			":POSTROUTING ACCEPT",
+			"-A POSTROUTING -o eth0 -j MASQUERADE",
+		},
+	}
+	if actual := rulesetLines(rulesets); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("ImportFirewalldDirect mismatch: \ngot  %v \nneed %v", actual, expected)
+	}
+
+	if _, err := ImportFirewalldDirect([]byte(`<direct><passthrough ipv="ipv4">-F INPUT</passthrough></direct>`), ProtocolIPv4); err == nil {
+		t.Fatalf("expected an error for an unsupported passthrough")
+	}
+}
+
+func TestImportDocker(t *testing.T) {
+	data := `*nat
+:PREROUTING ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:DOCKER - [0:0]
+-A PREROUTING -m addrtype --dst-type LOCAL -j DOCKER
+-A POSTROUTING -s 172.17.0.0/16 ! -o docker0 -j MASQUERADE
+-A POSTROUTING -o eth0 -j MASQUERADE
+-A DOCKER -i docker0 -j RETURN
+COMMIT
+*mangle
+:PREROUTING ACCEPT [0:0]
+-A PREROUTING -j MARK --set-mark 1
+COMMIT
+*filter
+:FORWARD DROP [0:0]
+:DOCKER-USER - [0:0]
+-A FORWARD -j DOCKER-USER
+-A FORWARD -o br-0123456789ab -j ACCEPT
+-A FORWARD -i eth1 -j ACCEPT
+-A DOCKER-USER -j RETURN
+COMMIT
+`
+	rulesets, err := ImportDocker(data)
+	if err != nil {
+		t.Fatalf("ImportDocker failed: %v", err)
+	}
+	expected := map[string][]string{
+		"nat": {
+			":PREROUTING ACCEPT",
+			"-A PREROUTING -m addrtype --dst-type LOCAL -j DOCKER",
+			":POSTROUTING ACCEPT",
+			"-A POSTROUTING -s 172.17.0.0/16 ! -o docker0 -j MASQUERADE",
+			":DOCKER -",
+			"-A DOCKER -i docker0 -j RETURN",
+		},
+		"filter": {
+			":FORWARD DROP",
+			"-A FORWARD -j DOCKER-USER",
+			"-A FORWARD -o br-0123456789ab -j ACCEPT",
+			":DOCKER-USER -",
+			"-A DOCKER-USER -j RETURN",
+		},
+	}
+	if actual := rulesetLines(rulesets); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("ImportDocker mismatch: \ngot  %v \nneed %v", actual, expected)
+	}
+}
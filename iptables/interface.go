@@ -0,0 +1,72 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+// Reader is the read-only part of the IPTables method set.
+type Reader interface {
+	Proto() Protocol
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	List(table, chain string) ([]string, error)
+	ListWithCounters(table, chain string) ([]string, error)
+	ListById(table, chain string, id int) (string, error)
+	ListParsed(table, chain string) ([]Rule, error)
+	ListChains(table string) ([]string, error)
+	ListTable(table string) (map[string][]string, error)
+	ListChainsWithInfo(table string) ([]ChainInfo, error)
+	ChainExists(table, chain string) (bool, error)
+	ChainPolicy(table, chain string) (string, error)
+	Stats(table, chain string) ([][]string, error)
+	ParseStat(stat []string) (Stat, error)
+	StructuredStats(table, chain string) ([]Stat, error)
+	HasRandomFully() bool
+	GetIptablesVersion() (int, int, int)
+}
+
+// Writer is the part of the IPTables method set modifying rules and
+// chains.
+type Writer interface {
+	Insert(table, chain string, pos int, rulespec ...string) error
+	Replace(table, chain string, pos int, rulespec ...string) error
+	InsertUnique(table, chain string, pos int, rulespec ...string) error
+	Append(table, chain string, rulespec ...string) error
+	AppendUnique(table, chain string, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+	DeleteIfExists(table, chain string, rulespec ...string) error
+	DeleteById(table, chain string, id int) error
+	NewChain(table, chain string) error
+	ClearChain(table, chain string) error
+	RenameChain(table, oldChain, newChain string) error
+	DeleteChain(table, chain string) error
+	ClearAndDeleteChain(table, chain string) error
+	ClearAll() error
+	FlushTable(table string) error
+	FlushAll() error
+	DeleteAll() error
+	ChangePolicy(table, chain, target string) error
+	SetPolicy(table, chain, policy string) error
+}
+
+// Interface is the method set of IPTables, for code that wants to accept
+// fakes (see the iptablestest package) or decorators instead of a handle.
+//
+// Methods added to IPTables in the future may not be added to these
+// interfaces, so that implementations outside of this package keep
+// compiling; depend on Reader or Writer alone where that's enough.
+type Interface interface {
+	Reader
+	Writer
+}
+
+var _ Interface = &IPTables{}
@@ -16,14 +16,20 @@ package iptables
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 // Adds the output of stderr to exec.ExitError
@@ -32,6 +38,15 @@ type Error struct {
 	cmd        exec.Cmd
 	msg        string
 	exitStatus *int //for overriding
+	proto      Protocol
+	mode       string
+}
+
+// NewError returns an *Error for a command run with args that exited with
+// exitStatus and printed msg on stderr. It lets fakes and command runners
+// report failures the way the library does.
+func NewError(args []string, exitStatus int, msg string) *Error {
+	return &Error{cmd: exec.Cmd{Args: args}, msg: msg, exitStatus: &exitStatus}
 }
 
 func (e *Error) ExitStatus() int {
@@ -54,12 +69,7 @@ var isNotExistPatterns = []string{
 
 // IsNotExist returns true if the error is due to the chain or rule not existing
 func (e *Error) IsNotExist() bool {
-	for _, str := range isNotExistPatterns {
-		if strings.Contains(e.msg, str) {
-			return true
-		}
-	}
-	return false
+	return containsAny(e.msg, isNotExistPatterns)
 }
 
 // Protocol to differentiate between IPv4 and IPv6
@@ -70,18 +80,62 @@ const (
 	ProtocolIPv6
 )
 
+// IPTables is a handle running the iptables binary of one family.
+//
+// A handle is safe for concurrent use. Restores (Restore, RestoreAll,
+// AppendMany and Transaction commits) are ordered with respect to the
+// changes made with single iptables invocations (Append, Insert, Delete,
+// NewChain and so on) on the same handle, and the copies returned by
+// WithWaitTimeout: a restore waits for the changes in progress to complete,
+// and changes started while it runs wait for it to end, so a change is
+// never lost to, nor applied in the middle of, a restore of the handle.
+// Reads, including Exists, are never held back by a restore. Other
+// changes run concurrently, unless the handle was created with
+// Serialize. Methods made of several invocations, such as AppendUnique,
+// are not atomic, and other handles or processes are not ordered; use
+// LockChain to coordinate them.
 type IPTables struct {
 	path              string
 	proto             Protocol
 	hasCheck          bool
 	hasWait           bool
 	waitSupportSecond bool
+	hasWaitInterval   bool
 	hasRandomFully    bool
+	hasRestoreWait    bool
 	v1                int
 	v2                int
 	v3                int
 	mode              string // the underlying iptables operating mode, e.g. nf_tables
 	timeout           int    // time to wait for the iptables lock, default waits forever
+	waitInterval      time.Duration
+	waitTuner         *waitTuner
+	restoreLock       *RestoreLock
+	profile           string // pinned version and mode, see CompatibilityProfile
+	quirks            quirks
+	metrics           MetricsRecorder
+	admission         Admission
+	latency           *latencyTracker
+	netns             string // network namespace to run in, see NetNS
+	nsenterPath       string
+	runner            Runner
+	debugLog          func(CommandEvent)
+	probeCtx          context.Context
+	disabledProbes    map[Probe]bool
+	prober            CapabilityProber
+	android           bool
+	order             *sync.RWMutex // orders restores and other changes
+	env               []string      // added to the environment of the commands
+	lockFile          string        // see XtablesLockFile
+	modprobe          string        // see Modprobe
+	serialize         bool          // see Serialize
+	limiter           *rateLimiter  // see RateLimit
+	forceVersion      *[3]int       // see ForceVersion
+	forceMode         string
+	forceCheck        *bool
+	forceWait         *bool
+	flushConntrack    bool      // see FlushConntrackOnDelete
+	recorder          *Recorder // see Record
 }
 
 // Stat represents a structured statistic entry.
@@ -106,6 +160,8 @@ func IPFamily(proto Protocol) option {
 	}
 }
 
+// Timeout sets the time to wait for the xtables lock, in seconds. See
+// WaitTimeout.
 func Timeout(timeout int) option {
 	return func(ipt *IPTables) {
 		ipt.timeout = timeout
@@ -123,7 +179,34 @@ func Path(path string) option {
 //
 //	IPFamily(Protocol)
 //	Timeout(int)
+//	WaitTimeout(time.Duration)
+//	WaitInterval(time.Duration)
 //	Path(string)
+//	AdaptiveWait(int, int, int)
+//	ExclusiveRestore(*RestoreLock)
+//	CompatibilityProfile(string)
+//	Metrics(MetricsRecorder)
+//	AdmissionControl(Admission)
+//	NetNS(string)
+//	NetNSFd(uintptr)
+//	CommandRunner(Runner)
+//	DebugLog(func(CommandEvent))
+//	ProbeContext(context.Context)
+//	DisableProbes(...Probe)
+//	Prober(CapabilityProber)
+//	Android()
+//	XtablesLibDir(string)
+//	XtablesLockFile(string)
+//	Env(...string)
+//	Modprobe(string)
+//	Serialize()
+//	RateLimit(float64, int)
+//	ForceVersion(int, int, int)
+//	ForceMode(string)
+//	ForceCheck(bool)
+//	ForceWait(bool)
+//	FlushConntrackOnDelete()
+//	Record(*Recorder)
 //
 // For backwards compatibility, by default New uses IPv4 and timeout 0.
 // i.e. you can create an IPv6 IPTables using a timeout of 5 seconds passing
@@ -136,6 +219,8 @@ func New(opts ...option) (*IPTables, error) {
 		proto:   ProtocolIPv4,
 		timeout: 0,
 		path:    "",
+		latency: newLatencyTracker(),
+		order:   &sync.RWMutex{},
 	}
 
 	for _, opt := range opts {
@@ -149,30 +234,46 @@ func New(opts ...option) (*IPTables, error) {
 	} else {
 		cmd = ipt.path
 	}
-	path, err := exec.LookPath(cmd)
+	lookPath := ipt.lookPath
+	if ipt.android {
+		lookPath = ipt.androidLookPath
+	}
+	path, err := lookPath(cmd)
 	if err != nil {
 		return nil, err
 	}
 	ipt.path = path
 
-	vstring, err := getIptablesVersionString(path)
-	if err != nil {
-		return nil, fmt.Errorf("could not get iptables version: %v", err)
-	}
-	v1, v2, v3, mode, err := extractIptablesVersion(vstring)
-	if err != nil {
-		return nil, fmt.Errorf("failed to extract iptables version from [%s]: %v", vstring, err)
+	if ipt.netns != "" {
+		if ipt.nsenterPath, err = ipt.lookPath("nsenter"); err != nil {
+			return nil, fmt.Errorf("nsenter is required to run in a network namespace: %v", err)
+		}
 	}
-	ipt.v1 = v1
-	ipt.v2 = v2
-	ipt.v3 = v3
-	ipt.mode = mode
 
-	checkPresent, waitPresent, waitSupportSecond, randomFullyPresent := getIptablesCommandSupport(v1, v2, v3)
-	ipt.hasCheck = checkPresent
-	ipt.hasWait = waitPresent
-	ipt.waitSupportSecond = waitSupportSecond
-	ipt.hasRandomFully = randomFullyPresent
+	var caps Capabilities
+	if v := ipt.forceVersion; v != nil {
+		caps = CapabilitiesForVersion(v[0], v[1], v[2], "legacy")
+	} else if ipt.profile != "" {
+		v1, v2, v3, mode, err := parseCompatibilityProfile(ipt.profile)
+		if err != nil {
+			return nil, err
+		}
+		caps = CapabilitiesForVersion(v1, v2, v3, mode)
+	} else if ipt.disabledProbes[ProbeVersion] {
+		return nil, fmt.Errorf("the version probe is disabled, a CompatibilityProfile is required")
+	} else {
+		prober := ipt.prober
+		if prober == nil {
+			prober = VersionProber{}
+		}
+		if caps, err = prober.ProbeCapabilities(ipt.probeContext(), ipt.probeCommand); err != nil {
+			return nil, err
+		}
+	}
+	if caps, err = ipt.forcedCapabilities(caps); err != nil {
+		return nil, err
+	}
+	ipt.setCapabilities(caps)
 
 	return ipt, nil
 }
@@ -239,6 +340,16 @@ func (ipt *IPTables) Append(table, chain string, rulespec ...string) error {
 	return ipt.run(cmd...)
 }
 
+// AppendString acts like Append with a rulespec written as a single
+// string, split with SplitRuleSpec.
+func (ipt *IPTables) AppendString(table, chain, rulespec string) error {
+	args, err := SplitRuleSpec(rulespec)
+	if err != nil {
+		return err
+	}
+	return ipt.Append(table, chain, args...)
+}
+
 // AppendUnique acts like Append except that it won't add a duplicate
 func (ipt *IPTables) AppendUnique(table, chain string, rulespec ...string) error {
 	exists, err := ipt.Exists(table, chain, rulespec...)
@@ -253,10 +364,29 @@ func (ipt *IPTables) AppendUnique(table, chain string, rulespec ...string) error
 	return nil
 }
 
-// Delete removes rulespec in specified table/chain
+// AppendMany appends every rulespec of rules to specified table/chain, in
+// order, with a single iptables-restore --noflush invocation instead of one
+// iptables invocation per rule. Either all the rules are appended or none.
+func (ipt *IPTables) AppendMany(table, chain string, rules [][]string) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	tx := ipt.NewTransaction()
+	for _, rulespec := range rules {
+		tx.Append(table, chain, rulespec...)
+	}
+	return tx.Commit()
+}
+
+// Delete removes rulespec in specified table/chain, flushing the conntrack
+// entries of its connections if the handle was created with
+// FlushConntrackOnDelete.
 func (ipt *IPTables) Delete(table, chain string, rulespec ...string) error {
 	cmd := append([]string{"-t", table, "-D", chain}, rulespec...)
-	return ipt.run(cmd...)
+	if err := ipt.run(cmd...); err != nil {
+		return err
+	}
+	return ipt.flushConntrackFor(chain, rulespec)
 }
 
 func (ipt *IPTables) DeleteIfExists(table, chain string, rulespec ...string) error {
@@ -273,8 +403,48 @@ func (ipt *IPTables) DeleteById(table, chain string, id int) error {
 	return ipt.run(cmd...)
 }
 
+// ErrRuleIndex is wrapped by the errors of the methods that check a rule
+// number against the length of its chain, such as ReplaceById.
+var ErrRuleIndex = errors.New("rule index out of range")
+
+// ReplaceById replaces the rule with the specified number (starting at 1)
+// of table/chain with rulespec. Unlike Replace, the number is checked
+// against the length of the chain first, returning an error wrapping
+// ErrRuleIndex if there is no such rule.
+func (ipt *IPTables) ReplaceById(table, chain string, id int, rulespec ...string) error {
+	if err := ipt.checkRuleIndex(table, chain, id); err != nil {
+		return err
+	}
+	return ipt.Replace(table, chain, id, rulespec...)
+}
+
+// checkRuleIndex returns an error wrapping ErrRuleIndex if table/chain has
+// no rule with number id.
+func (ipt *IPTables) checkRuleIndex(table, chain string, id int) error {
+	rules, err := ipt.List(table, chain)
+	if err != nil {
+		return err
+	}
+	// the first line is the chain definition
+	if id < 1 || id >= len(rules) {
+		return fmt.Errorf("%w: no rule %d in chain %s of table %s (%d rules)", ErrRuleIndex, id, chain, table, len(rules)-1)
+	}
+	return nil
+}
+
 // List rules in specified table/chain
 func (ipt *IPTables) ListById(table, chain string, id int) (string, error) {
+	if ipt.quirks.busybox {
+		rules, err := ipt.List(table, chain)
+		if err != nil {
+			return "", err
+		}
+		// the first line is the chain definition
+		if id < 1 || id >= len(rules) {
+			return "", fmt.Errorf("no rule %d in chain %s", id, chain)
+		}
+		return rules[id], nil
+	}
 	args := []string{"-t", table, "-S", chain, strconv.Itoa(id)}
 	rule, err := ipt.executeList(args)
 	if err != nil {
@@ -320,10 +490,42 @@ func (ipt *IPTables) ListChains(table string) ([]string, error) {
 	return chains, nil
 }
 
+// ListTable lists the rules of every chain in the specified table with a
+// single invocation. The result maps each chain name to what List would
+// return for it: the chain definition followed by its rules.
+func (ipt *IPTables) ListTable(table string) (map[string][]string, error) {
+	args := []string{"-t", table, "-S"}
+	result, err := ipt.executeList(args)
+	if err != nil {
+		return nil, err
+	}
+	return groupRulesByChain(result), nil
+}
+
+// groupRulesByChain splits the -S output of a whole table per chain.
+func groupRulesByChain(lines []string) map[string][]string {
+	chains := map[string][]string{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "-P", "-N", "-A":
+			chains[fields[1]] = append(chains[fields[1]], line)
+		}
+	}
+	return chains
+}
+
 // '-S' is fine with non existing rule index as long as the chain exists
 // therefore pass index 1 to reduce overhead for large chains
 func (ipt *IPTables) ChainExists(table, chain string) (bool, error) {
-	err := ipt.run("-t", table, "-S", chain, "1")
+	args := []string{"-t", table, "-S", chain, "1"}
+	if ipt.quirks.busybox {
+		args = args[:len(args)-1]
+	}
+	err := ipt.run(args...)
 	eerr, eok := err.(*Error)
 	switch {
 	case err == nil:
@@ -335,7 +537,10 @@ func (ipt *IPTables) ChainExists(table, chain string) (bool, error) {
 	}
 }
 
-// Stats lists rules including the byte and packet counts
+// Stats lists rules including the byte and packet counts. Like every
+// listing of this package, it passes -n, so that no DNS or service name
+// resolution slows it down, and -x, so that counters are exact rather than
+// scaled with K, M or G suffixes.
 func (ipt *IPTables) Stats(table, chain string) ([][]string, error) {
 	args := []string{"-t", table, "-L", chain, "-n", "-v", "-x"}
 	lines, err := ipt.executeList(args)
@@ -343,20 +548,8 @@ func (ipt *IPTables) Stats(table, chain string) ([][]string, error) {
 		return nil, err
 	}
 
-	appendSubnet := func(addr string) string {
-		if strings.IndexByte(addr, byte('/')) < 0 {
-			if strings.IndexByte(addr, '.') < 0 {
-				return addr + "/128"
-			}
-			return addr + "/32"
-		}
-		return addr
-	}
-
-	ipv6 := ipt.proto == ProtocolIPv6
-
 	// Skip the warning if exist
-	if strings.HasPrefix(lines[0], "#") {
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "#") {
 		lines = lines[1:]
 	}
 
@@ -366,44 +559,66 @@ func (ipt *IPTables) Stats(table, chain string) ([][]string, error) {
 		if i < 2 {
 			continue
 		}
+		rows = append(rows, ipt.statFields(line))
+	}
+	return rows, nil
+}
 
-		// Fields:
-		// 0=pkts 1=bytes 2=target 3=prot 4=opt 5=in 6=out 7=source 8=destination 9=options
-		line = strings.TrimSpace(line)
-		fields := strings.Fields(line)
-
-		// The ip6tables verbose output cannot be naively split due to the default "opt"
-		// field containing 2 single spaces.
-		if ipv6 {
-			// Check if field 6 is "opt" or "source" address
-			dest := fields[6]
-			ip, _, _ := net.ParseCIDR(dest)
-			if ip == nil {
-				ip = net.ParseIP(dest)
+// statFields splits a rule line of the -L -n -v -x output into the fields
+// returned by Stats.
+func (ipt *IPTables) statFields(line string) []string {
+	appendSubnet := func(addr string) string {
+		if strings.IndexByte(addr, byte('/')) < 0 {
+			if strings.IndexByte(addr, '.') < 0 {
+				return addr + "/128"
 			}
+			return addr + "/32"
+		}
+		return addr
+	}
 
-			// If we detected a CIDR or IP, the "opt" field is empty.. insert it.
-			if ip != nil {
-				f := []string{}
-				f = append(f, fields[:4]...)
-				f = append(f, "  ") // Empty "opt" field for ip6tables
-				f = append(f, fields[4:]...)
-				fields = f
-			}
+	// Fields:
+	// 0=pkts 1=bytes 2=target 3=prot 4=opt 5=in 6=out 7=source 8=destination 9=options
+	line = strings.TrimSpace(line)
+	fields := strings.Fields(line)
+
+	// The ip6tables verbose output cannot be naively split due to the default "opt"
+	// field containing 2 single spaces. Releases before 1.8.9 print it
+	// that way, but the columns are checked whatever the version, as the
+	// quirks may not match the binary that printed the line.
+	if ipt.proto == ProtocolIPv6 && len(fields) > 6 {
+		// Check if field 6 is "opt" or "source" address
+		dest := fields[6]
+		ip, _, _ := net.ParseCIDR(dest)
+		if ip == nil {
+			ip = net.ParseIP(dest)
 		}
 
-		// Adjust "source" and "destination" to include netmask, to match regular
-		// List output
-		fields[7] = appendSubnet(fields[7])
-		fields[8] = appendSubnet(fields[8])
+		// If we detected a CIDR or IP, the "opt" field is empty.. insert it.
+		if ip != nil {
+			f := []string{}
+			f = append(f, fields[:4]...)
+			f = append(f, "  ") // Empty "opt" field for ip6tables
+			f = append(f, fields[4:]...)
+			fields = f
+		}
+	}
 
-		// Combine "options" fields 9... into a single space-delimited field.
-		options := fields[9:]
-		fields = fields[:9]
-		fields = append(fields, strings.Join(options, " "))
-		rows = append(rows, fields)
+	// a truncated line, rejected by ParseStat
+	if len(fields) < 9 {
+		return fields
 	}
-	return rows, nil
+
+	// Adjust "source" and "destination" to include netmask, to match regular
+	// List output
+	fields[7] = appendSubnet(fields[7])
+	fields[8] = appendSubnet(fields[8])
+
+	// Combine "options" fields 9... into a single space-delimited field.
+	options := fields[9:]
+	fields = fields[:9]
+	fields = append(fields, strings.Join(options, " "))
+	return fields
 }
 
 // ParseStat parses a single statistic row into a Stat struct. The input should
@@ -414,6 +629,13 @@ func (ipt *IPTables) ParseStat(stat []string) (parsed Stat, err error) {
 		return parsed, fmt.Errorf("stat contained fewer fields than expected")
 	}
 
+	// Stats passes -x, but rows may come from elsewhere
+	for _, counter := range stat[:2] {
+		if n := len(counter); n > 1 && strings.ContainsAny(counter[n-1:], "KMGTP") {
+			return parsed, fmt.Errorf("counter %q is scaled, list with -x for exact counters", counter)
+		}
+	}
+
 	// Convert the fields that are not plain strings
 	parsed.Packets, err = strconv.ParseUint(stat[0], 0, 64)
 	if err != nil {
@@ -463,6 +685,38 @@ func (ipt *IPTables) StructuredStats(table, chain string) ([]Stat, error) {
 	return structStats, nil
 }
 
+// StatsTable returns the statistics of every chain of the specified table,
+// as StructuredStats does for a single chain, keyed by chain. The whole
+// table is listed with a single iptables invocation.
+func (ipt *IPTables) StatsTable(table string) (map[string][]Stat, error) {
+	lines, err := ipt.executeList([]string{"-t", table, "-L", "-n", "-v", "-x"})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := map[string][]Stat{}
+	chain := ""
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0 || strings.HasPrefix(line, "#"):
+			// blank line between chains, or warning
+		case fields[0] == "Chain" && len(fields) > 1:
+			chain = fields[1]
+			stats[chain] = []Stat{}
+		case chain == "" || fields[0] == "pkts":
+			// field header
+		default:
+			stat, err := ipt.ParseStat(ipt.statFields(line))
+			if err != nil {
+				return nil, err
+			}
+			stats[chain] = append(stats[chain], stat)
+		}
+	}
+	return stats, nil
+}
+
 func (ipt *IPTables) executeList(args []string) ([]string, error) {
 	var stdout bytes.Buffer
 	if err := ipt.runWithOutput(args, &stdout); err != nil {
@@ -508,14 +762,21 @@ func (ipt *IPTables) ClearChain(table, chain string) error {
 	}
 }
 
-// RenameChain renames the old chain to the new one.
+// RenameChain renames the old chain to the new one. Builtin chains cannot
+// be renamed, see BuiltinChainError.
 func (ipt *IPTables) RenameChain(table, oldChain, newChain string) error {
+	if err := checkNotBuiltin("rename-chain", table, oldChain); err != nil {
+		return err
+	}
 	return ipt.run("-t", table, "-E", oldChain, newChain)
 }
 
 // DeleteChain deletes the chain in the specified table.
-// The chain must be empty
+// The chain must be empty, and cannot be builtin, see BuiltinChainError.
 func (ipt *IPTables) DeleteChain(table, chain string) error {
+	if err := checkNotBuiltin("delete-chain", table, chain); err != nil {
+		return err
+	}
 	return ipt.run("-t", table, "-X", chain)
 }
 
@@ -535,13 +796,67 @@ func (ipt *IPTables) ClearAll() error {
 	return ipt.run("-F")
 }
 
+// FlushTable flushes (deletes all rules in) every chain of the specified
+// table with a single invocation. Chains and policies are kept.
+func (ipt *IPTables) FlushTable(table string) error {
+	return ipt.run("-t", table, "-F")
+}
+
+// standardTables are the tables known to iptables, not all of which are
+// necessarily loaded in the kernel.
+var standardTables = []string{"filter", "nat", "mangle", "raw", "security"}
+
+// FlushAll flushes every chain of every standard table. Tables that are
+// not available in the kernel are skipped; any other failure is returned
+// as an *Error.
+func (ipt *IPTables) FlushAll() error {
+	for _, table := range standardTables {
+		err := ipt.FlushTable(table)
+		if e, ok := err.(*Error); ok && e.IsNotExist() {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (ipt *IPTables) DeleteAll() error {
 	return ipt.run("-X")
 }
 
 // ChangePolicy changes policy on chain to target
 func (ipt *IPTables) ChangePolicy(table, chain, target string) error {
-	return ipt.run("-t", table, "-P", chain, target)
+	return ipt.SetPolicy(table, chain, target)
+}
+
+// SetPolicy sets the default policy (e.g. ACCEPT or DROP) of the builtin
+// chain in the specified table.
+func (ipt *IPTables) SetPolicy(table, chain, policy string) error {
+	return ipt.run("-t", table, "-P", chain, policy)
+}
+
+// ChainPolicy returns the default policy of the chain in the specified
+// table, as printed by "-S" (e.g. "-P INPUT ACCEPT"). User-defined chains
+// have no policy and return an empty string.
+func (ipt *IPTables) ChainPolicy(table, chain string) (string, error) {
+	lines, err := ipt.executeList([]string{"-t", table, "-S", chain})
+	if err != nil {
+		return "", err
+	}
+	return parsePolicy(lines, chain), nil
+}
+
+// parsePolicy returns the policy of chain from its "-P" line in -S output.
+func parsePolicy(lines []string, chain string) string {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "-P" && fields[1] == chain {
+			return fields[2]
+		}
+	}
+	return ""
 }
 
 // Check if the underlying iptables command supports the --random-fully flag
@@ -557,26 +872,91 @@ func (ipt *IPTables) GetIptablesVersion() (int, int, int) {
 // run runs an iptables command with the given arguments, ignoring
 // any stdout output
 func (ipt *IPTables) run(args ...string) error {
-	return ipt.runWithOutput(args, nil)
+	return ipt.runChange(args, nil)
+}
+
+// Run runs iptables with args, which exclude the binary, for the
+// operations the library doesn't wrap (e.g. "-t", "nat", "-Z", "chain").
+// The command goes through the same admission control, ordering, --wait
+// flags and rate limit as the wrapped ones, and fails with an *Error if
+// iptables exits with a non-zero status.
+func (ipt *IPTables) Run(args ...string) error {
+	return ipt.runChange(args, nil)
+}
+
+// RunWithOutput acts like Run, returning what iptables printed on stdout.
+func (ipt *IPTables) RunWithOutput(args ...string) (string, error) {
+	var stdout bytes.Buffer
+	err := ipt.runChange(args, &stdout)
+	return stdout.String(), err
+}
+
+// runChange runs an iptables command, which may change the rules, writing
+// any stdout output to the given writer.
+func (ipt *IPTables) runChange(args []string, stdout io.Writer) error {
+	if err := ipt.admit(args); err != nil {
+		return err
+	}
+	op, mutation := parseOperation(ipt.proto, args)
+	if mutation {
+		if err := checkDeprecatedOperations(op); err != nil {
+			return err
+		}
+	}
+	defer ipt.beginChange(mutation)()
+	if err := ipt.runWithOutput(args, stdout); err != nil {
+		return err
+	}
+	if mutation {
+		ipt.recorder.record(op)
+	}
+	return nil
 }
 
 // runWithOutput runs an iptables command with the given arguments,
 // writing any stdout output to the given writer
 func (ipt *IPTables) runWithOutput(args []string, stdout io.Writer) error {
+	if ipt.quirks.noListRules {
+		for _, arg := range args {
+			if arg == "-S" {
+				return fmt.Errorf("listing rules with -S is not supported by %s", ipt.path)
+			}
+		}
+	}
+	if ipt.waitTuner == nil || !ipt.hasWait || !ipt.waitSupportSecond {
+		return ipt.runWithTimeout(args, stdout, ipt.timeout)
+	}
+
+	for attempt := 0; ; attempt++ {
+		timeout, _ := ipt.waitTuner.current()
+		start := time.Now()
+		err := ipt.runWithTimeout(args, stdout, timeout)
+		lockErr := isLockError(err)
+		ipt.waitTuner.observe(time.Since(start), timeout, lockErr)
+		if _, retries := ipt.waitTuner.current(); !lockErr || attempt >= retries {
+			return err
+		}
+	}
+}
+
+// runWithTimeout runs an iptables command with the given arguments and
+// --wait timeout, writing any stdout output to the given writer
+func (ipt *IPTables) runWithTimeout(args []string, stdout io.Writer, timeout int) error {
 	args = append([]string{ipt.path}, args...)
+	if ipt.modprobe != "" {
+		args = append(args, "--modprobe="+ipt.modprobe)
+	}
 	if ipt.hasWait {
 		args = append(args, "--wait")
-		if ipt.timeout != 0 && ipt.waitSupportSecond {
-			args = append(args, strconv.Itoa(ipt.timeout))
+		if timeout != 0 && ipt.waitSupportSecond {
+			args = append(args, strconv.Itoa(timeout))
 		}
-	} else {
-		fmu, err := newXtablesFileLock()
-		if err != nil {
-			return err
+		if ipt.waitInterval > 0 && ipt.hasWaitInterval {
+			args = append(args, "--wait-interval", strconv.FormatInt(ipt.waitInterval.Microseconds(), 10))
 		}
-		ul, err := fmu.tryLock()
+	} else if ipt.runner == nil {
+		ul, err := lockXtables(ipt.lockFilePath())
 		if err != nil {
-			syscall.Close(fmu.fd)
 			return err
 		}
 		defer func() {
@@ -584,24 +964,73 @@ func (ipt *IPTables) runWithOutput(args []string, stdout io.Writer) error {
 		}()
 	}
 
+	return ipt.runCommand(args, nil, stdout)
+}
+
+// lockXtables takes the xtables lock on behalf of iptables binaries too old
+// to take it themselves.
+func lockXtables(path string) (Unlocker, error) {
+	fmu, err := newXtablesFileLock(path)
+	if err != nil {
+		return nil, err
+	}
+	ul, err := fmu.tryLock()
+	if err != nil {
+		syscall.Close(fmu.fd)
+		return nil, err
+	}
+	return ul, nil
+}
+
+// runCommand executes args[0] with the given arguments, in the handle's
+// network namespace if any, feeding it stdin and writing any stdout output
+// to the given writer. A non-zero exit status is returned as *Error.
+func (ipt *IPTables) runCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	return ipt.runCommandContext(context.Background(), args, stdin, stdout)
+}
+
+// runCommandContext is runCommand, killing the command if ctx is done
+// before it exits.
+func (ipt *IPTables) runCommandContext(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
 	var stderr bytes.Buffer
-	cmd := exec.Cmd{
-		Path:   ipt.path,
-		Args:   args,
-		Stdout: stdout,
-		Stderr: &stderr,
+	cmdArgs := ipt.nsenterArgs(args)
+	cmd := exec.CommandContext(ctx, cmdArgs[0], cmdArgs[1:]...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if len(ipt.env) > 0 {
+		cmd.Env = append(os.Environ(), ipt.env...)
 	}
 
-	if err := cmd.Run(); err != nil {
-		switch e := err.(type) {
-		case *exec.ExitError:
-			return &Error{*e, cmd, stderr.String(), nil}
-		default:
-			return err
+	throttled, err := ipt.waitRateLimit(ctx, args)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if ipt.runner != nil {
+		if stdout == nil {
+			stdout = ioutil.Discard
+		}
+		var status int
+		runArgs := cmdArgs
+		if len(ipt.env) > 0 {
+			runArgs = append(append([]string{"env"}, ipt.env...), cmdArgs...)
+		}
+		status, err = ipt.runner.Run(ctx, runArgs, stdin, stdout, &stderr)
+		if err == nil && status != 0 {
+			err = NewError(cmdArgs, status, stderr.String())
+		}
+	} else if err = cmd.Run(); err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			err = &Error{ExitError: *e, cmd: *cmd, msg: stderr.String()}
 		}
 	}
-
-	return nil
+	if e, ok := err.(*Error); ok {
+		e.proto, e.mode = ipt.proto, ipt.mode
+	}
+	ipt.observeExec(args, start, err, stderr.String())
+	ipt.logCommand(args, cmdArgs, start, throttled, err, stderr.String())
+	return err
 }
 
 // getIptablesCommand returns the correct command for the given protocol, either "iptables" or "ip6tables".
@@ -650,18 +1079,6 @@ func extractIptablesVersion(str string) (int, int, int, string, error) {
 	return v1, v2, v3, mode, nil
 }
 
-// Runs "iptables --version" to get the version string
-func getIptablesVersionString(path string) (string, error) {
-	cmd := exec.Command(path, "--version")
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
-	if err != nil {
-		return "", err
-	}
-	return out.String(), nil
-}
-
 // Checks if an iptables version is after 1.4.11, when --check was added
 func iptablesHasCheckCommand(v1 int, v2 int, v3 int) bool {
 	if v1 > 1 {
@@ -715,16 +1132,32 @@ func iptablesHasRandomFully(v1 int, v2 int, v3 int) bool {
 	return false
 }
 
-// Checks if a rule specification exists for a table
+// Checks if a rule specification exists for a table. Rules are compared
+// in their normalized form, as the rulespec rarely matches the -S output
+// verbatim.
 func (ipt *IPTables) existsForOldIptables(table, chain string, rulespec []string) (bool, error) {
-	rs := strings.Join(append([]string{"-A", chain}, rulespec...), " ")
+	rs := strings.Join(quoteArgs(append([]string{"-A", chain}, rulespec...)), " ")
 	args := []string{"-t", table, "-S"}
 	var stdout bytes.Buffer
 	err := ipt.runWithOutput(args, &stdout)
 	if err != nil {
 		return false, err
 	}
-	return strings.Contains(stdout.String(), rs), nil
+
+	want, err := ruleLineKey(rs)
+	if err != nil {
+		// not something we can parse, fall back to a textual comparison
+		return strings.Contains(stdout.String(), rs), nil
+	}
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if !strings.HasPrefix(line, "-A "+chain+" ") {
+			continue
+		}
+		if key, err := ruleLineKey(line); err == nil && key == want {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 // counterRegex is the regex used to detect nftables counter format
@@ -15,14 +15,18 @@
 package iptables
 
 import (
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"net"
 	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestProto(t *testing.T) {
@@ -854,3 +858,345 @@ func TestListById(t *testing.T) {
 		})
 	}
 }
+
+func TestParsePolicy(t *testing.T) {
+	testCases := []struct {
+		in     []string
+		chain  string
+		policy string
+	}{
+		{
+			[]string{"-P INPUT DROP", "-A INPUT -j ACCEPT"},
+			"INPUT",
+			"DROP",
+		},
+		{
+			[]string{"-N TEST-1", "-A TEST-1 -j ACCEPT"},
+			"TEST-1",
+			"",
+		},
+	}
+
+	for i, tt := range testCases {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			policy := parsePolicy(tt.in, tt.chain)
+			if policy != tt.policy {
+				t.Fatalf("expected policy %q, got %q", tt.policy, policy)
+			}
+		})
+	}
+}
+
+func TestGroupRulesByChain(t *testing.T) {
+	in := []string{
+		"-P INPUT ACCEPT",
+		"-P OUTPUT ACCEPT",
+		"-N TEST-1",
+		"-A INPUT -j TEST-1",
+		"-A TEST-1 -s 192.0.2.0/24 -j ACCEPT",
+		"-A TEST-1 -j DROP",
+	}
+	expected := map[string][]string{
+		"INPUT":  {"-P INPUT ACCEPT", "-A INPUT -j TEST-1"},
+		"OUTPUT": {"-P OUTPUT ACCEPT"},
+		"TEST-1": {"-N TEST-1", "-A TEST-1 -s 192.0.2.0/24 -j ACCEPT", "-A TEST-1 -j DROP"},
+	}
+
+	actual := groupRulesByChain(in)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("groupRulesByChain mismatch: \ngot  %#v \nneed %#v", actual, expected)
+	}
+}
+
+func TestParseCompatibilityProfile(t *testing.T) {
+	testCases := []struct {
+		in         string
+		v1, v2, v3 int
+		mode       string
+		err        bool
+	}{
+		{"1.8.4-nft", 1, 8, 4, "nf_tables", false},
+		{"1.8.4-legacy", 1, 8, 4, "legacy", false},
+		{"1.6.1", 1, 6, 1, "legacy", false},
+		{"1.8", 0, 0, 0, "", true},
+		{"1.8.4-bpf", 0, 0, 0, "", true},
+	}
+
+	for i, tt := range testCases {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			v1, v2, v3, mode, err := parseCompatibilityProfile(tt.in)
+			if err == nil && tt.err {
+				t.Fatal("expected err, got none")
+			} else if err != nil && !tt.err {
+				t.Fatalf("unexpected err %s", err)
+			}
+
+			if v1 != tt.v1 || v2 != tt.v2 || v3 != tt.v3 || mode != tt.mode {
+				t.Fatalf("expected %d %d %d %s, got %d %d %d %s",
+					tt.v1, tt.v2, tt.v3, tt.mode,
+					v1, v2, v3, mode)
+			}
+		})
+	}
+}
+
+func TestParseChainHeaders(t *testing.T) {
+	in := []string{
+		"Chain INPUT (policy DROP 10 packets, 600 bytes)",
+		"    pkts      bytes target     prot opt in     out     source               destination",
+		"       3      180 KUBE-SERVICES  0    --  *      *       0.0.0.0/0            0.0.0.0/0",
+		"",
+		"Chain OUTPUT (policy ACCEPT)",
+		"",
+		"Chain KUBE-SERVICES (2 references)",
+		"    pkts      bytes target     prot opt in     out     source               destination",
+	}
+	expected := []ChainInfo{
+		{Name: "INPUT", Policy: "DROP", Packets: 10, Bytes: 600, IsBuiltin: true},
+		{Name: "OUTPUT", Policy: "ACCEPT", IsBuiltin: true},
+		{Name: "KUBE-SERVICES", References: 2},
+	}
+
+	actual := parseChainHeaders(in)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("parseChainHeaders mismatch: \ngot  %#v \nneed %#v", actual, expected)
+	}
+}
+
+func TestExecOperation(t *testing.T) {
+	testCases := []struct {
+		args []string
+		op   string
+	}{
+		{[]string{"/sbin/iptables", "-t", "filter", "-A", "INPUT", "-j", "ACCEPT", "--wait"}, "append"},
+		{[]string{"/sbin/ip6tables", "-t", "nat", "-S", "POSTROUTING", "--wait"}, "list"},
+		{[]string{"/sbin/iptables-restore", "--noflush"}, "restore"},
+		{[]string{"/usr/sbin/ip6tables-legacy-save", "-t", "raw"}, "save"},
+		{[]string{"/usr/sbin/iptables-translate", "-t", "nat", "-A", "POSTROUTING", "-j", "MASQUERADE"}, "translate"},
+	}
+
+	for _, tt := range testCases {
+		if op := execOperation(tt.args); op != tt.op {
+			t.Fatalf("execOperation(%v): expected %s, got %s", tt.args, tt.op, op)
+		}
+	}
+}
+
+func TestMultiError(t *testing.T) {
+	notExist := &Error{msg: "iptables: No chain/target/match by that name.\n"}
+	var b multiErrorBuilder
+	b.add(Operation{Kind: "append", Proto: ProtocolIPv4, Table: "filter", Chain: "FOO"}, nil)
+	if err := b.err(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	b.add(Operation{Kind: "append", Proto: ProtocolIPv6, Table: "filter", Chain: "FOO"}, notExist)
+
+	err := b.err()
+	var merr *MultiError
+	if !errors.As(err, &merr) || len(merr.Errors) != 1 || len(merr.Succeeded) != 1 {
+		t.Fatalf("expected a MultiError with one failure and one success, got %v", err)
+	}
+	if merr.Errors[0].Op.Proto != ProtocolIPv6 {
+		t.Fatalf("expected the IPv6 part to fail, got %v", merr.Errors[0])
+	}
+	var e *Error
+	if !errors.As(err, &e) || !e.IsNotExist() || !errors.Is(err, notExist) {
+		t.Fatalf("expected the MultiError to expose %v, got %v", notExist, err)
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	ipt := &IPTables{latency: newLatencyTracker()}
+	ipt.latency.observe("append", 100*time.Millisecond)
+	ipt.latency.observe("append", 200*time.Millisecond)
+
+	stats := ipt.LatencyStats()
+	expected := LatencyStat{Average: 120 * time.Millisecond, Last: 200 * time.Millisecond, Count: 2}
+	if !reflect.DeepEqual(stats, map[string]LatencyStat{"append": expected}) {
+		t.Fatalf("unexpected latency stats %v", stats)
+	}
+}
+
+func TestNsenterArgs(t *testing.T) {
+	args := []string{"/sbin/iptables", "-t", "filter", "-S"}
+	ipt := &IPTables{}
+	if actual := ipt.nsenterArgs(args); !reflect.DeepEqual(actual, args) {
+		t.Fatalf("expected %v outside of a namespace, got %v", args, actual)
+	}
+
+	NetNS("/var/run/netns/blue")(ipt)
+	ipt.nsenterPath = "/usr/bin/nsenter"
+	expected := []string{"/usr/bin/nsenter", "--net=/var/run/netns/blue", "--", "/sbin/iptables", "-t", "filter", "-S"}
+	if actual := ipt.nsenterArgs(args); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("nsenterArgs mismatch: \ngot  %v \nneed %v", actual, expected)
+	}
+}
+
+func TestParseChainCounters(t *testing.T) {
+	lines := []string{
+		"# Warning: iptables-legacy tables present, use iptables-legacy to see them",
+		"Chain INPUT (policy DROP 12 packets, 720 bytes)",
+		"    pkts      bytes target     prot opt in     out     source               destination         ",
+		"     100     6000 ACCEPT     all  --  lo     *       0.0.0.0/0            0.0.0.0/0           ",
+		"      20    19000 ACCEPT     tcp  --  *      *       10.0.0.0/8           0.0.0.0/0            tcp dpt:22",
+	}
+	counters, err := parseChainCounters(lines)
+	if err != nil {
+		t.Fatalf("parseChainCounters failed: %v", err)
+	}
+	expected := ChainCounters{
+		ChainInfo:   ChainInfo{Name: "INPUT", Policy: "DROP", Packets: 12, Bytes: 720, IsBuiltin: true},
+		Rules:       2,
+		RulePackets: 120,
+		RuleBytes:   25000,
+	}
+	if !reflect.DeepEqual(counters, expected) {
+		t.Fatalf("parseChainCounters mismatch: \ngot  %+v \nneed %+v", counters, expected)
+	}
+
+	if _, err := parseChainCounters([]string{"garbage"}); err == nil {
+		t.Fatalf("expected an error for a missing chain header")
+	}
+}
+
+func TestParseStatExactCounters(t *testing.T) {
+	ipt := &IPTables{}
+	row := []string{"18446744073709551615", "9007199254740993", "ACCEPT", "all", "--", "*", "*", "0.0.0.0/0", "0.0.0.0/0", ""}
+	stat, err := ipt.ParseStat(row)
+	if err != nil {
+		t.Fatalf("ParseStat failed: %v", err)
+	}
+	if stat.Packets != 18446744073709551615 || stat.Bytes != 9007199254740993 {
+		t.Fatalf("counters lost precision: %d %d", stat.Packets, stat.Bytes)
+	}
+
+	row[1] = "12M"
+	if _, err := ipt.ParseStat(row); err == nil || !strings.Contains(err.Error(), "-x") {
+		t.Fatalf("expected an error about scaled counters, got %v", err)
+	}
+}
+
+func TestStatsTable(t *testing.T) {
+	var calls [][]string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, args)
+		io.WriteString(stdout, `Chain INPUT (policy ACCEPT 0 packets, 0 bytes)
+    pkts      bytes target     prot opt in     out     source               destination
+      12      720 ACCEPT     6    --  *      *       0.0.0.0/0            0.0.0.0/0            tcp dpt:22
+       3      180 DROP       0    --  eth0   *       10.0.0.0/8           0.0.0.0/0
+
+Chain FORWARD (policy DROP 0 packets, 0 bytes)
+    pkts      bytes target     prot opt in     out     source               destination
+
+Chain AGENT (0 references)
+    pkts      bytes target     prot opt in     out     source               destination
+       1       60 RETURN     0    --  *      *       0.0.0.0/0            192.168.1.1
+`)
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.9-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	stats, err := ipt.StatsTable("filter")
+	if err != nil {
+		t.Fatalf("StatsTable failed: %v", err)
+	}
+	if len(calls) != 1 || !reflect.DeepEqual(calls[0][:7], []string{"iptables", "-t", "filter", "-L", "-n", "-v", "-x"}) {
+		t.Fatalf("expected a single listing of the table, got %q", calls)
+	}
+	if len(stats) != 3 || len(stats["INPUT"]) != 2 || len(stats["FORWARD"]) != 0 || len(stats["AGENT"]) != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if s := stats["INPUT"][0]; s.Packets != 12 || s.Bytes != 720 || s.Target != "ACCEPT" || s.Options != "tcp dpt:22" {
+		t.Fatalf("unexpected stat %+v", s)
+	}
+	if s := stats["AGENT"][0]; s.Destination.String() != "192.168.1.1/32" {
+		t.Fatalf("unexpected destination %v", s.Destination)
+	}
+}
+
+func TestFlushTable(t *testing.T) {
+	var calls []string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, strings.Join(args, " "))
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := ipt.FlushTable("nat"); err != nil {
+		t.Fatalf("FlushTable failed: %v", err)
+	}
+	if !reflect.DeepEqual(calls, []string{"iptables -t nat -F --wait"}) {
+		t.Fatalf("expected a single flush of the table, got %q", calls)
+	}
+}
+
+func TestFlushAll(t *testing.T) {
+	var flushed []string
+	missing := map[string]bool{"security": true}
+	fail := map[string]bool{}
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		table := args[2]
+		switch {
+		case missing[table]:
+			io.WriteString(stderr, "iptables v1.8.7 (nf_tables): table '"+table+"' does not exist\nPerhaps iptables or your kernel needs to be upgraded.\n")
+			return 3, nil
+		case fail[table]:
+			io.WriteString(stderr, "iptables v1.8.7 (nf_tables): Could not fetch rule set generation id: Permission denied (you must be root)\n")
+			return 4, nil
+		}
+		flushed = append(flushed, table)
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	// tables missing from the kernel are skipped
+	if err := ipt.FlushAll(); err != nil {
+		t.Fatalf("FlushAll failed: %v", err)
+	}
+	if want := []string{"filter", "nat", "mangle", "raw"}; !reflect.DeepEqual(flushed, want) {
+		t.Fatalf("expected %q to be flushed, got %q", want, flushed)
+	}
+
+	// other failures are returned
+	flushed, fail["nat"] = nil, true
+	err = ipt.FlushAll()
+	if e, ok := err.(*Error); !ok || e.IsNotExist() || e.ExitStatus() != 4 {
+		t.Fatalf("expected the nat failure, got %v", err)
+	}
+	if !reflect.DeepEqual(flushed, []string{"filter"}) {
+		t.Fatalf("expected FlushAll to stop at nat, got %q", flushed)
+	}
+}
+
+func TestStatFieldsProfileMismatch(t *testing.T) {
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		return 0, nil
+	})
+	// a profile with the "--" opt column, listing an older ip6tables
+	ip6t, err := New(IPFamily(ProtocolIPv6), CommandRunner(runner), CompatibilityProfile("1.8.9-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	fields := ip6t.statFields("       3      180 ACCEPT     tcp      *      *       2001:db8::/32        ::/0                 tcp dpt:22")
+	expected := []string{"3", "180", "ACCEPT", "tcp", "  ", "*", "*", "2001:db8::/32", "::/0", "tcp dpt:22"}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Fatalf("statFields mismatch: \ngot  %q \nneed %q", fields, expected)
+	}
+
+	// truncated lines are returned as is rather than indexed past their end
+	for _, line := range []string{"", "       3      180 ACCEPT", "       3      180 ACCEPT     tcp      *      *       2001:db8::/32"} {
+		if fields := ip6t.statFields(line); len(fields) >= 10 {
+			t.Fatalf("unexpected fields %q for %q", fields, line)
+		}
+		if _, err := ip6t.ParseStat(ip6t.statFields(line)); err == nil {
+			t.Fatalf("expected ParseStat to reject %q", line)
+		}
+	}
+}
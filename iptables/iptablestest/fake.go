@@ -0,0 +1,738 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package iptablestest provides an in-memory implementation of the
+// IPTables method set, for unit testing code that programs iptables
+// without root privileges or a Linux kernel.
+package iptablestest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// builtinChains are the builtin chains of every table, in the order
+// iptables lists them.
+var builtinChains = map[string][]string{
+	"filter":   {"INPUT", "FORWARD", "OUTPUT"},
+	"nat":      {"PREROUTING", "INPUT", "OUTPUT", "POSTROUTING"},
+	"mangle":   {"PREROUTING", "INPUT", "FORWARD", "OUTPUT", "POSTROUTING"},
+	"raw":      {"PREROUTING", "OUTPUT"},
+	"security": {"INPUT", "FORWARD", "OUTPUT"},
+}
+
+// The messages iptables prints on the failures the fake reproduces.
+const (
+	msgNoChain      = "iptables: No chain/target/match by that name.\n"
+	msgNoRule       = "iptables: Bad rule (does a matching rule exist in that chain?).\n"
+	msgChainExists  = "iptables: Chain already exists.\n"
+	msgNotEmpty     = "iptables: Directory not empty.\n"
+	msgReferenced   = "iptables: Too many links.\n"
+	msgBuiltin      = "iptables: Invalid argument. Run `dmesg' for more information.\n"
+	msgBadIndex     = "iptables: Index of insertion too big.\n"
+	msgBadRuleIndex = "iptables: Index of deletion too big.\n"
+)
+
+type fakeChain struct {
+	name    string
+	builtin bool
+	policy  string
+	packets uint64
+	bytes   uint64
+	rules   []iptables.Rule
+}
+
+// Fake is an in-memory stand-in for *iptables.IPTables. All standard
+// tables exist, with their builtin chains and an ACCEPT policy. Rules are
+// stored normalized with iptables.NormalizeRule, so they are listed much
+// like iptables prints them and compared the way iptables -C does.
+//
+// Failures are reported as *iptables.Error with the exit status and
+// message of iptables, so that Error.IsNotExist and ExitStatus work as
+// with the real binary. Stats reports the matches of a rule in -S syntax
+// rather than in the format of iptables -L.
+//
+// A Fake is safe for concurrent use.
+type Fake struct {
+	proto      iptables.Protocol
+	v1, v2, v3 int
+
+	mu     sync.Mutex
+	tables map[string]map[string]*fakeChain
+}
+
+var _ iptables.Interface = &Fake{}
+
+// NewFake returns a Fake of the given family, pretending to be iptables
+// 1.8.9.
+func NewFake(proto iptables.Protocol) *Fake {
+	f := &Fake{proto: proto, v1: 1, v2: 8, v3: 9, tables: map[string]map[string]*fakeChain{}}
+	for table, chains := range builtinChains {
+		f.tables[table] = map[string]*fakeChain{}
+		for _, name := range chains {
+			f.tables[table][name] = &fakeChain{name: name, builtin: true, policy: "ACCEPT"}
+		}
+	}
+	return f
+}
+
+// SetVersion sets the version returned by GetIptablesVersion.
+func (f *Fake) SetVersion(v1, v2, v3 int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.v1, f.v2, f.v3 = v1, v2, v3
+}
+
+// AddCounters simulates traffic by adding to the counters of the rule at
+// pos (1-based) of table/chain, or to the policy counters if pos is 0.
+func (f *Fake) AddCounters(table, chain string, pos int, packets, bytes uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.chain("-Z", table, chain)
+	if err != nil {
+		return err
+	}
+	if pos == 0 {
+		c.packets += packets
+		c.bytes += bytes
+		return nil
+	}
+	if pos < 1 || pos > len(c.rules) {
+		return fakeError([]string{"-t", table, "-Z", chain, strconv.Itoa(pos)}, 1, msgBadRuleIndex)
+	}
+	c.rules[pos-1].Packets += packets
+	c.rules[pos-1].Bytes += bytes
+	return nil
+}
+
+func fakeError(args []string, status int, msg string) *iptables.Error {
+	return iptables.NewError(append([]string{"iptables"}, args...), status, msg)
+}
+
+// table returns the chains of table. Must be called with f.mu held.
+func (f *Fake) table(cmd, table string) (map[string]*fakeChain, error) {
+	chains, ok := f.tables[table]
+	if !ok {
+		return nil, fakeError([]string{"-t", table, cmd}, 3,
+			fmt.Sprintf("iptables v%d.%d.%d: can't initialize iptables table `%s': Table does not exist (do you need to insmod?)\n", f.v1, f.v2, f.v3, table))
+	}
+	return chains, nil
+}
+
+// chain returns table/name. Must be called with f.mu held.
+func (f *Fake) chain(cmd, table, name string) (*fakeChain, error) {
+	chains, err := f.table(cmd, table)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := chains[name]
+	if !ok {
+		return nil, fakeError([]string{"-t", table, cmd, name}, 1, msgNoChain)
+	}
+	return c, nil
+}
+
+// sortedChains returns the chains of table in the order iptables lists
+// them: builtin chains first, then user-defined ones by name.
+func sortedChains(table string, chains map[string]*fakeChain) []*fakeChain {
+	var sorted []*fakeChain
+	for _, name := range builtinChains[table] {
+		sorted = append(sorted, chains[name])
+	}
+	var user []string
+	for name, c := range chains {
+		if !c.builtin {
+			user = append(user, name)
+		}
+	}
+	sort.Strings(user)
+	for _, name := range user {
+		sorted = append(sorted, chains[name])
+	}
+	return sorted
+}
+
+// references counts the rules of table jumping to name.
+func references(chains map[string]*fakeChain, name string) int {
+	n := 0
+	for _, c := range chains {
+		for _, r := range c.rules {
+			if r.Target == name {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// parseRule parses rulespec into the form iptables would print it in.
+func parseRule(chain string, rulespec []string) (iptables.Rule, error) {
+	rule, err := iptables.ParseRulespec(chain, rulespec...)
+	return iptables.NormalizeRule(rule), err
+}
+
+// find returns the index of the first rule of c matching rule, or -1.
+func find(c *fakeChain, rule iptables.Rule) int {
+	key := iptables.NormalizeRule(rule).String()
+	for i, r := range c.rules {
+		if iptables.NormalizeRule(r).String() == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// Proto returns the family of the fake.
+func (f *Fake) Proto() iptables.Protocol {
+	return f.proto
+}
+
+// Exists checks if given rulespec in specified table/chain exists
+func (f *Fake) Exists(table, chain string, rulespec ...string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.chain("-C", table, chain)
+	if err != nil {
+		return false, err
+	}
+	rule, err := parseRule(chain, rulespec)
+	if err != nil {
+		return false, err
+	}
+	return find(c, rule) >= 0, nil
+}
+
+// Insert inserts rulespec to specified table/chain (in specified pos)
+func (f *Fake) Insert(table, chain string, pos int, rulespec ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.chain("-I", table, chain)
+	if err != nil {
+		return err
+	}
+	rule, err := parseRule(chain, rulespec)
+	if err != nil {
+		return err
+	}
+	if pos < 1 || pos > len(c.rules)+1 {
+		return fakeError(append([]string{"-t", table, "-I", chain, strconv.Itoa(pos)}, rulespec...), 1, msgBadIndex)
+	}
+	c.rules = append(c.rules, iptables.Rule{})
+	copy(c.rules[pos:], c.rules[pos-1:])
+	c.rules[pos-1] = rule
+	return nil
+}
+
+// Replace replaces rulespec to specified table/chain (in specified pos)
+func (f *Fake) Replace(table, chain string, pos int, rulespec ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.chain("-R", table, chain)
+	if err != nil {
+		return err
+	}
+	rule, err := parseRule(chain, rulespec)
+	if err != nil {
+		return err
+	}
+	if pos < 1 || pos > len(c.rules) {
+		return fakeError(append([]string{"-t", table, "-R", chain, strconv.Itoa(pos)}, rulespec...), 1, msgBadIndex)
+	}
+	c.rules[pos-1] = rule
+	return nil
+}
+
+// InsertUnique acts like Insert except that it won't insert a duplicate (no matter the position in the chain)
+func (f *Fake) InsertUnique(table, chain string, pos int, rulespec ...string) error {
+	exists, err := f.Exists(table, chain, rulespec...)
+	if err != nil || exists {
+		return err
+	}
+	return f.Insert(table, chain, pos, rulespec...)
+}
+
+// Append appends rulespec to specified table/chain
+func (f *Fake) Append(table, chain string, rulespec ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.chain("-A", table, chain)
+	if err != nil {
+		return err
+	}
+	rule, err := parseRule(chain, rulespec)
+	if err != nil {
+		return err
+	}
+	c.rules = append(c.rules, rule)
+	return nil
+}
+
+// AppendUnique acts like Append except that it won't add a duplicate
+func (f *Fake) AppendUnique(table, chain string, rulespec ...string) error {
+	exists, err := f.Exists(table, chain, rulespec...)
+	if err != nil || exists {
+		return err
+	}
+	return f.Append(table, chain, rulespec...)
+}
+
+// Delete removes rulespec in specified table/chain
+func (f *Fake) Delete(table, chain string, rulespec ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.chain("-D", table, chain)
+	if err != nil {
+		return err
+	}
+	rule, err := parseRule(chain, rulespec)
+	if err != nil {
+		return err
+	}
+	i := find(c, rule)
+	if i < 0 {
+		return fakeError(append([]string{"-t", table, "-D", chain}, rulespec...), 1, msgNoRule)
+	}
+	c.rules = append(c.rules[:i], c.rules[i+1:]...)
+	return nil
+}
+
+// DeleteIfExists removes rulespec in specified table/chain if it exists
+func (f *Fake) DeleteIfExists(table, chain string, rulespec ...string) error {
+	exists, err := f.Exists(table, chain, rulespec...)
+	if err == nil && exists {
+		err = f.Delete(table, chain, rulespec...)
+	}
+	return err
+}
+
+// DeleteById deletes the rule with the specified ID in the given table and chain.
+func (f *Fake) DeleteById(table, chain string, id int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.chain("-D", table, chain)
+	if err != nil {
+		return err
+	}
+	if id < 1 || id > len(c.rules) {
+		return fakeError([]string{"-t", table, "-D", chain, strconv.Itoa(id)}, 1, msgBadRuleIndex)
+	}
+	c.rules = append(c.rules[:id-1], c.rules[id:]...)
+	return nil
+}
+
+// ListById returns the rule with the specified ID in the given table and chain.
+func (f *Fake) ListById(table, chain string, id int) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.chain("-S", table, chain)
+	if err != nil {
+		return "", err
+	}
+	if id < 1 || id > len(c.rules) {
+		return "", fakeError([]string{"-t", table, "-S", chain, strconv.Itoa(id)}, 1, msgBadRuleIndex)
+	}
+	return c.rules[id-1].String(), nil
+}
+
+// chainLines returns the -S lines of c, with counters if requested.
+func chainLines(c *fakeChain, counters bool) []string {
+	head := "-N " + c.name
+	if c.builtin {
+		head = "-P " + c.name + " " + c.policy
+		if counters {
+			head += fmt.Sprintf(" -c %d %d", c.packets, c.bytes)
+		}
+	}
+	lines := []string{head}
+	for _, r := range c.rules {
+		line := r.String()
+		if counters {
+			line += fmt.Sprintf(" -c %d %d", r.Packets, r.Bytes)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func (f *Fake) list(table, chain string, counters bool) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.chain("-S", table, chain)
+	if err != nil {
+		return nil, err
+	}
+	return chainLines(c, counters), nil
+}
+
+// List rules in specified table/chain
+func (f *Fake) List(table, chain string) ([]string, error) {
+	return f.list(table, chain, false)
+}
+
+// ListWithCounters lists rules in specified table/chain, with counters
+func (f *Fake) ListWithCounters(table, chain string) ([]string, error) {
+	return f.list(table, chain, true)
+}
+
+// ListParsed lists the rules of the specified table/chain, including their
+// counters, as structured Rules.
+func (f *Fake) ListParsed(table, chain string) ([]iptables.Rule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.chain("-S", table, chain)
+	if err != nil {
+		return nil, err
+	}
+	return append([]iptables.Rule{}, c.rules...), nil
+}
+
+// ListChains returns a slice containing the name of each chain in the specified table.
+func (f *Fake) ListChains(table string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	chains, err := f.table("-S", table)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, c := range sortedChains(table, chains) {
+		names = append(names, c.name)
+	}
+	return names, nil
+}
+
+// ListTable returns the -S lines of every chain of the specified table,
+// keyed by chain.
+func (f *Fake) ListTable(table string) (map[string][]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	chains, err := f.table("-S", table)
+	if err != nil {
+		return nil, err
+	}
+	lines := map[string][]string{}
+	for name, c := range chains {
+		lines[name] = chainLines(c, false)
+	}
+	return lines, nil
+}
+
+// ListChainsWithInfo returns the chains of the specified table together
+// with their policy, policy counters and number of references.
+func (f *Fake) ListChainsWithInfo(table string) ([]iptables.ChainInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	chains, err := f.table("-L", table)
+	if err != nil {
+		return nil, err
+	}
+	infos := []iptables.ChainInfo{}
+	for _, c := range sortedChains(table, chains) {
+		info := iptables.ChainInfo{Name: c.name, IsBuiltin: c.builtin}
+		if c.builtin {
+			info.Policy, info.Packets, info.Bytes = c.policy, c.packets, c.bytes
+		} else {
+			info.References = references(chains, c.name)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// ChainExists checks whether the chain exists in the specified table.
+func (f *Fake) ChainExists(table, chain string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	chains, err := f.table("-S", table)
+	if err != nil {
+		return false, err
+	}
+	_, ok := chains[chain]
+	return ok, nil
+}
+
+// Stats lists rules including the byte and packet counts, as rows of
+// iptables -L -v output.
+func (f *Fake) Stats(table, chain string) ([][]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.chain("-L", table, chain)
+	if err != nil {
+		return nil, err
+	}
+	anyAddr := "0.0.0.0/0"
+	if f.proto == iptables.ProtocolIPv6 {
+		anyAddr = "::/0"
+	}
+	or := func(value, def string) string {
+		if value == "" {
+			return def
+		}
+		return value
+	}
+	rows := [][]string{}
+	for _, r := range c.rules {
+		var options []string
+		for _, m := range r.Matches {
+			if m.Name != "" {
+				options = append(options, m.Name)
+			}
+			options = append(options, m.Options...)
+		}
+		options = append(options, r.TargetOptions...)
+		rows = append(rows, []string{
+			strconv.FormatUint(r.Packets, 10),
+			strconv.FormatUint(r.Bytes, 10),
+			r.Target,
+			or(r.Protocol, "0"),
+			"--",
+			or(r.InInterface, "*"),
+			or(r.OutInterface, "*"),
+			or(r.Source, anyAddr),
+			or(r.Destination, anyAddr),
+			strings.Join(options, " "),
+		})
+	}
+	return rows, nil
+}
+
+// ParseStat parses a single statistic row into a Stat struct.
+func (f *Fake) ParseStat(stat []string) (iptables.Stat, error) {
+	return (&iptables.IPTables{}).ParseStat(stat)
+}
+
+// StructuredStats returns statistics as structured data.
+func (f *Fake) StructuredStats(table, chain string) ([]iptables.Stat, error) {
+	rows, err := f.Stats(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	stats := []iptables.Stat{}
+	for _, row := range rows {
+		stat, err := f.ParseStat(row)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+// NewChain creates a new chain in the specified table.
+// If the chain already exists, it will result in an error.
+func (f *Fake) NewChain(table, chain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	chains, err := f.table("-N", table)
+	if err != nil {
+		return err
+	}
+	if _, ok := chains[chain]; ok {
+		return fakeError([]string{"-t", table, "-N", chain}, 1, msgChainExists)
+	}
+	chains[chain] = &fakeChain{name: chain}
+	return nil
+}
+
+// ClearChain flushed (deletes all rules) in the specified table/chain.
+// If the chain does not exist, a new one will be created
+func (f *Fake) ClearChain(table, chain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	chains, err := f.table("-F", table)
+	if err != nil {
+		return err
+	}
+	if c, ok := chains[chain]; ok {
+		c.rules = nil
+		return nil
+	}
+	chains[chain] = &fakeChain{name: chain}
+	return nil
+}
+
+// RenameChain renames the old chain to the new one, updating the rules
+// jumping to it.
+func (f *Fake) RenameChain(table, oldChain, newChain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.chain("-E", table, oldChain)
+	if err != nil {
+		return err
+	}
+	chains := f.tables[table]
+	args := []string{"-t", table, "-E", oldChain, newChain}
+	if c.builtin {
+		return fakeError(args, 1, msgBuiltin)
+	}
+	if _, ok := chains[newChain]; ok {
+		return fakeError(args, 1, "iptables: File exists.\n")
+	}
+	delete(chains, oldChain)
+	c.name = newChain
+	chains[newChain] = c
+	for _, other := range chains {
+		for i := range other.rules {
+			if other.rules[i].Target == oldChain {
+				other.rules[i].Target = newChain
+			}
+		}
+	}
+	for i := range c.rules {
+		c.rules[i].Chain = newChain
+	}
+	return nil
+}
+
+// deleteChain deletes an empty, unreferenced user-defined chain. Must be
+// called with f.mu held.
+func (f *Fake) deleteChain(table, name string) error {
+	c, err := f.chain("-X", table, name)
+	if err != nil {
+		return err
+	}
+	chains := f.tables[table]
+	args := []string{"-t", table, "-X", name}
+	switch {
+	case c.builtin:
+		return fakeError(args, 1, msgBuiltin)
+	case references(chains, name) > 0:
+		return fakeError(args, 1, msgReferenced)
+	case len(c.rules) > 0:
+		return fakeError(args, 1, msgNotEmpty)
+	}
+	delete(chains, name)
+	return nil
+}
+
+// DeleteChain deletes the chain in the specified table.
+// The chain must be empty
+func (f *Fake) DeleteChain(table, chain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.deleteChain(table, chain)
+}
+
+// ClearAndDeleteChain flushes and deletes the chain in the specified
+// table, if it exists.
+func (f *Fake) ClearAndDeleteChain(table, chain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	chains, err := f.table("-F", table)
+	if err != nil {
+		return err
+	}
+	c, ok := chains[chain]
+	if !ok {
+		return nil
+	}
+	c.rules = nil
+	return f.deleteChain(table, chain)
+}
+
+// ClearAll flushes every chain of the filter table.
+func (f *Fake) ClearAll() error {
+	return f.FlushTable("filter")
+}
+
+// FlushTable flushes (deletes all rules in) every chain of the specified
+// table. Chains and policies are kept.
+func (f *Fake) FlushTable(table string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	chains, err := f.table("-F", table)
+	if err != nil {
+		return err
+	}
+	for _, c := range chains {
+		c.rules = nil
+	}
+	return nil
+}
+
+// FlushAll flushes every chain of every standard table.
+func (f *Fake) FlushAll() error {
+	for table := range builtinChains {
+		if err := f.FlushTable(table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteAll deletes every user-defined chain of the filter table, which
+// must be empty and unreferenced.
+func (f *Fake) DeleteAll() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range sortedChains("filter", f.tables["filter"]) {
+		if c.builtin {
+			continue
+		}
+		if err := f.deleteChain("filter", c.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChangePolicy changes policy on chain to target
+func (f *Fake) ChangePolicy(table, chain, target string) error {
+	return f.SetPolicy(table, chain, target)
+}
+
+// SetPolicy sets the default policy of the builtin chain in the specified
+// table.
+func (f *Fake) SetPolicy(table, chain, policy string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.chain("-P", table, chain)
+	if err != nil {
+		return err
+	}
+	if !c.builtin || (policy != "ACCEPT" && policy != "DROP") {
+		return fakeError([]string{"-t", table, "-P", chain, policy}, 1, "iptables: Bad built-in chain name.\n")
+	}
+	c.policy = policy
+	return nil
+}
+
+// ChainPolicy returns the default policy of the chain in the specified
+// table, or an empty string for user-defined chains.
+func (f *Fake) ChainPolicy(table, chain string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.chain("-S", table, chain)
+	if err != nil {
+		return "", err
+	}
+	return c.policy, nil
+}
+
+// HasRandomFully returns true, as iptables 1.6.2 and later do.
+func (f *Fake) HasRandomFully() bool {
+	return true
+}
+
+// GetIptablesVersion returns the version set with SetVersion.
+func (f *Fake) GetIptablesVersion() (int, int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.v1, f.v2, f.v3
+}
@@ -0,0 +1,194 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptablestest
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+func TestFake(t *testing.T) {
+	f := NewFake(iptables.ProtocolIPv4)
+
+	if err := f.NewChain("filter", "FOO"); err != nil {
+		t.Fatalf("NewChain failed: %v", err)
+	}
+	err := f.NewChain("filter", "FOO")
+	if e, ok := err.(*iptables.Error); !ok || e.ExitStatus() != 1 {
+		t.Fatalf("expected exit status 1 creating an existing chain, got %v", err)
+	}
+	if err := f.Append("filter", "INPUT", "-j", "FOO"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := f.AppendUnique("filter", "FOO", "-s", "10.1.0.0/16", "-p", "tcp", "--dport", "22", "-j", "ACCEPT"); err != nil {
+		t.Fatalf("AppendUnique failed: %v", err)
+	}
+	// a semantically equal rule is not added twice
+	if err := f.AppendUnique("filter", "FOO", "-s", "10.1.2.3/16", "-p", "tcp", "-m", "tcp", "--dport", "22", "-j", "ACCEPT"); err != nil {
+		t.Fatalf("AppendUnique failed: %v", err)
+	}
+	if err := f.Insert("filter", "FOO", 1, "-d", "192.0.2.1", "-j", "DROP"); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+
+	rules, err := f.List("filter", "FOO")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	expected := []string{
+		"-N FOO",
+		"-A FOO -d 192.0.2.1/32 -j DROP",
+		"-A FOO -s 10.1.0.0/16 -p tcp -m tcp --dport 22 -j ACCEPT",
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("List mismatch: \ngot  %#v \nneed %#v", rules, expected)
+	}
+
+	if err := f.AddCounters("filter", "FOO", 2, 3, 180); err != nil {
+		t.Fatalf("AddCounters failed: %v", err)
+	}
+	stats, err := f.StructuredStats("filter", "FOO")
+	if err != nil {
+		t.Fatalf("StructuredStats failed: %v", err)
+	}
+	if len(stats) != 2 || stats[1].Packets != 3 || stats[1].Source.String() != "10.1.0.0/16" || stats[0].Destination.String() != "192.0.2.1/32" {
+		t.Fatalf("unexpected stats %#v", stats)
+	}
+
+	err = f.DeleteChain("filter", "FOO")
+	if e, ok := err.(*iptables.Error); !ok || e.ExitStatus() != 1 {
+		t.Fatalf("expected an error deleting a referenced chain, got %v", err)
+	}
+	if err := f.Delete("filter", "INPUT", "-j", "FOO"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	err = f.Delete("filter", "INPUT", "-j", "FOO")
+	if e, ok := err.(*iptables.Error); !ok || !e.IsNotExist() {
+		t.Fatalf("expected a not exist error deleting a missing rule, got %v", err)
+	}
+	if err := f.ClearAndDeleteChain("filter", "FOO"); err != nil {
+		t.Fatalf("ClearAndDeleteChain failed: %v", err)
+	}
+	if exists, err := f.ChainExists("filter", "FOO"); err != nil || exists {
+		t.Fatalf("expected FOO to be gone, got %v, %v", exists, err)
+	}
+
+	if err := f.SetPolicy("filter", "INPUT", "DROP"); err != nil {
+		t.Fatalf("SetPolicy failed: %v", err)
+	}
+	if policy, err := f.ChainPolicy("filter", "INPUT"); err != nil || policy != "DROP" {
+		t.Fatalf("expected policy DROP, got %v, %v", policy, err)
+	}
+
+	_, err = f.List("nope", "INPUT")
+	if e, ok := err.(*iptables.Error); !ok || !e.IsNotExist() {
+		t.Fatalf("expected a not exist error for a missing table, got %v", err)
+	}
+}
+
+func TestLoadAndAssertSave(t *testing.T) {
+	f := NewFake(iptables.ProtocolIPv4)
+	err := f.Load(`*filter
+:INPUT DROP [5:300]
+:AGENT - [0:0]
+[3:180] -A INPUT -i lo -j ACCEPT
+-A INPUT -j AGENT
+-A AGENT -s 10.0.0.1 -j ACCEPT
+COMMIT
+`)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := f.Insert("filter", "AGENT", 1, "-s", "10.0.0.2/32", "-j", "ACCEPT"); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+
+	expected := `*filter
+:INPUT DROP [5:300]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:AGENT - [0:0]
+[3:180] -A INPUT -i lo -j ACCEPT
+[0:0] -A INPUT -j AGENT
+[0:0] -A AGENT -s 10.0.0.2/32 -j ACCEPT
+[0:0] -A AGENT -s 10.0.0.1/32 -j ACCEPT
+COMMIT
+`
+	if actual := f.Save("filter"); actual != expected {
+		t.Fatalf("Save mismatch: \ngot\n%s\nneed\n%s", actual, expected)
+	}
+
+	f.AssertSave(t, `*filter
+:INPUT DROP
+:AGENT -
+-A INPUT -i lo -j ACCEPT
+-A INPUT -j AGENT
+-A AGENT -s 10.0.0.2 -j ACCEPT
+-A AGENT -s 10.0.0.1 -j ACCEPT
+COMMIT
+`)
+
+	mock := &testing.T{}
+	f.AssertSave(mock, `*filter
+:INPUT DROP
+:AGENT -
+-A INPUT -i lo -j ACCEPT
+-A INPUT -j AGENT
+-A AGENT -s 10.0.0.1 -j ACCEPT
+-A AGENT -s 10.0.0.2 -j ACCEPT
+COMMIT
+`)
+	if !mock.Failed() {
+		t.Fatalf("AssertSave did not catch the wrong rule order")
+	}
+
+	if err := f.Load("*filter\n:FOO DROP\nCOMMIT\n"); err == nil {
+		t.Fatalf("expected an error for a policy on a user-defined chain")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	f := NewFake(iptables.ProtocolIPv4)
+	ops := []iptables.Operation{
+		{Kind: "new-chain", Table: "filter", Chain: "FOO"},
+		{Kind: "append", Table: "filter", Chain: "FOO", Rulespec: []string{"-s", "10.0.0.0/8", "-j", "ACCEPT"}},
+		{Kind: "insert", Table: "filter", Chain: "FOO", Pos: 1, Rulespec: []string{"-j", "LOG"}},
+		{Kind: "delete", Table: "filter", Chain: "FOO", Pos: 1},
+		{Kind: "policy", Table: "filter", Chain: "INPUT", Policy: "DROP"},
+		{Kind: "zero", Table: "filter"},
+	}
+	if err := iptables.Replay(f, ops); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	rules, err := f.List("filter", "FOO")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	expected := []string{"-N FOO", "-A FOO -s 10.0.0.0/8 -j ACCEPT"}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("List mismatch: \ngot  %#v \nneed %#v", rules, expected)
+	}
+	if policy, _ := f.ChainPolicy("filter", "INPUT"); policy != "DROP" {
+		t.Fatalf("expected the DROP policy, got %q", policy)
+	}
+
+	err = iptables.Replay(f, []iptables.Operation{{Kind: "delete-chain", Table: "filter", Chain: "BAR"}})
+	if err == nil || !strings.HasPrefix(err.Error(), "delete-chain filter/BAR: ") {
+		t.Fatalf("expected the failing operation in the error, got %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptablestest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// Load replaces the state of the tables found in save, iptables-save
+// output, as iptables-restore would: their user-defined chains are
+// deleted, builtin chains take the given policies (ACCEPT if not listed)
+// and the rules and counters are loaded. Other tables are left untouched.
+// It lets table-driven tests start from a readable fixture:
+//
+//	f := iptablestest.NewFake(iptables.ProtocolIPv4)
+//	if err := f.Load(`*filter
+//	:INPUT DROP [0:0]
+//	-A INPUT -i lo -j ACCEPT
+//	COMMIT
+//	`); err != nil {
+//		t.Fatal(err)
+//	}
+func (f *Fake) Load(save string) error {
+	rulesets, err := iptables.ParseSave(save)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, rs := range rulesets {
+		if _, ok := builtinChains[rs.Table]; !ok {
+			return fmt.Errorf("unknown table %s", rs.Table)
+		}
+		chains := map[string]*fakeChain{}
+		for _, name := range builtinChains[rs.Table] {
+			chains[name] = &fakeChain{name: name, builtin: true, policy: "ACCEPT"}
+		}
+		for _, c := range rs.Chains {
+			fc, ok := chains[c.Name]
+			switch {
+			case ok:
+				fc.policy = c.Policy
+				fc.packets, fc.bytes = c.Packets, c.Bytes
+			case c.Policy != "-":
+				return fmt.Errorf("%s is not a builtin chain of table %s", c.Name, rs.Table)
+			default:
+				fc = &fakeChain{name: c.Name}
+				chains[c.Name] = fc
+			}
+		}
+		for _, c := range rs.Chains {
+			for _, r := range c.Rules {
+				chains[c.Name].rules = append(chains[c.Name].rules, iptables.NormalizeRule(r))
+				// NormalizeRule drops the counters
+				last := &chains[c.Name].rules[len(chains[c.Name].rules)-1]
+				last.Packets, last.Bytes = r.Packets, r.Bytes
+			}
+		}
+		f.tables[rs.Table] = chains
+	}
+	return nil
+}
+
+// Save returns the state of the given tables, or of every table if none
+// is given, in iptables-save format with counters. Tables are listed in
+// alphabetical order and chains in the order iptables lists them.
+func (f *Fake) Save(tables ...string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(tables) == 0 {
+		for table := range f.tables {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+	}
+	var b strings.Builder
+	for _, table := range tables {
+		chains, ok := f.tables[table]
+		if !ok {
+			continue
+		}
+		sorted := sortedChains(table, chains)
+		fmt.Fprintf(&b, "*%s\n", table)
+		for _, c := range sorted {
+			policy := "-"
+			if c.builtin {
+				policy = c.policy
+			}
+			fmt.Fprintf(&b, ":%s %s [%d:%d]\n", c.name, policy, c.packets, c.bytes)
+		}
+		for _, c := range sorted {
+			for _, r := range c.rules {
+				fmt.Fprintf(&b, "[%d:%d] %s\n", r.Packets, r.Bytes, r.String())
+			}
+		}
+		b.WriteString("COMMIT\n")
+	}
+	return b.String()
+}
+
+// AssertSave fails t unless the tables found in expected, iptables-save
+// output, are in the same state in f. Counters are ignored, and both sides
+// are normalized the way the Fake stores rules, so expected may be written
+// with the same liberties as a Load fixture, e.g. omitting builtin chains
+// with an ACCEPT policy. The order of the rules matters.
+func (f *Fake) AssertSave(t testing.TB, expected string) {
+	t.Helper()
+	want := NewFake(f.proto)
+	if err := want.Load(expected); err != nil {
+		t.Fatalf("invalid expected ruleset: %v", err)
+	}
+	rulesets, _ := iptables.ParseSave(expected)
+	var tables []string
+	for _, rs := range rulesets {
+		tables = append(tables, rs.Table)
+	}
+	got, wanted := stripCounters(f.Save(tables...)), stripCounters(want.Save(tables...))
+	if got != wanted {
+		t.Errorf("unexpected ruleset:\n%s\nwant:\n%s", got, wanted)
+	}
+}
+
+// stripCounters removes the counters from Save output.
+func stripCounters(save string) string {
+	lines := strings.Split(save, "\n")
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, ":"):
+			if j := strings.LastIndex(line, " ["); j >= 0 {
+				lines[i] = line[:j]
+			}
+		case strings.HasPrefix(line, "["):
+			if j := strings.Index(line, "] "); j >= 0 {
+				lines[i] = line[j+2:]
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"strings"
+)
+
+// LabeledStat is the counters of a single rule together with its location
+// and the labels found in its comment, flattened for metrics exporters.
+type LabeledStat struct {
+	Table string `json:"table"`
+	Chain string `json:"chain"`
+	// Pos is the 1-based position of the rule in its chain
+	Pos     int    `json:"pos"`
+	Target  string `json:"target,omitempty"`
+	Packets uint64 `json:"pkts"`
+	Bytes   uint64 `json:"bytes"`
+	Comment string `json:"comment,omitempty"`
+	// Labels holds the key=value pairs of the comment
+	Labels map[string]string `json:"labels,omitempty"`
+	// Rule is the rule as printed by iptables -S
+	Rule string `json:"rule"`
+}
+
+// LabeledStats returns the counters of every rule of the specified table,
+// with a single iptables-save invocation. Comments made of key=value pairs
+// separated by commas or spaces, e.g. "app=web,team=edge", are parsed into
+// Labels; other words of the comment are ignored there.
+func (ipt *IPTables) LabeledStats(table string) ([]LabeledStat, error) {
+	rs, err := ipt.SaveRuleset(table)
+	if err != nil {
+		return nil, err
+	}
+	return labeledStats(rs), nil
+}
+
+func labeledStats(rs *Ruleset) []LabeledStat {
+	stats := []LabeledStat{}
+	for _, c := range rs.Chains {
+		for i, r := range c.Rules {
+			comment := ruleComment(r)
+			stats = append(stats, LabeledStat{
+				Table:   rs.Table,
+				Chain:   c.Name,
+				Pos:     i + 1,
+				Target:  r.Target,
+				Packets: r.Packets,
+				Bytes:   r.Bytes,
+				Comment: comment,
+				Labels:  parseLabels(comment),
+				Rule:    r.String(),
+			})
+		}
+	}
+	return stats
+}
+
+// ruleComment returns the comment of rule, or "" if it has none.
+func ruleComment(rule Rule) string {
+	for _, m := range rule.Matches {
+		if m.Name != "comment" {
+			continue
+		}
+		for i := 0; i+1 < len(m.Options); i++ {
+			if m.Options[i] == "--comment" {
+				return m.Options[i+1]
+			}
+		}
+	}
+	return ""
+}
+
+// parseLabels returns the key=value pairs of comment, or nil if there are
+// none.
+func parseLabels(comment string) map[string]string {
+	var labels map[string]string
+	fields := strings.FieldsFunc(comment, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	for _, field := range fields {
+		i := strings.IndexByte(field, '=')
+		if i <= 0 {
+			continue
+		}
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[field[:i]] = field[i+1:]
+	}
+	return labels
+}
@@ -0,0 +1,46 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLabeledStats(t *testing.T) {
+	rulesets, err := ParseSave(`*filter
+:INPUT ACCEPT [0:0]
+:WEB - [0:0]
+[10:600] -A INPUT -j WEB
+[7:420] -A WEB -p tcp -m tcp --dport 443 -m comment --comment "app=web,team=edge tls" -j ACCEPT
+COMMIT
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []LabeledStat{
+		{Table: "filter", Chain: "INPUT", Pos: 1, Target: "WEB", Packets: 10, Bytes: 600, Rule: "-A INPUT -j WEB"},
+		{
+			Table: "filter", Chain: "WEB", Pos: 1, Target: "ACCEPT", Packets: 7, Bytes: 420,
+			Comment: "app=web,team=edge tls",
+			Labels:  map[string]string{"app": "web", "team": "edge"},
+			Rule:    `-A WEB -p tcp -m tcp --dport 443 -m comment --comment "app=web,team=edge tls" -j ACCEPT`,
+		},
+	}
+	if stats := labeledStats(&rulesets[0]); !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("labeledStats mismatch: \ngot  %#v \nneed %#v", stats, expected)
+	}
+}
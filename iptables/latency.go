@@ -0,0 +1,73 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"sync"
+	"time"
+)
+
+// latencyAlpha is the weight of the newest sample in the moving averages.
+const latencyAlpha = 0.2
+
+// LatencyStat summarizes the recent latency of one operation.
+type LatencyStat struct {
+	// Average is an exponential moving average favoring recent samples
+	Average time.Duration
+	// Last is the latency of the latest invocation
+	Last  time.Duration
+	Count uint64
+}
+
+// latencyTracker keeps a LatencyStat per operation.
+type latencyTracker struct {
+	mu    sync.Mutex
+	stats map[string]LatencyStat
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{stats: map[string]LatencyStat{}}
+}
+
+func (l *latencyTracker) observe(op string, elapsed time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.stats[op]
+	if s.Count == 0 {
+		s.Average = elapsed
+	} else {
+		s.Average += time.Duration(latencyAlpha * float64(elapsed-s.Average))
+	}
+	s.Last = elapsed
+	s.Count++
+	l.stats[op] = s
+}
+
+// LatencyStats returns the recent latency of every operation the handle
+// ran, keyed by operation as reported to a MetricsRecorder (e.g. "append",
+// "delete", "list" or "restore"). Callers can use it to adapt, e.g. by
+// switching to a Batcher when appends get slow under contention.
+func (ipt *IPTables) LatencyStats() map[string]LatencyStat {
+	stats := map[string]LatencyStat{}
+	if ipt.latency == nil {
+		return stats
+	}
+	ipt.latency.mu.Lock()
+	defer ipt.latency.mu.Unlock()
+	for op, s := range ipt.latency.stats {
+		stats[op] = s
+	}
+	return stats
+}
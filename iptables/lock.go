@@ -73,10 +73,10 @@ func (l *fileLock) Unlock() error {
 	return syscall.Close(l.fd)
 }
 
-// newXtablesFileLock opens a new lock on the xtables lockfile without
-// acquiring the lock
-func newXtablesFileLock() (*fileLock, error) {
-	fd, err := syscall.Open(xtablesLockFilePath, os.O_CREATE, defaultFilePerm)
+// newXtablesFileLock opens a new lock on the xtables lockfile at path
+// without acquiring the lock
+func newXtablesFileLock(path string) (*fileLock, error) {
+	fd, err := syscall.Open(path, os.O_CREATE, defaultFilePerm)
 	if err != nil {
 		return nil, err
 	}
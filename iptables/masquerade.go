@@ -0,0 +1,98 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"net"
+)
+
+// MasqueradeOption configures EnsureMasquerade.
+type MasqueradeOption func(*masqueradeConfig)
+
+type masqueradeConfig struct {
+	randomFully bool
+}
+
+// MasqueradeRandomFully adds --random-fully to the rule if iptables
+// supports it, and leaves it out otherwise.
+func MasqueradeRandomFully() MasqueradeOption {
+	return func(c *masqueradeConfig) {
+		c.randomFully = true
+	}
+}
+
+// masqueradeRules returns the rulespec of the MASQUERADE rule of the
+// packets from srcCIDR leaving through outInterface, without and with
+// --random-fully.
+func (ipt *IPTables) masqueradeRules(srcCIDR, outInterface string) (plain, randomFully []string, err error) {
+	ip, src, err := net.ParseCIDR(srcCIDR)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !addrFamily(ipt.proto, ip) {
+		return nil, nil, fmt.Errorf("%s is not of the handle's family", srcCIDR)
+	}
+	match := []string{"-s", src.String()}
+	if outInterface != "" {
+		match = append(match, "-o", outInterface)
+	}
+	plain = append(append([]string(nil), match...), "-j", "MASQUERADE")
+	randomFully = append(append([]string(nil), plain...), "--random-fully")
+	return plain, randomFully, nil
+}
+
+// EnsureMasquerade makes sure that the packets from srcCIDR leaving
+// through outInterface ("" for any) are masqueraded, with a rule appended
+// to nat/POSTROUTING unless it exists. A rule differing only by
+// --random-fully is replaced.
+func (ipt *IPTables) EnsureMasquerade(srcCIDR, outInterface string, opts ...MasqueradeOption) error {
+	var cfg masqueradeConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	want, other, err := ipt.masqueradeRules(srcCIDR, outInterface)
+	if err != nil {
+		return err
+	}
+	if cfg.randomFully && ipt.hasRandomFully {
+		want, other = other, want
+	}
+	if err := ipt.AppendUnique(TableNAT, ChainPostrouting, want...); err != nil {
+		return err
+	}
+	if !ipt.hasRandomFully {
+		// the other rule cannot exist
+		return nil
+	}
+	return ipt.DeleteIfExists(TableNAT, ChainPostrouting, other...)
+}
+
+// RemoveMasquerade removes the rule installed by EnsureMasquerade for
+// srcCIDR and outInterface, with or without --random-fully. A missing rule
+// is not an error.
+func (ipt *IPTables) RemoveMasquerade(srcCIDR, outInterface string) error {
+	plain, randomFully, err := ipt.masqueradeRules(srcCIDR, outInterface)
+	if err != nil {
+		return err
+	}
+	if err := ipt.DeleteIfExists(TableNAT, ChainPostrouting, plain...); err != nil {
+		return err
+	}
+	if !ipt.hasRandomFully {
+		return nil
+	}
+	return ipt.DeleteIfExists(TableNAT, ChainPostrouting, randomFully...)
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMasquerade(t *testing.T) {
+	rt := &ruleTable{rules: map[string][]string{}}
+	ipt, err := New(CommandRunner(rt), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := ipt.EnsureMasquerade("10.1.2.3/16", "eth0"); err != nil {
+		t.Fatalf("EnsureMasquerade failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := ipt.EnsureMasquerade("10.1.0.0/16", "eth0", MasqueradeRandomFully()); err != nil {
+			t.Fatalf("EnsureMasquerade failed: %v", err)
+		}
+	}
+	expected := []string{"-s 10.1.0.0/16 -o eth0 -j MASQUERADE --random-fully"}
+	if !reflect.DeepEqual(rt.rules["nat/POSTROUTING"], expected) {
+		t.Fatalf("got %q, need %q", rt.rules["nat/POSTROUTING"], expected)
+	}
+	if err := ipt.RemoveMasquerade("10.1.0.0/16", "eth0"); err != nil {
+		t.Fatalf("RemoveMasquerade failed: %v", err)
+	}
+	if len(rt.rules["nat/POSTROUTING"]) != 0 {
+		t.Fatalf("rules left behind: %q", rt.rules)
+	}
+
+	// without support, --random-fully is left out
+	old, err := New(CommandRunner(rt), CompatibilityProfile("1.6.1-legacy"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := old.EnsureMasquerade("10.1.0.0/16", "", MasqueradeRandomFully()); err != nil {
+		t.Fatalf("EnsureMasquerade failed: %v", err)
+	}
+	expected = []string{"-s 10.1.0.0/16 -j MASQUERADE"}
+	if !reflect.DeepEqual(rt.rules["nat/POSTROUTING"], expected) {
+		t.Fatalf("got %q, need %q", rt.rules["nat/POSTROUTING"], expected)
+	}
+
+	if err := ipt.EnsureMasquerade("fd00::/64", "eth0"); err == nil {
+		t.Fatalf("expected an error for an address of the other family")
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ctStates are the states accepted by --ctstate, in the order iptables
+// lists them.
+var ctStates = []string{"INVALID", "NEW", "RELATED", "ESTABLISHED", "UNTRACKED", "SNAT", "DNAT"}
+
+var validCtStates = func() map[string]bool {
+	m := map[string]bool{}
+	for _, s := range ctStates {
+		m[s] = true
+	}
+	return m
+}()
+
+// ConntrackMatch returns the rulespec fragment matching the connection
+// tracking states given, e.g. "-m conntrack --ctstate RELATED,ESTABLISHED".
+// States are case insensitive, and are written once each in the order
+// iptables lists them in, so that the rule compares equal once listed.
+func ConntrackMatch(states ...string) ([]string, error) {
+	if len(states) == 0 {
+		return nil, fmt.Errorf("conntrack match requires at least one state")
+	}
+	seen := map[string]bool{}
+	for _, s := range states {
+		s = strings.ToUpper(s)
+		if !validCtStates[s] {
+			return nil, fmt.Errorf("unknown conntrack state %q", s)
+		}
+		seen[s] = true
+	}
+	var ordered []string
+	for _, s := range ctStates {
+		if seen[s] {
+			ordered = append(ordered, s)
+		}
+	}
+	return []string{"-m", "conntrack", "--ctstate", strings.Join(ordered, ",")}, nil
+}
+
+// PortRange is a port, or a range of ports from First to Last inclusive.
+// Leaving Last unset selects First alone, and the zero value any port.
+type PortRange struct {
+	First, Last uint16
+}
+
+// Port returns the PortRange of a single port.
+func Port(port uint16) PortRange {
+	return PortRange{First: port}
+}
+
+// isAny reports whether r is the zero value, matching any port.
+func (r PortRange) isAny() bool {
+	return r == PortRange{}
+}
+
+// single reports whether r holds a single port.
+func (r PortRange) single() bool {
+	return r.Last == 0 || r.Last == r.First
+}
+
+// String formats r as iptables does, "port" or "first:last".
+func (r PortRange) String() string {
+	if r.single() {
+		return strconv.Itoa(int(r.First))
+	}
+	return fmt.Sprintf("%d:%d", r.First, r.Last)
+}
+
+// validate returns an error if r is an empty range.
+func (r PortRange) validate() error {
+	if !r.single() && r.Last < r.First {
+		return fmt.Errorf("invalid port range %d:%d", r.First, r.Last)
+	}
+	return nil
+}
+
+// PortDirection selects the ports a match applies to.
+type PortDirection string
+
+const (
+	// SourcePorts matches the source ports (--sports, --sport)
+	SourcePorts PortDirection = "s"
+	// DestinationPorts matches the destination ports (--dports, --dport)
+	DestinationPorts PortDirection = "d"
+)
+
+// maxMultiport is the number of ports a multiport match accepts, a range
+// counting as two.
+const maxMultiport = 15
+
+// multiportProtocols are the protocols the multiport match supports.
+var multiportProtocols = map[string]bool{"tcp": true, "udp": true, "udplite": true, "sctp": true, "dccp": true}
+
+// MultiportMatch returns the rulespec fragment matching the packets of
+// protocol to or from any of ports, e.g.
+// "-p tcp -m multiport --dports 80,443,8000:8080". Ports are sorted and
+// deduplicated, and may count at most 15 entries, a range counting as two,
+// as iptables requires.
+func MultiportMatch(protocol string, dir PortDirection, ports ...PortRange) ([]string, error) {
+	if !multiportProtocols[protocol] {
+		return nil, fmt.Errorf("multiport match does not support protocol %q", protocol)
+	}
+	if dir != SourcePorts && dir != DestinationPorts {
+		return nil, fmt.Errorf("unknown port direction %q", dir)
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("multiport match requires at least one port")
+	}
+	sorted := append([]PortRange(nil), ports...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].First != sorted[j].First {
+			return sorted[i].First < sorted[j].First
+		}
+		return sorted[i].Last < sorted[j].Last
+	})
+	var list []string
+	entries := 0
+	for i, r := range sorted {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+		if i > 0 && r.String() == sorted[i-1].String() {
+			continue
+		}
+		entries++
+		if !r.single() {
+			entries++
+		}
+		list = append(list, r.String())
+	}
+	if entries > maxMultiport {
+		return nil, fmt.Errorf("multiport match takes at most %d ports, got %d", maxMultiport, entries)
+	}
+	return []string{"-p", protocol, "-m", "multiport", "--" + string(dir) + "ports", strings.Join(list, ",")}, nil
+}
+
+// portMatch returns the rulespec fragment of the tcp or udp match.
+func portMatch(protocol string, sport, dport PortRange) ([]string, error) {
+	spec := []string{"-p", protocol, "-m", protocol}
+	for _, p := range []struct {
+		flag string
+		r    PortRange
+	}{{"--sport", sport}, {"--dport", dport}} {
+		if p.r.isAny() {
+			continue
+		}
+		if err := p.r.validate(); err != nil {
+			return nil, err
+		}
+		spec = append(spec, p.flag, p.r.String())
+	}
+	return spec, nil
+}
+
+// TCPMatch returns the rulespec fragment matching TCP packets from sport
+// to dport, e.g. "-p tcp -m tcp --dport 22". A zero PortRange matches any
+// port.
+func TCPMatch(sport, dport PortRange) ([]string, error) {
+	return portMatch("tcp", sport, dport)
+}
+
+// UDPMatch returns the rulespec fragment matching UDP packets from sport
+// to dport, e.g. "-p udp -m udp --dport 53". A zero PortRange matches any
+// port.
+func UDPMatch(sport, dport PortRange) ([]string, error) {
+	return portMatch("udp", sport, dport)
+}
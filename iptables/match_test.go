@@ -0,0 +1,85 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConntrackMatch(t *testing.T) {
+	spec, err := ConntrackMatch("established", "RELATED", "ESTABLISHED")
+	if err != nil {
+		t.Fatalf("ConntrackMatch failed: %v", err)
+	}
+	expected := []string{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED"}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Fatalf("got %q, need %q", spec, expected)
+	}
+	if _, err := ConntrackMatch("CONNECTED"); err == nil {
+		t.Fatalf("expected an error for an unknown state")
+	}
+	if _, err := ConntrackMatch(); err == nil {
+		t.Fatalf("expected an error without states")
+	}
+}
+
+func TestMultiportMatch(t *testing.T) {
+	spec, err := MultiportMatch("tcp", DestinationPorts, Port(443), PortRange{8000, 8080}, Port(80), Port(443))
+	if err != nil {
+		t.Fatalf("MultiportMatch failed: %v", err)
+	}
+	expected := []string{"-p", "tcp", "-m", "multiport", "--dports", "80,443,8000:8080"}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Fatalf("got %q, need %q", spec, expected)
+	}
+
+	var ports []PortRange
+	for p := uint16(1); p <= 15; p++ {
+		ports = append(ports, Port(p))
+	}
+	if _, err := MultiportMatch("udp", SourcePorts, ports...); err != nil {
+		t.Fatalf("15 ports should be accepted: %v", err)
+	}
+	ports[0] = PortRange{100, 200}
+	if _, err := MultiportMatch("udp", SourcePorts, ports...); err == nil {
+		t.Fatalf("expected an error for 16 entries")
+	}
+	if _, err := MultiportMatch("icmp", SourcePorts, Port(1)); err == nil {
+		t.Fatalf("expected an error for a protocol without ports")
+	}
+	if _, err := MultiportMatch("tcp", DestinationPorts, PortRange{90, 80}); err == nil {
+		t.Fatalf("expected an error for an empty range")
+	}
+}
+
+func TestPortMatch(t *testing.T) {
+	spec, err := TCPMatch(PortRange{1024, 65535}, Port(22))
+	if err != nil {
+		t.Fatalf("TCPMatch failed: %v", err)
+	}
+	expected := []string{"-p", "tcp", "-m", "tcp", "--sport", "1024:65535", "--dport", "22"}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Fatalf("got %q, need %q", spec, expected)
+	}
+	spec, err = UDPMatch(PortRange{}, Port(53))
+	if err != nil {
+		t.Fatalf("UDPMatch failed: %v", err)
+	}
+	expected = []string{"-p", "udp", "-m", "udp", "--dport", "53"}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Fatalf("got %q, need %q", spec, expected)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MetricsRecorder receives measurements of the commands run by a handle,
+// e.g. to export them as Prometheus counters and histograms. Its methods
+// are called synchronously and concurrently, so they must be cheap and
+// safe for concurrent use.
+type MetricsRecorder interface {
+	// ObserveExec is called after every invocation of iptables,
+	// iptables-restore or iptables-save with the operation (e.g. "append",
+	// "list", "restore"), how long it ran and its exit status, which is 0
+	// on success and -1 if the command could not be run at all.
+	ObserveExec(op string, duration time.Duration, exitStatus int)
+
+	// ObserveLockWait is called when an invocation had to wait for, or
+	// gave up on, the xtables lock held by another process.
+	ObserveLockWait(op string)
+}
+
+// Metrics makes the handle report every command it runs to m.
+func Metrics(m MetricsRecorder) option {
+	return func(ipt *IPTables) {
+		ipt.metrics = m
+	}
+}
+
+// execOperations maps the iptables commands to the operation names
+// reported to a MetricsRecorder.
+var execOperations = map[string]string{
+	"-A":        "append",
+	"-C":        "check",
+	"-D":        "delete",
+	"-E":        "rename-chain",
+	"-F":        "flush",
+	"-I":        "insert",
+	"-L":        "list",
+	"-N":        "new-chain",
+	"-P":        "policy",
+	"-R":        "replace",
+	"-S":        "list",
+	"-X":        "delete-chain",
+	"-Z":        "zero",
+	"--version": "version",
+}
+
+// execOperation returns the operation performed by the command line args.
+func execOperation(args []string) string {
+	base := filepath.Base(args[0])
+	switch {
+	case strings.HasSuffix(base, "-restore"):
+		return "restore"
+	case strings.HasSuffix(base, "-save"):
+		return "save"
+	case strings.HasSuffix(base, "-translate"):
+		return "translate"
+	}
+	for _, arg := range args[1:] {
+		if op, ok := execOperations[arg]; ok {
+			return op
+		}
+	}
+	return "other"
+}
+
+// observeExec records the latency of an invocation and reports it to the
+// handle's MetricsRecorder, if any.
+func (ipt *IPTables) observeExec(args []string, start time.Time, err error, stderr string) {
+	if ipt.metrics == nil && ipt.latency == nil {
+		return
+	}
+	op := execOperation(args)
+	elapsed := time.Since(start)
+	if ipt.latency != nil {
+		ipt.latency.observe(op, elapsed)
+	}
+	if ipt.metrics == nil {
+		return
+	}
+	ipt.metrics.ObserveExec(op, elapsed, exitStatus(err))
+	// iptables reports on stderr every time it waits for the lock, even
+	// when it eventually succeeds
+	if strings.Contains(stderr, "xtables lock") {
+		ipt.metrics.ObserveLockWait(op)
+	}
+}
+
+// exitStatus returns the exit status of a command that returned err, or -1
+// if it could not be run at all.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(*Error); ok {
+		return e.ExitStatus()
+	}
+	return -1
+}
@@ -0,0 +1,195 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ErrModuleMissing is matched by errors.Is for the errors due to a kernel
+// module that isn't loaded: *ModuleMissingError, and the *Error of
+// commands failing for that reason (see Error.MissingModule).
+var ErrModuleMissing = errors.New("kernel module missing")
+
+// ModuleMissingError is returned by Preflight and EnsureModules for a
+// kernel module that is not loaded.
+type ModuleMissingError struct {
+	Module string
+	// Err is the error of modprobe, if it was run
+	Err error
+}
+
+func (e *ModuleMissingError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("kernel module %s missing: %v", e.Module, e.Err)
+	}
+	return fmt.Sprintf("kernel module %s missing", e.Module)
+}
+
+// Is makes errors.Is(err, ErrModuleMissing) succeed.
+func (e *ModuleMissingError) Is(target error) bool {
+	return target == ErrModuleMissing
+}
+
+func (e *ModuleMissingError) Unwrap() error {
+	return e.Err
+}
+
+// Modprobe sets the modprobe binary iptables runs to load the modules it
+// needs (--modprobe) and EnsureModules runs. By default iptables uses the
+// one of the kernel (/proc/sys/kernel/modprobe) and EnsureModules looks up
+// "modprobe".
+func Modprobe(path string) option {
+	return func(ipt *IPTables) {
+		ipt.modprobe = path
+	}
+}
+
+// missingTableRegex matches the messages of the legacy iptables for a
+// table whose kernel module is not loaded, e.g.
+//
+//	iptables v1.6.1: can't initialize iptables table `nat': Table does not exist (do you need to insmod?)
+var missingTableRegex = regexp.MustCompile("can't initialize (ip6?)tables table `([^']+)': Table does not exist \\(do you need to insmod\\?\\)")
+
+// missingExtensionRegex matches the messages of iptables for an extension
+// whose kernel module is not loaded, e.g.
+//
+//	iptables v1.6.1: Couldn't load match `conntrack':No such file or directory
+//	iptables v1.8.7 (nf_tables): Couldn't load target `MASQUERADE':No such file or directory
+//	Extension conntrack revision 0 not supported, missing kernel module?
+var missingExtensionRegex = regexp.MustCompile("Couldn't load (?:match|target) `([^']+)'|Extension (\\S+) revision \\d+ not supported, missing kernel module")
+
+// MissingModule returns the kernel module the failure of the command is
+// attributed to, e.g. "iptable_nat" or "xt_conntrack", or "" if it isn't
+// due to a missing module.
+func (e *Error) MissingModule() string {
+	if m := missingTableRegex.FindStringSubmatch(e.msg); m != nil {
+		return m[1] + "table_" + m[2]
+	}
+	if m := missingExtensionRegex.FindStringSubmatch(e.msg); m != nil {
+		return "xt_" + m[1] + m[2]
+	}
+	return ""
+}
+
+// tableModule returns the module providing table with the legacy backend.
+func tableModule(proto Protocol, table string) string {
+	if proto == ProtocolIPv6 {
+		return "ip6table_" + table
+	}
+	return "iptable_" + table
+}
+
+// Preflight checks that the given tables can be used, returning a
+// *ModuleMissingError for the first one whose module is missing, or
+// another error if a table is unavailable for another reason.
+func (ipt *IPTables) Preflight(tables ...string) error {
+	for _, table := range tables {
+		_, err := ipt.executeList([]string{"-t", table, "-S"})
+		if err == nil {
+			continue
+		}
+		var eerr *Error
+		if errors.As(err, &eerr) && eerr.IsTableUnavailable() {
+			module := eerr.MissingModule()
+			if module == "" {
+				module = tableModule(ipt.proto, table)
+			}
+			return &ModuleMissingError{Module: module}
+		}
+		return err
+	}
+	return nil
+}
+
+// EnsureModules loads the given kernel modules that are neither loaded
+// nor built into the kernel with modprobe, returning a *ModuleMissingError
+// for the first one that could not be loaded. It needs the privileges to
+// load modules; in a container, the modules must be loaded by the host.
+func (ipt *IPTables) EnsureModules(modules ...string) error {
+	loaded, err := ipt.loadedModules()
+	if err != nil {
+		return err
+	}
+	modprobe := ipt.modprobe
+	if modprobe == "" {
+		modprobe = "modprobe"
+	}
+	for _, module := range modules {
+		if loaded[moduleName(module)] {
+			continue
+		}
+		if err := ipt.runCommand([]string{modprobe, "--", module}, nil, nil); err != nil {
+			return &ModuleMissingError{Module: module, Err: err}
+		}
+	}
+	return nil
+}
+
+// moduleName returns the canonical name of a module, as listed by
+// /proc/modules: dashes and underscores are interchangeable.
+func moduleName(module string) string {
+	return strings.ReplaceAll(module, "-", "_")
+}
+
+// loadedModules returns the modules loaded (/proc/modules) or built into
+// the running kernel (modules.builtin), read where the commands of the
+// handle run.
+func (ipt *IPTables) loadedModules() (map[string]bool, error) {
+	var out bytes.Buffer
+	if err := ipt.runCommand([]string{"cat", "/proc/modules"}, nil, &out); err != nil {
+		return nil, err
+	}
+	loaded := parseModules(out.String(), false)
+
+	out.Reset()
+	if err := ipt.runCommand([]string{"cat", "/proc/sys/kernel/osrelease"}, nil, &out); err != nil {
+		return nil, err
+	}
+	release := strings.TrimSpace(out.String())
+	out.Reset()
+	// kernels without modules.builtin have nothing built in we know of
+	if err := ipt.runCommand([]string{"cat", path.Join("/lib/modules", release, "modules.builtin")}, nil, &out); err == nil {
+		for module := range parseModules(out.String(), true) {
+			loaded[module] = true
+		}
+	}
+	return loaded, nil
+}
+
+// parseModules parses /proc/modules, or modules.builtin if builtin is set.
+func parseModules(data string, builtin bool) map[string]bool {
+	modules := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		name := fields[0]
+		if builtin {
+			// e.g. kernel/net/netfilter/xt_conntrack.ko
+			name = strings.TrimSuffix(path.Base(name), ".ko")
+		}
+		modules[moduleName(name)] = true
+	}
+	return modules
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMissingModule(t *testing.T) {
+	for msg, module := range map[string]string{
+		"iptables v1.6.1: can't initialize iptables table `nat': Table does not exist (do you need to insmod?)\n":   "iptable_nat",
+		"ip6tables v1.6.1: can't initialize ip6tables table `raw': Table does not exist (do you need to insmod?)\n": "ip6table_raw",
+		"iptables v1.8.7 (legacy): Couldn't load match `conntrack':No such file or directory\n":                     "xt_conntrack",
+		"Warning: Extension MASQUERADE revision 0 not supported, missing kernel module?\n":                          "xt_MASQUERADE",
+		"iptables: Bad rule (does a matching rule exist in that chain?).\n":                                         "",
+		"iptables v1.8.7 (nf_tables): table 'security' does not exist\n":                                            "",
+	} {
+		err := NewError([]string{"iptables"}, 1, msg)
+		if got := err.MissingModule(); got != module {
+			t.Errorf("MissingModule(%q) = %q, expected %q", msg, got, module)
+		}
+		if errors.Is(err, ErrModuleMissing) != (module != "") {
+			t.Errorf("errors.Is(%q, ErrModuleMissing) = %v", msg, !(module != ""))
+		}
+	}
+}
+
+func TestEnsureModules(t *testing.T) {
+	var modprobed []string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		switch strings.Join(args, " ") {
+		case "cat /proc/modules":
+			io.WriteString(stdout, "xt_conntrack 16384 3 - Live 0x0000000000000000\nnf_conntrack 172032 4 xt_conntrack, Live 0x0000000000000000\n")
+		case "cat /proc/sys/kernel/osrelease":
+			io.WriteString(stdout, "6.1.0-test\n")
+		case "cat /lib/modules/6.1.0-test/modules.builtin":
+			io.WriteString(stdout, "kernel/net/ipv4/netfilter/iptable_filter.ko\n")
+		case "/sbin/modprobe -- xt_recent":
+			io.WriteString(stderr, "modprobe: FATAL: Module xt_recent not found in directory /lib/modules/6.1.0-test\n")
+			return 1, nil
+		default:
+			if args[0] == "/sbin/modprobe" {
+				modprobed = append(modprobed, args[2])
+			}
+		}
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-legacy"), Modprobe("/sbin/modprobe"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := ipt.EnsureModules("xt-conntrack", "iptable_filter", "iptable_nat"); err != nil {
+		t.Fatalf("EnsureModules failed: %v", err)
+	}
+	if !reflect.DeepEqual(modprobed, []string{"iptable_nat"}) {
+		t.Fatalf("unexpected modules loaded %q", modprobed)
+	}
+
+	err = ipt.EnsureModules("xt_recent")
+	var merr *ModuleMissingError
+	if !errors.As(err, &merr) || merr.Module != "xt_recent" || !errors.Is(err, ErrModuleMissing) {
+		t.Fatalf("expected a ModuleMissingError, got %v", err)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	var calls [][]string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, args)
+		if args[2] == "nat" {
+			io.WriteString(stderr, "iptables v1.8.7 (legacy): can't initialize iptables table `nat': Table does not exist (do you need to insmod?)\n")
+			return 3, nil
+		}
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-legacy"), Modprobe("/sbin/modprobe"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	err = ipt.Preflight("filter", "nat")
+	var merr *ModuleMissingError
+	if !errors.As(err, &merr) || merr.Module != "iptable_nat" {
+		t.Fatalf("expected iptable_nat to be missing, got %v", err)
+	}
+	if !contains(calls[0], "--modprobe=/sbin/modprobe") {
+		t.Fatalf("--modprobe not passed: %q", calls[0])
+	}
+}
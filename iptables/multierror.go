@@ -0,0 +1,109 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// OperationError is the failure of a single part of an operation made of
+// several, e.g. one of the removals of Tracker.Cleanup.
+type OperationError struct {
+	Op  Operation
+	Err error
+}
+
+func (e *OperationError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", familyName(e.Op.Proto), e.Op, e.Err)
+}
+
+func (e *OperationError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError reports the outcome of an operation made of several parts,
+// some of which failed: Errors holds the failed parts and Succeeded the
+// ones that were applied, so that callers can retry only the former.
+//
+// errors.Is and errors.As look through every failed part.
+type MultiError struct {
+	Errors    []*OperationError
+	Succeeded []Operation
+}
+
+func (e *MultiError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d of %d operations failed: %s",
+		len(e.Errors), len(e.Errors)+len(e.Succeeded), strings.Join(msgs, "; "))
+}
+
+// Is reports whether any failed part matches target.
+func (e *MultiError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first failed part matching target.
+func (e *MultiError) As(target interface{}) bool {
+	for _, err := range e.Errors {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// multiErrorBuilder accumulates the outcome of the parts of an operation.
+type multiErrorBuilder struct {
+	MultiError
+}
+
+// add records the outcome of op, returning true if it succeeded.
+func (b *multiErrorBuilder) add(op Operation, err error) bool {
+	if err != nil {
+		b.Errors = append(b.Errors, &OperationError{op, err})
+		return false
+	}
+	b.Succeeded = append(b.Succeeded, op)
+	return true
+}
+
+// err returns the *MultiError, or nil if no part failed.
+func (b *multiErrorBuilder) err() error {
+	if len(b.Errors) == 0 {
+		return nil
+	}
+	return &b.MultiError
+}
+
+// familyName returns the name of proto used in messages.
+func familyName(proto Protocol) string {
+	switch proto {
+	case ProtocolIPv4:
+		return "ipv4"
+	case ProtocolIPv6:
+		return "ipv6"
+	}
+	return fmt.Sprintf("family %d", proto)
+}
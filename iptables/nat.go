@@ -0,0 +1,159 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// NATRange is the address and port range a NAT target maps packets to.
+// Leaving MaxAddr or MaxPort unset selects a single address or port, and
+// leaving MinPort unset keeps the port of the packets. Ports can only be
+// mapped by rules matching a protocol with ports, e.g. "-p tcp".
+type NATRange struct {
+	MinAddr, MaxAddr net.IP
+	MinPort, MaxPort uint16
+}
+
+// addrFamily returns whether ip belongs to proto.
+func addrFamily(proto Protocol, ip net.IP) bool {
+	if proto == ProtocolIPv6 {
+		return ip.To4() == nil && ip.To16() != nil
+	}
+	return ip.To4() != nil
+}
+
+// ports formats the port range of r, or returns "" if it has none.
+func (r NATRange) ports() (string, error) {
+	switch {
+	case r.MinPort == 0 && r.MaxPort == 0:
+		return "", nil
+	case r.MinPort == 0:
+		return "", fmt.Errorf("NAT range has a maximum port but no minimum")
+	case r.MaxPort == 0 || r.MaxPort == r.MinPort:
+		return strconv.Itoa(int(r.MinPort)), nil
+	case r.MaxPort < r.MinPort:
+		return "", fmt.Errorf("invalid NAT port range %d-%d", r.MinPort, r.MaxPort)
+	}
+	return fmt.Sprintf("%d-%d", r.MinPort, r.MaxPort), nil
+}
+
+// format returns the range of addresses and ports of r in the form
+// expected by --to-source and --to-destination: "addr[-addr][:port[-port]]",
+// with the addresses in brackets for IPv6 if ports are given.
+func (r NATRange) format(proto Protocol) (string, error) {
+	var addrs string
+	if r.MinAddr != nil {
+		if !addrFamily(proto, r.MinAddr) {
+			return "", fmt.Errorf("NAT address %s is not of the handle's family", r.MinAddr)
+		}
+		addrs = r.MinAddr.String()
+		if r.MaxAddr != nil && !r.MaxAddr.Equal(r.MinAddr) {
+			if !addrFamily(proto, r.MaxAddr) {
+				return "", fmt.Errorf("NAT address %s is not of the handle's family", r.MaxAddr)
+			}
+			if bytes.Compare(r.MaxAddr.To16(), r.MinAddr.To16()) < 0 {
+				return "", fmt.Errorf("invalid NAT address range %s-%s", r.MinAddr, r.MaxAddr)
+			}
+			addrs += "-" + r.MaxAddr.String()
+		}
+	} else if r.MaxAddr != nil {
+		return "", fmt.Errorf("NAT range has a maximum address but no minimum")
+	}
+	ports, err := r.ports()
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case ports == "":
+		return addrs, nil
+	case proto == ProtocolIPv6 && addrs != "":
+		return "[" + addrs + "]:" + ports, nil
+	}
+	return addrs + ":" + ports, nil
+}
+
+// NATTarget returns the rulespec fragment of the DNAT, SNAT or MASQUERADE
+// target mapping the packets of proto to to:
+//
+//	-j DNAT --to-destination addr[-addr][:port[-port]]
+//	-j SNAT --to-source addr[-addr][:port[-port]] [--random-fully]
+//	-j MASQUERADE [--to-ports port[-port]] [--random-fully]
+//
+// DNAT and SNAT require a range, MASQUERADE only accepts ports. Whether
+// iptables supports --random-fully can be checked with HasRandomFully;
+// the SNAT and Masquerade methods of IPTables do so.
+func NATTarget(proto Protocol, target string, to NATRange, randomFully bool) ([]string, error) {
+	var spec []string
+	switch target {
+	case "DNAT", "SNAT":
+		if to.MinAddr == nil && to.MinPort == 0 {
+			return nil, fmt.Errorf("%s requires an address or port", target)
+		}
+		s, err := to.format(proto)
+		if err != nil {
+			return nil, err
+		}
+		flag := "--to-destination"
+		if target == "SNAT" {
+			flag = "--to-source"
+		}
+		spec = []string{"-j", target, flag, s}
+	case "MASQUERADE":
+		if to.MinAddr != nil || to.MaxAddr != nil {
+			return nil, fmt.Errorf("MASQUERADE does not take addresses")
+		}
+		spec = []string{"-j", target}
+		ports, err := to.ports()
+		if err != nil {
+			return nil, err
+		}
+		if ports != "" {
+			spec = append(spec, "--to-ports", ports)
+		}
+	default:
+		return nil, fmt.Errorf("unknown NAT target %q", target)
+	}
+	if randomFully {
+		if target == "DNAT" {
+			return nil, fmt.Errorf("DNAT does not support --random-fully")
+		}
+		spec = append(spec, "--random-fully")
+	}
+	return spec, nil
+}
+
+// DNAT returns the rulespec fragment of the DNAT target mapping the
+// packets of the handle's family to to, see NATTarget.
+func (ipt *IPTables) DNAT(to NATRange) ([]string, error) {
+	return NATTarget(ipt.proto, "DNAT", to, false)
+}
+
+// SNAT returns the rulespec fragment of the SNAT target mapping the
+// packets of the handle's family to to, with --random-fully if iptables
+// supports it, see NATTarget.
+func (ipt *IPTables) SNAT(to NATRange) ([]string, error) {
+	return NATTarget(ipt.proto, "SNAT", to, ipt.hasRandomFully)
+}
+
+// Masquerade returns the rulespec fragment of the MASQUERADE target,
+// mapping to the ports of to if any, with --random-fully if iptables
+// supports it, see NATTarget.
+func (ipt *IPTables) Masquerade(to NATRange) ([]string, error) {
+	return NATTarget(ipt.proto, "MASQUERADE", to, ipt.hasRandomFully)
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestNATTarget(t *testing.T) {
+	for _, tc := range []struct {
+		proto       Protocol
+		target      string
+		to          NATRange
+		randomFully bool
+		expected    []string
+	}{
+		{ProtocolIPv4, "DNAT", NATRange{MinAddr: net.ParseIP("10.0.0.1")},
+			false, []string{"-j", "DNAT", "--to-destination", "10.0.0.1"}},
+		{ProtocolIPv4, "DNAT", NATRange{MinAddr: net.ParseIP("10.0.0.1"), MaxAddr: net.ParseIP("10.0.0.5"), MinPort: 8080, MaxPort: 8090},
+			false, []string{"-j", "DNAT", "--to-destination", "10.0.0.1-10.0.0.5:8080-8090"}},
+		{ProtocolIPv6, "DNAT", NATRange{MinAddr: net.ParseIP("2001:db8::1"), MinPort: 80},
+			false, []string{"-j", "DNAT", "--to-destination", "[2001:db8::1]:80"}},
+		{ProtocolIPv6, "SNAT", NATRange{MinAddr: net.ParseIP("2001:db8::1"), MaxAddr: net.ParseIP("2001:db8::5")},
+			true, []string{"-j", "SNAT", "--to-source", "2001:db8::1-2001:db8::5", "--random-fully"}},
+		{ProtocolIPv4, "MASQUERADE", NATRange{},
+			true, []string{"-j", "MASQUERADE", "--random-fully"}},
+		{ProtocolIPv4, "MASQUERADE", NATRange{MinPort: 1024, MaxPort: 65535},
+			false, []string{"-j", "MASQUERADE", "--to-ports", "1024-65535"}},
+
+		{ProtocolIPv4, "DNAT", NATRange{}, false, nil},
+		{ProtocolIPv4, "DNAT", NATRange{MinAddr: net.ParseIP("2001:db8::1")}, false, nil},
+		{ProtocolIPv6, "SNAT", NATRange{MinAddr: net.ParseIP("10.0.0.1")}, false, nil},
+		{ProtocolIPv4, "SNAT", NATRange{MinAddr: net.ParseIP("10.0.0.5"), MaxAddr: net.ParseIP("10.0.0.1")}, false, nil},
+		{ProtocolIPv4, "SNAT", NATRange{MinAddr: net.ParseIP("10.0.0.1"), MinPort: 90, MaxPort: 80}, false, nil},
+		{ProtocolIPv4, "DNAT", NATRange{MinAddr: net.ParseIP("10.0.0.1")}, true, nil},
+		{ProtocolIPv4, "MASQUERADE", NATRange{MinAddr: net.ParseIP("10.0.0.1")}, false, nil},
+		{ProtocolIPv4, "REDIRECT", NATRange{MinPort: 80}, false, nil},
+	} {
+		spec, err := NATTarget(tc.proto, tc.target, tc.to, tc.randomFully)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("%s %+v: expected an error, got %q", tc.target, tc.to, spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %+v: %v", tc.target, tc.to, err)
+		} else if !reflect.DeepEqual(spec, tc.expected) {
+			t.Errorf("%s %+v: got %q, need %q", tc.target, tc.to, spec, tc.expected)
+		}
+	}
+}
+
+func TestMasqueradeRandomFully(t *testing.T) {
+	for profile, expected := range map[string][]string{
+		"1.6.1-legacy": {"-j", "MASQUERADE"},
+		"1.6.2-legacy": {"-j", "MASQUERADE", "--random-fully"},
+	} {
+		ipt, err := New(CommandRunner(RunnerFunc(nil)), CompatibilityProfile(profile))
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		spec, err := ipt.Masquerade(NATRange{})
+		if err != nil {
+			t.Fatalf("Masquerade failed: %v", err)
+		}
+		if !reflect.DeepEqual(spec, expected) {
+			t.Errorf("%s: got %q, need %q", profile, spec, expected)
+		}
+	}
+}
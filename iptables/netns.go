@@ -0,0 +1,45 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"os"
+)
+
+// NetNS makes the handle run every command in the network namespace at
+// path, e.g. /var/run/netns/blue or /proc/1234/ns/net, through nsenter.
+// The rest of the environment, including the filesystem and thus the
+// xtables lock, is shared with the caller.
+func NetNS(path string) option {
+	return func(ipt *IPTables) {
+		ipt.netns = path
+	}
+}
+
+// NetNSFd acts like NetNS for a network namespace the caller holds open
+// as fd. The fd must stay open for as long as the handle is used.
+func NetNSFd(fd uintptr) option {
+	return NetNS(fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), fd))
+}
+
+// nsenterArgs prefixes args with the nsenter invocation entering the
+// handle's network namespace, if any.
+func (ipt *IPTables) nsenterArgs(args []string) []string {
+	if ipt.netns == "" {
+		return args
+	}
+	return append([]string{ipt.nsenterPath, "--net=" + ipt.netns, "--"}, args...)
+}
@@ -0,0 +1,223 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// protocolNames maps the protocol numbers and aliases accepted by iptables
+// to the names it prints.
+var protocolNames = map[string]string{
+	"1":      "icmp",
+	"6":      "tcp",
+	"17":     "udp",
+	"33":     "dccp",
+	"58":     "ipv6-icmp",
+	"132":    "sctp",
+	"136":    "udplite",
+	"icmpv6": "ipv6-icmp",
+	"0":      "",
+	"all":    "",
+}
+
+// protocolMatches maps protocols to the match extension iptables loads
+// implicitly for their options, e.g. "-p tcp --dport 22".
+var protocolMatches = map[string]string{
+	"tcp":       "tcp",
+	"udp":       "udp",
+	"udplite":   "udplite",
+	"sctp":      "sctp",
+	"dccp":      "dccp",
+	"icmp":      "icmp",
+	"ipv6-icmp": "icmp6",
+}
+
+// protocolMatchOptions lists the options of the matches in
+// protocolMatches, which is all an unnamed match may hold to be taken for
+// the implicit protocol match.
+var protocolMatchOptions = map[string][]string{
+	"tcp":     {"--sport", "--dport", "--tcp-flags", "--syn", "--tcp-option"},
+	"udp":     {"--sport", "--dport"},
+	"udplite": {"--sport", "--dport"},
+	"sctp":    {"--sport", "--dport", "--chunk-types"},
+	"dccp":    {"--sport", "--dport", "--dccp-types", "--dccp-option"},
+	"icmp":    {"--icmp-type"},
+	"icmp6":   {"--icmpv6-type"},
+}
+
+// matchOptionAliases maps long match options to the form iptables prints.
+var matchOptionAliases = map[string]string{
+	"--destination-port":  "--dport",
+	"--source-port":       "--sport",
+	"--destination-ports": "--dports",
+	"--source-ports":      "--sports",
+}
+
+// NormalizeRule returns rule in a canonical form, so that rules can be
+// compared regardless of the iptables version that printed them or of the
+// way they were written by hand:
+//
+//   - counters are dropped
+//   - addresses are masked and given a prefix length, e.g. "10.1.2.3/8"
+//     becomes "10.0.0.0/8", "192.0.2.1" becomes "192.0.2.1/32" and a
+//     dotted netmask becomes a prefix length; "anywhere", 0.0.0.0/0 and
+//     ::/0 are dropped unless negated
+//   - protocols are named, e.g. "6" becomes "tcp", and "all" is dropped
+//   - the match implicitly loaded by a protocol is made explicit, e.g.
+//     "-p tcp --dport 22" becomes "-p tcp -m tcp --dport 22", provided
+//     all the options of the unnamed match belong to it
+//   - long match options are shortened, e.g. "--destination-port" becomes
+//     "--dport", and the old "--dport ! 22" negation becomes "! --dport 22"
+func NormalizeRule(rule Rule) Rule {
+	rule.Packets, rule.Bytes = 0, 0
+	rule.Source = normalizeAddress(rule.Source)
+	rule.Destination = normalizeAddress(rule.Destination)
+	rule.Protocol = normalizeProtocol(rule.Protocol)
+
+	matches := make([]Match, len(rule.Matches))
+	for i, m := range rule.Matches {
+		if name := protocolMatches[strings.TrimPrefix(rule.Protocol, "!")]; m.Name == "" && ownsOptions(name, m.Options) {
+			m.Name = name
+		}
+		m.Options = normalizeMatchOptions(m.Options)
+		matches[i] = m
+	}
+	if len(matches) > 0 {
+		rule.Matches = matches
+	}
+	return rule
+}
+
+// ownsOptions reports whether every option of options, values aside,
+// belongs to the protocol match name.
+func ownsOptions(name string, options []string) bool {
+	known := protocolMatchOptions[name]
+	if len(known) == 0 {
+		return false
+	}
+	for _, opt := range options {
+		if !strings.HasPrefix(opt, "-") {
+			continue
+		}
+		if alias, ok := matchOptionAliases[opt]; ok {
+			opt = alias
+		}
+		found := false
+		for _, k := range known {
+			if opt == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeAddress returns the canonical form of a source or destination.
+func normalizeAddress(orig string) string {
+	negate := strings.HasPrefix(orig, "!")
+	addr := strings.TrimPrefix(orig, "!")
+	if addr == "" || addr == "anywhere" && !negate {
+		return ""
+	}
+
+	host, mask := addr, ""
+	if i := strings.Index(addr, "/"); i >= 0 {
+		host, mask = addr[:i], addr[i+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// a hostname, left to iptables to resolve
+		return orig
+	}
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	} else {
+		ip = ip.To4()
+	}
+
+	ones := bits
+	if mask != "" {
+		if m := net.ParseIP(mask); m != nil {
+			if bits == 32 {
+				m = m.To4()
+			}
+			ones, _ = net.IPMask(m).Size()
+		} else if n, err := parsePrefixLength(mask, bits); err == nil {
+			ones = n
+		} else {
+			return orig
+		}
+	}
+	// "! -s 0.0.0.0/0" matches nothing, unlike 0.0.0.0/0
+	if ones == 0 && !negate {
+		return ""
+	}
+
+	network := &net.IPNet{IP: ip.Mask(net.CIDRMask(ones, bits)), Mask: net.CIDRMask(ones, bits)}
+	if negate {
+		return "!" + network.String()
+	}
+	return network.String()
+}
+
+// parsePrefixLength parses a prefix length between 0 and bits.
+func parsePrefixLength(s string, bits int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err == nil && (n < 0 || n > bits) {
+		err = fmt.Errorf("invalid prefix length %d", n)
+	}
+	return n, err
+}
+
+// normalizeProtocol returns the canonical form of a protocol.
+func normalizeProtocol(proto string) string {
+	negate := strings.HasPrefix(proto, "!")
+	proto = strings.ToLower(strings.TrimPrefix(proto, "!"))
+	if name, ok := protocolNames[proto]; ok {
+		proto = name
+	}
+	if negate && proto != "" {
+		return "!" + proto
+	}
+	return proto
+}
+
+// normalizeMatchOptions shortens aliases and moves old-style negations in
+// front of their option.
+func normalizeMatchOptions(options []string) []string {
+	out := make([]string, 0, len(options))
+	for i := 0; i < len(options); i++ {
+		opt := options[i]
+		if alias, ok := matchOptionAliases[opt]; ok {
+			opt = alias
+		}
+		if strings.HasPrefix(opt, "--") && i+1 < len(options) && options[i+1] == "!" {
+			out = append(out, "!", opt)
+			i++
+			continue
+		}
+		out = append(out, opt)
+	}
+	return out
+}
@@ -0,0 +1,56 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+// Serialize makes the handle run its changes one at a time: a change made
+// with a single iptables invocation waits for the other changes and
+// restores of the handle, and the copies returned by WithWaitTimeout, to
+// complete. Reads such as List or Exists still run in parallel with each
+// other and with changes. This keeps goroutines sharing a handle from
+// contending for the xtables lock, at the cost of throughput.
+func Serialize() option {
+	return func(ipt *IPTables) {
+		ipt.serialize = true
+	}
+}
+
+// beginChange marks the start of a change made with a single iptables
+// invocation, such as Append or Delete, and returns the function marking
+// its end. Such changes run concurrently with each other, unless the
+// handle was created with Serialize, but not with a restore started with
+// beginRestore. mutation is false for reads, such as the -C of Exists,
+// which are never held back.
+func (ipt *IPTables) beginChange(mutation bool) func() {
+	if ipt.order == nil || !mutation {
+		return func() {}
+	}
+	if ipt.serialize {
+		ipt.order.Lock()
+		return ipt.order.Unlock
+	}
+	ipt.order.RLock()
+	return ipt.order.RUnlock
+}
+
+// beginRestore marks the start of a restore, and returns the function
+// marking its end. It waits for the changes in progress on the handle to
+// complete, and holds back the ones started meanwhile until it ends.
+func (ipt *IPTables) beginRestore() func() {
+	if ipt.order == nil {
+		return func() {}
+	}
+	ipt.order.Lock()
+	return ipt.order.Unlock
+}
@@ -0,0 +1,143 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRestoreOrdering(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	restoring := make(chan struct{})
+	release := make(chan struct{})
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		if args[0] == "iptables-restore" {
+			io.Copy(io.Discard, stdin)
+			close(restoring)
+			<-release
+			record("restore")
+			return 0, nil
+		}
+		record(args[3])
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	restored := make(chan error)
+	go func() {
+		restored <- ipt.Restore("filter", map[string][][]string{"AGENT": {{"-j", "DROP"}}}, RestoreNoFlush())
+	}()
+	<-restoring
+
+	appended := make(chan error)
+	go func() {
+		appended <- ipt.Append("filter", "AGENT", "-j", "ACCEPT")
+	}()
+	select {
+	case err := <-appended:
+		t.Fatalf("Append completed during the restore: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// reads aren't held back
+	if _, err := ipt.List("filter", "AGENT"); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if _, err := ipt.Exists("filter", "AGENT", "-j", "ACCEPT"); err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+
+	close(release)
+	if err := <-restored; err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if err := <-appended; err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if !reflect.DeepEqual(events, []string{"-S", "-C", "restore", "-A"}) {
+		t.Fatalf("unexpected order %q", events)
+	}
+}
+
+func TestSerialize(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	appending := make(chan struct{}, 2)
+	release := make(chan struct{})
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		if args[3] != "-A" {
+			return 0, nil
+		}
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		appending <- struct{}{}
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"), Serialize())
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	appended := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			appended <- ipt.Append("filter", "AGENT", "-j", "ACCEPT")
+		}()
+	}
+	<-appending
+	select {
+	case <-appending:
+		t.Fatalf("two changes ran concurrently")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// reads aren't held back
+	if _, err := ipt.List("filter", "AGENT"); err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if _, err := ipt.Exists("filter", "AGENT", "-j", "ACCEPT"); err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-appended; err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	if maxRunning != 1 {
+		t.Fatalf("expected changes to run one at a time, got %d at once", maxRunning)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Action is a single step of a plan such as the one returned by
+// PlanTeardown.
+type Action = Operation
+
+// FormatPlan returns plan as numbered lines, for review before running it
+// with ExecutePlan.
+func FormatPlan(plan []Action) string {
+	var b strings.Builder
+	for i, action := range plan {
+		fmt.Fprintf(&b, "%d. %s\n", i+1, action)
+	}
+	return b.String()
+}
+
+// ExecutePlan runs the actions of plan in order, stopping at the first
+// failure.
+func (ipt *IPTables) ExecutePlan(plan []Action) error {
+	return Replay(ipt, plan)
+}
+
+// PlanTeardown computes how to delete the given chains of table safely:
+// first the rules of other chains jumping to them are deleted, then the
+// chains are flushed and finally deleted, each chain before the chains it
+// jumps to. Chains that don't exist are skipped.
+func (ipt *IPTables) PlanTeardown(table string, chains []string) ([]Action, error) {
+	current, err := ipt.ListTable(table)
+	if err != nil {
+		return nil, err
+	}
+	return planTeardown(ipt.proto, table, current, chains)
+}
+
+// planTeardown computes PlanTeardown from the -S lines of every chain of
+// table.
+func planTeardown(proto Protocol, table string, current map[string][]string, chains []string) ([]Action, error) {
+	remove := map[string]bool{}
+	for _, chain := range chains {
+		lines, ok := current[chain]
+		if !ok {
+			continue
+		}
+		if len(lines) > 0 && strings.HasPrefix(lines[0], "-P ") {
+			return nil, fmt.Errorf("cannot delete builtin chain %s", chain)
+		}
+		remove[chain] = true
+	}
+
+	// jumps holds the chains to remove each chain to remove jumps to
+	jumps := map[string][]string{}
+	var plan []Action
+	for _, chain := range sortedKeys(current) {
+		rules, err := parseRules(current[chain])
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rules {
+			if !remove[r.Target] {
+				continue
+			}
+			if remove[chain] {
+				jumps[chain] = append(jumps[chain], r.Target)
+			} else {
+				plan = append(plan, Action{Kind: "delete", Proto: proto, Table: table, Chain: chain, Rulespec: r.Spec()})
+			}
+		}
+	}
+
+	// order the chains so that referrers come before the chains they
+	// jump to; cycles are broken arbitrarily, flushing makes it safe
+	var order []string
+	visited := map[string]bool{}
+	var visit func(chain string)
+	visit = func(chain string) {
+		if visited[chain] {
+			return
+		}
+		visited[chain] = true
+		for _, target := range jumps[chain] {
+			visit(target)
+		}
+		order = append(order, chain)
+	}
+	for _, chain := range sortedKeys(remove) {
+		visit(chain)
+	}
+	// visit appended targets first: reverse to get referrers first
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+
+	for _, chain := range order {
+		plan = append(plan, Action{Kind: "flush", Proto: proto, Table: table, Chain: chain})
+	}
+	for _, chain := range order {
+		plan = append(plan, Action{Kind: "delete-chain", Proto: proto, Table: table, Chain: chain})
+	}
+	return plan, nil
+}
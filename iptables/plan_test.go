@@ -0,0 +1,53 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"testing"
+)
+
+func TestPlanTeardown(t *testing.T) {
+	current := groupRulesByChain([]string{
+		"-P INPUT ACCEPT",
+		"-P FORWARD ACCEPT",
+		"-N APP",
+		"-N APP-WEB",
+		"-N OTHER",
+		"-A INPUT -j APP",
+		"-A FORWARD -p tcp -j APP-WEB",
+		"-A APP -j APP-WEB",
+		"-A APP-WEB -p tcp -m tcp --dport 80 -j ACCEPT",
+		"-A OTHER -j ACCEPT",
+	})
+
+	plan, err := planTeardown(ProtocolIPv4, "filter", current, []string{"APP-WEB", "APP", "MISSING"})
+	if err != nil {
+		t.Fatalf("planTeardown failed: %v", err)
+	}
+	expected := `1. delete filter/FORWARD -p tcp -j APP-WEB
+2. delete filter/INPUT -j APP
+3. flush filter/APP
+4. flush filter/APP-WEB
+5. delete-chain filter/APP
+6. delete-chain filter/APP-WEB
+`
+	if actual := FormatPlan(plan); actual != expected {
+		t.Fatalf("plan mismatch: \ngot\n%s\nneed\n%s", actual, expected)
+	}
+
+	if _, err := planTeardown(ProtocolIPv4, "filter", current, []string{"INPUT"}); err == nil {
+		t.Fatal("expected an error tearing down a builtin chain, got none")
+	}
+}
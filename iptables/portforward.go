@@ -0,0 +1,119 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"net"
+)
+
+// PortForward describes the forwarding of a port of the host to an
+// internal address, made of a DNAT rule in nat/PREROUTING and a rule
+// accepting the forwarded packets in filter/FORWARD.
+type PortForward struct {
+	// Protocol is "tcp" or "udp"
+	Protocol string
+	// InInterface is the external interface, or "" for any
+	InInterface string
+	// Port is the external port
+	Port uint16
+	// ToAddr is the internal address, of the handle's family
+	ToAddr net.IP
+	// ToPort is the internal port, Port if unset
+	ToPort uint16
+	// Comment, if set, is added to both rules to tell them apart
+	Comment string
+}
+
+// portForwardRules returns the rulespecs of the DNAT rule and of the
+// FORWARD rule of f for the handle.
+func (ipt *IPTables) portForwardRules(f PortForward) (dnat, accept []string, err error) {
+	var port func(sport, dport PortRange) ([]string, error)
+	switch f.Protocol {
+	case "tcp":
+		port = TCPMatch
+	case "udp":
+		port = UDPMatch
+	default:
+		return nil, nil, fmt.Errorf("cannot forward ports of protocol %q", f.Protocol)
+	}
+	if f.Port == 0 || f.ToAddr == nil {
+		return nil, nil, fmt.Errorf("port forward requires a port and an internal address")
+	}
+	toPort := f.ToPort
+	if toPort == 0 {
+		toPort = f.Port
+	}
+	var comment []string
+	if f.Comment != "" {
+		if comment, err = Comment(f.Comment); err != nil {
+			return nil, nil, err
+		}
+	}
+	var in []string
+	if f.InInterface != "" {
+		in = []string{"-i", f.InInterface}
+	}
+
+	external, err := port(PortRange{}, Port(f.Port))
+	if err != nil {
+		return nil, nil, err
+	}
+	target, err := ipt.DNAT(NATRange{MinAddr: f.ToAddr, MinPort: toPort})
+	if err != nil {
+		return nil, nil, err
+	}
+	dnat = append(append(append(in, external...), comment...), target...)
+
+	internal, err := port(PortRange{}, Port(toPort))
+	if err != nil {
+		return nil, nil, err
+	}
+	bits := 32
+	if ipt.proto == ProtocolIPv6 {
+		bits = 128
+	}
+	dest := (&net.IPNet{IP: f.ToAddr, Mask: net.CIDRMask(bits, bits)}).String()
+	accept = append(append(append(append([]string{"-d", dest}, in...), internal...), comment...), "-j", "ACCEPT")
+	return dnat, accept, nil
+}
+
+// EnsurePortForward installs the rules of f unless they exist. The accept
+// rule is inserted first in filter/FORWARD, so that it precedes any
+// catch-all rule, before the DNAT rule is appended to nat/PREROUTING, so
+// that no forwarded packet is dropped in between.
+func (ipt *IPTables) EnsurePortForward(f PortForward) error {
+	dnat, accept, err := ipt.portForwardRules(f)
+	if err != nil {
+		return err
+	}
+	if err := ipt.InsertUnique(TableFilter, ChainForward, 1, accept...); err != nil {
+		return err
+	}
+	return ipt.AppendUnique(TableNAT, ChainPrerouting, dnat...)
+}
+
+// RemovePortForward removes the rules of f installed by
+// EnsurePortForward, the DNAT rule first. Missing rules are not an error.
+func (ipt *IPTables) RemovePortForward(f PortForward) error {
+	dnat, accept, err := ipt.portForwardRules(f)
+	if err != nil {
+		return err
+	}
+	if err := ipt.DeleteIfExists(TableNAT, ChainPrerouting, dnat...); err != nil {
+		return err
+	}
+	return ipt.DeleteIfExists(TableFilter, ChainForward, accept...)
+}
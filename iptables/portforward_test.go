@@ -0,0 +1,100 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ruleTable is a runner keeping the rules appended, inserted and deleted
+// by table and chain, answering -C accordingly.
+type ruleTable struct {
+	rules map[string][]string
+	calls []string
+}
+
+func (rt *ruleTable) Run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	// iptables -t table -X chain [pos] rulespec... --wait
+	key := args[2] + "/" + args[4]
+	spec := args[5 : len(args)-1]
+	if args[3] == "-I" {
+		spec = spec[1:]
+	}
+	rule := strings.Join(spec, " ")
+	rt.calls = append(rt.calls, args[3]+" "+key)
+	switch args[3] {
+	case "-C":
+		for _, r := range rt.rules[key] {
+			if r == rule {
+				return 0, nil
+			}
+		}
+		return 1, nil
+	case "-A", "-I":
+		rt.rules[key] = append(rt.rules[key], rule)
+	case "-D":
+		for i, r := range rt.rules[key] {
+			if r == rule {
+				rt.rules[key] = append(rt.rules[key][:i], rt.rules[key][i+1:]...)
+				break
+			}
+		}
+	}
+	return 0, nil
+}
+
+func TestPortForward(t *testing.T) {
+	rt := &ruleTable{rules: map[string][]string{}}
+	ipt, err := New(CommandRunner(rt), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	f := PortForward{Protocol: "tcp", InInterface: "eth0", Port: 8080, ToAddr: net.ParseIP("10.0.0.2"), ToPort: 80, Comment: "web"}
+	for i := 0; i < 2; i++ {
+		if err := ipt.EnsurePortForward(f); err != nil {
+			t.Fatalf("EnsurePortForward failed: %v", err)
+		}
+	}
+	expected := map[string][]string{
+		"nat/PREROUTING": {"-i eth0 -p tcp -m tcp --dport 8080 -m comment --comment web -j DNAT --to-destination 10.0.0.2:80"},
+		"filter/FORWARD": {"-d 10.0.0.2/32 -i eth0 -p tcp -m tcp --dport 80 -m comment --comment web -j ACCEPT"},
+	}
+	if !reflect.DeepEqual(rt.rules, expected) {
+		t.Fatalf("got %q, need %q", rt.rules, expected)
+	}
+	if !reflect.DeepEqual(rt.calls[:4], []string{"-C filter/FORWARD", "-I filter/FORWARD", "-C nat/PREROUTING", "-A nat/PREROUTING"}) {
+		t.Fatalf("unexpected calls %q", rt.calls)
+	}
+
+	if err := ipt.RemovePortForward(f); err != nil {
+		t.Fatalf("RemovePortForward failed: %v", err)
+	}
+	if len(rt.rules["nat/PREROUTING"]) != 0 || len(rt.rules["filter/FORWARD"]) != 0 {
+		t.Fatalf("rules left behind: %q", rt.rules)
+	}
+	if err := ipt.RemovePortForward(f); err != nil {
+		t.Fatalf("RemovePortForward of missing rules failed: %v", err)
+	}
+
+	f.Protocol = "icmp"
+	if err := ipt.EnsurePortForward(f); err == nil {
+		t.Fatalf("expected an error for a protocol without ports")
+	}
+}
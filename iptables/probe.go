@@ -0,0 +1,77 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"os/exec"
+)
+
+// Probe is an auxiliary operation New performs to discover its
+// environment, before any iptables command is run.
+type Probe string
+
+const (
+	// ProbeVersion runs the CapabilityProber, by default the iptables
+	// binary with --version, to detect its version and features. When
+	// disabled, a CompatibilityProfile is required.
+	ProbeVersion Probe = "version"
+	// ProbeLookPath resolves the iptables, iptables-restore and nsenter
+	// binaries in PATH. When disabled, they are run by the name given
+	// with Path, or their default name, and resolved on every run.
+	ProbeLookPath Probe = "lookpath"
+)
+
+// ProbeContext sets the context bounding the probes of New, e.g. with a
+// deadline, so that a hung binary doesn't block the creation of the
+// handle. Probes run through the Runner of the handle and are reported to
+// its Metrics and DebugLog like any other command.
+func ProbeContext(ctx context.Context) option {
+	return func(ipt *IPTables) {
+		ipt.probeCtx = ctx
+	}
+}
+
+// DisableProbes prevents New from performing the given probes, so that
+// constrained environments can account for every process and file access
+// of the library.
+func DisableProbes(probes ...Probe) option {
+	return func(ipt *IPTables) {
+		if ipt.disabledProbes == nil {
+			ipt.disabledProbes = map[Probe]bool{}
+		}
+		for _, p := range probes {
+			ipt.disabledProbes[p] = true
+		}
+	}
+}
+
+// probeContext returns the context of the probes.
+func (ipt *IPTables) probeContext() context.Context {
+	if ipt.probeCtx == nil {
+		return context.Background()
+	}
+	return ipt.probeCtx
+}
+
+// lookPath resolves the binary name like exec.LookPath, unless commands
+// go through a Runner, which resolves them itself, or ProbeLookPath is
+// disabled.
+func (ipt *IPTables) lookPath(name string) (string, error) {
+	if ipt.runner != nil || ipt.disabledProbes[ProbeLookPath] {
+		return name, nil
+	}
+	return exec.LookPath(name)
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+type probeContextKey struct{}
+
+func TestProbes(t *testing.T) {
+	var calls int
+	var events []CommandEvent
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls++
+		if ctx.Value(probeContextKey{}) != "probe" {
+			t.Errorf("probe ran without the probe context")
+		}
+		io.WriteString(stdout, "ip6tables v1.8.9 (legacy)\n")
+		return 0, nil
+	})
+	ctx := context.WithValue(context.Background(), probeContextKey{}, "probe")
+	debugLog := DebugLog(func(e CommandEvent) { events = append(events, e) })
+
+	ipt, err := New(IPFamily(ProtocolIPv6), CommandRunner(runner), ProbeContext(ctx), debugLog)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if ipt.Profile() != "1.8.9-legacy" || calls != 1 {
+		t.Fatalf("unexpected profile %s after %d probes", ipt.Profile(), calls)
+	}
+	if len(events) != 1 || events[0].Operation != "version" {
+		t.Fatalf("the version probe was not logged: %+v", events)
+	}
+
+	if _, err := New(CommandRunner(runner), DisableProbes(ProbeVersion)); err == nil {
+		t.Fatalf("expected an error without a compatibility profile")
+	}
+	ipt, err = New(CommandRunner(runner), DisableProbes(ProbeVersion), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if ipt.Profile() != "1.8.7-nft" || calls != 1 {
+		t.Fatalf("unexpected profile %s after %d probes", ipt.Profile(), calls)
+	}
+
+	ipt, err = New(DisableProbes(ProbeVersion, ProbeLookPath), CompatibilityProfile("1.8.7-nft"), Path("iptables-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if ipt.path != "iptables-nft" {
+		t.Fatalf("expected the path not to be resolved, got %s", ipt.path)
+	}
+}
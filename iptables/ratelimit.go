@@ -0,0 +1,116 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimitRecorder may be implemented by a MetricsRecorder to be told
+// how long the invocations of a handle configured with RateLimit were held
+// back.
+type RateLimitRecorder interface {
+	// ObserveRateLimitWait is called before an invocation that had to wait
+	// for the rate limit, with the operation and how long it waited.
+	ObserveRateLimitWait(op string, wait time.Duration)
+}
+
+// RateLimit caps the rate at which the handle, and the copies returned by
+// WithWaitTimeout, run commands to perSecond, allowing bursts of up to
+// burst commands, so that a runaway reconcile loop cannot starve the other
+// users of the xtables lock. Commands over the limit wait their turn; the
+// wait is not part of the timeouts and is reported to the Metrics
+// recorder, if it implements RateLimitRecorder, and to the DebugLog
+// callback. A perSecond of 0 or less disables the limit.
+func RateLimit(perSecond float64, burst int) option {
+	return func(ipt *IPTables) {
+		if perSecond <= 0 {
+			ipt.limiter = nil
+			return
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		ipt.limiter = &rateLimiter{
+			rate:   perSecond,
+			burst:  float64(burst),
+			tokens: float64(burst),
+		}
+	}
+}
+
+// rateLimiter is a token bucket holding up to burst tokens, refilled at
+// rate tokens per second.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token at now, and returns how long to wait before
+// using it.
+func (l *rateLimiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() && now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	if now.After(l.last) {
+		l.last = now
+	}
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel gives back a token that was reserved but not used.
+func (l *rateLimiter) cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens++
+}
+
+// waitRateLimit waits for the handle's rate limit, if any, to allow running
+// another command, and returns how long it waited.
+func (ipt *IPTables) waitRateLimit(ctx context.Context, args []string) (time.Duration, error) {
+	if ipt.limiter == nil {
+		return 0, nil
+	}
+	wait := ipt.limiter.reserve(time.Now())
+	if wait <= 0 {
+		return 0, nil
+	}
+	if r, ok := ipt.metrics.(RateLimitRecorder); ok {
+		r.ObserveRateLimitWait(execOperation(args), wait)
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return wait, nil
+	case <-ctx.Done():
+		ipt.limiter.cancel()
+		return 0, ctx.Err()
+	}
+}
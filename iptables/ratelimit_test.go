@@ -0,0 +1,90 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	l := &rateLimiter{rate: 10, burst: 2, tokens: 2}
+	now := time.Unix(1000, 0)
+	for i, expected := range []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		if wait := l.reserve(now); wait != expected {
+			t.Fatalf("reservation %d: expected to wait %s, got %s", i, expected, wait)
+		}
+	}
+	// the two tokens owed are paid back after 200ms, then the bucket refills
+	if wait := l.reserve(now.Add(time.Second)); wait != 0 {
+		t.Fatalf("expected the bucket to have refilled, got a wait of %s", wait)
+	}
+	l.cancel()
+	if l.tokens != 2 {
+		t.Fatalf("expected the cancelled token back, got %v tokens", l.tokens)
+	}
+}
+
+type rateLimitRecorder struct {
+	mu    sync.Mutex
+	waits []time.Duration
+}
+
+func (r *rateLimitRecorder) ObserveExec(op string, duration time.Duration, exitStatus int) {}
+
+func (r *rateLimitRecorder) ObserveLockWait(op string) {}
+
+func (r *rateLimitRecorder) ObserveRateLimitWait(op string, wait time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.waits = append(r.waits, wait)
+}
+
+func TestRateLimit(t *testing.T) {
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		return 0, nil
+	})
+	var events []CommandEvent
+	rec := &rateLimitRecorder{}
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"), RateLimit(50, 1), Metrics(rec),
+		DebugLog(func(e CommandEvent) { events = append(events, e) }))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := ipt.ClearChain("filter", "AGENT"); err != nil {
+			t.Fatalf("ClearChain failed: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("expected 3 commands at 50/s to be rate limited, took %s", elapsed)
+	}
+	if len(rec.waits) != 2 {
+		t.Fatalf("expected 2 rate limited commands, got %v", rec.waits)
+	}
+	if events[0].RateLimitWait != 0 || events[2].RateLimitWait <= 0 {
+		t.Fatalf("unexpected rate limit waits %s and %s", events[0].RateLimitWait, events[2].RateLimitWait)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ipt.waitRateLimit(ctx, []string{"iptables", "-F"}); err != context.Canceled {
+		t.Fatalf("expected the wait to be cancelled, got %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Reconciler brings chains to a desired state with the fewest rule
+// operations, applying all of them with a single Transaction.
+//
+// Only the chains listed in the desired state are managed: they are
+// created if missing and their rules are made to match, in order. Other
+// chains of the same tables are left alone.
+type Reconciler struct {
+	ipt *IPTables
+}
+
+// NewReconciler returns a Reconciler applying to this handle.
+func (ipt *IPTables) NewReconciler() *Reconciler {
+	return &Reconciler{ipt: ipt}
+}
+
+// Plan returns the operations turning the current rules into desired,
+// which holds a list of rulespecs per chain and table, without applying
+// them. Rules that are already in place, in the right order, are kept;
+// all positions refer to the chain as modified by the preceding
+// operations.
+func (r *Reconciler) Plan(desired map[string]map[string][][]string) ([]Operation, error) {
+	var ops []Operation
+	for _, table := range sortedKeys(desired) {
+		current, err := r.ipt.ListTable(table)
+		if err != nil {
+			return nil, err
+		}
+		for _, chain := range sortedKeys(desired[table]) {
+			lines, exists := current[chain]
+			if !exists {
+				ops = append(ops, Operation{Kind: "new-chain", Proto: r.ipt.proto, Table: table, Chain: chain})
+			}
+			chainOps, err := planChain(r.ipt.proto, table, chain, lines, desired[table][chain])
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, chainOps...)
+		}
+	}
+	return ops, nil
+}
+
+// Apply plans and applies the operations bringing the chains to desired,
+// and returns them. Nothing is run if the chains are already up to date.
+//
+// The plan deletes rules by position, so the changes of the handle are
+// held back from the listing the plan is computed from until the commit,
+// as during a restore. Changes made by other handles or processes in
+// between can still shift the positions.
+func (r *Reconciler) Apply(desired map[string]map[string][][]string) ([]Operation, error) {
+	defer r.ipt.beginRestore()()
+
+	ops, err := r.Plan(desired)
+	if err != nil || len(ops) == 0 {
+		return ops, err
+	}
+
+	tx := r.ipt.NewTransaction()
+	for _, op := range ops {
+		switch op.Kind {
+		case "new-chain":
+			tx.NewChain(op.Table, op.Chain)
+		case "delete":
+			tx.add(op.Table, "-D", op.Chain, strconv.Itoa(op.Pos))
+		case "insert":
+			tx.Insert(op.Table, op.Chain, op.Pos, op.Rulespec...)
+		case "append":
+			tx.Append(op.Table, op.Chain, op.Rulespec...)
+		}
+	}
+	return ops, tx.commit(false)
+}
+
+// planChain computes the operations turning the rules of chain, given as
+// -S lines, into the desired rulespecs. The rules common to both, in
+// order, are kept; every other current rule is deleted, from the last one
+// so that positions stay valid, and the missing ones are then inserted at
+// their final position.
+func planChain(proto Protocol, table, chain string, lines []string, desired [][]string) ([]Operation, error) {
+	var current []string
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "-A ") {
+			continue
+		}
+		key, err := ruleLineKey(line)
+		if err != nil {
+			return nil, err
+		}
+		current = append(current, key)
+	}
+	wanted := make([]string, len(desired))
+	for i, spec := range desired {
+		key, err := ruleLineKey(strings.Join(quoteArgs(append([]string{"-A", chain}, spec...)), " "))
+		if err != nil {
+			return nil, err
+		}
+		wanted[i] = key
+	}
+
+	keepCurrent, keepWanted := commonSubsequence(current, wanted)
+
+	var ops []Operation
+	for i := len(current) - 1; i >= 0; i-- {
+		if !keepCurrent[i] {
+			ops = append(ops, Operation{Kind: "delete", Proto: proto, Table: table, Chain: chain, Pos: i + 1})
+		}
+	}
+	length := len(current) - len(ops)
+	for i, spec := range desired {
+		if keepWanted[i] {
+			continue
+		}
+		op := Operation{Kind: "insert", Proto: proto, Table: table, Chain: chain, Pos: i + 1, Rulespec: spec}
+		if i == length {
+			op.Kind, op.Pos = "append", 0
+		}
+		ops = append(ops, op)
+		length++
+	}
+	return ops, nil
+}
+
+// ruleLineKey returns the form of a rule line used to compare rules.
+func ruleLineKey(line string) (string, error) {
+	rule, err := ParseRule(line)
+	if err != nil {
+		return "", err
+	}
+	return ruleKey(rule), nil
+}
+
+// ruleKey returns the form of a rule used to compare rules.
+func ruleKey(rule Rule) string {
+	return NormalizeRule(rule).String()
+}
+
+// commonSubsequence returns which elements of a and b are part of their
+// longest common subsequence.
+func commonSubsequence(a, b []string) ([]bool, []bool) {
+	// lengths[i][j] is the length of the LCS of a[i:] and b[j:]
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			case lengths[i+1][j] >= lengths[i][j+1]:
+				lengths[i][j] = lengths[i+1][j]
+			default:
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	inA, inB := make([]bool, len(a)), make([]bool, len(b))
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			inA[i], inB[j] = true, true
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return inA, inB
+}
@@ -0,0 +1,108 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPlanChain(t *testing.T) {
+	lines := []string{
+		"-N FOO",
+		"-A FOO -s 10.0.0.1/32 -j ACCEPT",
+		"-A FOO -s 10.0.0.2/32 -j ACCEPT",
+		"-A FOO -s 10.0.0.3/32 -j ACCEPT",
+	}
+	desired := [][]string{
+		{"-s", "10.0.0.0/8", "-j", "DROP"},
+		{"-s", "10.0.0.1", "-j", "ACCEPT"},
+		{"-s", "10.0.0.3", "-j", "ACCEPT"},
+		{"-s", "10.0.0.4", "-j", "ACCEPT"},
+	}
+	expected := []Operation{
+		{Kind: "delete", Table: "filter", Chain: "FOO", Pos: 2},
+		{Kind: "insert", Table: "filter", Chain: "FOO", Pos: 1, Rulespec: desired[0]},
+		{Kind: "append", Table: "filter", Chain: "FOO", Rulespec: desired[3]},
+	}
+
+	ops, err := planChain(ProtocolIPv4, "filter", "FOO", lines, desired)
+	if err != nil {
+		t.Fatalf("planChain failed: %v", err)
+	}
+	if !reflect.DeepEqual(ops, expected) {
+		t.Fatalf("planChain mismatch: \ngot  %v \nneed %v", ops, expected)
+	}
+
+	// applying the same state again is a no-op
+	ops, err = planChain(ProtocolIPv4, "filter", "FOO", []string{
+		"-A FOO -s 10.0.0.0/8 -j DROP",
+		"-A FOO -s 10.0.0.1/32 -j ACCEPT",
+		"-A FOO -s 10.0.0.3/32 -j ACCEPT",
+		"-A FOO -s 10.0.0.4/32 -j ACCEPT",
+	}, desired)
+	if err != nil || len(ops) != 0 {
+		t.Fatalf("expected no operations, got %v, %v", ops, err)
+	}
+}
+
+func TestReconcilerApplyOrdering(t *testing.T) {
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	var ipt *IPTables
+	appended := make(chan error, 1)
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		if args[0] == "iptables-restore" {
+			io.Copy(io.Discard, stdin)
+			record("restore")
+			return 0, nil
+		}
+		if args[3] == "-S" {
+			// a change made between the listing and the commit
+			go func() { appended <- ipt.Append("filter", "FOO", "-j", "LOG") }()
+			time.Sleep(50 * time.Millisecond)
+			io.WriteString(stdout, "-P INPUT ACCEPT\n-N FOO\n-A FOO -s 10.0.0.1/32 -j ACCEPT\n")
+		}
+		record(args[3])
+		return 0, nil
+	})
+	var err error
+	ipt, err = New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	ops, err := ipt.NewReconciler().Apply(map[string]map[string][][]string{
+		"filter": {"FOO": {{"-j", "DROP"}}},
+	})
+	if err != nil || len(ops) != 2 {
+		t.Fatalf("unexpected Apply result %+v, %v", ops, err)
+	}
+	if err := <-appended; err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if !reflect.DeepEqual(events, []string{"-S", "restore", "-A"}) {
+		t.Fatalf("expected the change to wait for the commit, got %q", events)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Recorder captures the changes made through the handles it is attached
+// to with Record, so that they can be checked against a golden master or
+// replayed elsewhere, e.g. on another host, in another network namespace,
+// or into an iptablestest.Fake. A Recorder is safe for concurrent use and
+// may be shared by several handles.
+type Recorder struct {
+	mu  sync.Mutex
+	ops []Operation
+}
+
+// NewRecorder returns an empty Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Record makes the handle report every change it makes successfully to r.
+// Changes are recorded as the operations passed to AdmissionControl, so
+// the changes made with Restore, RestoreAll and Transaction.Commit are
+// recorded line by line.
+func Record(r *Recorder) option {
+	return func(ipt *IPTables) {
+		ipt.recorder = r
+	}
+}
+
+// record appends ops to the recorded operations; r may be nil.
+func (r *Recorder) record(ops ...Operation) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ops = append(r.ops, ops...)
+}
+
+// Operations returns the recorded operations, in the order they were made.
+func (r *Recorder) Operations() []Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Operation(nil), r.ops...)
+}
+
+// Reset forgets the recorded operations.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ops = nil
+}
+
+// Replay makes the recorded operations again through w, see Replay.
+func (r *Recorder) Replay(w Writer) error {
+	return Replay(w, r.Operations())
+}
+
+// Replay makes ops through w in order, stopping at the first failure. The
+// operations are replayed as they were recorded, whatever the family of
+// w. Flushing a chain is replayed with ClearChain, and zeroing counters is
+// only replayed on an *IPTables, as Writer can't do either otherwise.
+func Replay(w Writer, ops []Operation) error {
+	ipt, _ := w.(*IPTables)
+	for _, op := range ops {
+		var err error
+		switch op.Kind {
+		case "append":
+			err = w.Append(op.Table, op.Chain, op.Rulespec...)
+		case "insert":
+			err = w.Insert(op.Table, op.Chain, op.Pos, op.Rulespec...)
+		case "replace":
+			err = w.Replace(op.Table, op.Chain, op.Pos, op.Rulespec...)
+		case "delete":
+			if op.Pos > 0 {
+				err = w.DeleteById(op.Table, op.Chain, op.Pos)
+			} else {
+				err = w.Delete(op.Table, op.Chain, op.Rulespec...)
+			}
+		case "new-chain":
+			err = w.NewChain(op.Table, op.Chain)
+		case "clear-chain":
+			err = w.ClearChain(op.Table, op.Chain)
+		case "flush":
+			switch {
+			case op.Chain == "":
+				err = w.FlushTable(op.Table)
+			case ipt != nil:
+				err = ipt.run("-t", op.Table, "-F", op.Chain)
+			default:
+				err = w.ClearChain(op.Table, op.Chain)
+			}
+		case "rename-chain":
+			err = w.RenameChain(op.Table, op.Chain, op.NewName)
+		case "delete-chain":
+			err = w.DeleteChain(op.Table, op.Chain)
+		case "policy":
+			err = w.SetPolicy(op.Table, op.Chain, op.Policy)
+		case "zero":
+			if ipt != nil {
+				err = ipt.run(zeroArgs(op)...)
+			}
+		default:
+			err = fmt.Errorf("unsupported operation %q", op.Kind)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	return nil
+}
+
+// zeroArgs returns the iptables arguments of a zero operation.
+func zeroArgs(op Operation) []string {
+	args := []string{"-t", op.Table, "-Z"}
+	if op.Chain != "" {
+		args = append(args, op.Chain)
+		if op.Pos > 0 {
+			args = append(args, fmt.Sprint(op.Pos))
+		}
+	}
+	return args
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	var calls []string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, strings.Join(args, " "))
+		if args[len(args)-2] == "fail" {
+			return 2, nil
+		}
+		return 0, nil
+	})
+	r := NewRecorder()
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"), Record(r))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := ipt.NewChain("nat", "FOO"); err != nil {
+		t.Fatalf("NewChain failed: %v", err)
+	}
+	if err := ipt.Append("nat", "FOO", "-j", "MASQUERADE"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if _, err := ipt.Exists("nat", "FOO", "-j", "MASQUERADE"); err != nil {
+		t.Fatalf("Exists failed: %v", err)
+	}
+	if err := ipt.Append("nat", "FOO", "-j", "fail"); err == nil {
+		t.Fatalf("expected the append to fail")
+	}
+	if err := ipt.RestoreAll(map[string]map[string][][]string{"filter": {"BAR": {{"-j", "DROP"}}}}, RestoreNoFlush()); err != nil {
+		t.Fatalf("RestoreAll failed: %v", err)
+	}
+	if err := ipt.DeleteById("nat", "FOO", 1); err != nil {
+		t.Fatalf("DeleteById failed: %v", err)
+	}
+
+	expected := []string{
+		"new-chain nat/FOO",
+		"append nat/FOO -j MASQUERADE",
+		"clear-chain filter/BAR",
+		"flush filter/BAR",
+		"append filter/BAR -j DROP",
+		"delete nat/FOO",
+	}
+	var recorded []string
+	for _, op := range r.Operations() {
+		recorded = append(recorded, op.String())
+	}
+	if !reflect.DeepEqual(recorded, expected) {
+		t.Fatalf("recorded mismatch: \ngot  %q \nneed %q", recorded, expected)
+	}
+
+	calls = nil
+	other, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := r.Replay(other); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	replayed := []string{
+		"iptables -t nat -N FOO --wait",
+		"iptables -t nat -A FOO -j MASQUERADE --wait",
+		"iptables -t filter -N BAR --wait",
+		"iptables -t filter -F BAR --wait",
+		"iptables -t filter -A BAR -j DROP --wait",
+		"iptables -t nat -D FOO 1 --wait",
+	}
+	if !reflect.DeepEqual(calls, replayed) {
+		t.Fatalf("replayed mismatch: \ngot  %q \nneed %q", calls, replayed)
+	}
+
+	r.Reset()
+	if ops := r.Operations(); len(ops) != 0 {
+		t.Fatalf("Reset left %v", ops)
+	}
+}
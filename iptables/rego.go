@@ -0,0 +1,165 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// RegoEvaluator evaluates a Rego policy query against an input document,
+// returning the value of the query (e.g. the first expression of the
+// first result of an OPA rego.PreparedEvalQuery), or nil if it is
+// undefined.
+//
+// This package does not embed a Rego evaluator: the module has no
+// dependencies, and vendoring OPA into every user of go-iptables would be
+// out of proportion. Agents enforcing Rego policies load the policy bundle
+// with OPA themselves and wrap the prepared query:
+//
+//	query, err := rego.New(
+//		rego.Query("data.iptables.admission"),
+//		rego.LoadBundle("/etc/agent/policy-bundle"),
+//	).PrepareForEval(ctx)
+//	...
+//	eval := iptables.RegoEvaluatorFunc(func(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+//		rs, err := query.Eval(ctx, rego.EvalInput(input))
+//		if err != nil || len(rs) == 0 {
+//			return nil, err
+//		}
+//		return rs[0].Expressions[0].Value, nil
+//	})
+//	ipt, err := iptables.New(iptables.AdmissionControl(iptables.RegoAdmission(eval)))
+type RegoEvaluator interface {
+	Evaluate(ctx context.Context, input map[string]interface{}) (interface{}, error)
+}
+
+// RegoEvaluatorFunc adapts an ordinary function to the RegoEvaluator
+// interface.
+type RegoEvaluatorFunc func(ctx context.Context, input map[string]interface{}) (interface{}, error)
+
+// Evaluate calls f(ctx, input).
+func (f RegoEvaluatorFunc) Evaluate(ctx context.Context, input map[string]interface{}) (interface{}, error) {
+	return f(ctx, input)
+}
+
+// RegoAdmission returns an Admission deciding with a Rego policy. The
+// policy gets the document returned by Operation.Input as input, and its
+// decision is either a boolean, or an object with an "allow" boolean
+// and/or a "deny" set of messages, e.g.
+//
+//	package iptables.admission
+//
+//	deny[msg] {
+//		input.chain == "INPUT"
+//		input.rule.target == "ACCEPT"
+//		not input.rule.source
+//		msg := "INPUT must not accept traffic from anywhere"
+//	}
+//
+// An operation is rejected if any deny message is set, if allow is false,
+// or if the decision is undefined.
+func RegoAdmission(eval RegoEvaluator) Admission {
+	return AdmissionFunc(func(op Operation) error {
+		decision, err := eval.Evaluate(context.Background(), op.Input())
+		if err != nil {
+			return fmt.Errorf("evaluating policy: %v", err)
+		}
+		return regoDecision(decision)
+	})
+}
+
+// regoDecision interprets the value of an admission policy.
+func regoDecision(decision interface{}) error {
+	switch d := decision.(type) {
+	case nil:
+		return fmt.Errorf("policy returned no decision")
+	case bool:
+		if !d {
+			return fmt.Errorf("denied by policy")
+		}
+		return nil
+	case map[string]interface{}:
+		if deny, ok := d["deny"].([]interface{}); ok && len(deny) > 0 {
+			msgs := make([]string, len(deny))
+			for i, msg := range deny {
+				msgs[i] = fmt.Sprint(msg)
+			}
+			return fmt.Errorf("denied by policy: %s", strings.Join(msgs, "; "))
+		}
+		allow, ok := d["allow"]
+		if ok && allow != true {
+			return fmt.Errorf("denied by policy")
+		}
+		if _, hasDeny := d["deny"]; !ok && !hasDeny {
+			return fmt.Errorf("policy returned no decision")
+		}
+		return nil
+	}
+	return fmt.Errorf("unexpected policy decision %#v", decision)
+}
+
+// Input returns the operation as a JSON-like document, for policy engines:
+//
+//	{"kind": "append", "family": "ipv4", "table": "filter", "chain": "INPUT",
+//	 "rulespec": ["-p", "tcp", ...], "rule": {...}}
+//
+// "rule" holds the rule in the form of Rule's JSON encoding, and is only
+// set for operations carrying a rulespec. "pos", "policy" and "newName"
+// are only set when relevant.
+func (op Operation) Input() map[string]interface{} {
+	input := map[string]interface{}{
+		"kind":   op.Kind,
+		"family": familyName(op.Proto),
+		"table":  op.Table,
+		"chain":  op.Chain,
+	}
+	if op.Pos != 0 {
+		input["pos"] = op.Pos
+	}
+	if op.Policy != "" {
+		input["policy"] = op.Policy
+	}
+	if op.NewName != "" {
+		input["newName"] = op.NewName
+	}
+	if len(op.Rulespec) > 0 {
+		rulespec := make([]interface{}, len(op.Rulespec))
+		for i, arg := range op.Rulespec {
+			rulespec[i] = arg
+		}
+		input["rulespec"] = rulespec
+		if rule, err := op.Rule(); err == nil {
+			if doc, err := ruleInput(rule); err == nil {
+				input["rule"] = doc
+			}
+		}
+	}
+	return input
+}
+
+// ruleInput returns rule as a JSON-like document, following its JSON
+// encoding.
+func ruleInput(rule Rule) (map[string]interface{}, error) {
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	err = json.Unmarshal(data, &doc)
+	return doc, err
+}
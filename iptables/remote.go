@@ -0,0 +1,95 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Transport runs shell command lines on a remote host, e.g. over SSH.
+//
+// An adapter for golang.org/x/crypto/ssh is a few lines long:
+//
+//	type sshTransport struct{ client *ssh.Client }
+//
+//	func (t sshTransport) Exec(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) error {
+//		s, err := t.client.NewSession()
+//		if err != nil {
+//			return err
+//		}
+//		defer s.Close()
+//		s.Stdin, s.Stdout, s.Stderr = stdin, stdout, stderr
+//		return s.Run(command)
+//	}
+type Transport interface {
+	// Exec runs command on the remote host, feeding it stdin and copying
+	// its output to stdout and stderr. A non-zero exit status must be
+	// reported as an error with an ExitStatus() int method, as
+	// *ssh.ExitError does; any other error means the command could not be
+	// run.
+	Exec(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) error
+}
+
+// TransportFunc adapts an ordinary function to the Transport interface.
+type TransportFunc func(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) error
+
+// Exec calls f(ctx, command, stdin, stdout, stderr).
+func (f TransportFunc) Exec(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) error {
+	return f(ctx, command, stdin, stdout, stderr)
+}
+
+// RemoteRunner returns a Runner executing commands on the remote host t
+// connects to. The arguments are quoted for a POSIX shell, so the remote
+// account must use one.
+func RemoteRunner(t Transport) Runner {
+	return RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		if err := ctx.Err(); err != nil {
+			return -1, err
+		}
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = shellQuote(arg)
+		}
+		err := t.Exec(ctx, strings.Join(quoted, " "), stdin, stdout, stderr)
+		if e, ok := err.(interface{ ExitStatus() int }); ok {
+			return e.ExitStatus(), nil
+		}
+		if err != nil {
+			return -1, err
+		}
+		return 0, nil
+	})
+}
+
+// NewRemote returns a handle managing the rules of the remote host t
+// connects to. All commands, including the version probe, run remotely;
+// their output is parsed locally as usual. See New for the options.
+func NewRemote(t Transport, opts ...option) (*IPTables, error) {
+	return New(append(opts, CommandRunner(RemoteRunner(t)))...)
+}
+
+// shellSafeRegex matches the arguments a POSIX shell leaves alone.
+var shellSafeRegex = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote quotes arg for a POSIX shell.
+func shellQuote(arg string) string {
+	if shellSafeRegex.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
@@ -0,0 +1,72 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+type exitStatusError int
+
+func (e exitStatusError) Error() string {
+	return fmt.Sprintf("Process exited with status %d", int(e))
+}
+
+func (e exitStatusError) ExitStatus() int {
+	return int(e)
+}
+
+func TestRemoteRunner(t *testing.T) {
+	var commands []string
+	transport := TransportFunc(func(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) error {
+		commands = append(commands, command)
+		switch {
+		case command == "ip6tables --version":
+			io.WriteString(stdout, "ip6tables v1.8.9 (nf_tables)\n")
+		case command == "unreachable":
+			return errors.New("connection reset")
+		default:
+			io.WriteString(stderr, "ip6tables: Bad rule (does a matching rule exist in that chain?).\n")
+			return exitStatusError(1)
+		}
+		return nil
+	})
+
+	ipt, err := NewRemote(transport, IPFamily(ProtocolIPv6))
+	if err != nil {
+		t.Fatalf("NewRemote failed: %v", err)
+	}
+	if ipt.Profile() != "1.8.9-nft" {
+		t.Fatalf("unexpected profile %s", ipt.Profile())
+	}
+
+	err = ipt.Delete("filter", "INPUT", "-m", "comment", "--comment", "it's remote", "-j", "ACCEPT")
+	if e, ok := err.(*Error); !ok || !e.IsNotExist() {
+		t.Fatalf("expected a not exist error, got %v", err)
+	}
+	expected := `ip6tables -t filter -D INPUT -m comment --comment 'it'\''s remote' -j ACCEPT --wait`
+	if commands[1] != expected {
+		t.Fatalf("command mismatch: \ngot  %s \nneed %s", commands[1], expected)
+	}
+
+	status, err := RemoteRunner(transport).Run(context.Background(), []string{"unreachable"}, nil, io.Discard, io.Discard)
+	if status != -1 || err == nil {
+		t.Fatalf("expected a transport error, got %d, %v", status, err)
+	}
+}
@@ -0,0 +1,446 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// helperPath returns the path of the companion tool with the given suffix
+// (e.g. "-restore") matching the iptables binary of this handle, so that
+// iptables-legacy is paired with iptables-legacy-restore and so on.
+func (ipt *IPTables) helperPath(suffix string) (string, error) {
+	var candidates []string
+	dir, base := filepath.Split(ipt.path)
+	if strings.HasPrefix(base, "iptables") || strings.HasPrefix(base, "ip6tables") {
+		candidates = append(candidates, filepath.Join(dir, base+suffix))
+	}
+	candidates = append(candidates, getIptablesCommand(ipt.proto)+suffix)
+
+	var err error
+	for _, c := range candidates {
+		var path string
+		if path, err = ipt.lookPath(c); err == nil {
+			return path, nil
+		}
+	}
+	return "", err
+}
+
+// RestoreOption configures a Restore, RestoreAll or ApplySaveFormat
+// invocation.
+type RestoreOption func(*restoreConfig)
+
+type restoreConfig struct {
+	noflush    bool
+	counters   bool
+	test       bool
+	wait       *int
+	progress   func(RestoreProgress)
+	appendOnly map[string]map[string]bool
+	tables     map[string]bool
+}
+
+// RestoreNoFlush passes --noflush, leaving the chains that are not part of
+// the restored rules untouched.
+func RestoreNoFlush() RestoreOption {
+	return func(c *restoreConfig) {
+		c.noflush = true
+	}
+}
+
+// RestoreAppendOnly makes the restore append the rules of the given chains
+// of table to the existing ones instead of replacing them, as if the
+// chains weren't declared in the iptables-restore input, while the other
+// chains of the map are still flushed first. The chains must exist. As
+// iptables-restore replaces entire tables without --noflush, it implies
+// RestoreNoFlush.
+func RestoreAppendOnly(table string, chains ...string) RestoreOption {
+	return func(c *restoreConfig) {
+		c.noflush = true
+		if c.appendOnly == nil {
+			c.appendOnly = map[string]map[string]bool{}
+		}
+		if c.appendOnly[table] == nil {
+			c.appendOnly[table] = map[string]bool{}
+		}
+		for _, chain := range chains {
+			c.appendOnly[table][chain] = true
+		}
+	}
+}
+
+// flushed returns the chains of table, in order, whose rules the restore
+// replaces rather than appends to.
+func (c restoreConfig) flushed(table string, chains []string) []string {
+	if len(c.appendOnly[table]) == 0 {
+		return chains
+	}
+	var flushed []string
+	for _, chain := range chains {
+		if !c.appendOnly[table][chain] {
+			flushed = append(flushed, chain)
+		}
+	}
+	return flushed
+}
+
+// RestoreCounters passes --counters, restoring the packet and byte counters
+// given in the rules ("-c pkts bytes") and chain definitions.
+func RestoreCounters() RestoreOption {
+	return func(c *restoreConfig) {
+		c.counters = true
+	}
+}
+
+// RestoreTables restricts ApplySaveFormat to the given tables, leaving
+// the other tables of its input alone.
+func RestoreTables(tables ...string) RestoreOption {
+	return func(c *restoreConfig) {
+		if c.tables == nil {
+			c.tables = map[string]bool{}
+		}
+		for _, table := range tables {
+			c.tables[table] = true
+		}
+	}
+}
+
+// RestoreWait overrides the time, in seconds, iptables-restore waits for
+// the xtables lock. 0 waits forever. By default the handle's Timeout is
+// used.
+func RestoreWait(seconds int) RestoreOption {
+	return func(c *restoreConfig) {
+		c.wait = &seconds
+	}
+}
+
+// Restore replaces the rules of the given chains of table with the ones in
+// the map, which holds a list of rulespecs per chain. Chains are created
+// if needed. Without RestoreNoFlush, table is replaced entirely: the other
+// user-defined chains of table are deleted and the rules of its other
+// builtin chains too; see RestoreChains to leave them alone.
+func (ipt *IPTables) Restore(table string, chains map[string][][]string, opts ...RestoreOption) error {
+	return ipt.RestoreAll(map[string]map[string][][]string{table: chains}, opts...)
+}
+
+// RestoreChains acts like Restore for the chains a caller owns in a table
+// shared with other agents, e.g. the nat table of a node running several
+// controllers: only the given chains are declared and flushed, with
+// --noflush, and the other chains of table are left untouched. Builtin
+// chains are shared, and refused with a *BuiltinChainError without running
+// anything; jump to the owned chains from them with InsertUnique or
+// AppendUnique instead.
+func (ipt *IPTables) RestoreChains(table string, chains map[string][][]string, opts ...RestoreOption) error {
+	for _, chain := range sortedKeys(chains) {
+		if err := checkNotBuiltin("restore", table, chain); err != nil {
+			return err
+		}
+	}
+	return ipt.Restore(table, chains, append(opts, RestoreNoFlush())...)
+}
+
+// RestoreAll acts like Restore for several tables at once, applying all of
+// them with a single iptables-restore invocation. Without RestoreNoFlush,
+// each of the given tables is replaced entirely, as iptables-restore does
+// by default: the rules of the builtin chains that are not in the map are
+// deleted, and so are the user-defined chains that are not in the map,
+// including the ones of other programs.
+func (ipt *IPTables) RestoreAll(tables map[string]map[string][][]string, opts ...RestoreOption) error {
+	return ipt.RestoreAllContext(context.Background(), tables, opts...)
+}
+
+// RestoreProgress reports how far the input of a restore was written.
+type RestoreProgress struct {
+	// Table and Chain are the last chain written; Chain is empty once the
+	// table is complete
+	Table string
+	Chain string
+	// Bytes is the size of the input written so far
+	Bytes int64
+}
+
+// RestoreOnProgress makes RestoreAllContext call fn every time the rules
+// of a chain were written to iptables-restore.
+func RestoreOnProgress(fn func(RestoreProgress)) RestoreOption {
+	return func(c *restoreConfig) {
+		c.progress = fn
+	}
+}
+
+// RestoreAllContext acts like RestoreAll, streaming the input to
+// iptables-restore one chain at a time instead of building it in memory
+// first, so that large rulesets keep memory usage flat.
+//
+// If ctx is done before all the input was written, iptables-restore is
+// given truncated input, which it rejects, and ctx.Err() is returned. As
+// each table is applied on its own, tables written entirely before the
+// cancellation may have been applied nonetheless.
+func (ipt *IPTables) RestoreAllContext(ctx context.Context, tables map[string]map[string][][]string, opts ...RestoreOption) error {
+	var cfg restoreConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	ops := restoreOperations(ipt.proto, tables, cfg)
+	if err := checkDeprecatedOperations(ops...); err != nil {
+		return err
+	}
+	if ipt.admission != nil {
+		for _, op := range ops {
+			if err := ipt.admission.Admit(op); err != nil {
+				return &AdmissionError{op, err}
+			}
+		}
+	}
+
+	defer ipt.beginRestore()()
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	var werr error
+	go func() {
+		defer close(done)
+		werr = writeRestorePayload(ctx, pw, tables, cfg)
+		pw.CloseWithError(werr)
+	}()
+	err := ipt.runRestore(pr, opts...)
+	// unblock the writer if iptables-restore exited early
+	pr.Close()
+	<-done
+
+	// the input was truncated by ctx, rather than by an early exit
+	if werr != nil && werr == ctx.Err() {
+		return werr
+	}
+	if err != nil {
+		return err
+	}
+	ipt.recorder.record(ops...)
+	return nil
+}
+
+// restoreAllPayload builds the iptables-restore input for RestoreAll.
+func restoreAllPayload(tables map[string]map[string][][]string, cfg restoreConfig) []byte {
+	var buf bytes.Buffer
+	// writing to a bytes.Buffer never fails
+	_ = writeRestorePayload(context.Background(), &buf, tables, cfg)
+	return buf.Bytes()
+}
+
+// writeRestorePayload writes the iptables-restore input for RestoreAll to
+// w, a chain at a time, checking ctx and reporting progress in between.
+func writeRestorePayload(ctx context.Context, w io.Writer, tables map[string]map[string][][]string, cfg restoreConfig) error {
+	var p restorePayload
+	var written int64
+	flush := func(table, chain string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := w.Write(p.Bytes())
+		written += int64(n)
+		p.buf.Reset()
+		if err == nil && cfg.progress != nil {
+			cfg.progress(RestoreProgress{table, chain, written})
+		}
+		return err
+	}
+
+	for _, table := range sortedKeys(tables) {
+		chains := tables[table]
+		names := sortedKeys(chains)
+		flushed := cfg.flushed(table, names)
+		p.raw("*%s", table)
+		for _, chain := range flushed {
+			p.raw(":%s - [0:0]", chain)
+		}
+		if cfg.noflush {
+			// with --noflush, declaring a builtin chain doesn't flush it
+			for _, chain := range flushed {
+				p.line("-F", chain)
+			}
+		}
+		for _, chain := range names {
+			for _, rule := range chains[chain] {
+				p.line(append([]string{"-A", chain}, rule...)...)
+			}
+			if err := flush(table, chain); err != nil {
+				return err
+			}
+		}
+		p.raw("COMMIT")
+		if err := flush(table, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreOperations returns the operations performed by the input
+// restoreAllPayload builds, for admission.
+func restoreOperations(proto Protocol, tables map[string]map[string][][]string, cfg restoreConfig) []Operation {
+	var ops []Operation
+	for _, table := range sortedKeys(tables) {
+		chains := tables[table]
+		names := sortedKeys(chains)
+		flushed := cfg.flushed(table, names)
+		for _, chain := range flushed {
+			ops = append(ops, Operation{Kind: "clear-chain", Proto: proto, Table: table, Chain: chain})
+		}
+		if cfg.noflush {
+			for _, chain := range flushed {
+				ops = append(ops, Operation{Kind: "flush", Proto: proto, Table: table, Chain: chain})
+			}
+		}
+		for _, chain := range names {
+			for _, rule := range chains[chain] {
+				ops = append(ops, Operation{Kind: "append", Proto: proto, Table: table, Chain: chain, Rulespec: rule})
+			}
+		}
+	}
+	return ops
+}
+
+// runRestore feeds payload to iptables-restore, holding the xtables lock
+// (and the RestoreLock, if configured) while doing so.
+func (ipt *IPTables) runRestore(payload io.Reader, opts ...RestoreOption) error {
+	var cfg restoreConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	path, err := ipt.helperPath("-restore")
+	if err != nil {
+		return err
+	}
+	if ipt.restoreLock != nil {
+		if err := ipt.restoreLock.Acquire(); err != nil {
+			return err
+		}
+	}
+	args := []string{path}
+	if cfg.noflush {
+		args = append(args, "--noflush")
+	}
+	if cfg.counters {
+		args = append(args, "--counters")
+	}
+	if cfg.test {
+		args = append(args, "--test")
+	}
+	if ipt.hasRestoreWait {
+		timeout, _ := ipt.WaitTuning()
+		if cfg.wait != nil {
+			timeout = *cfg.wait
+		}
+		if timeout != 0 {
+			args = append(args, "--wait="+strconv.Itoa(timeout))
+		} else {
+			args = append(args, "--wait")
+		}
+		if ipt.waitInterval > 0 {
+			args = append(args, "--wait-interval="+strconv.FormatInt(ipt.waitInterval.Microseconds(), 10))
+		}
+	} else if ipt.runner == nil {
+		// as for iptables, the local lock doesn't protect the host a
+		// Runner runs commands on
+		ul, err := lockXtables(ipt.lockFilePath())
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = ul.Unlock()
+		}()
+	}
+
+	return ipt.runCommand(args, payload, nil)
+}
+
+// ValidateRestorePayload runs payload, in iptables-restore format, through
+// iptables-restore --test, which parses it and checks it against the
+// running iptables without committing anything, so that generated rulesets
+// can be validated before being applied. opts such as RestoreNoFlush are
+// passed on, as they change how the payload is interpreted.
+func (ipt *IPTables) ValidateRestorePayload(payload []byte, opts ...RestoreOption) error {
+	if ipt.quirks.busybox {
+		return fmt.Errorf("iptables-restore --test is not supported by BusyBox")
+	}
+	return ipt.runRestore(bytes.NewReader(payload), append(opts, func(c *restoreConfig) {
+		c.test = true
+	})...)
+}
+
+// sortedKeys returns the keys of m in order, for deterministic payloads.
+func sortedKeys(m interface{}) []string {
+	v := reflect.ValueOf(m)
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// runSave runs iptables-save with the given arguments, writing its output
+// to the given writer.
+func (ipt *IPTables) runSave(stdout io.Writer, args ...string) error {
+	path, err := ipt.helperPath("-save")
+	if err != nil {
+		return err
+	}
+	return ipt.runCommand(append([]string{path}, args...), nil, stdout)
+}
+
+// restorePayload accumulates iptables-restore input, one table at a time.
+type restorePayload struct {
+	buf bytes.Buffer
+	// lines is the number of lines written so far
+	lines int
+}
+
+// line writes a single line made of args, quoting them as needed.
+func (p *restorePayload) line(args ...string) {
+	for i, arg := range args {
+		if i > 0 {
+			p.buf.WriteByte(' ')
+		}
+		p.buf.WriteString(quoteRuleArg(arg))
+	}
+	p.buf.WriteByte('\n')
+	p.lines++
+}
+
+// raw writes a line verbatim.
+func (p *restorePayload) raw(format string, a ...interface{}) {
+	fmt.Fprintf(&p.buf, format, a...)
+	p.buf.WriteByte('\n')
+	p.lines++
+}
+
+func (p *restorePayload) Bytes() []byte {
+	return p.buf.Bytes()
+}
+
+// Checks if an iptables version is after 1.6.2, when iptables-restore
+// learned to take the xtables lock (--wait)
+func iptablesRestoreHasWait(v1 int, v2 int, v3 int) bool {
+	return iptablesHasRandomFully(v1, v2, v3)
+}
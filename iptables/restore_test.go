@@ -0,0 +1,396 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRestoreAllPayload(t *testing.T) {
+	tables := map[string]map[string][][]string{
+		"nat": {
+			"POSTROUTING": {{"-s", "10.0.0.0/8", "-j", "MASQUERADE"}},
+		},
+		"filter": {
+			"MY-CHAIN": {
+				{"-m", "comment", "--comment", "allow web", "-p", "tcp", "--dport", "80", "-j", "ACCEPT"},
+				{"-j", "DROP"},
+			},
+			"INPUT": {{"-j", "MY-CHAIN"}},
+		},
+	}
+
+	testCases := []struct {
+		name string
+		cfg  restoreConfig
+		out  string
+	}{
+		{
+			"flush",
+			restoreConfig{},
+			`*filter
+:INPUT - [0:0]
+:MY-CHAIN - [0:0]
+-A INPUT -j MY-CHAIN
+-A MY-CHAIN -m comment --comment "allow web" -p tcp --dport 80 -j ACCEPT
+-A MY-CHAIN -j DROP
+COMMIT
+*nat
+:POSTROUTING - [0:0]
+-A POSTROUTING -s 10.0.0.0/8 -j MASQUERADE
+COMMIT
+`,
+		},
+		{
+			"noflush",
+			restoreConfig{noflush: true},
+			`*filter
+:INPUT - [0:0]
+:MY-CHAIN - [0:0]
+-F INPUT
+-F MY-CHAIN
+-A INPUT -j MY-CHAIN
+-A MY-CHAIN -m comment --comment "allow web" -p tcp --dport 80 -j ACCEPT
+-A MY-CHAIN -j DROP
+COMMIT
+*nat
+:POSTROUTING - [0:0]
+-F POSTROUTING
+-A POSTROUTING -s 10.0.0.0/8 -j MASQUERADE
+COMMIT
+`,
+		},
+		{
+			"append-only",
+			func() restoreConfig {
+				var cfg restoreConfig
+				RestoreAppendOnly("filter", "INPUT")(&cfg)
+				return cfg
+			}(),
+			`*filter
+:MY-CHAIN - [0:0]
+-F MY-CHAIN
+-A INPUT -j MY-CHAIN
+-A MY-CHAIN -m comment --comment "allow web" -p tcp --dport 80 -j ACCEPT
+-A MY-CHAIN -j DROP
+COMMIT
+*nat
+:POSTROUTING - [0:0]
+-F POSTROUTING
+-A POSTROUTING -s 10.0.0.0/8 -j MASQUERADE
+COMMIT
+`,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := string(restoreAllPayload(tables, tt.cfg))
+			if actual != tt.out {
+				t.Fatalf("expect\n%s\nactual\n%s", tt.out, actual)
+			}
+		})
+	}
+}
+
+func TestWriteRestorePayloadProgress(t *testing.T) {
+	tables := map[string]map[string][][]string{
+		"filter": {
+			"A": {{"-j", "ACCEPT"}},
+			"B": {{"-j", "DROP"}},
+		},
+	}
+
+	var progress []RestoreProgress
+	cfg := restoreConfig{progress: func(p RestoreProgress) { progress = append(progress, p) }}
+	var buf bytes.Buffer
+	if err := writeRestorePayload(context.Background(), &buf, tables, cfg); err != nil {
+		t.Fatal(err)
+	}
+	expected := []RestoreProgress{
+		{"filter", "A", 45},
+		{"filter", "B", 58},
+		{"filter", "", 65},
+	}
+	if !reflect.DeepEqual(progress, expected) {
+		t.Fatalf("progress mismatch: \ngot  %v \nneed %v", progress, expected)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := writeRestorePayload(ctx, &buf, tables, cfg); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestAppendMany(t *testing.T) {
+	var calls [][]string
+	var payload bytes.Buffer
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, args)
+		if stdin != nil {
+			payload.ReadFrom(stdin)
+		}
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := ipt.AppendMany("filter", "AGENT", nil); err != nil || len(calls) != 0 {
+		t.Fatalf("AppendMany without rules ran %q, %v", calls, err)
+	}
+	err = ipt.AppendMany("filter", "AGENT", [][]string{
+		{"-i", "lo", "-j", "ACCEPT"},
+		{"-m", "comment", "--comment", "drop the rest", "-j", "DROP"},
+	})
+	if err != nil {
+		t.Fatalf("AppendMany failed: %v", err)
+	}
+	if len(calls) != 1 || calls[0][0] != "iptables-restore" || calls[0][1] != "--noflush" {
+		t.Fatalf("unexpected invocations %q", calls)
+	}
+	expected := `*filter
+-A AGENT -i lo -j ACCEPT
+-A AGENT -m comment --comment "drop the rest" -j DROP
+COMMIT
+`
+	if payload.String() != expected {
+		t.Fatalf("unexpected payload:\n%s", payload.String())
+	}
+}
+
+func TestValidateRestorePayload(t *testing.T) {
+	var args []string
+	runner := RunnerFunc(func(ctx context.Context, a []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		args = a
+		data, _ := io.ReadAll(stdin)
+		if bytes.Contains(data, []byte("BOGUS")) {
+			io.WriteString(stderr, "iptables-restore v1.8.7 (nf_tables): Couldn't load target `BOGUS':No such file or directory\nError occurred at line: 2\n")
+			return 2, nil
+		}
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := ipt.ValidateRestorePayload([]byte("*filter\n-A INPUT -j ACCEPT\nCOMMIT\n"), RestoreNoFlush()); err != nil {
+		t.Fatalf("ValidateRestorePayload failed: %v", err)
+	}
+	if !reflect.DeepEqual(args[:3], []string{"iptables-restore", "--noflush", "--test"}) {
+		t.Fatalf("unexpected arguments %q", args)
+	}
+	if err := ipt.ValidateRestorePayload([]byte("*filter\n-A INPUT -j BOGUS\nCOMMIT\n")); err == nil {
+		t.Fatalf("expected an invalid payload to be rejected")
+	}
+}
+
+func TestApplySaveFormat(t *testing.T) {
+	var calls [][]string
+	var payload bytes.Buffer
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, args)
+		payload.Reset()
+		if stdin != nil {
+			payload.ReadFrom(stdin)
+		}
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	input := `# Generated by iptables-save v1.8.7
+*nat
+:PREROUTING ACCEPT [3:180]
+:POSTROUTING ACCEPT [0:0]
+-A POSTROUTING -o eth0 -j MASQUERADE
+COMMIT
+*filter
+:INPUT DROP [10:600]
+:FORWARD ACCEPT [0:0]
+:AGENT - [0:0]
+[5:300] -A INPUT -i lo -j ACCEPT
+-A INPUT -m comment --comment "agent rules" -j AGENT
+COMMIT
+`
+	for _, tc := range []struct {
+		opts     []RestoreOption
+		args     []string
+		expected string
+	}{
+		{
+			nil,
+			[]string{"iptables-restore", "--wait"},
+			`*nat
+:PREROUTING ACCEPT
+:POSTROUTING ACCEPT
+-A POSTROUTING -o eth0 -j MASQUERADE
+COMMIT
+*filter
+:INPUT DROP
+:FORWARD ACCEPT
+:AGENT -
+-A INPUT -i lo -j ACCEPT
+-A INPUT -m comment --comment "agent rules" -j AGENT
+COMMIT
+`,
+		},
+		{
+			[]RestoreOption{RestoreTables("filter"), RestoreNoFlush(), RestoreCounters()},
+			[]string{"iptables-restore", "--noflush", "--counters", "--wait"},
+			`*filter
+:INPUT DROP [10:600]
+:FORWARD ACCEPT [0:0]
+:AGENT - [0:0]
+-F INPUT
+-F FORWARD
+-F AGENT
+[5:300] -A INPUT -i lo -j ACCEPT
+[0:0] -A INPUT -m comment --comment "agent rules" -j AGENT
+COMMIT
+`,
+		},
+	} {
+		calls = nil
+		if err := ipt.ApplySaveFormat(strings.NewReader(input), tc.opts...); err != nil {
+			t.Fatalf("ApplySaveFormat failed: %v", err)
+		}
+		if len(calls) != 1 || !reflect.DeepEqual(calls[0], tc.args) {
+			t.Fatalf("unexpected invocations %q", calls)
+		}
+		if payload.String() != tc.expected {
+			t.Fatalf("payload mismatch: \ngot\n%s\nneed\n%s", payload.String(), tc.expected)
+		}
+	}
+
+	calls = nil
+	if err := ipt.ApplySaveFormat(strings.NewReader("*filter\n-A INPUT -j ACCEPT\n")); err == nil || len(calls) != 0 {
+		t.Fatalf("expected malformed input to be rejected without running anything, got %v", err)
+	}
+	if err := ipt.ApplySaveFormat(strings.NewReader(input), RestoreTables("raw")); err != nil || len(calls) != 0 {
+		t.Fatalf("expected nothing to be applied, got %q, %v", calls, err)
+	}
+}
+
+func TestRestoreChains(t *testing.T) {
+	var calls [][]string
+	var payload bytes.Buffer
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, args)
+		if stdin != nil {
+			payload.ReadFrom(stdin)
+		}
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	err = ipt.RestoreChains("nat", map[string][][]string{
+		"AGENT-SNAT": {{"-s", "10.0.0.0/8", "-j", "MASQUERADE"}},
+		"AGENT-DNAT": {},
+	})
+	if err != nil {
+		t.Fatalf("RestoreChains failed: %v", err)
+	}
+	if len(calls) != 1 || !reflect.DeepEqual(calls[0][:2], []string{"iptables-restore", "--noflush"}) {
+		t.Fatalf("unexpected invocations %q", calls)
+	}
+	expected := `*nat
+:AGENT-DNAT - [0:0]
+:AGENT-SNAT - [0:0]
+-F AGENT-DNAT
+-F AGENT-SNAT
+-A AGENT-SNAT -s 10.0.0.0/8 -j MASQUERADE
+COMMIT
+`
+	if payload.String() != expected {
+		t.Fatalf("unexpected payload:\n%s", payload.String())
+	}
+
+	calls = nil
+	err = ipt.RestoreChains("nat", map[string][][]string{"POSTROUTING": {{"-j", "AGENT-SNAT"}}})
+	if !errors.Is(err, ErrBuiltinChain) || len(calls) != 0 {
+		t.Fatalf("expected the builtin chain to be refused, got %q, %v", calls, err)
+	}
+}
+
+func TestRestoreAllContextDone(t *testing.T) {
+	var cancel context.CancelFunc
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		data, _ := io.ReadAll(stdin)
+		if !bytes.HasSuffix(data, []byte("COMMIT\n")) {
+			io.WriteString(stderr, "iptables-restore: COMMIT expected at line 3\n")
+			return 1, nil
+		}
+		// ctx is done once all the input was written
+		cancel()
+		return 0, nil
+	})
+	r := NewRecorder()
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"), Record(r))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	tables := map[string]map[string][][]string{"filter": {"AGENT": {{"-j", "DROP"}}}}
+
+	var ctx context.Context
+	ctx, cancel = context.WithCancel(context.Background())
+	if err := ipt.RestoreAllContext(ctx, tables, RestoreNoFlush()); err != nil {
+		t.Fatalf("expected the complete restore to succeed, got %v", err)
+	}
+	if ops := r.Operations(); len(ops) != 3 {
+		t.Fatalf("expected the restore to be recorded, got %v", ops)
+	}
+
+	// truncated input
+	r.Reset()
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := ipt.RestoreAllContext(ctx, tables, RestoreNoFlush()); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if ops := r.Operations(); len(ops) != 0 {
+		t.Fatalf("expected nothing to be recorded, got %v", ops)
+	}
+}
+
+func TestRestoreWithoutWaitRunner(t *testing.T) {
+	var calls [][]string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, args)
+		return 0, nil
+	})
+	// iptables-restore 1.6.1 lacks --wait; the local lock file can't even
+	// be created, and mustn't be taken for the runner
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.6.1-legacy"), XtablesLockFile("/nonexistent/xtables.lock"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := ipt.Restore("filter", map[string][][]string{"AGENT": {{"-j", "DROP"}}}, RestoreNoFlush()); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if len(calls) != 1 || contains(calls[0], "--wait") {
+		t.Fatalf("unexpected invocations %q", calls)
+	}
+}
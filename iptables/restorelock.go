@@ -0,0 +1,185 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RestoreLock is an advisory lock, separate from the xtables lock, that
+// lets a single process own restore based reconciliation on a host. It is
+// meant for applications running several replicas on the same host, which
+// would otherwise keep overwriting each other's rules.
+//
+// The lock is held from the first successful Acquire until Release or the
+// exit of the process. While held, the owner writes a heartbeat to the lock
+// file so that other processes can tell who owns it and whether the owner
+// is still making progress.
+type RestoreLock struct {
+	path      string
+	owner     string
+	heartbeat time.Duration
+
+	mu   sync.Mutex
+	file *os.File
+	stop chan struct{}
+	done chan struct{}
+}
+
+// RestoreLockHeldError is returned when another process owns a RestoreLock.
+type RestoreLockHeldError struct {
+	Owner string
+	// Heartbeat is the last time the owner reported being alive
+	Heartbeat time.Time
+	// Stale is true if the owner missed several heartbeats
+	Stale bool
+}
+
+func (e *RestoreLockHeldError) Error() string {
+	msg := fmt.Sprintf("restore lock held by %q (last heartbeat %s)", e.Owner, e.Heartbeat.Format(time.RFC3339))
+	if e.Stale {
+		msg += ", owner looks stuck"
+	}
+	return msg
+}
+
+// NewRestoreLock returns a RestoreLock using the lock file at path,
+// identifying this process as owner and refreshing the heartbeat every
+// heartbeat interval, which must be positive.
+func NewRestoreLock(path, owner string, heartbeat time.Duration) (*RestoreLock, error) {
+	if heartbeat <= 0 {
+		return nil, fmt.Errorf("invalid heartbeat interval %v", heartbeat)
+	}
+	return &RestoreLock{path: path, owner: owner, heartbeat: heartbeat}, nil
+}
+
+// ExclusiveRestore makes every iptables-restore invocation of the handle
+// first acquire the given RestoreLock, failing with RestoreLockHeldError if
+// another process owns it.
+func ExclusiveRestore(l *RestoreLock) option {
+	return func(ipt *IPTables) {
+		ipt.restoreLock = l
+	}
+}
+
+// Acquire takes the lock without blocking. It is a no-op if the lock is
+// already held by this RestoreLock.
+func (l *RestoreLock) Acquire() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		return nil
+	}
+
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, defaultFilePerm)
+	if err != nil {
+		return err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		defer f.Close()
+		return l.heldError(f)
+	} else if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	if err := l.beat(); err != nil {
+		l.file = nil
+		f.Close()
+		return err
+	}
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go l.heartbeatLoop(l.stop, l.done)
+	return nil
+}
+
+// Held reports whether this RestoreLock currently owns the lock.
+func (l *RestoreLock) Held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file != nil
+}
+
+// Release stops the heartbeat and gives up the lock.
+func (l *RestoreLock) Release() error {
+	l.mu.Lock()
+	if l.file == nil {
+		l.mu.Unlock()
+		return nil
+	}
+	close(l.stop)
+	done := l.done
+	l.mu.Unlock()
+	<-done
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (l *RestoreLock) heartbeatLoop(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(l.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			_ = l.beat()
+			l.mu.Unlock()
+		}
+	}
+}
+
+// beat writes the owner and the current time to the lock file. Must be
+// called with l.mu held.
+func (l *RestoreLock) beat() error {
+	content := fmt.Sprintf("%s\n%d\n", l.owner, time.Now().Unix())
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := l.file.WriteAt([]byte(content), 0)
+	return err
+}
+
+// heldError describes the current owner from the lock file contents.
+func (l *RestoreLock) heldError(f *os.File) error {
+	buf := make([]byte, 512)
+	n, _ := f.ReadAt(buf, 0)
+	lines := strings.SplitN(string(buf[:n]), "\n", 3)
+
+	e := &RestoreLockHeldError{}
+	if len(lines) >= 2 {
+		e.Owner = lines[0]
+		if ts, err := strconv.ParseInt(lines[1], 10, 64); err == nil {
+			e.Heartbeat = time.Unix(ts, 0)
+			e.Stale = time.Since(e.Heartbeat) > 3*l.heartbeat
+		}
+	}
+	return e
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoreLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restorelock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "restore.lock")
+
+	l1, err := NewRestoreLock(path, "replica-1", time.Minute)
+	if err != nil {
+		t.Fatalf("NewRestoreLock failed: %v", err)
+	}
+	l2, err := NewRestoreLock(path, "replica-2", time.Minute)
+	if err != nil {
+		t.Fatalf("NewRestoreLock failed: %v", err)
+	}
+
+	if err := l1.Acquire(); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	if err := l1.Acquire(); err != nil {
+		t.Fatalf("Acquire of held lock failed: %v", err)
+	}
+
+	err = l2.Acquire()
+	e, ok := err.(*RestoreLockHeldError)
+	if !ok {
+		t.Fatalf("expected RestoreLockHeldError, got %v", err)
+	}
+	if e.Owner != "replica-1" || e.Stale {
+		t.Fatalf("unexpected owner %q (stale %t)", e.Owner, e.Stale)
+	}
+
+	if err := l1.Release(); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if err := l2.Acquire(); err != nil {
+		t.Fatalf("Acquire after release failed: %v", err)
+	}
+	if !l2.Held() || l1.Held() {
+		t.Fatal("lock ownership not transferred")
+	}
+	if err := l2.Release(); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+}
+
+func TestRestoreLockHeartbeat(t *testing.T) {
+	for _, heartbeat := range []time.Duration{0, -time.Second} {
+		if _, err := NewRestoreLock("/nonexistent/restore.lock", "replica-1", heartbeat); err == nil {
+			t.Fatalf("expected NewRestoreLock to reject heartbeat %v", heartbeat)
+		}
+	}
+}
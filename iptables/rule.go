@@ -0,0 +1,452 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Rule is the structured form of a single rule as printed by iptables -S.
+//
+// The builtin criteria (protocol, addresses and interfaces) are stored in
+// their own fields. A negated criterion keeps a leading "!", e.g. a rule
+// printed as "! -s 10.0.0.0/8" has Source "!10.0.0.0/8".
+type Rule struct {
+	Chain         string   `json:"chain"`
+	Protocol      string   `json:"protocol,omitempty"`
+	Source        string   `json:"source,omitempty"`
+	Destination   string   `json:"destination,omitempty"`
+	InInterface   string   `json:"in,omitempty"`
+	OutInterface  string   `json:"out,omitempty"`
+	Matches       []Match  `json:"matches,omitempty"`
+	Target        string   `json:"target,omitempty"`
+	Goto          bool     `json:"goto,omitempty"`
+	TargetOptions []string `json:"targetOptions,omitempty"`
+	Packets       uint64   `json:"pkts"`
+	Bytes         uint64   `json:"bytes"`
+}
+
+// Match is a single match extension of a rule, e.g. "-m tcp --dport 80".
+// Options the parser does not recognize that appear before the first match
+// extension are kept in a Match with an empty Name, so that no part of the
+// rule is lost.
+type Match struct {
+	Name    string   `json:"name"`
+	Options []string `json:"options,omitempty"`
+}
+
+// ParseRule parses a single line of iptables -S (or -v -S) output, e.g.
+//
+//	-A INPUT -s 10.0.0.0/8 -p tcp -m tcp --dport 22 -j ACCEPT
+//
+// Counters are accepted both as "-c pkts bytes" anywhere in the line and
+// in the "[pkts:bytes]" prefix form printed by nftables-based iptables.
+// Chain definitions ("-N" and "-P" lines) are not rules and return an error.
+func ParseRule(line string) (Rule, error) {
+	var rule Rule
+
+	args, err := splitRuleLine(filterRuleOutput(strings.TrimSpace(line)))
+	if err != nil {
+		return rule, err
+	}
+	if len(args) < 2 || args[0] != "-A" {
+		return rule, fmt.Errorf("not a rule: %q", line)
+	}
+	rule.Chain = args[1]
+	args = args[2:]
+
+	const (
+		inCriteria = iota
+		inMatch
+		inTarget
+	)
+	state := inCriteria
+	negate := false
+
+	// appendOpt adds an unrecognized token to whatever is currently being
+	// parsed, creating an unnamed Match when no extension was seen yet.
+	appendOpt := func(opt string) {
+		switch state {
+		case inMatch:
+			m := &rule.Matches[len(rule.Matches)-1]
+			m.Options = append(m.Options, opt)
+		case inTarget:
+			rule.TargetOptions = append(rule.TargetOptions, opt)
+		default:
+			if len(rule.Matches) == 0 || rule.Matches[len(rule.Matches)-1].Name != "" {
+				rule.Matches = append(rule.Matches, Match{})
+			}
+			m := &rule.Matches[len(rule.Matches)-1]
+			m.Options = append(m.Options, opt)
+		}
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		value := func() (string, error) {
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("option %s requires a value in rule %q", arg, line)
+			}
+			i++
+			return args[i], nil
+		}
+
+		if arg == "!" && i+1 < len(args) && criteriaField(&rule, args[i+1]) != nil {
+			negate = true
+			continue
+		}
+
+		if field := criteriaField(&rule, arg); field != nil {
+			v, err := value()
+			if err != nil {
+				return rule, err
+			}
+			if negate {
+				v = "!" + v
+				negate = false
+			}
+			*field = v
+			state = inCriteria
+			continue
+		}
+
+		switch arg {
+		case "-m", "--match":
+			name, err := value()
+			if err != nil {
+				return rule, err
+			}
+			rule.Matches = append(rule.Matches, Match{Name: name})
+			state = inMatch
+		case "-j", "--jump", "-g", "--goto":
+			target, err := value()
+			if err != nil {
+				return rule, err
+			}
+			rule.Target = target
+			rule.Goto = arg == "-g" || arg == "--goto"
+			state = inTarget
+		case "-c", "--set-counters":
+			if i+2 >= len(args) {
+				return rule, fmt.Errorf("option %s requires two values in rule %q", arg, line)
+			}
+			if rule.Packets, err = strconv.ParseUint(args[i+1], 10, 64); err != nil {
+				return rule, fmt.Errorf("could not parse packets in rule %q: %v", line, err)
+			}
+			if rule.Bytes, err = strconv.ParseUint(args[i+2], 10, 64); err != nil {
+				return rule, fmt.Errorf("could not parse bytes in rule %q: %v", line, err)
+			}
+			i += 2
+		default:
+			appendOpt(arg)
+		}
+	}
+
+	return rule, nil
+}
+
+// ParseRulespec parses a rule specification of chain, as passed to Append,
+// Insert, Delete and friends.
+func ParseRulespec(chain string, rulespec ...string) (Rule, error) {
+	return ParseRule(strings.Join(quoteArgs(append([]string{"-A", chain}, rulespec...)), " "))
+}
+
+// criteriaField returns the Rule field holding the builtin criterion
+// selected by opt, or nil if opt is not a builtin criterion.
+func criteriaField(rule *Rule, opt string) *string {
+	switch opt {
+	case "-p", "--protocol":
+		return &rule.Protocol
+	case "-s", "--source":
+		return &rule.Source
+	case "-d", "--destination":
+		return &rule.Destination
+	case "-i", "--in-interface":
+		return &rule.InInterface
+	case "-o", "--out-interface":
+		return &rule.OutInterface
+	}
+	return nil
+}
+
+// Spec returns the rule specification, without the chain and counters, in
+// the form expected by Append, Insert, Delete and friends. The arguments
+// follow the order iptables -S prints them in.
+func (r Rule) Spec() []string {
+	var spec []string
+	criteria := func(opt, value string) {
+		if value == "" {
+			return
+		}
+		if strings.HasPrefix(value, "!") {
+			spec = append(spec, "!")
+			value = value[1:]
+		}
+		spec = append(spec, opt, value)
+	}
+	criteria("-s", r.Source)
+	criteria("-d", r.Destination)
+	criteria("-i", r.InInterface)
+	criteria("-o", r.OutInterface)
+	criteria("-p", r.Protocol)
+
+	for _, m := range r.Matches {
+		if m.Name != "" {
+			spec = append(spec, "-m", m.Name)
+		}
+		spec = append(spec, m.Options...)
+	}
+
+	if r.Target != "" {
+		if r.Goto {
+			spec = append(spec, "-g", r.Target)
+		} else {
+			spec = append(spec, "-j", r.Target)
+		}
+		spec = append(spec, r.TargetOptions...)
+	}
+	return spec
+}
+
+// String returns the rule as iptables -S would print it, without counters.
+func (r Rule) String() string {
+	return strings.Join(quoteArgs(append([]string{"-A", r.Chain}, r.Spec()...)), " ")
+}
+
+// ListParsed lists the rules of the specified table/chain, including their
+// counters, as structured Rules. Chain definitions are skipped.
+func (ipt *IPTables) ListParsed(table, chain string) ([]Rule, error) {
+	lines, err := ipt.ListWithCounters(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	return parseRules(lines)
+}
+
+// CountedRule is a rule with its counters split off its rulespec.
+type CountedRule struct {
+	Chain string `json:"chain"`
+	// Rulespec is the rule as listed by iptables, without the chain and
+	// the counters, as accepted by Append, Exists or Delete
+	Rulespec []string `json:"rulespec"`
+	Packets  uint64   `json:"pkts"`
+	Bytes    uint64   `json:"bytes"`
+}
+
+// ListWithCountersParsed lists the rules of the specified table/chain like
+// ListWithCounters, with the counters as numbers rather than part of the
+// rule. Both placements of the counters are handled: "-c pkts bytes"
+// within the rule, as printed by legacy iptables, and the "[pkts:bytes]"
+// prefix printed by some nftables-based versions.
+func (ipt *IPTables) ListWithCountersParsed(table, chain string) ([]CountedRule, error) {
+	lines, err := ipt.ListWithCounters(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	var rules []CountedRule
+	for _, line := range lines {
+		rule, ok, err := parseCountedRule(line)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// GetRuleCounters returns the packet and byte counters of the rule of the
+// specified table/chain matching rulespec, compared after normalization
+// (see NormalizeRule), with a single listing of the chain. If several
+// rules match, the first one is used. The error wraps ErrNotExist if no
+// rule matches.
+func (ipt *IPTables) GetRuleCounters(table, chain string, rulespec ...string) (packets, bytes uint64, err error) {
+	rules, err := ipt.ListWithLineNumbers(table, chain)
+	if err != nil {
+		return 0, 0, err
+	}
+	matching, err := AnchorSpec(rulespec...).match(chain, rules)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(matching) == 0 {
+		return 0, 0, fmt.Errorf("%w: no rule %q in chain %s of table %s", ErrNotExist, strings.Join(quoteArgs(rulespec), " "), chain, table)
+	}
+	return matching[0].Packets, matching[0].Bytes, nil
+}
+
+// parseCountedRule parses a line of iptables -v -S output, returning false
+// for chain definitions.
+func parseCountedRule(line string) (CountedRule, bool, error) {
+	var rule CountedRule
+	args, err := splitRuleLine(filterRuleOutput(strings.TrimSpace(line)))
+	if err != nil {
+		return rule, false, err
+	}
+	if len(args) < 2 || args[0] != "-A" {
+		return rule, false, nil
+	}
+	rule.Chain = args[1]
+	rule.Rulespec = []string{}
+	for i := 2; i < len(args); i++ {
+		if args[i] != "-c" && args[i] != "--set-counters" {
+			rule.Rulespec = append(rule.Rulespec, args[i])
+			continue
+		}
+		if i+2 >= len(args) {
+			return rule, false, fmt.Errorf("option %s requires two values in rule %q", args[i], line)
+		}
+		if rule.Packets, err = strconv.ParseUint(args[i+1], 10, 64); err != nil {
+			return rule, false, fmt.Errorf("could not parse packets in rule %q: %v", line, err)
+		}
+		if rule.Bytes, err = strconv.ParseUint(args[i+2], 10, 64); err != nil {
+			return rule, false, fmt.Errorf("could not parse bytes in rule %q: %v", line, err)
+		}
+		i += 2
+	}
+	return rule, true, nil
+}
+
+// NumberedRule is a rule together with its 1-based position in its chain,
+// as used by Insert, Replace, DeleteById and ListById.
+type NumberedRule struct {
+	Pos int `json:"pos"`
+	Rule
+}
+
+// ListWithLineNumbers lists the rules of the specified table/chain,
+// including their counters, together with their positions.
+func (ipt *IPTables) ListWithLineNumbers(table, chain string) ([]NumberedRule, error) {
+	rules, err := ipt.ListParsed(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	numbered := make([]NumberedRule, len(rules))
+	for i, r := range rules {
+		numbered[i] = NumberedRule{Pos: i + 1, Rule: r}
+	}
+	return numbered, nil
+}
+
+// DeleteAllMatching lists the specified table/chain once, and deletes the
+// rules for which predicate returns true, by position from the end of the
+// chain so that the positions of the rules still to delete remain valid.
+// It returns how many rules were deleted, stopping at the first failure.
+func (ipt *IPTables) DeleteAllMatching(table, chain string, predicate func(Rule) bool) (int, error) {
+	rules, err := ipt.ListWithLineNumbers(table, chain)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for i := len(rules) - 1; i >= 0; i-- {
+		if !predicate(rules[i].Rule) {
+			continue
+		}
+		if err := ipt.DeleteById(table, chain, rules[i].Pos); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// parseRules parses every "-A" line of iptables -S output, skipping the
+// chain definitions.
+func parseRules(lines []string) ([]Rule, error) {
+	rules := []Rule{}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "-A ") {
+			continue
+		}
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// SplitRuleSpec splits a rulespec written as a single string, e.g.
+// `-m set --match-set foo src -m comment --comment "allow foo"`, into the
+// arguments the methods taking a rulespec expect. It tokenizes like
+// iptables-restore: arguments are separated by spaces or tabs, double
+// quotes group words and a backslash escapes the next character. Single
+// quotes have no special meaning.
+func SplitRuleSpec(spec string) ([]string, error) {
+	return splitRuleLine(spec)
+}
+
+// splitRuleLine splits a line of iptables -S output into arguments. Double
+// quoted arguments, as printed for comments, are unquoted; a backslash
+// escapes the following character.
+func splitRuleLine(line string) ([]string, error) {
+	var (
+		args    []string
+		cur     strings.Builder
+		inArg   bool
+		inQuote bool
+	)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line):
+			i++
+			cur.WriteByte(line[i])
+			inArg = true
+		case c == '"':
+			inQuote = !inQuote
+			inArg = true
+		case (c == ' ' || c == '\t') && !inQuote:
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quote in %q", line)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// quoteRuleArg quotes arg the way iptables -S and iptables-save do, so that
+// it survives splitRuleLine and iptables-restore.
+func quoteRuleArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"\\'") {
+		return arg
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(arg) + `"`
+}
+
+// quoteArgs quotes every argument as iptables -S does.
+func quoteArgs(args []string) []string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = quoteRuleArg(arg)
+	}
+	return quoted
+}
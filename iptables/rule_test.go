@@ -0,0 +1,399 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+		out  Rule
+		err  bool
+	}{
+		{
+			"simple accept",
+			"-A INPUT -s 10.0.0.0/8 -d 192.0.2.1/32 -j ACCEPT",
+			Rule{
+				Chain:       "INPUT",
+				Source:      "10.0.0.0/8",
+				Destination: "192.0.2.1/32",
+				Target:      "ACCEPT",
+			},
+			false,
+		},
+		{
+			"matches and target options",
+			`-A PREROUTING -i lo -p tcp -m tcp --dport 3000 -m comment --comment "my \"svc\" port" -j DNAT --to-destination 127.0.0.1:3000`,
+			Rule{
+				Chain:       "PREROUTING",
+				InInterface: "lo",
+				Protocol:    "tcp",
+				Matches: []Match{
+					{Name: "tcp", Options: []string{"--dport", "3000"}},
+					{Name: "comment", Options: []string{"--comment", `my "svc" port`}},
+				},
+				Target:        "DNAT",
+				TargetOptions: []string{"--to-destination", "127.0.0.1:3000"},
+			},
+			false,
+		},
+		{
+			"negation",
+			"-A FORWARD ! -s 10.0.0.0/8 -p tcp -m tcp ! --dport 22 -g OTHER",
+			Rule{
+				Chain:    "FORWARD",
+				Source:   "!10.0.0.0/8",
+				Protocol: "tcp",
+				Matches: []Match{
+					{Name: "tcp", Options: []string{"!", "--dport", "22"}},
+				},
+				Target: "OTHER",
+				Goto:   true,
+			},
+			false,
+		},
+		{
+			"legacy counters",
+			"-A foo1 -p tcp -m tcp --dport 1337 -c 99 42 -j ACCEPT",
+			Rule{
+				Chain:    "foo1",
+				Protocol: "tcp",
+				Matches:  []Match{{Name: "tcp", Options: []string{"--dport", "1337"}}},
+				Target:   "ACCEPT",
+				Packets:  99,
+				Bytes:    42,
+			},
+			false,
+		},
+		{
+			"nft counters",
+			"[99:42] -A foo1 -p tcp -m tcp --dport 1337 -j ACCEPT",
+			Rule{
+				Chain:    "foo1",
+				Protocol: "tcp",
+				Matches:  []Match{{Name: "tcp", Options: []string{"--dport", "1337"}}},
+				Target:   "ACCEPT",
+				Packets:  99,
+				Bytes:    42,
+			},
+			false,
+		},
+		{
+			"unknown criteria",
+			"-A foo1 -f -j DROP",
+			Rule{
+				Chain:   "foo1",
+				Matches: []Match{{Options: []string{"-f"}}},
+				Target:  "DROP",
+			},
+			false,
+		},
+		{
+			"chain definition",
+			"-N foo1",
+			Rule{},
+			true,
+		},
+		{
+			"unterminated quote",
+			`-A foo1 -m comment --comment "oops -j DROP`,
+			Rule{},
+			true,
+		},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := ParseRule(tt.in)
+			if err == nil && tt.err {
+				t.Fatal("expected err, got none")
+			} else if err != nil && !tt.err {
+				t.Fatalf("unexpected err %s", err)
+			}
+			if tt.err {
+				return
+			}
+			if !reflect.DeepEqual(rule, tt.out) {
+				t.Fatalf("ParseRule mismatch: \ngot  %#v \nneed %#v", rule, tt.out)
+			}
+		})
+	}
+}
+
+func TestRuleString(t *testing.T) {
+	testCases := []string{
+		"-A INPUT -s 10.0.0.0/8 -d 192.0.2.1/32 -j ACCEPT",
+		`-A PREROUTING -i lo -p tcp -m tcp --dport 3000 -m comment --comment "my \"svc\" port" -j DNAT --to-destination 127.0.0.1:3000`,
+		"-A FORWARD ! -s 10.0.0.0/8 -p tcp -m tcp ! --dport 22 -g OTHER",
+		"-A foo1 -f -j DROP",
+	}
+
+	for _, in := range testCases {
+		t.Run(in, func(t *testing.T) {
+			rule, err := ParseRule(in)
+			if err != nil {
+				t.Fatalf("unexpected err %s", err)
+			}
+			if rule.String() != in {
+				t.Fatalf("expect %s actual %s", in, rule.String())
+			}
+		})
+	}
+}
+
+func TestNormalizeRule(t *testing.T) {
+	testCases := []struct {
+		a, b string
+	}{
+		{
+			"-A INPUT -s 10.0.0.1 -p 6 --destination-port 22 -j ACCEPT",
+			"-A INPUT -s 10.0.0.1/32 -p tcp -m tcp --dport 22 -j ACCEPT",
+		},
+		{
+			"-A INPUT -s 10.1.2.3/255.0.0.0 -d 0.0.0.0/0 -p all -j DROP",
+			"-A INPUT -s 10.0.0.0/8 -j DROP",
+		},
+		{
+			"-A FORWARD ! -d 2001:db8::1 -p icmpv6 -j ACCEPT",
+			"-A FORWARD ! -d 2001:db8::1/128 -p ipv6-icmp -j ACCEPT",
+		},
+		{
+			"-A INPUT -p udp -m udp --dport ! 53 -j REJECT",
+			"[5:300] -A INPUT -p udp -m udp ! --dport 53 -j REJECT",
+		},
+	}
+
+	for _, tt := range testCases {
+		a, err := ParseRule(tt.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ParseRule(tt.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if na, nb := NormalizeRule(a).String(), NormalizeRule(b).String(); na != nb {
+			t.Fatalf("expected %q and %q to normalize alike, got %q and %q", tt.a, tt.b, na, nb)
+		}
+	}
+
+	// rules that must not normalize alike
+	distinct := []struct {
+		a, b string
+	}{
+		{"-A INPUT ! -s 0.0.0.0/0 -j DROP", "-A INPUT -j DROP"},
+		{"-A INPUT ! -s ::/0 -j DROP", "-A INPUT -j DROP"},
+		{"-A INPUT ! -s example.com -j DROP", "-A INPUT -s example.com -j DROP"},
+		// -f isn't an option of the tcp match
+		{"-A INPUT -p tcp -f -j DROP", "-A INPUT -p tcp -m tcp -f -j DROP"},
+	}
+	for _, tt := range distinct {
+		a, err := ParseRule(tt.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ParseRule(tt.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if na, nb := NormalizeRule(a).String(), NormalizeRule(b).String(); na == nb {
+			t.Fatalf("expected %q and %q to normalize differently, both gave %q", tt.a, tt.b, na)
+		}
+	}
+}
+
+func TestListWithLineNumbers(t *testing.T) {
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		io.WriteString(stdout, "-N AGENT\n-A AGENT -i lo -c 1 60 -j ACCEPT\n-A AGENT -c 0 0 -j DROP\n")
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	rules, err := ipt.ListWithLineNumbers("filter", "AGENT")
+	if err != nil {
+		t.Fatalf("ListWithLineNumbers failed: %v", err)
+	}
+	expected := []NumberedRule{
+		{Pos: 1, Rule: Rule{Chain: "AGENT", InInterface: "lo", Target: "ACCEPT", Packets: 1, Bytes: 60}},
+		{Pos: 2, Rule: Rule{Chain: "AGENT", Target: "DROP"}},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("ListWithLineNumbers mismatch: \ngot  %+v \nneed %+v", rules, expected)
+	}
+}
+
+func TestReplaceById(t *testing.T) {
+	var replaced []string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		switch args[3] {
+		case "-S":
+			io.WriteString(stdout, "-N AGENT\n-A AGENT -i lo -j ACCEPT\n-A AGENT -j DROP\n")
+		case "-R":
+			replaced = append(replaced, strings.Join(args[4:len(args)-1], " "))
+		}
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := ipt.ReplaceById("filter", "AGENT", 2, "-j", "REJECT"); err != nil {
+		t.Fatalf("ReplaceById failed: %v", err)
+	}
+	for _, id := range []int{0, 3} {
+		if err := ipt.ReplaceById("filter", "AGENT", id, "-j", "REJECT"); !errors.Is(err, ErrRuleIndex) {
+			t.Fatalf("expected ErrRuleIndex for rule %d, got %v", id, err)
+		}
+	}
+	if !reflect.DeepEqual(replaced, []string{"AGENT 2 -j REJECT"}) {
+		t.Fatalf("unexpected replacements %q", replaced)
+	}
+}
+
+func TestDeleteAllMatching(t *testing.T) {
+	var deleted []string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		switch args[3] {
+		case "-v":
+			io.WriteString(stdout, `-N AGENT
+-A AGENT -d 10.0.0.1/32 -c 0 0 -j DNAT --to-destination 192.168.0.1
+-A AGENT -d 10.0.0.2/32 -c 0 0 -j DNAT --to-destination 192.168.0.2
+-A AGENT -d 10.0.0.3/32 -c 0 0 -j DNAT --to-destination 192.168.0.1
+`)
+		case "-D":
+			deleted = append(deleted, args[5])
+		}
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	n, err := ipt.DeleteAllMatching("nat", "AGENT", func(r Rule) bool {
+		return reflect.DeepEqual(r.TargetOptions, []string{"--to-destination", "192.168.0.1"})
+	})
+	if err != nil {
+		t.Fatalf("DeleteAllMatching failed: %v", err)
+	}
+	if n != 2 || !reflect.DeepEqual(deleted, []string{"3", "1"}) {
+		t.Fatalf("DeleteAllMatching deleted %d rules, positions %q", n, deleted)
+	}
+}
+
+func TestSplitRuleSpec(t *testing.T) {
+	args, err := SplitRuleSpec(`-m set --match-set foo src  -m comment --comment "allow \"foo\" hosts" -j ACCEPT`)
+	if err != nil {
+		t.Fatalf("SplitRuleSpec failed: %v", err)
+	}
+	expected := []string{"-m", "set", "--match-set", "foo", "src", "-m", "comment", "--comment", `allow "foo" hosts`, "-j", "ACCEPT"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("got %q, need %q", args, expected)
+	}
+	if _, err := SplitRuleSpec(`-m comment --comment "unterminated`); err == nil {
+		t.Fatalf("expected an error for an unterminated quote")
+	}
+
+	var appended []string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		appended = args
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if err := ipt.AppendString("filter", "INPUT", `-s 10.0.0.0/8 -m comment --comment "private nets" -j ACCEPT`); err != nil {
+		t.Fatalf("AppendString failed: %v", err)
+	}
+	expected = []string{"iptables", "-t", "filter", "-A", "INPUT", "-s", "10.0.0.0/8", "-m", "comment", "--comment", "private nets", "-j", "ACCEPT", "--wait"}
+	if !reflect.DeepEqual(appended, expected) {
+		t.Fatalf("args mismatch: \ngot  %v \nneed %v", appended, expected)
+	}
+}
+
+func TestListWithCountersParsed(t *testing.T) {
+	for _, output := range []string{
+		// legacy
+		`-P INPUT ACCEPT -c 10 600
+-A INPUT -s 10.0.0.0/8 -m comment --comment "private nets" -c 7 420 -j ACCEPT
+-A INPUT -c 0 0 -j DROP
+`,
+		// nftables
+		`-P INPUT ACCEPT -c 10 600
+[7:420] -A INPUT -s 10.0.0.0/8 -m comment --comment "private nets" -j ACCEPT
+[0:0] -A INPUT -j DROP
+`,
+	} {
+		runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+			io.WriteString(stdout, output)
+			return 0, nil
+		})
+		ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		rules, err := ipt.ListWithCountersParsed("filter", "INPUT")
+		if err != nil {
+			t.Fatalf("ListWithCountersParsed failed: %v", err)
+		}
+		expected := []CountedRule{
+			{"INPUT", []string{"-s", "10.0.0.0/8", "-m", "comment", "--comment", "private nets", "-j", "ACCEPT"}, 7, 420},
+			{"INPUT", []string{"-j", "DROP"}, 0, 0},
+		}
+		if !reflect.DeepEqual(rules, expected) {
+			t.Fatalf("got %+v, need %+v", rules, expected)
+		}
+	}
+}
+
+func TestGetRuleCounters(t *testing.T) {
+	calls := 0
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls++
+		io.WriteString(stdout, `-P INPUT ACCEPT -c 0 0
+-A INPUT -s 10.0.0.1/32 -p tcp -m tcp --dport 22 -c 5 300 -j ACCEPT
+-A INPUT -s 192.168.0.0/16 -c 42 2520 -j DROP
+`)
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	packets, bytes, err := ipt.GetRuleCounters("filter", "INPUT", "-s", "192.168.0.0/16", "-j", "DROP")
+	if err != nil {
+		t.Fatalf("GetRuleCounters failed: %v", err)
+	}
+	if packets != 42 || bytes != 2520 || calls != 1 {
+		t.Fatalf("unexpected counters %d/%d after %d calls", packets, bytes, calls)
+	}
+	// matched after normalization
+	if packets, _, err := ipt.GetRuleCounters("filter", "INPUT", "-s", "10.0.0.1", "-p", "tcp", "--dport", "22", "-j", "ACCEPT"); err != nil || packets != 5 {
+		t.Fatalf("unexpected counters %d: %v", packets, err)
+	}
+	if _, _, err := ipt.GetRuleCounters("filter", "INPUT", "-j", "REJECT"); !errors.Is(err, ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+}
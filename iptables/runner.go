@@ -0,0 +1,80 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"os/exec"
+)
+
+// Runner runs the commands of a handle. It makes it possible to run
+// iptables through sudo, on another host or in another process, or not at
+// all in unit tests, while keeping the argument building, output parsing
+// and error handling of the library.
+type Runner interface {
+	// Run runs args, where args[0] is the binary, feeding it stdin and
+	// writing its output to stdout and stderr. It returns the exit status
+	// of the command, and an error only if it could not be run at all.
+	Run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error)
+}
+
+// RunnerFunc adapts an ordinary function to the Runner interface.
+type RunnerFunc func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error)
+
+// Run calls f(ctx, args, stdin, stdout, stderr).
+func (f RunnerFunc) Run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	return f(ctx, args, stdin, stdout, stderr)
+}
+
+// CommandRunner makes the handle run its commands with r instead of
+// executing them directly. Binaries are then not looked up locally: the
+// iptables binary is run by the name given with Path, or its default
+// name. The version probe of New goes through r as well. The local
+// xtables lock is not taken on behalf of binaries lacking --wait, as it
+// would not protect the host r runs commands on.
+func CommandRunner(r Runner) option {
+	return func(ipt *IPTables) {
+		ipt.runner = r
+	}
+}
+
+// ExecRunner is the Runner executing commands as child processes, as
+// handles do by default. It is meant to be wrapped by other Runners.
+type ExecRunner struct{}
+
+// Run implements Runner.
+func (ExecRunner) Run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if e, ok := err.(*exec.ExitError); ok {
+		return e.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// PrefixRunner returns a Runner executing commands prefixed with prefix,
+// e.g. PrefixRunner("sudo", "-n") to run iptables through sudo.
+func PrefixRunner(prefix ...string) Runner {
+	return RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		return ExecRunner{}.Run(ctx, append(append([]string{}, prefix...), args...), stdin, stdout, stderr)
+	})
+}
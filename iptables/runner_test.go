@@ -0,0 +1,146 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommandRunner(t *testing.T) {
+	var calls [][]string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, args)
+		if stdin != nil {
+			b, _ := ioutil.ReadAll(stdin)
+			io.WriteString(stdout, string(b))
+		}
+		switch {
+		case args[len(args)-1] == "--version":
+			io.WriteString(stdout, "iptables v1.8.7 (nf_tables)\n")
+		case strings.Contains(strings.Join(args, " "), "MISSING"):
+			io.WriteString(stderr, "iptables: No chain/target/match by that name.\n")
+			return 1, nil
+		default:
+			io.WriteString(stdout, "-P INPUT ACCEPT\n")
+		}
+		return 0, nil
+	})
+
+	ipt, err := New(CommandRunner(runner), Path("/usr/sbin/iptables-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if v1, v2, v3 := ipt.GetIptablesVersion(); v1 != 1 || v2 != 8 || v3 != 7 {
+		t.Fatalf("unexpected version %d.%d.%d", v1, v2, v3)
+	}
+
+	rules, err := ipt.List("filter", "INPUT")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if !reflect.DeepEqual(rules, []string{"-P INPUT ACCEPT"}) {
+		t.Fatalf("unexpected rules %v", rules)
+	}
+	expected := []string{"/usr/sbin/iptables-nft", "-t", "filter", "-S", "INPUT", "--wait"}
+	if actual := calls[len(calls)-1]; !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("runner args mismatch: \ngot  %v \nneed %v", actual, expected)
+	}
+
+	err = ipt.DeleteChain("filter", "MISSING")
+	e, ok := err.(*Error)
+	if !ok || e.ExitStatus() != 1 || !e.IsNotExist() {
+		t.Fatalf("expected a not exist error, got %v", err)
+	}
+
+	var out strings.Builder
+	if err := ipt.runCommand([]string{"cat"}, strings.NewReader("payload"), &out); err != nil {
+		t.Fatalf("runCommand failed: %v", err)
+	}
+	if !strings.HasPrefix(out.String(), "payload") {
+		t.Fatalf("stdin was not passed to the runner, got %q", out.String())
+	}
+}
+
+func TestListingsAreNumeric(t *testing.T) {
+	var calls [][]string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, args)
+		io.WriteString(stdout, "Chain INPUT (policy ACCEPT 0 packets, 0 bytes)\n    pkts      bytes target     prot opt in     out     source               destination\n")
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	ipt.Stats("filter", "INPUT")
+	ipt.StructuredStats("filter", "INPUT")
+	ipt.ListChainsWithInfo("filter")
+	ipt.GetChainCounters("filter", "INPUT")
+	ipt.List("filter", "INPUT")
+	ipt.ListChains("filter")
+
+	listings := 0
+	for _, args := range calls {
+		if !contains(args, "-L") {
+			continue
+		}
+		listings++
+		if !contains(args, "-n") {
+			t.Errorf("listing without -n: %q", args)
+		}
+	}
+	if listings != 4 {
+		t.Fatalf("expected 4 -L listings, got %d in %q", listings, calls)
+	}
+}
+
+func TestRun(t *testing.T) {
+	var calls [][]string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, args)
+		if args[1] == "-E" {
+			io.WriteString(stderr, "iptables: No chain/target/match by that name.\n")
+			return 1, nil
+		}
+		io.WriteString(stdout, "-P INPUT ACCEPT\n")
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"), Timeout(3))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	out, err := ipt.RunWithOutput("-t", "nat", "-Z", "POSTROUTING")
+	if err != nil {
+		t.Fatalf("RunWithOutput failed: %v", err)
+	}
+	if out != "-P INPUT ACCEPT\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+	expected := []string{"iptables", "-t", "nat", "-Z", "POSTROUTING", "--wait", "3"}
+	if !reflect.DeepEqual(calls[0], expected) {
+		t.Fatalf("args mismatch: \ngot  %v \nneed %v", calls[0], expected)
+	}
+
+	err = ipt.Run("-E", "OLD", "NEW")
+	if e, ok := err.(*Error); !ok || !e.IsNotExist() {
+		t.Fatalf("expected a not exist error, got %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// PacketQueue reads the packets iptables hands to an NFQUEUE queue. This
+// package doesn't speak nfnetlink itself; implement it on top of a netlink
+// library, e.g. github.com/florianl/go-nfqueue.
+type PacketQueue interface {
+	// Receive binds queue num and calls handle with every packet queued to
+	// it, starting with its IP header, until ctx is done. Every packet must
+	// be given the ACCEPT verdict, so that sampling doesn't change the fate
+	// of the traffic.
+	Receive(ctx context.Context, num uint16, handle func(packet []byte)) error
+}
+
+// SampleOptions configures SampleChain.
+type SampleOptions struct {
+	// Queue is the NFQUEUE queue number to use
+	Queue uint16
+	// Probability is the fraction of the packets entering the chain that
+	// are sampled, 0.01 by default
+	Probability float64
+	// Duration is how long to sample for, 10 seconds by default
+	Duration time.Duration
+	// MaxPackets ends sampling early once reached, if not 0
+	MaxPackets int
+}
+
+// TrafficSummary classifies the packets sampled by SampleChain.
+type TrafficSummary struct {
+	Table   string `json:"table"`
+	Chain   string `json:"chain"`
+	Packets int    `json:"packets"`
+	// Protocols counts the packets per protocol, e.g. "tcp"
+	Protocols map[string]int `json:"protocols"`
+	// Ports counts the TCP, UDP and SCTP packets per destination port,
+	// e.g. "tcp/443"
+	Ports map[string]int `json:"ports"`
+}
+
+// TopPorts returns the n destination ports seen most often, most frequent
+// first.
+func (s *TrafficSummary) TopPorts(n int) []string {
+	ports := make([]string, 0, len(s.Ports))
+	for port := range s.Ports {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if s.Ports[ports[i]] != s.Ports[ports[j]] {
+			return s.Ports[ports[i]] > s.Ports[ports[j]]
+		}
+		return ports[i] < ports[j]
+	})
+	if len(ports) > n {
+		ports = ports[:n]
+	}
+	return ports
+}
+
+// SampleChain shows what traffic enters table/chain before changing it:
+// it inserts at the top of the chain a rule queuing a random sample of the
+// packets to q, with --queue-bypass so that packets flow normally whenever
+// nobody reads the queue, and classifies the packets received until
+// opts.Duration elapses or ctx is done. The rule is deleted before
+// SampleChain returns.
+func (ipt *IPTables) SampleChain(ctx context.Context, table, chain string, q PacketQueue, opts SampleOptions) (*TrafficSummary, error) {
+	if opts.Probability <= 0 {
+		opts.Probability = 0.01
+	}
+	if opts.Duration <= 0 {
+		opts.Duration = 10 * time.Second
+	}
+	rulespec := []string{
+		"-m", "statistic", "--mode", "random", "--probability", strconv.FormatFloat(opts.Probability, 'f', -1, 64),
+		"-m", "comment", "--comment", "go-iptables sample",
+		"-j", "NFQUEUE", "--queue-num", strconv.Itoa(int(opts.Queue)), "--queue-bypass",
+	}
+
+	summary := &TrafficSummary{Table: table, Chain: chain, Protocols: map[string]int{}, Ports: map[string]int{}}
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+	received := make(chan error, 1)
+	go func() {
+		received <- q.Receive(ctx, opts.Queue, func(packet []byte) {
+			// Receive calls handle sequentially
+			if opts.MaxPackets > 0 && summary.Packets >= opts.MaxPackets {
+				return
+			}
+			summary.add(packet)
+			if opts.MaxPackets > 0 && summary.Packets >= opts.MaxPackets {
+				cancel()
+			}
+		})
+	}()
+
+	if err := ipt.Insert(table, chain, 1, rulespec...); err != nil {
+		cancel()
+		<-received
+		return nil, err
+	}
+	<-ctx.Done()
+	err := ipt.Delete(table, chain, rulespec...)
+	if rerr := <-received; rerr != nil && rerr != context.Canceled && rerr != context.DeadlineExceeded {
+		return nil, fmt.Errorf("could not read queue %d: %w", opts.Queue, rerr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not remove the sampling rule: %w", err)
+	}
+	return summary, nil
+}
+
+// ipProtocolNames maps the IP protocol numbers of common protocols to the
+// names iptables uses.
+var ipProtocolNames = map[byte]string{
+	1:   "icmp",
+	6:   "tcp",
+	17:  "udp",
+	58:  "ipv6-icmp",
+	132: "sctp",
+}
+
+// add classifies packet, starting with its IPv4 or IPv6 header.
+func (s *TrafficSummary) add(packet []byte) {
+	if len(packet) < 1 {
+		return
+	}
+	var proto byte
+	var payload []byte
+	switch packet[0] >> 4 {
+	case 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if len(packet) < 20 || len(packet) < ihl {
+			return
+		}
+		proto, payload = packet[9], packet[ihl:]
+	case 6:
+		if len(packet) < 40 {
+			return
+		}
+		// extension headers are reported as the protocol
+		proto, payload = packet[6], packet[40:]
+	default:
+		return
+	}
+
+	s.Packets++
+	name, ok := ipProtocolNames[proto]
+	if !ok {
+		name = strconv.Itoa(int(proto))
+	}
+	s.Protocols[name]++
+	switch name {
+	case "tcp", "udp", "sctp":
+		if len(payload) >= 4 {
+			s.Ports[name+"/"+strconv.Itoa(int(binary.BigEndian.Uint16(payload[2:4])))]++
+		}
+	}
+}
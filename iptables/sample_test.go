@@ -0,0 +1,85 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queueFunc adapts a function to PacketQueue.
+type queueFunc func(ctx context.Context, num uint16, handle func([]byte)) error
+
+func (f queueFunc) Receive(ctx context.Context, num uint16, handle func([]byte)) error {
+	return f(ctx, num, handle)
+}
+
+func TestSampleChain(t *testing.T) {
+	var commands []string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		commands = append(commands, strings.Join(args[3:len(args)-1], " "))
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	ipv4 := func(proto byte, dport uint16) []byte {
+		p := make([]byte, 24)
+		p[0] = 0x45
+		p[9] = proto
+		p[22], p[23] = byte(dport>>8), byte(dport)
+		return p
+	}
+	ipv6 := make([]byte, 44)
+	ipv6[0] = 0x60
+	ipv6[6] = 17
+	ipv6[42], ipv6[43] = 0, 53
+	packets := [][]byte{ipv4(6, 443), ipv4(6, 443), ipv4(6, 22), ipv4(1, 0), ipv6, ipv4(6, 80)}
+
+	q := queueFunc(func(ctx context.Context, num uint16, handle func([]byte)) error {
+		if num != 7 {
+			t.Errorf("unexpected queue %d", num)
+		}
+		for _, p := range packets {
+			handle(p)
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	summary, err := ipt.SampleChain(context.Background(), "filter", "INPUT", q, SampleOptions{Queue: 7, Probability: 0.5, Duration: time.Minute, MaxPackets: 5})
+	if err != nil {
+		t.Fatalf("SampleChain failed: %v", err)
+	}
+
+	rule := "-m statistic --mode random --probability 0.5 -m comment --comment go-iptables sample -j NFQUEUE --queue-num 7 --queue-bypass"
+	if !reflect.DeepEqual(commands, []string{"-I INPUT 1 " + rule, "-D INPUT " + rule}) {
+		t.Fatalf("unexpected commands %q", commands)
+	}
+	if summary.Packets != 5 {
+		t.Fatalf("expected sampling to stop after 5 packets, got %d", summary.Packets)
+	}
+	if !reflect.DeepEqual(summary.Protocols, map[string]int{"tcp": 3, "icmp": 1, "udp": 1}) {
+		t.Fatalf("unexpected protocols %v", summary.Protocols)
+	}
+	if top := summary.TopPorts(2); !reflect.DeepEqual(top, []string{"tcp/443", "tcp/22"}) {
+		t.Fatalf("unexpected top ports %v (%v)", top, summary.Ports)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Ruleset is the structured form of a single table, as printed by
+// iptables-save.
+type Ruleset struct {
+	Table  string  `json:"table"`
+	Chains []Chain `json:"chains"`
+}
+
+// Chain is a chain of a Ruleset together with its rules. Policy is "-" for
+// user-defined chains.
+type Chain struct {
+	Name    string `json:"name"`
+	Policy  string `json:"policy"`
+	Packets uint64 `json:"pkts"`
+	Bytes   uint64 `json:"bytes"`
+	Rules   []Rule `json:"rules"`
+}
+
+// FindChain returns the chain with the given name, or nil if the ruleset
+// has no such chain.
+func (rs *Ruleset) FindChain(name string) *Chain {
+	for i := range rs.Chains {
+		if rs.Chains[i].Name == name {
+			return &rs.Chains[i]
+		}
+	}
+	return nil
+}
+
+// Save returns the output of iptables-save for the specified table.
+func (ipt *IPTables) Save(table string) (string, error) {
+	var stdout bytes.Buffer
+	if err := ipt.runSave(&stdout, "-t", table); err != nil {
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// SaveAll returns the output of iptables-save for all tables.
+func (ipt *IPTables) SaveAll() (string, error) {
+	var stdout bytes.Buffer
+	if err := ipt.runSave(&stdout); err != nil {
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// SaveRuleset returns the specified table, including counters, as a
+// structured Ruleset.
+func (ipt *IPTables) SaveRuleset(table string) (*Ruleset, error) {
+	var stdout bytes.Buffer
+	if err := ipt.runSave(&stdout, "-c", "-t", table); err != nil {
+		return nil, err
+	}
+	rulesets, err := ParseSave(stdout.String())
+	if err != nil {
+		return nil, err
+	}
+	if len(rulesets) != 1 || rulesets[0].Table != table {
+		return nil, fmt.Errorf("iptables-save did not return table %s", table)
+	}
+	return &rulesets[0], nil
+}
+
+// chainDefRegex matches chain definitions such as ":INPUT ACCEPT [0:0]".
+var chainDefRegex = regexp.MustCompile(`^:(\S+)\s+(\S+)(?:\s+\[([0-9]+):([0-9]+)\])?$`)
+
+// ParseSave parses iptables-save output, with or without counters, into
+// one Ruleset per table.
+func ParseSave(data string) ([]Ruleset, error) {
+	var (
+		rulesets []Ruleset
+		current  *Ruleset
+	)
+	for n, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		wrap := func(err error) error {
+			return fmt.Errorf("line %d: %v", n+1, err)
+		}
+
+		switch {
+		case strings.HasPrefix(line, "*"):
+			if current != nil {
+				return nil, wrap(fmt.Errorf("table %s not committed", current.Table))
+			}
+			current = &Ruleset{Table: line[1:], Chains: []Chain{}}
+		case current == nil:
+			return nil, wrap(fmt.Errorf("%q outside of a table", line))
+		case line == "COMMIT":
+			rulesets = append(rulesets, *current)
+			current = nil
+		case strings.HasPrefix(line, ":"):
+			m := chainDefRegex.FindStringSubmatch(line)
+			if m == nil {
+				return nil, wrap(fmt.Errorf("invalid chain definition %q", line))
+			}
+			chain := Chain{Name: m[1], Policy: m[2], Rules: []Rule{}}
+			if m[3] != "" {
+				chain.Packets, _ = strconv.ParseUint(m[3], 10, 64)
+				chain.Bytes, _ = strconv.ParseUint(m[4], 10, 64)
+			}
+			current.Chains = append(current.Chains, chain)
+		default:
+			rule, err := ParseRule(line)
+			if err != nil {
+				return nil, wrap(err)
+			}
+			chain := current.FindChain(rule.Chain)
+			if chain == nil {
+				return nil, wrap(fmt.Errorf("rule for undeclared chain %s", rule.Chain))
+			}
+			chain.Rules = append(chain.Rules, rule)
+		}
+	}
+	if current != nil {
+		return nil, fmt.Errorf("table %s not committed", current.Table)
+	}
+	return rulesets, nil
+}
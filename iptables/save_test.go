@@ -0,0 +1,97 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testSave = `# Generated by iptables-save v1.8.7 on Thu Jan  1 00:00:00 1970
+*nat
+:PREROUTING ACCEPT [12:720]
+:POSTROUTING ACCEPT [3:180]
+:KUBE-MARK-MASQ - [0:0]
+[5:300] -A POSTROUTING -s 10.0.0.0/8 -o eth0 -j MASQUERADE
+-A KUBE-MARK-MASQ -j MARK --set-xmark 0x4000/0x4000
+COMMIT
+# Completed on Thu Jan  1 00:00:00 1970
+*filter
+:INPUT DROP [0:0]
+-A INPUT -p tcp -m tcp --dport 22 -m comment --comment "ssh access" -j ACCEPT
+COMMIT
+`
+
+func TestParseSave(t *testing.T) {
+	rulesets, err := ParseSave(testSave)
+	if err != nil {
+		t.Fatalf("ParseSave failed: %v", err)
+	}
+
+	expected := []Ruleset{
+		{
+			Table: "nat",
+			Chains: []Chain{
+				{Name: "PREROUTING", Policy: "ACCEPT", Packets: 12, Bytes: 720, Rules: []Rule{}},
+				{Name: "POSTROUTING", Policy: "ACCEPT", Packets: 3, Bytes: 180, Rules: []Rule{
+					{Chain: "POSTROUTING", Source: "10.0.0.0/8", OutInterface: "eth0", Target: "MASQUERADE", Packets: 5, Bytes: 300},
+				}},
+				{Name: "KUBE-MARK-MASQ", Policy: "-", Rules: []Rule{
+					{Chain: "KUBE-MARK-MASQ", Target: "MARK", TargetOptions: []string{"--set-xmark", "0x4000/0x4000"}},
+				}},
+			},
+		},
+		{
+			Table: "filter",
+			Chains: []Chain{
+				{Name: "INPUT", Policy: "DROP", Rules: []Rule{
+					{
+						Chain:    "INPUT",
+						Protocol: "tcp",
+						Matches: []Match{
+							{Name: "tcp", Options: []string{"--dport", "22"}},
+							{Name: "comment", Options: []string{"--comment", "ssh access"}},
+						},
+						Target: "ACCEPT",
+					},
+				}},
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(rulesets, expected) {
+		t.Fatalf("ParseSave mismatch: \ngot  %#v \nneed %#v", rulesets, expected)
+	}
+}
+
+func TestParseSaveErrors(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+	}{
+		{"missing commit", "*filter\n:INPUT ACCEPT [0:0]\n"},
+		{"rule outside table", "-A INPUT -j ACCEPT\n"},
+		{"undeclared chain", "*filter\n-A INPUT -j ACCEPT\nCOMMIT\n"},
+		{"bad chain definition", "*filter\n:INPUT\nCOMMIT\n"},
+	}
+
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseSave(tt.in); err == nil {
+				t.Fatal("expected err, got none")
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// SchemaVersion is the version of the JSON documents produced by
+// MarshalEnvelope. It changes whenever the JSON form of an exported type
+// changes incompatibly.
+const SchemaVersion = "v1"
+
+//go:embed schema/*.json
+var schemas embed.FS
+
+// JSONSchema returns the JSON schema describing the given kind (e.g.
+// "Rule", "Ruleset", "Stat", "ChainInfo", "ChainDiff", "Inventory" or
+// "Envelope"), so that non-Go tooling can validate the documents it
+// consumes.
+func JSONSchema(kind string) ([]byte, error) {
+	kind = strings.TrimSuffix(kind, "List")
+	return schemas.ReadFile("schema/" + strings.ToLower(kind) + ".json")
+}
+
+// Envelope is the versioned wrapper of the documents produced by
+// MarshalEnvelope.
+type Envelope struct {
+	SchemaVersion string          `json:"schemaVersion"`
+	Kind          string          `json:"kind"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// envelopeKind returns the kind of v, or an error if it cannot be wrapped.
+func envelopeKind(v interface{}) (string, error) {
+	switch v.(type) {
+	case Rule, *Rule:
+		return "Rule", nil
+	case []Rule, *[]Rule:
+		return "RuleList", nil
+	case Ruleset, *Ruleset:
+		return "Ruleset", nil
+	case []Ruleset, *[]Ruleset:
+		return "RulesetList", nil
+	case Stat, *Stat:
+		return "Stat", nil
+	case []Stat, *[]Stat:
+		return "StatList", nil
+	case ChainInfo, *ChainInfo:
+		return "ChainInfo", nil
+	case []ChainInfo, *[]ChainInfo:
+		return "ChainInfoList", nil
+	case ChainDiff, *ChainDiff:
+		return "ChainDiff", nil
+	case []ChainDiff, *[]ChainDiff:
+		return "ChainDiffList", nil
+	case LabeledStat, *LabeledStat:
+		return "LabeledStat", nil
+	case []LabeledStat, *[]LabeledStat:
+		return "LabeledStatList", nil
+	case Inventory, *Inventory:
+		return "Inventory", nil
+	}
+	return "", fmt.Errorf("unsupported envelope type %T", v)
+}
+
+// MarshalJSON encodes the stat with its source and destination as CIDR
+// strings, e.g. "10.0.0.0/8", or null if unset.
+func (s Stat) MarshalJSON() ([]byte, error) {
+	type stat Stat
+	return json.Marshal(struct {
+		stat
+		Source      *string `json:"source"`
+		Destination *string `json:"destination"`
+	}{stat(s), cidrString(s.Source), cidrString(s.Destination)})
+}
+
+// UnmarshalJSON decodes a stat encoded by MarshalJSON.
+func (s *Stat) UnmarshalJSON(data []byte) error {
+	type stat Stat
+	var v struct {
+		*stat
+		Source      *string `json:"source"`
+		Destination *string `json:"destination"`
+	}
+	v.stat = (*stat)(s)
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	var err error
+	if s.Source, err = parseCIDRString(v.Source); err != nil {
+		return err
+	}
+	s.Destination, err = parseCIDRString(v.Destination)
+	return err
+}
+
+func cidrString(n *net.IPNet) *string {
+	if n == nil {
+		return nil
+	}
+	s := n.String()
+	return &s
+}
+
+func parseCIDRString(s *string) (*net.IPNet, error) {
+	if s == nil {
+		return nil, nil
+	}
+	_, n, err := net.ParseCIDR(*s)
+	return n, err
+}
+
+// Inventory is a snapshot of every table of a handle's family, together
+// with the iptables binary it was taken with.
+type Inventory struct {
+	// Family is "ipv4" or "ipv6"
+	Family string `json:"family"`
+	// Mode is the operating mode of iptables, "legacy" or "nf_tables"
+	Mode    string    `json:"mode"`
+	Version string    `json:"version"`
+	Tables  []Ruleset `json:"tables"`
+}
+
+// Inventory returns the tables of the handle's family, as returned by
+// Dump, along with the family, mode and version of iptables.
+func (ipt *IPTables) Inventory() (*Inventory, error) {
+	d, err := ipt.Dump()
+	if err != nil {
+		return nil, err
+	}
+	v1, v2, v3 := ipt.GetIptablesVersion()
+	return &Inventory{
+		Family:  familyName(ipt.proto),
+		Mode:    ipt.mode,
+		Version: fmt.Sprintf("%d.%d.%d", v1, v2, v3),
+		Tables:  d.Tables,
+	}, nil
+}
+
+// MarshalEnvelope encodes v, one of the structured types of this package or
+// a slice of them, wrapped in a versioned Envelope.
+func MarshalEnvelope(v interface{}) ([]byte, error) {
+	kind, err := envelopeKind(v)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{SchemaVersion: SchemaVersion, Kind: kind, Data: data})
+}
+
+// UnmarshalEnvelope decodes an Envelope produced by MarshalEnvelope into v,
+// which must be a pointer to the type the envelope holds. Envelopes of
+// another schema version are rejected.
+func UnmarshalEnvelope(data []byte, v interface{}) error {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return err
+	}
+	if env.SchemaVersion != SchemaVersion {
+		return fmt.Errorf("unsupported schema version %q, want %q", env.SchemaVersion, SchemaVersion)
+	}
+	kind, err := envelopeKind(v)
+	if err != nil {
+		return err
+	}
+	if kind != env.Kind {
+		return fmt.Errorf("envelope holds %s, not %s", env.Kind, kind)
+	}
+	return json.Unmarshal(env.Data, v)
+}
+
+// ListJSON returns the rules of the specified table/chain, including their
+// counters, as an Envelope of kind "RuleList".
+func (ipt *IPTables) ListJSON(table, chain string) ([]byte, error) {
+	rules, err := ipt.ListParsed(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	return MarshalEnvelope(rules)
+}
+
+// RulesetJSON returns every chain of the specified table with its policy,
+// rules and counters as an Envelope of kind "Ruleset".
+func (ipt *IPTables) RulesetJSON(table string) ([]byte, error) {
+	rs, err := ipt.SaveRuleset(table)
+	if err != nil {
+		return nil, err
+	}
+	return MarshalEnvelope(rs)
+}
+
+// ChainsJSON returns the chains of the specified table, as listed by
+// ListChainsWithInfo, as an Envelope of kind "ChainInfoList".
+func (ipt *IPTables) ChainsJSON(table string) ([]byte, error) {
+	chains, err := ipt.ListChainsWithInfo(table)
+	if err != nil {
+		return nil, err
+	}
+	return MarshalEnvelope(chains)
+}
+
+// StatsJSON returns the statistics of the specified table/chain, as listed
+// by StructuredStats, as an Envelope of kind "StatList".
+func (ipt *IPTables) StatsJSON(table, chain string) ([]byte, error) {
+	stats, err := ipt.StructuredStats(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	return MarshalEnvelope(stats)
+}
+
+// InventoryJSON returns the Inventory of the handle as an Envelope of kind
+// "Inventory".
+func (ipt *IPTables) InventoryJSON() ([]byte, error) {
+	inv, err := ipt.Inventory()
+	if err != nil {
+		return nil, err
+	}
+	return MarshalEnvelope(inv)
+}
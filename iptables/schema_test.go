@@ -0,0 +1,153 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	rules := []Rule{
+		{Chain: "INPUT", Protocol: "tcp", Matches: []Match{{Name: "tcp", Options: []string{"--dport", "22"}}}, Target: "ACCEPT", Packets: 1, Bytes: 60},
+	}
+
+	data, err := MarshalEnvelope(rules)
+	if err != nil {
+		t.Fatalf("MarshalEnvelope failed: %v", err)
+	}
+
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.SchemaVersion != SchemaVersion || env.Kind != "RuleList" {
+		t.Fatalf("unexpected envelope %s %s", env.SchemaVersion, env.Kind)
+	}
+
+	var decoded []Rule
+	if err := UnmarshalEnvelope(data, &decoded); err != nil {
+		t.Fatalf("UnmarshalEnvelope failed: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, rules) {
+		t.Fatalf("round trip mismatch: \ngot  %#v \nneed %#v", decoded, rules)
+	}
+
+	var stats []Stat
+	if err := UnmarshalEnvelope(data, &stats); err == nil {
+		t.Fatal("expected kind mismatch error, got none")
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	for _, kind := range []string{"Rule", "RuleList", "Ruleset", "Stat", "ChainInfo", "ChainDiff", "LabeledStat", "Inventory", "Envelope"} {
+		schema, err := JSONSchema(kind)
+		if err != nil {
+			t.Fatalf("JSONSchema(%s) failed: %v", kind, err)
+		}
+		var v map[string]interface{}
+		if err := json.Unmarshal(schema, &v); err != nil {
+			t.Fatalf("schema of %s is not valid JSON: %v", kind, err)
+		}
+	}
+}
+
+func TestListJSON(t *testing.T) {
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		io.WriteString(stdout, "-P INPUT ACCEPT -c 10 600\n-A INPUT -s 10.0.0.0/8 -c 3 180 -j ACCEPT\n")
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	data, err := ipt.ListJSON("filter", "INPUT")
+	if err != nil {
+		t.Fatalf("ListJSON failed: %v", err)
+	}
+	expected := `{"schemaVersion":"v1","kind":"RuleList","data":[{"chain":"INPUT","source":"10.0.0.0/8","target":"ACCEPT","pkts":3,"bytes":180}]}`
+	if string(data) != expected {
+		t.Fatalf("ListJSON mismatch: \ngot  %s \nneed %s", data, expected)
+	}
+	var rules []Rule
+	if err := UnmarshalEnvelope(data, &rules); err != nil || len(rules) != 1 {
+		t.Fatalf("could not decode %s: %v", data, err)
+	}
+}
+
+func TestStatJSON(t *testing.T) {
+	_, src, _ := net.ParseCIDR("10.0.0.0/8")
+	_, dst, _ := net.ParseCIDR("2001:db8::1/128")
+	stat := Stat{Packets: 3, Bytes: 180, Target: "ACCEPT", Protocol: "0", Opt: "--", Input: "*", Output: "*", Source: src, Destination: dst}
+
+	data, err := json.Marshal(stat)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	expected := `{"pkts":3,"bytes":180,"target":"ACCEPT","prot":"0","opt":"--","in":"*","out":"*","options":"","source":"10.0.0.0/8","destination":"2001:db8::1/128"}`
+	if string(data) != expected {
+		t.Fatalf("Marshal mismatch: \ngot  %s \nneed %s", data, expected)
+	}
+	var decoded Stat
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, stat) {
+		t.Fatalf("round trip mismatch: \ngot  %#v \nneed %#v", decoded, stat)
+	}
+
+	// unset networks are null
+	data, err = json.Marshal([]Stat{{Target: "DROP"}})
+	if err != nil || !strings.Contains(string(data), `"source":null,"destination":null`) {
+		t.Fatalf("unexpected encoding %s, %v", data, err)
+	}
+	var stats []Stat
+	if err := json.Unmarshal(data, &stats); err != nil || stats[0].Source != nil || stats[0].Target != "DROP" {
+		t.Fatalf("unexpected decoding %+v, %v", stats, err)
+	}
+	if err := json.Unmarshal([]byte(`{"source":"10.0.0.0"}`), &decoded); err == nil {
+		t.Fatal("expected an invalid network to be rejected")
+	}
+}
+
+func TestInventoryJSON(t *testing.T) {
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		io.WriteString(stdout, "*filter\n:INPUT ACCEPT [10:600]\n[3:180] -A INPUT -s 10.0.0.0/8 -j ACCEPT\nCOMMIT\n")
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	data, err := ipt.InventoryJSON()
+	if err != nil {
+		t.Fatalf("InventoryJSON failed: %v", err)
+	}
+	var inv Inventory
+	if err := UnmarshalEnvelope(data, &inv); err != nil {
+		t.Fatalf("could not decode %s: %v", data, err)
+	}
+	if inv.Family != "ipv4" || inv.Mode != "nf_tables" || inv.Version != "1.8.7" || len(inv.Tables) != 1 {
+		t.Fatalf("unexpected inventory %+v", inv)
+	}
+	if input := inv.Tables[0].FindChain("INPUT"); input == nil || len(input.Rules) != 1 || input.Rules[0].Packets != 3 {
+		t.Fatalf("unexpected tables %+v", inv.Tables)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+)
+
+// SelfTestCheck is the outcome of a single step of SelfTest. Err is nil if
+// the step behaved as expected.
+type SelfTestCheck struct {
+	Name string
+	Err  error
+}
+
+// SelfTestReport is the result of SelfTest.
+type SelfTestReport struct {
+	// Profile is the compatibility profile the handle used
+	Profile string
+	Checks  []SelfTestCheck
+}
+
+// OK reports whether every check passed.
+func (r *SelfTestReport) OK() bool {
+	for _, c := range r.Checks {
+		if c.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Failed returns the checks that did not pass.
+func (r *SelfTestReport) Failed() []SelfTestCheck {
+	var failed []SelfTestCheck
+	for _, c := range r.Checks {
+		if c.Err != nil {
+			failed = append(failed, c)
+		}
+	}
+	return failed
+}
+
+// SelfTest exercises the main operations and parsing paths of the library
+// against the iptables binary of the handle, run through its Runner if one
+// was set with CommandRunner, using a scratch chain of the filter table
+// that is removed afterwards. Mismatches, e.g. unexpected
+// output formats of a new iptables release, are reported as failed checks.
+//
+// An error is returned if the scratch chain cannot be set up or ctx is done
+// before all checks ran; the partial report is returned along with it.
+func (ipt *IPTables) SelfTest(ctx context.Context) (*SelfTestReport, error) {
+	report := &SelfTestReport{Profile: ipt.Profile()}
+	const table = "filter"
+	chain := fmt.Sprintf("GOIPT-SELFTEST-%d", os.Getpid())
+
+	src, dst := "192.0.2.0/24", "198.51.100.1/32"
+	if ipt.proto == ProtocolIPv6 {
+		src, dst = "2001:db8:a::/48", "2001:db8::1/128"
+	}
+	spec := []string{"-s", src, "-p", "tcp", "-m", "tcp", "--dport", "22", "-m", "comment", "--comment", "go-iptables self test", "-j", "ACCEPT"}
+	anySpec := []string{"-d", dst, "-j", "RETURN"}
+	expected := Rule{
+		Chain:    chain,
+		Source:   src,
+		Protocol: "tcp",
+		Matches: []Match{
+			{Name: "tcp", Options: []string{"--dport", "22"}},
+			{Name: "comment", Options: []string{"--comment", "go-iptables self test"}},
+		},
+		Target: "ACCEPT",
+	}
+
+	if err := ipt.NewChain(table, chain); err != nil {
+		return report, fmt.Errorf("could not create scratch chain %s: %v", chain, err)
+	}
+	defer func() {
+		_ = ipt.ClearAndDeleteChain(table, chain)
+	}()
+
+	check := func(name string, fn func() error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		report.Checks = append(report.Checks, SelfTestCheck{Name: name, Err: fn()})
+		return nil
+	}
+	mismatch := func(what string, got, want interface{}) error {
+		if reflect.DeepEqual(got, want) {
+			return nil
+		}
+		return fmt.Errorf("%s mismatch: got %#v, want %#v", what, got, want)
+	}
+
+	steps := []struct {
+		name string
+		fn   func() error
+	}{
+		{"append", func() error {
+			if err := ipt.Append(table, chain, spec...); err != nil {
+				return err
+			}
+			return ipt.Append(table, chain, anySpec...)
+		}},
+		{"exists", func() error {
+			exists, err := ipt.Exists(table, chain, spec...)
+			if err != nil {
+				return err
+			}
+			return mismatch("Exists", exists, true)
+		}},
+		{"list", func() error {
+			rules, err := ipt.List(table, chain)
+			if err != nil {
+				return err
+			}
+			return mismatch("List", rules, []string{
+				"-N " + chain,
+				expected.String(),
+				Rule{Chain: chain, Destination: dst, Target: "RETURN"}.String(),
+			})
+		}},
+		{"list parsed", func() error {
+			rules, err := ipt.ListParsed(table, chain)
+			if err != nil {
+				return err
+			}
+			if len(rules) != 2 {
+				return fmt.Errorf("ListParsed returned %d rules, want 2", len(rules))
+			}
+			return mismatch("ListParsed", rules[0], expected)
+		}},
+		{"stats", func() error {
+			stats, err := ipt.Stats(table, chain)
+			if err != nil {
+				return err
+			}
+			if len(stats) != 2 {
+				return fmt.Errorf("Stats returned %d rows, want 2", len(stats))
+			}
+			opt, prot := "--", "0"
+			if ipt.proto == ProtocolIPv6 && ipt.quirks.ipv6BlankOpt {
+				opt = "  "
+			}
+			if ipt.quirks.protAll {
+				prot = "all"
+			}
+			want := []string{"0", "0", "RETURN", prot, opt, "*", "*", anyAddress(ipt.proto), dst, ""}
+			return mismatch("Stats", stats[1], want)
+		}},
+		{"structured stats", func() error {
+			_, err := ipt.StructuredStats(table, chain)
+			return err
+		}},
+		{"insert", func() error {
+			if err := ipt.Insert(table, chain, 1, anySpec...); err != nil {
+				return err
+			}
+			rule, err := ipt.ListById(table, chain, 1)
+			if err != nil {
+				return err
+			}
+			return mismatch("ListById", rule, Rule{Chain: chain, Destination: dst, Target: "RETURN"}.String())
+		}},
+		{"replace", func() error {
+			return ipt.Replace(table, chain, 1, "-d", dst, "-j", "DROP")
+		}},
+		{"delete", func() error {
+			if err := ipt.Delete(table, chain, "-d", dst, "-j", "DROP"); err != nil {
+				return err
+			}
+			return ipt.DeleteById(table, chain, 1)
+		}},
+		{"delete missing", func() error {
+			err := ipt.Delete(table, chain, "-d", dst, "-j", "DROP")
+			if e, ok := err.(*Error); !ok || !e.IsNotExist() {
+				return fmt.Errorf("deleting a missing rule returned %v, want a not exist error", err)
+			}
+			return nil
+		}},
+	}
+
+	for _, step := range steps {
+		if err := check(step.name, step.fn); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// anyAddress returns the address -L -n prints for rules without a source
+// or destination.
+func anyAddress(proto Protocol) string {
+	if proto == ProtocolIPv6 {
+		return "::/0"
+	}
+	return "0.0.0.0/0"
+}
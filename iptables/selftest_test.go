@@ -0,0 +1,176 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeChain is a Runner emulating iptables 1.8.9 on a single chain of the
+// filter table, enough for SelfTest. protAll makes -L print "all" in the
+// prot column like older releases.
+type fakeChain struct {
+	chain   string
+	rules   [][]string
+	exists  bool
+	protAll bool
+}
+
+func (f *fakeChain) Run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	// iptables -t filter [-v] -X chain args... --wait
+	args = args[3 : len(args)-1]
+	verbose := args[0] == "-v"
+	if verbose {
+		args = args[1:]
+	}
+	cmd, chain, rest := args[0], args[1], args[2:]
+	if cmd != "-N" && (!f.exists || chain != f.chain) {
+		io.WriteString(stderr, "iptables: No chain/target/match by that name.\n")
+		return 1, nil
+	}
+	switch cmd {
+	case "-N":
+		f.chain, f.exists = chain, true
+	case "-X":
+		f.exists = false
+	case "-F":
+		f.rules = nil
+	case "-A":
+		f.rules = append(f.rules, rest)
+	case "-I", "-R":
+		n, _ := strconv.Atoi(rest[0])
+		if cmd == "-R" {
+			f.rules = append(f.rules[:n-1], f.rules[n:]...)
+		}
+		f.rules = append(f.rules[:n-1], append([][]string{rest[1:]}, f.rules[n-1:]...)...)
+	case "-C", "-D":
+		if n, err := strconv.Atoi(rest[0]); err == nil && cmd == "-D" {
+			f.rules = append(f.rules[:n-1], f.rules[n:]...)
+			return 0, nil
+		}
+		for i, r := range f.rules {
+			if strings.Join(r, " ") == strings.Join(rest, " ") {
+				if cmd == "-D" {
+					f.rules = append(f.rules[:i], f.rules[i+1:]...)
+				}
+				return 0, nil
+			}
+		}
+		io.WriteString(stderr, "iptables: Bad rule (does a matching rule exist in that chain?).\n")
+		return 1, nil
+	case "-S":
+		if len(rest) == 0 {
+			fmt.Fprintf(stdout, "-N %s\n", chain)
+		}
+		for i, r := range f.rules {
+			if len(rest) > 0 && rest[0] != strconv.Itoa(i+1) {
+				continue
+			}
+			line := strings.Join(quoteArgs(append([]string{"-A", chain}, r...)), " ")
+			if verbose {
+				line += " -c 0 0"
+			}
+			fmt.Fprintln(stdout, line)
+		}
+	case "-L":
+		fmt.Fprintf(stdout, "Chain %s (0 references)\n", chain)
+		fmt.Fprintln(stdout, "    pkts      bytes target     prot opt in     out     source               destination")
+		for _, r := range f.rules {
+			fmt.Fprintln(stdout, f.statLine(r))
+		}
+	default:
+		return 2, fmt.Errorf("unexpected command %q", args)
+	}
+	return 0, nil
+}
+
+// statLine formats a rule of the chain like -L -n -v -x.
+func (f *fakeChain) statLine(rule []string) string {
+	prot, src, dst, target, options := "0", "0.0.0.0/0", "0.0.0.0/0", "", ""
+	if f.protAll {
+		prot = "all"
+	}
+	for i := 0; i < len(rule)-1; i++ {
+		switch rule[i] {
+		case "-p":
+			prot = "6"
+		case "-s":
+			src = rule[i+1]
+		case "-d":
+			dst = strings.TrimSuffix(rule[i+1], "/32")
+		case "--dport":
+			options += "tcp dpt:" + rule[i+1] + " "
+		case "--comment":
+			options += "/* " + rule[i+1] + " */ "
+		case "-j":
+			target = rule[i+1]
+		}
+	}
+	return fmt.Sprintf("       0        0 %-10s %-4s --  *      *       %-20s %-20s %s", target, prot, src, dst, options)
+}
+
+func TestSelfTest(t *testing.T) {
+	f := &fakeChain{}
+	ipt, err := New(CommandRunner(f), CompatibilityProfile("1.8.9-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	report, err := ipt.SelfTest(context.Background())
+	if err != nil {
+		t.Fatalf("SelfTest failed: %v", err)
+	}
+	if !report.OK() || len(report.Checks) != 10 || report.Profile != "1.8.9-nft" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if f.exists {
+		t.Fatalf("the scratch chain %s was not removed", f.chain)
+	}
+
+	// an output format that doesn't match the profile fails the stats check
+	f = &fakeChain{protAll: true}
+	ipt, err = New(CommandRunner(f), CompatibilityProfile("1.8.9-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	report, err = ipt.SelfTest(context.Background())
+	if err != nil {
+		t.Fatalf("SelfTest failed: %v", err)
+	}
+	if failed := report.Failed(); len(failed) != 1 || failed[0].Name != "stats" {
+		t.Fatalf("expected only the stats check to fail, got %+v", failed)
+	}
+}
+
+func TestSelfTestCanceled(t *testing.T) {
+	f := &fakeChain{}
+	ipt, err := New(CommandRunner(f), CompatibilityProfile("1.8.9-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err := ipt.SelfTest(ctx)
+	if err != context.Canceled || len(report.Checks) != 0 {
+		t.Fatalf("expected a canceled empty report, got %+v, %v", report, err)
+	}
+	if f.exists {
+		t.Fatalf("the scratch chain %s was not removed", f.chain)
+	}
+}
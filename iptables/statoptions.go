@@ -0,0 +1,127 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import "strings"
+
+// FragmentMatch is how a rule matches IPv4 fragments, as shown in the
+// "opt" column of a Stat.
+type FragmentMatch int
+
+const (
+	// FragmentAny matches all packets, shown as "--", or as blank by
+	// ip6tables before 1.8.9
+	FragmentAny FragmentMatch = iota
+	// FragmentOnly matches second and further fragments ("-f")
+	FragmentOnly
+	// FragmentNone matches unfragmented packets and first fragments ("!f")
+	FragmentNone
+)
+
+// Fragment returns how the rule matches fragments, whichever way the
+// iptables version prints the opt column.
+func (s Stat) Fragment() FragmentMatch {
+	switch strings.TrimSpace(s.Opt) {
+	case "-f":
+		return FragmentOnly
+	case "!f":
+		return FragmentNone
+	}
+	return FragmentAny
+}
+
+// StatOptions is the options column of a Stat split into what the match
+// extensions and the target printed.
+type StatOptions struct {
+	// Matches are the words printed by the match extensions, in order,
+	// e.g. "tcp", "dpt:22", "ctstate", "RELATED,ESTABLISHED"
+	Matches []string
+	// Comment is the text of the comment match, if any
+	Comment string
+	// Target is what the target printed, e.g.
+	// "reject-with icmp-port-unreachable" or "to:10.0.0.1:80". It is only
+	// split off for the targets listed in targetMarkers, and part of
+	// Matches otherwise.
+	Target string
+}
+
+// targetMarkers are the words the targets start their -L output with.
+var targetMarkers = map[string][]string{
+	"CONNMARK":   {"CONNMARK "},
+	"CT":         {"CT "},
+	"DNAT":       {"to:"},
+	"DSCP":       {"DSCP set "},
+	"HL":         {"HL "},
+	"LOG":        {"LOG flags "},
+	"MARK":       {"MARK "},
+	"MASQUERADE": {"masq ports: ", "random-fully", "random"},
+	"NETMAP":     {"to:"},
+	"NFQUEUE":    {"NFQUEUE "},
+	"REDIRECT":   {"redir ports ", "random"},
+	"REJECT":     {"reject-with "},
+	"SNAT":       {"to:"},
+	"TCPMSS":     {"TCPMSS "},
+	"TPROXY":     {"TPROXY "},
+	"TTL":        {"TTL "},
+}
+
+// ParseOptions splits the options column of the stat.
+func (s Stat) ParseOptions() StatOptions {
+	var opts StatOptions
+	rest := s.Options
+	if i := strings.Index(rest, "/* "); i >= 0 {
+		if j := strings.Index(rest[i:], " */"); j >= 0 {
+			opts.Comment = rest[i+3 : i+j]
+			rest = rest[:i] + rest[i+j+3:]
+		}
+	}
+	rest = strings.TrimSpace(rest)
+
+	target := -1
+	for _, marker := range targetMarkers[s.Target] {
+		for from := 0; from < len(rest); {
+			i := strings.Index(rest[from:], marker)
+			if i < 0 {
+				break
+			}
+			i += from
+			// only at the start of a word
+			if i == 0 || rest[i-1] == ' ' {
+				if target < 0 || i < target {
+					target = i
+				}
+				break
+			}
+			from = i + 1
+		}
+	}
+	if target >= 0 {
+		opts.Target = strings.TrimSpace(rest[target:])
+		rest = rest[:target]
+	}
+	opts.Matches = strings.Fields(rest)
+	return opts
+}
+
+// Value returns the value of the first "key:value" word of the matches,
+// e.g. "22" for "dpt".
+func (o StatOptions) Value(key string) (string, bool) {
+	for _, m := range o.Matches {
+		if strings.HasPrefix(m, key+":") {
+			return m[len(key)+1:], true
+		}
+	}
+	return "", false
+}
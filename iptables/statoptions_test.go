@@ -0,0 +1,74 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStatFragment(t *testing.T) {
+	for opt, expected := range map[string]FragmentMatch{
+		"--": FragmentAny,
+		"  ": FragmentAny,
+		"-f": FragmentOnly,
+		"!f": FragmentNone,
+	} {
+		if f := (Stat{Opt: opt}).Fragment(); f != expected {
+			t.Errorf("opt %q: got %v, need %v", opt, f, expected)
+		}
+	}
+}
+
+func TestStatParseOptions(t *testing.T) {
+	for _, tc := range []struct {
+		stat     Stat
+		expected StatOptions
+	}{
+		{
+			Stat{Target: "ACCEPT", Options: "tcp dpt:22 /* allow ssh */ ctstate NEW"},
+			StatOptions{Matches: []string{"tcp", "dpt:22", "ctstate", "NEW"}, Comment: "allow ssh"},
+		},
+		{
+			Stat{Target: "REJECT", Options: "udp dpt:53 reject-with icmp-port-unreachable"},
+			StatOptions{Matches: []string{"udp", "dpt:53"}, Target: "reject-with icmp-port-unreachable"},
+		},
+		{
+			Stat{Target: "DNAT", Options: "/* web */ tcp dpt:80 to:10.0.0.1:8080"},
+			StatOptions{Matches: []string{"tcp", "dpt:80"}, Comment: "web", Target: "to:10.0.0.1:8080"},
+		},
+		{
+			Stat{Target: "MASQUERADE", Options: "random-fully"},
+			StatOptions{Matches: []string{}, Target: "random-fully"},
+		},
+		{
+			Stat{Target: "AGENT", Options: ""},
+			StatOptions{Matches: []string{}},
+		},
+	} {
+		opts := tc.stat.ParseOptions()
+		if !reflect.DeepEqual(opts, tc.expected) {
+			t.Errorf("%q: got %+v, need %+v", tc.stat.Options, opts, tc.expected)
+		}
+	}
+
+	opts := (Stat{Target: "ACCEPT", Options: "tcp spt:1024 dpt:22"}).ParseOptions()
+	if v, ok := opts.Value("dpt"); !ok || v != "22" {
+		t.Errorf("unexpected dpt %q", v)
+	}
+	if _, ok := opts.Value("to"); ok {
+		t.Errorf("unexpected to value")
+	}
+}
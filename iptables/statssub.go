@@ -0,0 +1,159 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// StatsDelta is the change of the counters of a rule between two samples
+// of a StatsSubscription.
+type StatsDelta struct {
+	LabeledStat
+	// PacketsDelta and BytesDelta are the increase of the counters since
+	// the previous sample. When the counters were reset, they are the
+	// current counters.
+	PacketsDelta uint64 `json:"pktsDelta"`
+	BytesDelta   uint64 `json:"bytesDelta"`
+	// PacketRate and ByteRate are the deltas per second
+	PacketRate float64 `json:"pktRate"`
+	ByteRate   float64 `json:"byteRate"`
+}
+
+// StatsSubscription samples the counters of every rule of a set of tables
+// and passes the rules whose counters changed since the previous sample to
+// its subscribers, so that exporters watching many mostly idle chains only
+// process what moved.
+//
+// Rules are identified by their table, chain and rulespec, so that rules
+// inserted or deleted between samples don't shift the counters of the
+// others.
+type StatsSubscription struct {
+	ipt    *IPTables
+	tables []string
+
+	mu          sync.Mutex
+	subscribers []func([]StatsDelta)
+	prev        map[statsKey]LabeledStat
+	last        time.Time
+}
+
+// statsKey identifies a rule across samples; n tells identical rules of a
+// chain apart.
+type statsKey struct {
+	table, chain, rule string
+	n                  int
+}
+
+// NewStatsSubscription returns a StatsSubscription of the specified
+// tables. No sample is taken until Poll or Run is called.
+func (ipt *IPTables) NewStatsSubscription(tables ...string) *StatsSubscription {
+	return &StatsSubscription{ipt: ipt, tables: tables}
+}
+
+// Subscribe registers fn to be called by Poll with the rules whose counters
+// changed. fn is not called when nothing changed.
+func (s *StatsSubscription) Subscribe(fn func([]StatsDelta)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers = append(s.subscribers, fn)
+}
+
+// Poll samples the counters, with one iptables-save invocation per table,
+// and notifies the subscribers of the changes. The first sample only sets
+// the baseline.
+func (s *StatsSubscription) Poll() error {
+	var stats []LabeledStat
+	for _, table := range s.tables {
+		rs, err := s.ipt.SaveRuleset(table)
+		if err != nil {
+			return err
+		}
+		stats = append(stats, labeledStats(rs)...)
+	}
+	s.update(time.Now(), stats)
+	return nil
+}
+
+// Run calls Poll every interval until ctx is done, passing its errors to
+// onError, which may be nil. It returns an error right away if interval
+// isn't positive, and nil once ctx is done.
+func (s *StatsSubscription) Run(ctx context.Context, interval time.Duration, onError func(error)) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid interval %v", interval)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Poll(); err != nil && onError != nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// update records the sample stats taken at now and notifies the
+// subscribers of the changes since the previous one.
+func (s *StatsSubscription) update(now time.Time, stats []LabeledStat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	first := s.prev == nil
+	elapsed := now.Sub(s.last).Seconds()
+	seen := map[statsKey]int{}
+	next := make(map[statsKey]LabeledStat, len(stats))
+	var deltas []StatsDelta
+	for _, st := range stats {
+		key := statsKey{table: st.Table, chain: st.Chain, rule: st.Rule}
+		key.n = seen[key]
+		seen[key]++
+		next[key] = st
+
+		old, ok := s.prev[key]
+		if first || (ok && old.Packets == st.Packets && old.Bytes == st.Bytes) {
+			continue
+		}
+		d := StatsDelta{LabeledStat: st, PacketsDelta: st.Packets, BytesDelta: st.Bytes}
+		if ok && st.Packets >= old.Packets && st.Bytes >= old.Bytes {
+			d.PacketsDelta -= old.Packets
+			d.BytesDelta -= old.Bytes
+		}
+		if d.PacketsDelta == 0 && d.BytesDelta == 0 {
+			// a new rule without traffic
+			continue
+		}
+		if elapsed > 0 {
+			d.PacketRate = float64(d.PacketsDelta) / elapsed
+			d.ByteRate = float64(d.BytesDelta) / elapsed
+		}
+		deltas = append(deltas, d)
+	}
+	s.prev = next
+	s.last = now
+
+	if len(deltas) == 0 {
+		return
+	}
+	for _, fn := range s.subscribers {
+		fn(deltas)
+	}
+}
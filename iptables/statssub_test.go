@@ -0,0 +1,87 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStatsSubscription(t *testing.T) {
+	s := (&IPTables{}).NewStatsSubscription("filter")
+	var got [][]StatsDelta
+	s.Subscribe(func(deltas []StatsDelta) {
+		got = append(got, deltas)
+	})
+
+	stat := func(chain, rule string, pkts, bytes uint64) LabeledStat {
+		return LabeledStat{Table: "filter", Chain: chain, Rule: rule, Packets: pkts, Bytes: bytes}
+	}
+	start := time.Unix(1000, 0)
+	s.update(start, []LabeledStat{
+		stat("INPUT", "-A INPUT -j ACCEPT", 10, 1000),
+		stat("IDLE", "-A IDLE -j DROP", 0, 0),
+	})
+	if len(got) != 0 {
+		t.Fatalf("the baseline notified %v", got)
+	}
+
+	s.update(start.Add(2*time.Second), []LabeledStat{
+		stat("INPUT", "-A INPUT -j ACCEPT", 30, 3000),
+		stat("IDLE", "-A IDLE -j DROP", 0, 0),
+	})
+	if len(got) != 1 || len(got[0]) != 1 {
+		t.Fatalf("unexpected notifications %+v", got)
+	}
+	d := got[0][0]
+	if d.Chain != "INPUT" || d.PacketsDelta != 20 || d.BytesDelta != 2000 || d.PacketRate != 10 || d.ByteRate != 1000 {
+		t.Fatalf("unexpected delta %+v", d)
+	}
+
+	// nothing moved
+	s.update(start.Add(4*time.Second), []LabeledStat{
+		stat("INPUT", "-A INPUT -j ACCEPT", 30, 3000),
+		stat("IDLE", "-A IDLE -j DROP", 0, 0),
+	})
+	if len(got) != 1 {
+		t.Fatalf("idle sample notified %+v", got[1:])
+	}
+
+	// counters reset, and a rule inserted before an existing one
+	s.update(start.Add(5*time.Second), []LabeledStat{
+		stat("INPUT", "-A INPUT -i lo -j ACCEPT", 1, 60),
+		stat("INPUT", "-A INPUT -j ACCEPT", 5, 500),
+		stat("IDLE", "-A IDLE -j DROP", 0, 0),
+	})
+	if len(got) != 2 || len(got[1]) != 2 {
+		t.Fatalf("unexpected notifications %+v", got)
+	}
+	if d := got[1][0]; d.Rule != "-A INPUT -i lo -j ACCEPT" || d.PacketsDelta != 1 || d.PacketRate != 1 {
+		t.Fatalf("unexpected delta of the new rule %+v", d)
+	}
+	if d := got[1][1]; d.PacketsDelta != 5 || d.BytesDelta != 500 {
+		t.Fatalf("unexpected delta after a reset %+v", d)
+	}
+}
+
+func TestStatsSubscriptionRun(t *testing.T) {
+	s := (&IPTables{}).NewStatsSubscription("filter")
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := s.Run(context.Background(), interval, nil); err == nil {
+			t.Fatalf("expected Run to reject interval %v", interval)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// tableNamesFile returns the file the kernel lists the legacy xtables
+// tables of proto in.
+func tableNamesFile(proto Protocol) string {
+	if proto == ProtocolIPv6 {
+		return "/proc/net/ip6_tables_names"
+	}
+	return "/proc/net/ip_tables_names"
+}
+
+// ListTables returns the tables of the handle's family currently present
+// in the kernel, sorted, so that tools can avoid referencing a table whose
+// module isn't loaded. In legacy mode they are read from
+// /proc/net/ip_tables_names (ip6_tables_names for IPv6), where the
+// commands of the handle run; in nf_tables mode, or if that file cannot
+// be read, from the output of iptables-save. Listing doesn't load any
+// module.
+func (ipt *IPTables) ListTables() ([]string, error) {
+	var out bytes.Buffer
+	if ipt.mode != "nf_tables" {
+		if err := ipt.runCommand([]string{"cat", tableNamesFile(ipt.proto)}, nil, &out); err == nil {
+			tables := strings.Fields(out.String())
+			sort.Strings(tables)
+			return tables, nil
+		}
+		out.Reset()
+	}
+
+	if err := ipt.runSave(&out); err != nil {
+		return nil, err
+	}
+	var tables []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "*") {
+			tables = append(tables, strings.TrimSpace(line[1:]))
+		}
+	}
+	sort.Strings(tables)
+	return tables, nil
+}
+
+// TableExists reports whether table is present in the kernel, as listed by
+// ListTables.
+func (ipt *IPTables) TableExists(table string) (bool, error) {
+	tables, err := ipt.ListTables()
+	if err != nil {
+		return false, err
+	}
+	for _, t := range tables {
+		if t == table {
+			return true, nil
+		}
+	}
+	return false, nil
+}
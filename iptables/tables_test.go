@@ -0,0 +1,67 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestListTables(t *testing.T) {
+	var commands []string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		commands = append(commands, args[0])
+		switch args[0] {
+		case "cat":
+			if args[1] != "/proc/net/ip6_tables_names" {
+				return 1, nil
+			}
+			io.WriteString(stdout, "nat\nfilter\n")
+		case "ip6tables-save", "iptables-save":
+			io.WriteString(stdout, "# Generated by iptables-nft-save\n*mangle\n:PREROUTING ACCEPT [0:0]\nCOMMIT\n*filter\n:INPUT ACCEPT [0:0]\nCOMMIT\n")
+		}
+		return 0, nil
+	})
+
+	for _, tc := range []struct {
+		proto    Protocol
+		profile  string
+		expected []string
+		commands []string
+	}{
+		{ProtocolIPv6, "1.8.7-legacy", []string{"filter", "nat"}, []string{"cat"}},
+		// the file cannot be read
+		{ProtocolIPv4, "1.8.7-legacy", []string{"filter", "mangle"}, []string{"cat", "iptables-save"}},
+		{ProtocolIPv6, "1.8.7-nft", []string{"filter", "mangle"}, []string{"ip6tables-save"}},
+	} {
+		commands = nil
+		ipt, err := New(IPFamily(tc.proto), CommandRunner(runner), CompatibilityProfile(tc.profile))
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		tables, err := ipt.ListTables()
+		if err != nil {
+			t.Fatalf("ListTables failed: %v", err)
+		}
+		if !reflect.DeepEqual(tables, tc.expected) || !reflect.DeepEqual(commands, tc.commands) {
+			t.Errorf("%s: got %q with %q, need %q with %q", tc.profile, tables, commands, tc.expected, tc.commands)
+		}
+		if exists, err := ipt.TableExists("mangle"); err != nil || exists != contains(tc.expected, "mangle") {
+			t.Errorf("%s: TableExists(mangle) returned %v, %v", tc.profile, exists, err)
+		}
+	}
+}
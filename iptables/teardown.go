@@ -0,0 +1,108 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"fmt"
+)
+
+// CleanupPolicy selects what Tracker.Cleanup does with the owned rules.
+type CleanupPolicy int
+
+const (
+	// CleanupLeave leaves all rules in place (fail-closed for rules
+	// enforcing restrictions, fail-open for rules granting access).
+	CleanupLeave CleanupPolicy = iota
+	// CleanupRemoveOwned removes every owned rule and chain.
+	CleanupRemoveOwned
+	// CleanupFallback applies the fallback ruleset set with SetFallback,
+	// then removes every owned rule and chain.
+	CleanupFallback
+)
+
+// SetFallback sets the ruleset applied by Cleanup with CleanupFallback. It
+// is applied with RestoreAll and RestoreNoFlush, so only the listed chains
+// are replaced.
+func (t *Tracker) SetFallback(tables map[string]map[string][][]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fallback = tables
+}
+
+// Cleanup applies the given policy to the owned rules and chains. Removal
+// is best-effort: every owned rule and chain is attempted, and failures are
+// reported as a *MultiError. Rules and chains that could not be removed
+// stay owned, so that Cleanup can be retried.
+func (t *Tracker) Cleanup(policy CleanupPolicy) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch policy {
+	case CleanupLeave:
+		return nil
+	case CleanupFallback:
+		if t.fallback == nil {
+			return fmt.Errorf("no fallback ruleset configured")
+		}
+		if err := t.ipt.RestoreAll(t.fallback, RestoreNoFlush()); err != nil {
+			return err
+		}
+	case CleanupRemoveOwned:
+	default:
+		return fmt.Errorf("unknown cleanup policy %d", policy)
+	}
+
+	var b multiErrorBuilder
+
+	// remove rules first, in reverse order, so that jumps to owned chains
+	// are gone by the time the chains are deleted
+	var rules []OwnedRule
+	for i := len(t.owned.Rules) - 1; i >= 0; i-- {
+		r := t.owned.Rules[i]
+		op := Operation{Kind: "delete", Proto: t.ipt.proto, Table: r.Table, Chain: r.Chain, Rulespec: r.Spec}
+		if !b.add(op, t.ipt.DeleteIfExists(r.Table, r.Chain, r.Spec...)) {
+			rules = append([]OwnedRule{r}, rules...)
+		}
+	}
+	t.owned.Rules = rules
+
+	var chains []OwnedChain
+	for i := len(t.owned.Chains) - 1; i >= 0; i-- {
+		c := t.owned.Chains[i]
+		op := Operation{Kind: "delete-chain", Proto: t.ipt.proto, Table: c.Table, Chain: c.Chain}
+		if !b.add(op, t.ipt.ClearAndDeleteChain(c.Table, c.Chain)) {
+			chains = append([]OwnedChain{c}, chains...)
+		}
+	}
+	t.owned.Chains = chains
+
+	if err := t.save(); err != nil {
+		return err
+	}
+	return b.err()
+}
+
+// TeardownOnContext runs Cleanup with the given policy once ctx is done,
+// e.g. when the process receives a termination signal. The result of
+// Cleanup is delivered on the returned channel.
+func (t *Tracker) TeardownOnContext(ctx context.Context, policy CleanupPolicy) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		result <- t.Cleanup(policy)
+	}()
+	return result
+}
@@ -0,0 +1,172 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// teardownRunner records the commands that change the ruleset and fails
+// those listed in fail.
+type teardownRunner struct {
+	calls []string
+	fail  map[string]bool
+}
+
+func (r *teardownRunner) Run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	if strings.HasSuffix(args[0], "-restore") {
+		data, _ := io.ReadAll(stdin)
+		r.calls = append(r.calls, "restore "+strings.Join(args[1:], " ")+"\n"+string(data))
+		return 0, nil
+	}
+	cmd := strings.Join(args[1:len(args)-1], " ")
+	switch args[3] {
+	case "-S", "-C":
+		return 0, nil
+	}
+	r.calls = append(r.calls, cmd)
+	if r.fail[cmd] {
+		io.WriteString(stderr, "iptables: Resource busy.\n")
+		return 4, nil
+	}
+	return 0, nil
+}
+
+func newTeardownTracker(t *testing.T, r *teardownRunner) (*Tracker, *memoryStore) {
+	ipt, err := New(CommandRunner(r), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	store := &memoryStore{o: Ownership{
+		Chains: []OwnedChain{{Table: "filter", Chain: "AGENT"}, {Table: "nat", Chain: "AGENT"}},
+		Rules: []OwnedRule{
+			{Table: "filter", Chain: "INPUT", Spec: []string{"-j", "AGENT"}},
+			{Table: "filter", Chain: "AGENT", Spec: []string{"-j", "DROP"}},
+			{Table: "nat", Chain: "PREROUTING", Spec: []string{"-j", "AGENT"}},
+		},
+	}}
+	tr, err := NewTracker(ipt, store)
+	if err != nil {
+		t.Fatalf("NewTracker failed: %v", err)
+	}
+	return tr, store
+}
+
+func TestCleanup(t *testing.T) {
+	r := &teardownRunner{}
+	tr, store := newTeardownTracker(t, r)
+
+	if err := tr.Cleanup(CleanupLeave); err != nil || len(r.calls) != 0 {
+		t.Fatalf("CleanupLeave ran %q, %v", r.calls, err)
+	}
+	if err := tr.Cleanup(CleanupFallback); err == nil {
+		t.Fatalf("expected CleanupFallback without a fallback ruleset to fail")
+	}
+
+	if err := tr.Cleanup(CleanupRemoveOwned); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	// rules in reverse order, then chains in reverse order
+	want := []string{
+		"-t nat -D PREROUTING -j AGENT",
+		"-t filter -D AGENT -j DROP",
+		"-t filter -D INPUT -j AGENT",
+		"-t nat -F AGENT",
+		"-t nat -X AGENT",
+		"-t filter -F AGENT",
+		"-t filter -X AGENT",
+	}
+	if !reflect.DeepEqual(r.calls, want) {
+		t.Fatalf("expected %q, got %q", want, r.calls)
+	}
+	if o := tr.Owned(); len(o.Rules) != 0 || len(o.Chains) != 0 || len(store.o.Rules) != 0 || len(store.o.Chains) != 0 {
+		t.Fatalf("expected no owned rules or chains, got %+v, stored %+v", o, store.o)
+	}
+}
+
+func TestCleanupPartialFailure(t *testing.T) {
+	r := &teardownRunner{fail: map[string]bool{
+		"-t filter -D AGENT -j DROP": true,
+		"-t filter -X AGENT":         true,
+	}}
+	tr, store := newTeardownTracker(t, r)
+
+	err := tr.Cleanup(CleanupRemoveOwned)
+	var merr *MultiError
+	if !errors.As(err, &merr) || len(merr.Errors) != 2 {
+		t.Fatalf("expected a MultiError with 2 errors, got %v", err)
+	}
+	// every rule and chain is still attempted
+	if len(r.calls) != 7 {
+		t.Fatalf("expected every removal to be attempted, got %q", r.calls)
+	}
+	want := Ownership{
+		Chains: []OwnedChain{{Table: "filter", Chain: "AGENT"}},
+		Rules:  []OwnedRule{{Table: "filter", Chain: "AGENT", Spec: []string{"-j", "DROP"}}},
+	}
+	if o := tr.Owned(); !reflect.DeepEqual(o, want) || !reflect.DeepEqual(store.o, want) {
+		t.Fatalf("expected %+v to stay owned, got %+v, stored %+v", want, o, store.o)
+	}
+
+	// a retry removes what is left
+	r.fail, r.calls = nil, nil
+	if err := tr.Cleanup(CleanupRemoveOwned); err != nil {
+		t.Fatalf("retried Cleanup failed: %v", err)
+	}
+	want2 := []string{"-t filter -D AGENT -j DROP", "-t filter -F AGENT", "-t filter -X AGENT"}
+	if !reflect.DeepEqual(r.calls, want2) {
+		t.Fatalf("expected %q, got %q", want2, r.calls)
+	}
+}
+
+func TestCleanupFallback(t *testing.T) {
+	r := &teardownRunner{}
+	tr, _ := newTeardownTracker(t, r)
+	tr.SetFallback(map[string]map[string][][]string{
+		"filter": {"INPUT": {{"-j", "ACCEPT"}}},
+	})
+
+	if err := tr.Cleanup(CleanupFallback); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	if len(r.calls) != 8 || !strings.HasPrefix(r.calls[0], "restore ") || !strings.Contains(r.calls[0], "--noflush") {
+		t.Fatalf("expected the fallback to be restored with --noflush before the removals, got %q", r.calls)
+	}
+}
+
+func TestTeardownOnContext(t *testing.T) {
+	r := &teardownRunner{}
+	tr, _ := newTeardownTracker(t, r)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := tr.TeardownOnContext(ctx, CleanupRemoveOwned)
+	select {
+	case err := <-result:
+		t.Fatalf("teardown ran before the context was done: %v", err)
+	default:
+	}
+	cancel()
+	if err := <-result; err != nil {
+		t.Fatalf("teardown failed: %v", err)
+	}
+	if o := tr.Owned(); len(o.Rules) != 0 || len(o.Chains) != 0 {
+		t.Fatalf("expected no owned rules or chains, got %+v", o)
+	}
+}
@@ -0,0 +1,384 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// OwnedChain is a chain created through a Tracker.
+type OwnedChain struct {
+	Table string `json:"table"`
+	Chain string `json:"chain"`
+}
+
+// OwnedRule is a rule created through a Tracker. Pending is set while the
+// rule is being added, so that a crash between running iptables and
+// recording the result can be detected on the next start.
+type OwnedRule struct {
+	Table   string   `json:"table"`
+	Chain   string   `json:"chain"`
+	Spec    []string `json:"spec"`
+	Pending bool     `json:"pending,omitempty"`
+}
+
+// Ownership is the set of chains and rules a Tracker believes it owns.
+type Ownership struct {
+	Chains []OwnedChain `json:"chains"`
+	Rules  []OwnedRule  `json:"rules"`
+}
+
+// OwnershipStore persists the Ownership of a Tracker across restarts.
+type OwnershipStore interface {
+	// Load returns the stored Ownership, which is empty if nothing was
+	// stored yet.
+	Load() (*Ownership, error)
+	Save(*Ownership) error
+}
+
+// FileStore is an OwnershipStore keeping the Ownership as a JSON file.
+type FileStore struct {
+	path string
+}
+
+// NewFileStore returns a FileStore using the file at path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load reads the Ownership from the file.
+func (s *FileStore) Load() (*Ownership, error) {
+	o := &Ownership{}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return o, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Save atomically replaces the file with the given Ownership.
+func (s *FileStore) Save(o *Ownership) error {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Tracker wraps an IPTables handle and records the chains and rules created
+// through it in an OwnershipStore, giving daemons a crash-consistent view
+// of their footprint across restarts.
+type Tracker struct {
+	ipt   *IPTables
+	store OwnershipStore
+
+	mu       sync.Mutex
+	owned    Ownership
+	fallback map[string]map[string][][]string
+}
+
+// ProvenanceReport is the result of Tracker.Reconcile.
+type ProvenanceReport struct {
+	// Missing holds owned rules that were deleted by someone else
+	Missing []OwnedRule
+	// MissingChains holds owned chains that were deleted by someone else
+	MissingChains []OwnedChain
+	// Orphans holds rules found in owned chains that are not owned
+	Orphans []OwnedRule
+	// Recovered holds rules that were being added when the previous
+	// process stopped and turned out to be present
+	Recovered []OwnedRule
+}
+
+// NewTracker returns a Tracker for ipt, loading the previously owned
+// chains and rules from store.
+func NewTracker(ipt *IPTables, store OwnershipStore) (*Tracker, error) {
+	o, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	return &Tracker{ipt: ipt, store: store, owned: *o}, nil
+}
+
+// Owned returns a copy of the chains and rules the Tracker owns.
+func (t *Tracker) Owned() Ownership {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return Ownership{
+		Chains: append([]OwnedChain{}, t.owned.Chains...),
+		Rules:  append([]OwnedRule{}, t.owned.Rules...),
+	}
+}
+
+// NewChain creates a new owned chain in the specified table.
+func (t *Tracker) NewChain(table, chain string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.ipt.NewChain(table, chain); err != nil {
+		return err
+	}
+	t.owned.Chains = append(t.owned.Chains, OwnedChain{table, chain})
+	return t.save()
+}
+
+// ClearAndDeleteChain flushes and deletes an owned chain, forgetting it and
+// the rules it contained.
+func (t *Tracker) ClearAndDeleteChain(table, chain string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.ipt.ClearAndDeleteChain(table, chain); err != nil {
+		return err
+	}
+	t.forgetChain(table, chain)
+	return t.save()
+}
+
+// Append appends an owned rulespec to specified table/chain, unless the
+// Tracker owns it already
+func (t *Tracker) Append(table, chain string, rulespec ...string) error {
+	return t.add(table, chain, rulespec, func() error {
+		return t.ipt.Append(table, chain, rulespec...)
+	})
+}
+
+// AppendUnique acts like Append except that it won't add a duplicate
+func (t *Tracker) AppendUnique(table, chain string, rulespec ...string) error {
+	return t.add(table, chain, rulespec, func() error {
+		return t.ipt.AppendUnique(table, chain, rulespec...)
+	})
+}
+
+// Insert inserts an owned rulespec to specified table/chain (in specified
+// pos), unless the Tracker owns it already
+func (t *Tracker) Insert(table, chain string, pos int, rulespec ...string) error {
+	return t.add(table, chain, rulespec, func() error {
+		return t.ipt.Insert(table, chain, pos, rulespec...)
+	})
+}
+
+// InsertUnique acts like Insert except that it won't insert a duplicate
+func (t *Tracker) InsertUnique(table, chain string, pos int, rulespec ...string) error {
+	return t.add(table, chain, rulespec, func() error {
+		return t.ipt.InsertUnique(table, chain, pos, rulespec...)
+	})
+}
+
+// Delete removes rulespec in specified table/chain and forgets it.
+func (t *Tracker) Delete(table, chain string, rulespec ...string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.ipt.Delete(table, chain, rulespec...); err != nil {
+		return err
+	}
+	t.forgetRule(table, chain, rulespec)
+	return t.save()
+}
+
+// DeleteIfExists removes rulespec in specified table/chain if it exists
+// and forgets it.
+func (t *Tracker) DeleteIfExists(table, chain string, rulespec ...string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.ipt.DeleteIfExists(table, chain, rulespec...); err != nil {
+		return err
+	}
+	t.forgetRule(table, chain, rulespec)
+	return t.save()
+}
+
+// Reconcile compares the owned chains and rules with the live state and
+// resolves the rules left pending by a crash: those found are kept, the
+// others forgotten.
+func (t *Tracker) Reconcile() (*ProvenanceReport, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	report := &ProvenanceReport{}
+	owned := map[string]bool{}
+	rules := t.owned.Rules[:0:0]
+	for _, r := range t.owned.Rules {
+		exists, err := t.ipt.Exists(r.Table, r.Chain, r.Spec...)
+		if err != nil && !isNotExistError(err) {
+			return nil, err
+		}
+		switch {
+		case r.Pending && exists:
+			r.Pending = false
+			report.Recovered = append(report.Recovered, r)
+		case r.Pending:
+			continue
+		case !exists:
+			report.Missing = append(report.Missing, r)
+		}
+		rules = append(rules, r)
+		owned[ownedRuleKey(r.Table, r.Chain, r.Spec)] = true
+	}
+	t.owned.Rules = rules
+
+	for _, c := range t.owned.Chains {
+		exists, err := t.ipt.ChainExists(c.Table, c.Chain)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			report.MissingChains = append(report.MissingChains, c)
+			continue
+		}
+		live, err := t.ipt.List(c.Table, c.Chain)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parseRules(live)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range parsed {
+			if !owned[ownedRuleKey(c.Table, c.Chain, r.Spec())] {
+				report.Orphans = append(report.Orphans, OwnedRule{Table: c.Table, Chain: c.Chain, Spec: r.Spec()})
+			}
+		}
+	}
+
+	return report, t.save()
+}
+
+// add records rulespec as pending, runs fn, and then confirms or forgets
+// the rule depending on the outcome. A rule that is owned already is left
+// alone, since a single record can't account for a second copy; only a
+// rule left pending by a crash is added again, and its record is only
+// forgotten once fn succeeded, so that a failure doesn't orphan a rule
+// that is still installed.
+func (t *Tracker) add(table, chain string, rulespec []string, fn func() error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := t.findRule(table, chain, rulespec)
+	if i >= 0 && !t.owned.Rules[i].Pending {
+		return nil
+	}
+	owned := i >= 0
+	if !owned {
+		t.owned.Rules = append(t.owned.Rules, OwnedRule{
+			Table:   table,
+			Chain:   chain,
+			Spec:    append([]string{}, rulespec...),
+			Pending: true,
+		})
+		if err := t.save(); err != nil {
+			t.owned.Rules = t.owned.Rules[:len(t.owned.Rules)-1]
+			return err
+		}
+	}
+
+	if err := fn(); err != nil {
+		if !owned {
+			t.owned.Rules = t.owned.Rules[:len(t.owned.Rules)-1]
+			_ = t.save()
+		}
+		return err
+	}
+	t.forgetRule(table, chain, rulespec)
+	t.owned.Rules = append(t.owned.Rules, OwnedRule{
+		Table: table,
+		Chain: chain,
+		Spec:  append([]string{}, rulespec...),
+	})
+	return t.save()
+}
+
+// findRule returns the index of the record of rulespec, or -1.
+func (t *Tracker) findRule(table, chain string, rulespec []string) int {
+	for i, r := range t.owned.Rules {
+		if r.Table == table && r.Chain == chain && reflect.DeepEqual(r.Spec, rulespec) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *Tracker) forgetRule(table, chain string, rulespec []string) {
+	rules := t.owned.Rules[:0]
+	for _, r := range t.owned.Rules {
+		if r.Table != table || r.Chain != chain || !reflect.DeepEqual(r.Spec, rulespec) {
+			rules = append(rules, r)
+		}
+	}
+	t.owned.Rules = rules
+}
+
+func (t *Tracker) forgetChain(table, chain string) {
+	chains := t.owned.Chains[:0]
+	for _, c := range t.owned.Chains {
+		if c.Table != table || c.Chain != chain {
+			chains = append(chains, c)
+		}
+	}
+	t.owned.Chains = chains
+
+	rules := t.owned.Rules[:0]
+	for _, r := range t.owned.Rules {
+		if r.Table != table || r.Chain != chain {
+			rules = append(rules, r)
+		}
+	}
+	t.owned.Rules = rules
+}
+
+func (t *Tracker) save() error {
+	return t.store.Save(&t.owned)
+}
+
+// ownedRuleKey identifies a rule independently of the way its rulespec
+// was written, by going through its normalized form.
+func ownedRuleKey(table, chain string, spec []string) string {
+	line := strings.Join(append([]string{"-A", chain}, quoteArgs(spec)...), " ")
+	if r, err := ParseRule(line); err == nil {
+		line = ruleKey(r)
+	}
+	return table + " " + line
+}
+
+// isNotExistError checks if err is an *Error for a missing chain or rule.
+func isNotExistError(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.IsNotExist()
+}
@@ -0,0 +1,158 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// memoryStore is an OwnershipStore keeping the Ownership in memory.
+type memoryStore struct {
+	o     Ownership
+	saves int
+}
+
+func (s *memoryStore) Load() (*Ownership, error) {
+	o := s.o
+	return &o, nil
+}
+
+func (s *memoryStore) Save(o *Ownership) error {
+	s.o = Ownership{Chains: append([]OwnedChain{}, o.Chains...), Rules: append([]OwnedRule{}, o.Rules...)}
+	s.saves++
+	return nil
+}
+
+// failingRuleTable is a ruleTable whose commands fail while fail is set.
+func failingRuleTable(rt *ruleTable, fail *bool) Runner {
+	return RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		if *fail {
+			io.WriteString(stderr, "iptables: Permission denied.\n")
+			return 4, nil
+		}
+		return rt.Run(ctx, args, stdin, stdout, stderr)
+	})
+}
+
+func TestTracker(t *testing.T) {
+	rt := &ruleTable{rules: map[string][]string{}}
+	fail := false
+	ipt, err := New(CommandRunner(failingRuleTable(rt, &fail)), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	store := &memoryStore{}
+	tr, err := NewTracker(ipt, store)
+	if err != nil {
+		t.Fatalf("NewTracker failed: %v", err)
+	}
+
+	if err := tr.Append("filter", "INPUT", "-j", "ACCEPT"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := tr.AppendUnique("filter", "INPUT", "-j", "ACCEPT"); err != nil {
+		t.Fatalf("AppendUnique failed: %v", err)
+	}
+	owned := []OwnedRule{{Table: "filter", Chain: "INPUT", Spec: []string{"-j", "ACCEPT"}}}
+	if !reflect.DeepEqual(tr.Owned().Rules, owned) || !reflect.DeepEqual(store.o.Rules, owned) {
+		t.Fatalf("unexpected ownership %+v, stored %+v", tr.Owned().Rules, store.o.Rules)
+	}
+
+	// an owned rule isn't added again
+	if err := tr.Append("filter", "INPUT", "-j", "ACCEPT"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if len(rt.rules["filter/INPUT"]) != 1 {
+		t.Fatalf("expected a single live copy, got %q", rt.rules["filter/INPUT"])
+	}
+
+	// a failure keeps the rule that is still installed
+	fail = true
+	if err := tr.InsertUnique("filter", "INPUT", 1, "-j", "ACCEPT"); err != nil {
+		t.Fatalf("InsertUnique of an owned rule failed: %v", err)
+	}
+	if err := tr.Insert("filter", "INPUT", 1, "-j", "DROP"); err == nil {
+		t.Fatalf("expected Insert to fail")
+	}
+	if !reflect.DeepEqual(tr.Owned().Rules, owned) || !reflect.DeepEqual(store.o.Rules, owned) {
+		t.Fatalf("failures changed the ownership to %+v, stored %+v", tr.Owned().Rules, store.o.Rules)
+	}
+	fail = false
+
+	if err := tr.Delete("filter", "INPUT", "-j", "ACCEPT"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if len(tr.Owned().Rules) != 0 || len(rt.rules["filter/INPUT"]) != 0 {
+		t.Fatalf("expected the rule to be gone, got %+v, %q", tr.Owned().Rules, rt.rules)
+	}
+}
+
+func TestTrackerReconcile(t *testing.T) {
+	rt := &ruleTable{rules: map[string][]string{"filter/INPUT": {"-j ACCEPT", "-j LOG"}}}
+	ipt, err := New(CommandRunner(rt), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	store := &memoryStore{o: Ownership{Rules: []OwnedRule{
+		{Table: "filter", Chain: "INPUT", Spec: []string{"-j", "ACCEPT"}, Pending: true},
+		{Table: "filter", Chain: "INPUT", Spec: []string{"-j", "DROP"}, Pending: true},
+		{Table: "filter", Chain: "INPUT", Spec: []string{"-j", "REJECT"}},
+		{Table: "filter", Chain: "INPUT", Spec: []string{"-j", "LOG"}},
+	}}}
+	tr, err := NewTracker(ipt, store)
+	if err != nil {
+		t.Fatalf("NewTracker failed: %v", err)
+	}
+	report, err := tr.Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	accept := OwnedRule{Table: "filter", Chain: "INPUT", Spec: []string{"-j", "ACCEPT"}}
+	reject := OwnedRule{Table: "filter", Chain: "INPUT", Spec: []string{"-j", "REJECT"}}
+	if !reflect.DeepEqual(report.Recovered, []OwnedRule{accept}) || !reflect.DeepEqual(report.Missing, []OwnedRule{reject}) {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	var specs []string
+	for _, r := range store.o.Rules {
+		specs = append(specs, strings.Join(r.Spec, " "))
+	}
+	// the pending rule that wasn't added is forgotten
+	if !reflect.DeepEqual(specs, []string{"-j ACCEPT", "-j REJECT", "-j LOG"}) {
+		t.Fatalf("unexpected stored rules %q", specs)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	s := NewFileStore(filepath.Join(t.TempDir(), "owned.json"))
+	o, err := s.Load()
+	if err != nil || len(o.Chains) != 0 || len(o.Rules) != 0 {
+		t.Fatalf("expected an empty ownership, got %+v, %v", o, err)
+	}
+	want := &Ownership{
+		Chains: []OwnedChain{{Table: "nat", Chain: "AGENT"}},
+		Rules:  []OwnedRule{{Table: "nat", Chain: "AGENT", Spec: []string{"-j", "MASQUERADE"}, Pending: true}},
+	}
+	if err := s.Save(want); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if o, err := s.Load(); err != nil || !reflect.DeepEqual(o, want) {
+		t.Fatalf("Load mismatch: %+v, %v", o, err)
+	}
+}
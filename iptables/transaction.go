@@ -0,0 +1,195 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Transaction queues chain and rule operations and applies all of them
+// with a single iptables-restore invocation on Commit.
+//
+// The operations of each table are applied atomically. When a transaction
+// spans several tables and one of them fails, the tables already committed
+// are rolled back to the state they had before Commit.
+type Transaction struct {
+	ipt    *IPTables
+	tables []string
+	ops    map[string][][]string
+}
+
+// NewTransaction returns an empty Transaction applying to this handle.
+func (ipt *IPTables) NewTransaction() *Transaction {
+	return &Transaction{ipt: ipt, ops: map[string][][]string{}}
+}
+
+func (tx *Transaction) add(table string, args ...string) {
+	if _, ok := tx.ops[table]; !ok {
+		tx.tables = append(tx.tables, table)
+	}
+	tx.ops[table] = append(tx.ops[table], args)
+}
+
+// NewChain queues the creation of a new chain in the specified table.
+func (tx *Transaction) NewChain(table, chain string) {
+	tx.add(table, "-N", chain)
+}
+
+// ClearChain queues flushing the specified table/chain, creating it if it
+// does not exist.
+func (tx *Transaction) ClearChain(table, chain string) {
+	tx.add(table, ":"+chain, "-", "[0:0]")
+}
+
+// DeleteChain queues the deletion of the chain in the specified table.
+func (tx *Transaction) DeleteChain(table, chain string) {
+	tx.add(table, "-X", chain)
+}
+
+// Append queues appending rulespec to specified table/chain
+func (tx *Transaction) Append(table, chain string, rulespec ...string) {
+	tx.add(table, append([]string{"-A", chain}, rulespec...)...)
+}
+
+// Insert queues inserting rulespec to specified table/chain (in specified pos)
+func (tx *Transaction) Insert(table, chain string, pos int, rulespec ...string) {
+	tx.add(table, append([]string{"-I", chain, strconv.Itoa(pos)}, rulespec...)...)
+}
+
+// Delete queues removing rulespec in specified table/chain
+func (tx *Transaction) Delete(table, chain string, rulespec ...string) {
+	tx.add(table, append([]string{"-D", chain}, rulespec...)...)
+}
+
+// operations returns the queued operations.
+func (tx *Transaction) operations() []Operation {
+	p, _ := tx.payload()
+	ops, _ := payloadOperations(tx.ipt.proto, p.Bytes())
+	return ops
+}
+
+// Len returns the number of queued operations.
+func (tx *Transaction) Len() int {
+	n := 0
+	for _, ops := range tx.ops {
+		n += len(ops)
+	}
+	return n
+}
+
+// Commit applies the queued operations. On success the transaction is
+// emptied and may be reused.
+func (tx *Transaction) Commit() error {
+	return tx.commit(true)
+}
+
+// commit applies the queued operations, waiting for the changes of the
+// handle in progress first if ordered is set. Callers that already called
+// beginRestore pass false.
+func (tx *Transaction) commit(ordered bool) error {
+	if len(tx.tables) == 0 {
+		return nil
+	}
+
+	p, commitLines := tx.payload()
+	ops, err := payloadOperations(tx.ipt.proto, p.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := checkDeprecatedOperations(ops...); err != nil {
+		return err
+	}
+	if err := tx.ipt.admitPayload(p.Bytes()); err != nil {
+		return err
+	}
+
+	if ordered {
+		defer tx.ipt.beginRestore()()
+	}
+
+	// a failure can only leave partial changes behind with several tables
+	var snapshots [][]byte
+	if len(tx.tables) > 1 {
+		for _, table := range tx.tables {
+			var snapshot bytes.Buffer
+			if err := tx.ipt.runSave(&snapshot, "-c", "-t", table); err != nil {
+				return fmt.Errorf("could not snapshot table %s: %v", table, err)
+			}
+			snapshots = append(snapshots, snapshot.Bytes())
+		}
+	}
+
+	err = tx.ipt.runRestore(bytes.NewReader(p.Bytes()), RestoreNoFlush())
+	if err == nil {
+		tx.ipt.recorder.record(ops...)
+		tx.tables = nil
+		tx.ops = map[string][][]string{}
+		return nil
+	}
+	if snapshots == nil {
+		return err
+	}
+
+	// roll back every table committed before the failing line, or all of
+	// them if iptables-restore didn't tell which line failed
+	failed := restoreFailedLine(err)
+	for i := range tx.tables {
+		if failed > 0 && commitLines[i] >= failed {
+			break
+		}
+		if rerr := tx.ipt.runRestore(bytes.NewReader(snapshots[i]), RestoreCounters()); rerr != nil {
+			return fmt.Errorf("%w; rollback of table %s failed: %v", err, tx.tables[i], rerr)
+		}
+	}
+	return err
+}
+
+// payload returns the iptables-restore input applying the queued
+// operations, and the line number of each table's COMMIT.
+func (tx *Transaction) payload() (*restorePayload, []int) {
+	p := &restorePayload{}
+	commitLines := make([]int, len(tx.tables))
+	for i, table := range tx.tables {
+		p.raw("*%s", table)
+		for _, op := range tx.ops[table] {
+			p.line(op...)
+		}
+		p.raw("COMMIT")
+		commitLines[i] = p.lines
+	}
+	return p, commitLines
+}
+
+// restoreLineRegex extracts the failing line from iptables-restore errors
+// such as "iptables-restore: line 5 failed".
+var restoreLineRegex = regexp.MustCompile(`line (\d+)`)
+
+// restoreFailedLine returns the payload line iptables-restore reported as
+// failing, or 0 if unknown.
+func restoreFailedLine(err error) int {
+	e, ok := err.(*Error)
+	if !ok {
+		return 0
+	}
+	m := restoreLineRegex.FindStringSubmatch(e.msg)
+	if m == nil {
+		return 0
+	}
+	line, _ := strconv.Atoi(m[1])
+	return line
+}
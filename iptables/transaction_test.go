@@ -0,0 +1,148 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// txRunner fakes iptables-save and iptables-restore. It records every
+// invocation and fails restores whose payload contains "FAIL", reporting
+// failedLine if it is set.
+type txRunner struct {
+	calls      []string
+	failedLine int
+}
+
+func (r *txRunner) Run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	switch {
+	case strings.HasSuffix(args[0], "-save"):
+		// iptables-save -c -t table
+		r.calls = append(r.calls, "save "+strings.Join(args[1:], " "))
+		fmt.Fprintf(stdout, "*%s\n# snapshot\nCOMMIT\n", args[3])
+	case strings.HasSuffix(args[0], "-restore"):
+		data, _ := io.ReadAll(stdin)
+		r.calls = append(r.calls, "restore "+strings.Join(args[1:], " ")+"\n"+string(data))
+		if strings.Contains(string(data), "FAIL") {
+			if r.failedLine > 0 {
+				fmt.Fprintf(stderr, "iptables-restore: line %d failed\n", r.failedLine)
+			} else {
+				io.WriteString(stderr, "iptables-restore: failed\n")
+			}
+			return 1, nil
+		}
+	default:
+		return 2, fmt.Errorf("unexpected command %q", args)
+	}
+	return 0, nil
+}
+
+func newTxTest(t *testing.T, r *txRunner) *IPTables {
+	ipt, err := New(CommandRunner(r), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return ipt
+}
+
+func TestTransactionCommit(t *testing.T) {
+	r := &txRunner{}
+	tx := newTxTest(t, r).NewTransaction()
+	tx.NewChain("filter", "AGENT")
+	tx.Append("filter", "AGENT", "-j", "ACCEPT")
+	tx.Insert("filter", "INPUT", 1, "-j", "AGENT")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	// a single table needs no snapshot
+	want := []string{"restore --noflush --wait\n*filter\n-N AGENT\n-A AGENT -j ACCEPT\n-I INPUT 1 -j AGENT\nCOMMIT\n"}
+	if !reflect.DeepEqual(r.calls, want) {
+		t.Fatalf("expected %q, got %q", want, r.calls)
+	}
+	if tx.Len() != 0 {
+		t.Fatalf("expected the transaction to be emptied, %d operations left", tx.Len())
+	}
+
+	// the transaction can be reused
+	r.calls = nil
+	tx.Delete("filter", "INPUT", "-j", "AGENT")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("second Commit failed: %v", err)
+	}
+	if len(r.calls) != 1 || !strings.Contains(r.calls[0], "-D INPUT -j AGENT") || strings.Contains(r.calls[0], "-N AGENT") {
+		t.Fatalf("unexpected second commit %q", r.calls)
+	}
+}
+
+func TestTransactionFailure(t *testing.T) {
+	r := &txRunner{failedLine: 2}
+	tx := newTxTest(t, r).NewTransaction()
+	tx.Append("filter", "INPUT", "-j", "FAIL")
+	if err := tx.Commit(); err == nil {
+		t.Fatalf("expected Commit to fail")
+	}
+	// nothing to roll back with a single table
+	if len(r.calls) != 1 {
+		t.Fatalf("expected a single restore, got %q", r.calls)
+	}
+	if tx.Len() != 1 {
+		t.Fatalf("expected the operations to be kept, got %d", tx.Len())
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		failedLine int
+		rolledBack []string
+	}{
+		// the payload is *filter, -A, COMMIT, *nat, -A, COMMIT, *mangle, -A, COMMIT
+		{name: "failed table", failedLine: 5, rolledBack: []string{"filter"}},
+		{name: "last table", failedLine: 8, rolledBack: []string{"filter", "nat"}},
+		{name: "unknown line", rolledBack: []string{"filter", "nat", "mangle"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &txRunner{failedLine: tt.failedLine}
+			tx := newTxTest(t, r).NewTransaction()
+			tx.Append("filter", "INPUT", "-j", "ACCEPT")
+			tx.Append("nat", "PREROUTING", "-j", "ACCEPT")
+			tx.Append("mangle", "PREROUTING", "-j", "FAIL")
+			if err := tx.Commit(); err == nil {
+				t.Fatalf("expected Commit to fail")
+			}
+
+			want := []string{"save -c -t filter", "save -c -t nat", "save -c -t mangle"}
+			if !reflect.DeepEqual(r.calls[:3], want) {
+				t.Fatalf("expected snapshots %q, got %q", want, r.calls[:3])
+			}
+			if !strings.HasPrefix(r.calls[3], "restore --noflush --wait\n*filter\n") {
+				t.Fatalf("expected the commit, got %q", r.calls[3])
+			}
+			// snapshots are restored without --noflush, replacing the tables
+			var rollbacks []string
+			for _, table := range tt.rolledBack {
+				rollbacks = append(rollbacks, fmt.Sprintf("restore --counters --wait\n*%s\n# snapshot\nCOMMIT\n", table))
+			}
+			if !reflect.DeepEqual(r.calls[4:], rollbacks) {
+				t.Fatalf("expected rollbacks %q, got %q", rollbacks, r.calls[4:])
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Translate returns the nft command equivalent to appending rulespec to
+// table/chain, as printed by iptables-translate (ip6tables-translate for
+// IPv6), e.g. "nft 'add rule ip filter INPUT tcp dport 22 counter
+// accept'". A rule translating into several commands yields several
+// lines. Rules iptables-translate cannot translate are returned as a
+// comment starting with "# Translated by" followed by the original rule,
+// exactly as the tool prints them.
+func (ipt *IPTables) Translate(table, chain string, rulespec ...string) (string, error) {
+	path, err := ipt.helperPath("-translate")
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	args := append([]string{path, "-t", table, "-A", chain}, rulespec...)
+	if err := ipt.runCommand(args, nil, &out); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// TranslateRuleset returns the nft script equivalent to rs, as printed by
+// iptables-restore-translate (ip6tables-restore-translate for IPv6),
+// ready to be loaded with "nft -f". Counters are not translated.
+func (ipt *IPTables) TranslateRuleset(rs *Ruleset) (string, error) {
+	path, err := ipt.helperPath("-restore-translate")
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	args := []string{path, "-f", "/dev/stdin"}
+	if err := ipt.runCommand(args, strings.NewReader(saveText(rs)), &out); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// saveText renders rs in iptables-save format, without counters.
+func saveText(rs *Ruleset) string {
+	var b strings.Builder
+	writeSaveTable(&b, rs, false)
+	return b.String()
+}
@@ -0,0 +1,69 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestTranslate(t *testing.T) {
+	var calls [][]string
+	var input string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, args)
+		switch args[0] {
+		case "ip6tables-translate":
+			io.WriteString(stdout, "nft 'add rule ip6 filter INPUT tcp dport 22 counter accept'\n")
+		case "ip6tables-restore-translate":
+			b, _ := ioutil.ReadAll(stdin)
+			input = string(b)
+			io.WriteString(stdout, "add table ip6 filter\nadd chain ip6 filter INPUT { type filter hook input priority 0; policy drop; }\n")
+		}
+		return 0, nil
+	})
+	ipt, err := New(IPFamily(ProtocolIPv6), CommandRunner(runner), CompatibilityProfile("1.8.9-legacy"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	nft, err := ipt.Translate("filter", "INPUT", "-p", "tcp", "--dport", "22", "-j", "ACCEPT")
+	if err != nil {
+		t.Fatalf("Translate failed: %v", err)
+	}
+	if nft != "nft 'add rule ip6 filter INPUT tcp dport 22 counter accept'" {
+		t.Fatalf("unexpected translation %q", nft)
+	}
+	expected := []string{"ip6tables-translate", "-t", "filter", "-A", "INPUT", "-p", "tcp", "--dport", "22", "-j", "ACCEPT"}
+	if !reflect.DeepEqual(calls[0], expected) {
+		t.Fatalf("args mismatch: \ngot  %v \nneed %v", calls[0], expected)
+	}
+
+	rs := &Ruleset{Table: "filter", Chains: []Chain{
+		{Name: "INPUT", Policy: "DROP", Packets: 3, Rules: []Rule{{Chain: "INPUT", InInterface: "lo", Target: "ACCEPT", Packets: 5}}},
+	}}
+	if _, err := ipt.TranslateRuleset(rs); err != nil {
+		t.Fatalf("TranslateRuleset failed: %v", err)
+	}
+	if input != "*filter\n:INPUT DROP\n-A INPUT -i lo -j ACCEPT\nCOMMIT\n" {
+		t.Fatalf("unexpected translator input %q", input)
+	}
+	if !reflect.DeepEqual(calls[1], []string{"ip6tables-restore-translate", "-f", "/dev/stdin"}) {
+		t.Fatalf("unexpected args %v", calls[1])
+	}
+}
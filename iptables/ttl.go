@@ -0,0 +1,93 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TTLAction is the way a TTL or HL target changes the TTL (IPv4) or hop
+// limit (IPv6) of packets.
+type TTLAction string
+
+const (
+	// TTLSet sets the TTL to the value (--ttl-set, --hl-set)
+	TTLSet TTLAction = "set"
+	// TTLInc increments the TTL by the value (--ttl-inc, --hl-inc)
+	TTLInc TTLAction = "inc"
+	// TTLDec decrements the TTL by the value (--ttl-dec, --hl-dec)
+	TTLDec TTLAction = "dec"
+)
+
+// TTLTarget returns the rulespec fragment of the target changing the TTL
+// of packets of proto: "-j TTL --ttl-<action> value" for IPv4 and
+// "-j HL --hl-<action> value" for IPv6. value must be 0-255 for TTLSet and
+// 1-255 otherwise, as iptables requires.
+func TTLTarget(proto Protocol, action TTLAction, value int) ([]string, error) {
+	switch action {
+	case TTLSet:
+		if value < 0 || value > 255 {
+			return nil, fmt.Errorf("TTL value %d out of range 0-255", value)
+		}
+	case TTLInc, TTLDec:
+		if value < 1 || value > 255 {
+			return nil, fmt.Errorf("TTL change %d out of range 1-255", value)
+		}
+	default:
+		return nil, fmt.Errorf("unknown TTL action %q", action)
+	}
+	target, prefix := "TTL", "--ttl-"
+	if proto == ProtocolIPv6 {
+		target, prefix = "HL", "--hl-"
+	}
+	return []string{"-j", target, prefix + string(action), strconv.Itoa(value)}, nil
+}
+
+// HasTarget reports whether the iptables binary of the handle supports the
+// target extension with the given name, by asking it for the help of the
+// target.
+func (ipt *IPTables) HasTarget(target string) (bool, error) {
+	var stdout bytes.Buffer
+	err := ipt.runWithOutput([]string{"-j", target, "-h"}, &stdout)
+	if eerr, ok := err.(*Error); ok && eerr.ExitStatus() == 2 {
+		// "Couldn't load target"
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(stdout.String(), target+" target options"), nil
+}
+
+// AppendTTL appends to chain of the mangle table a rule made of matchspec
+// and the target built by TTLTarget for the protocol of the handle, after
+// checking that iptables supports that target.
+func (ipt *IPTables) AppendTTL(chain string, action TTLAction, value int, matchspec ...string) error {
+	target, err := TTLTarget(ipt.proto, action, value)
+	if err != nil {
+		return err
+	}
+	ok, err := ipt.HasTarget(target[1])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("the %s target is not supported by %s", target[1], ipt.path)
+	}
+	return ipt.Append("mangle", chain, append(append([]string{}, matchspec...), target...)...)
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTTLTarget(t *testing.T) {
+	for _, tc := range []struct {
+		proto  Protocol
+		action TTLAction
+		value  int
+		out    []string
+	}{
+		{ProtocolIPv4, TTLSet, 64, []string{"-j", "TTL", "--ttl-set", "64"}},
+		{ProtocolIPv4, TTLSet, 0, []string{"-j", "TTL", "--ttl-set", "0"}},
+		{ProtocolIPv4, TTLInc, 1, []string{"-j", "TTL", "--ttl-inc", "1"}},
+		{ProtocolIPv6, TTLDec, 255, []string{"-j", "HL", "--hl-dec", "255"}},
+		{ProtocolIPv4, TTLSet, 256, nil},
+		{ProtocolIPv4, TTLInc, 0, nil},
+		{ProtocolIPv6, TTLDec, -1, nil},
+		{ProtocolIPv4, "reset", 1, nil},
+	} {
+		out, err := TTLTarget(tc.proto, tc.action, tc.value)
+		if tc.out == nil {
+			if err == nil {
+				t.Fatalf("TTLTarget(%v, %s, %d): expected an error, got %q", tc.proto, tc.action, tc.value, out)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(out, tc.out) {
+			t.Fatalf("TTLTarget(%v, %s, %d) = %q, %v", tc.proto, tc.action, tc.value, out, err)
+		}
+	}
+}
+
+func TestAppendTTL(t *testing.T) {
+	var appended []string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		switch {
+		case args[1] == "-j" && args[2] == "HL":
+			io.WriteString(stdout, "ip6tables v1.8.7\n\nUsage: ...\n\nHL target options\n  --hl-set value\t\tSet HL to <value 0-255>\n")
+		case args[1] == "-j":
+			io.WriteString(stderr, "ip6tables v1.8.7 (nf_tables): Couldn't load target `"+args[2]+"':No such file or directory\n")
+			return 2, nil
+		case args[1] == "-t":
+			appended = append(appended, strings.Join(args[2:len(args)-1], " "))
+		}
+		return 0, nil
+	})
+	ipt, err := New(IPFamily(ProtocolIPv6), CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if ok, err := ipt.HasTarget("TTL"); ok || err != nil {
+		t.Fatalf("HasTarget(TTL) = %v, %v", ok, err)
+	}
+	if err := ipt.AppendTTL("POSTROUTING", TTLSet, 65, "-o", "wwan0"); err != nil {
+		t.Fatalf("AppendTTL failed: %v", err)
+	}
+	if !reflect.DeepEqual(appended, []string{"mangle -A POSTROUTING -o wwan0 -j HL --hl-set 65"}) {
+		t.Fatalf("unexpected rules %q", appended)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// WaitTimeout sets the time to wait for the xtables lock; 0 waits forever.
+// iptables only accepts whole seconds, so d is rounded up to the next
+// second.
+func WaitTimeout(d time.Duration) option {
+	return func(ipt *IPTables) {
+		ipt.timeout = waitSeconds(d)
+	}
+}
+
+// WaitInterval sets how long iptables sleeps between attempts to take the
+// xtables lock (--wait-interval), which defaults to one second. Sub-second
+// intervals let short waits end as soon as the lock is released. It is
+// ignored by iptables versions that don't support it (older than 1.6.0),
+// see Capabilities.WaitInterval.
+func WaitInterval(d time.Duration) option {
+	return func(ipt *IPTables) {
+		ipt.waitInterval = d
+	}
+}
+
+// WithWaitTimeout returns a handle sharing the configuration and state of
+// ipt, but waiting at most d for the xtables lock (0 waits forever), e.g.
+// to fail fast on reads while writes wait longer:
+//
+//	rules, err := ipt.WithWaitTimeout(time.Second).List("filter", "INPUT")
+//
+// The returned handle does not use AdaptiveWait.
+func (ipt *IPTables) WithWaitTimeout(d time.Duration) *IPTables {
+	override := *ipt
+	override.timeout = waitSeconds(d)
+	override.waitTuner = nil
+	return &override
+}
+
+// waitSeconds converts d to the whole number of seconds --wait expects,
+// rounding up.
+func waitSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// waitTuner adapts the --wait timeout and the number of retries to the
+// contention observed on the xtables lock.
+type waitTuner struct {
+	mu         sync.Mutex
+	min, max   int // bounds of the timeout, in seconds
+	maxRetries int
+	timeout    int
+	retries    int
+}
+
+// AdaptiveWait makes the handle tune the --wait timeout between min and max
+// seconds, and the number of retries after the lock could not be acquired
+// up to maxRetries, based on how long operations actually wait for the
+// xtables lock. It requires an iptables version supporting "--wait seconds"
+// and overrides Timeout.
+func AdaptiveWait(min, max, maxRetries int) option {
+	return func(ipt *IPTables) {
+		if min < 1 {
+			min = 1
+		}
+		if max < min {
+			max = min
+		}
+		ipt.waitTuner = &waitTuner{
+			min:        min,
+			max:        max,
+			maxRetries: maxRetries,
+			timeout:    min,
+		}
+	}
+}
+
+// WaitTuning returns the current --wait timeout in seconds and the current
+// retry budget of a handle configured with AdaptiveWait. Without
+// AdaptiveWait it returns the fixed Timeout and no retries.
+func (ipt *IPTables) WaitTuning() (timeout int, retries int) {
+	if ipt.waitTuner == nil {
+		return ipt.timeout, 0
+	}
+	return ipt.waitTuner.current()
+}
+
+func (w *waitTuner) current() (int, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.timeout, w.retries
+}
+
+// observe records the outcome of a single invocation that took elapsed to
+// run with the given timeout.
+func (w *waitTuner) observe(elapsed time.Duration, timeout int, lockErr bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	switch {
+	case lockErr:
+		// we gave up waiting: be more patient and allow more retries
+		w.timeout = timeout * 2
+		if w.retries < w.maxRetries {
+			w.retries++
+		}
+	case elapsed > time.Duration(timeout)*time.Second/2:
+		// we got the lock, but only just
+		w.timeout++
+	default:
+		// no contention, slowly go back to the lower bound
+		w.timeout--
+		if w.retries > 0 {
+			w.retries--
+		}
+	}
+
+	if w.timeout < w.min {
+		w.timeout = w.min
+	}
+	if w.timeout > w.max {
+		w.timeout = w.max
+	}
+}
+
+// isLockError checks if err is iptables giving up on the xtables lock.
+func isLockError(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.ExitStatus() == 4 && strings.Contains(e.msg, "xtables lock")
+}
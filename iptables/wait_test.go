@@ -0,0 +1,176 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWaitTimeout(t *testing.T) {
+	var calls [][]string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, args)
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-legacy"),
+		WaitTimeout(1500*time.Millisecond), WaitInterval(100*time.Millisecond), AdaptiveWait(2, 10, 1))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if ipt.timeout != 2 {
+		t.Fatalf("expected the timeout to be rounded up to 2s, got %d", ipt.timeout)
+	}
+
+	if err := ipt.WithWaitTimeout(5 * time.Second).ClearAll(); err != nil {
+		t.Fatalf("ClearAll failed: %v", err)
+	}
+	expected := []string{"iptables", "-F", "--wait", "5", "--wait-interval", "100000"}
+	if !reflect.DeepEqual(calls[0], expected) {
+		t.Fatalf("args mismatch: \ngot  %v \nneed %v", calls[0], expected)
+	}
+	if timeout, _ := ipt.WaitTuning(); timeout != 2 {
+		t.Fatalf("the override changed the handle timeout to %d", timeout)
+	}
+}
+
+func TestWaitIntervalSupport(t *testing.T) {
+	var calls [][]string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls = append(calls, args)
+		return 0, nil
+	})
+	for _, tc := range []struct {
+		profile  string
+		expected []string
+	}{
+		{"1.4.21-legacy", []string{"iptables", "-F", "--wait"}},
+		{"1.6.0-legacy", []string{"iptables", "-F", "--wait", "--wait-interval", "50000"}},
+	} {
+		calls = nil
+		ipt, err := New(CommandRunner(runner), CompatibilityProfile(tc.profile), WaitInterval(50*time.Millisecond))
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		if ipt.Capabilities().WaitInterval != (len(tc.expected) > 3) {
+			t.Fatalf("%s: unexpected capabilities %+v", tc.profile, ipt.Capabilities())
+		}
+		if err := ipt.ClearAll(); err != nil {
+			t.Fatalf("ClearAll failed: %v", err)
+		}
+		if !reflect.DeepEqual(calls[0], tc.expected) {
+			t.Fatalf("%s: args mismatch: \ngot  %v \nneed %v", tc.profile, calls[0], tc.expected)
+		}
+	}
+}
+
+// lockContention is a Runner failing the first fail invocations, or all
+// of them if fail is negative, like iptables giving up on the xtables
+// lock. It records the --wait timeout of every invocation.
+type lockContention struct {
+	fail  int
+	waits []int
+}
+
+func (l *lockContention) Run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	for i, arg := range args {
+		if arg == "--wait" && i+1 < len(args) {
+			wait, _ := strconv.Atoi(args[i+1])
+			l.waits = append(l.waits, wait)
+		}
+	}
+	if l.fail != 0 {
+		l.fail--
+		io.WriteString(stderr, "Another app is currently holding the xtables lock. Stopped waiting after 2s.\n")
+		return 4, nil
+	}
+	return 0, nil
+}
+
+func TestAdaptiveWait(t *testing.T) {
+	l := &lockContention{fail: 2}
+	ipt, err := New(CommandRunner(l), CompatibilityProfile("1.8.7-legacy"), AdaptiveWait(2, 10, 3))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	// each lock failure doubles the timeout and allows one more retry
+	if err := ipt.ClearAll(); err != nil {
+		t.Fatalf("ClearAll failed: %v", err)
+	}
+	if !reflect.DeepEqual(l.waits, []int{2, 4, 8}) {
+		t.Fatalf("unexpected timeouts %v", l.waits)
+	}
+	// the uncontended success decays both
+	if timeout, retries := ipt.WaitTuning(); timeout != 7 || retries != 1 {
+		t.Fatalf("unexpected tuning %d, %d", timeout, retries)
+	}
+
+	// down to the lower bound
+	for i := 0; i < 10; i++ {
+		if err := ipt.ClearAll(); err != nil {
+			t.Fatalf("ClearAll failed: %v", err)
+		}
+	}
+	if timeout, retries := ipt.WaitTuning(); timeout != 2 || retries != 0 {
+		t.Fatalf("unexpected tuning %d, %d after uncontended runs", timeout, retries)
+	}
+}
+
+func TestAdaptiveWaitRetryBudget(t *testing.T) {
+	l := &lockContention{fail: -1}
+	ipt, err := New(CommandRunner(l), CompatibilityProfile("1.8.7-legacy"), AdaptiveWait(2, 10, 1))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	// a single retry, then the lock error is returned
+	err = ipt.ClearAll()
+	if e, ok := err.(*Error); !ok || e.ExitStatus() != 4 {
+		t.Fatalf("expected the lock error, got %v", err)
+	}
+	if !reflect.DeepEqual(l.waits, []int{2, 4}) {
+		t.Fatalf("unexpected timeouts %v", l.waits)
+	}
+
+	// the timeout is capped at the upper bound, and so are the retries
+	l.waits = nil
+	if err := ipt.ClearAll(); err == nil {
+		t.Fatal("expected ClearAll to fail")
+	}
+	if !reflect.DeepEqual(l.waits, []int{8, 10}) {
+		t.Fatalf("unexpected timeouts %v", l.waits)
+	}
+	if timeout, retries := ipt.WaitTuning(); timeout != 10 || retries != 1 {
+		t.Fatalf("unexpected tuning %d, %d", timeout, retries)
+	}
+}
+
+func TestWaitTunerObserve(t *testing.T) {
+	w := &waitTuner{min: 2, max: 10, maxRetries: 1, timeout: 4}
+	// the lock was acquired after more than half the timeout
+	w.observe(3*time.Second, 4, false)
+	if timeout, retries := w.current(); timeout != 5 || retries != 0 {
+		t.Fatalf("unexpected tuning %d, %d", timeout, retries)
+	}
+	w.observe(0, 5, false)
+	if timeout, _ := w.current(); timeout != 4 {
+		t.Fatalf("unexpected timeout %d", timeout)
+	}
+}
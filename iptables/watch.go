@@ -0,0 +1,216 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WatchEventType is the kind of change reported by a Watcher.
+type WatchEventType int
+
+const (
+	// ChainAdded reports a chain that appeared.
+	ChainAdded WatchEventType = iota
+	// ChainRemoved reports a chain that disappeared.
+	ChainRemoved
+	// ChainModified reports a chain whose rules or policy changed.
+	ChainModified
+)
+
+func (t WatchEventType) String() string {
+	switch t {
+	case ChainAdded:
+		return "added"
+	case ChainRemoved:
+		return "removed"
+	case ChainModified:
+		return "modified"
+	}
+	return "unknown"
+}
+
+// WatchEvent reports a change of a chain.
+type WatchEvent struct {
+	Type  WatchEventType
+	Table string
+	Chain string
+}
+
+// Watcher detects modifications of the chains of a set of tables by
+// polling iptables-save and comparing a fingerprint of every chain with
+// the one seen at the previous poll. Counters are ignored.
+//
+// Changes made through the library are reported as well: controllers
+// owning chains typically resync them on every event of their chains, which
+// is a no-op when the change was their own.
+type Watcher struct {
+	ipt      *IPTables
+	tables   []string
+	interval time.Duration
+	onError  func(error)
+	events   chan WatchEvent
+
+	// fingerprints holds the fingerprint of every chain, per table
+	fingerprints map[string]map[string]uint64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewWatcher starts watching the specified tables every interval. The
+// initial state is fingerprinted before NewWatcher returns and produces no
+// events. Errors of later polls are passed to onError, which may be nil.
+// interval must be positive.
+func (ipt *IPTables) NewWatcher(interval time.Duration, onError func(error), tables ...string) (*Watcher, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid interval %v", interval)
+	}
+	w := &Watcher{
+		ipt:          ipt,
+		tables:       tables,
+		interval:     interval,
+		onError:      onError,
+		events:       make(chan WatchEvent, 16),
+		fingerprints: map[string]map[string]uint64{},
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	for _, table := range tables {
+		fp, err := w.fingerprint(table)
+		if err != nil {
+			return nil, err
+		}
+		w.fingerprints[table] = fp
+	}
+	go w.loop()
+	return w, nil
+}
+
+// Events returns the channel on which changes are delivered. It is closed
+// by Close.
+func (w *Watcher) Events() <-chan WatchEvent {
+	return w.events
+}
+
+// Close stops the Watcher and closes its Events channel.
+func (w *Watcher) Close() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+	<-w.done
+}
+
+func (w *Watcher) loop() {
+	defer close(w.done)
+	defer close(w.events)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+		for _, table := range w.tables {
+			fp, err := w.fingerprint(table)
+			if err != nil {
+				if w.onError != nil {
+					w.onError(err)
+				}
+				continue
+			}
+			for _, ev := range diffFingerprints(table, w.fingerprints[table], fp) {
+				select {
+				case w.events <- ev:
+				case <-w.stop:
+					return
+				}
+			}
+			w.fingerprints[table] = fp
+		}
+	}
+}
+
+// fingerprint returns the fingerprint of every chain of table.
+func (w *Watcher) fingerprint(table string) (map[string]uint64, error) {
+	var out bytes.Buffer
+	if err := w.ipt.runSave(&out, "-t", table); err != nil {
+		return nil, err
+	}
+	return fingerprintSave(out.Bytes()), nil
+}
+
+// fingerprintSave hashes the declaration, without counters, and the rules
+// of every chain of iptables-save output.
+func fingerprintSave(data []byte) map[string]uint64 {
+	lines := map[string][]string{}
+	var order []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, ":"):
+			if m := chainDefRegex.FindStringSubmatch(line); m != nil {
+				order = append(order, m[1])
+				lines[m[1]] = append(lines[m[1]], m[2])
+			}
+		case strings.HasPrefix(line, "-A "):
+			if fields := strings.Fields(line); len(fields) > 1 {
+				lines[fields[1]] = append(lines[fields[1]], line)
+			}
+		}
+	}
+
+	fp := make(map[string]uint64, len(order))
+	for _, chain := range order {
+		h := fnv.New64a()
+		for _, line := range lines[chain] {
+			h.Write([]byte(line))
+			h.Write([]byte{'\n'})
+		}
+		fp[chain] = h.Sum64()
+	}
+	return fp
+}
+
+// diffFingerprints returns the events turning old into new: added and
+// modified chains first, then removed ones, each sorted by name.
+func diffFingerprints(table string, old, new map[string]uint64) []WatchEvent {
+	var events []WatchEvent
+	for _, chain := range sortedKeys(new) {
+		prev, ok := old[chain]
+		switch {
+		case !ok:
+			events = append(events, WatchEvent{ChainAdded, table, chain})
+		case prev != new[chain]:
+			events = append(events, WatchEvent{ChainModified, table, chain})
+		}
+	}
+	for _, chain := range sortedKeys(old) {
+		if _, ok := new[chain]; !ok {
+			events = append(events, WatchEvent{ChainRemoved, table, chain})
+		}
+	}
+	return events
+}
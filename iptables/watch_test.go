@@ -0,0 +1,87 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatchFingerprints(t *testing.T) {
+	before := fingerprintSave([]byte(`*filter
+:INPUT ACCEPT [10:600]
+:FORWARD ACCEPT [0:0]
+:KEEP - [0:0]
+:GONE - [0:0]
+-A INPUT -j KEEP
+-A KEEP -s 10.0.0.0/8 -j ACCEPT
+COMMIT
+`))
+	after := fingerprintSave([]byte(`*filter
+:INPUT ACCEPT [25:1500]
+:FORWARD DROP [0:0]
+:KEEP - [0:0]
+:NEW - [0:0]
+-A INPUT -j KEEP
+-A KEEP -s 10.0.0.0/8 -j ACCEPT
+-A KEEP -s 192.168.0.0/16 -j ACCEPT
+COMMIT
+`))
+
+	expected := []WatchEvent{
+		{ChainModified, "filter", "FORWARD"},
+		{ChainModified, "filter", "KEEP"},
+		{ChainAdded, "filter", "NEW"},
+		{ChainRemoved, "filter", "GONE"},
+	}
+	events := diffFingerprints("filter", before, after)
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("diffFingerprints mismatch: \ngot  %v \nneed %v", events, expected)
+	}
+}
+
+func TestNewWatcherInterval(t *testing.T) {
+	calls := 0
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		calls++
+		io.WriteString(stdout, "*filter\n:INPUT ACCEPT [0:0]\nCOMMIT\n")
+		return 0, nil
+	})
+	ipt, err := New(CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if w, err := ipt.NewWatcher(interval, nil, "filter"); err == nil {
+			w.Close()
+			t.Fatalf("expected NewWatcher to reject interval %v", interval)
+		}
+	}
+	if calls != 0 {
+		t.Fatalf("iptables ran %d times", calls)
+	}
+
+	w, err := ipt.NewWatcher(time.Hour, nil, "filter")
+	if err != nil {
+		t.Fatalf("NewWatcher failed: %v", err)
+	}
+	w.Close()
+	if _, ok := <-w.Events(); ok {
+		t.Fatalf("expected Events to be closed")
+	}
+}
@@ -0,0 +1,9 @@
+module github.com/coreos/go-iptables/v2
+
+go 1.16
+
+require github.com/coreos/go-iptables v0.9.0
+
+// Builds inside this repository use the v1 sources next to v2; modules
+// depending on v2 ignore this directive and get the tagged v1 release.
+replace github.com/coreos/go-iptables => ../
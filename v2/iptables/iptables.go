@@ -0,0 +1,323 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package iptables is version 2 of the go-iptables API.
+//
+// It consolidates the structured types, interfaces and options added to
+// version 1 over time: listing methods return parsed rules rather than
+// strings, lock timeouts are durations, and the redundant variants of
+// methods are gone. It is a thin layer over version 1, which remains
+// maintained and keeps its signatures; both can be used side by side, and
+// V1 gives access to the methods not carried over.
+package iptables
+
+import (
+	"time"
+
+	v1 "github.com/coreos/go-iptables/iptables"
+)
+
+// Types shared with version 1.
+type (
+	Protocol      = v1.Protocol
+	Rule          = v1.Rule
+	Match         = v1.Match
+	NumberedRule  = v1.NumberedRule
+	Stat          = v1.Stat
+	ChainInfo     = v1.ChainInfo
+	ChainCounters = v1.ChainCounters
+	Ruleset       = v1.Ruleset
+	Chain         = v1.Chain
+	Error         = v1.Error
+	Capabilities  = v1.Capabilities
+	Runner        = v1.Runner
+	RunnerFunc    = v1.RunnerFunc
+	CommandEvent  = v1.CommandEvent
+	Operation     = v1.Operation
+	Admission     = v1.Admission
+	RuleFilter    = v1.RuleFilter
+	RulePosition  = v1.RulePosition
+	RestoreOption = v1.RestoreOption
+)
+
+const (
+	ProtocolIPv4 = v1.ProtocolIPv4
+	ProtocolIPv6 = v1.ProtocolIPv6
+
+	Prepend = v1.Prepend
+	Append  = v1.Append
+)
+
+// Errors wrapped by the errors of this package, for errors.Is.
+var (
+	ErrNotExist         = v1.ErrNotExist
+	ErrExists           = v1.ErrExists
+	ErrLocked           = v1.ErrLocked
+	ErrPermission       = v1.ErrPermission
+	ErrTableUnavailable = v1.ErrTableUnavailable
+	ErrRuleIndex        = v1.ErrRuleIndex
+	ErrAnchorNotFound   = v1.ErrAnchorNotFound
+	ErrBuiltinChain     = v1.ErrBuiltinChain
+)
+
+// Rule filters, see RuleFilter.
+var (
+	AllOf              = v1.AllOf
+	AnyOf              = v1.AnyOf
+	Not                = v1.Not
+	FilterTarget       = v1.FilterTarget
+	FilterSource       = v1.FilterSource
+	FilterDestination  = v1.FilterDestination
+	FilterInInterface  = v1.FilterInInterface
+	FilterOutInterface = v1.FilterOutInterface
+	FilterComment      = v1.FilterComment
+	FilterProtocol     = v1.FilterProtocol
+)
+
+// Restore options, see IPTables.Restore.
+var (
+	RestoreNoFlush    = v1.RestoreNoFlush
+	RestoreCounters   = v1.RestoreCounters
+	RestoreAppendOnly = v1.RestoreAppendOnly
+	RestoreTables     = v1.RestoreTables
+)
+
+// Option configures a handle created by New.
+type Option func(*v1.IPTables)
+
+// IPFamily selects the family of the handle, IPv4 by default.
+func IPFamily(proto Protocol) Option {
+	return Option(v1.IPFamily(proto))
+}
+
+// WaitTimeout sets how long to wait for the xtables lock; 0, the default,
+// waits forever.
+func WaitTimeout(d time.Duration) Option {
+	return Option(v1.WaitTimeout(d))
+}
+
+// WaitInterval sets how often the xtables lock is polled while waiting.
+func WaitInterval(d time.Duration) Option {
+	return Option(v1.WaitInterval(d))
+}
+
+// Path sets the iptables binary to run instead of looking it up.
+func Path(path string) Option {
+	return Option(v1.Path(path))
+}
+
+// CompatibilityProfile pins the iptables version and mode, e.g.
+// "1.8.7-nft", instead of probing the binary.
+func CompatibilityProfile(profile string) Option {
+	return Option(v1.CompatibilityProfile(profile))
+}
+
+// CommandRunner runs the iptables commands through r.
+func CommandRunner(r Runner) Option {
+	return Option(v1.CommandRunner(r))
+}
+
+// DebugLog calls fn after every iptables command.
+func DebugLog(fn func(CommandEvent)) Option {
+	return Option(v1.DebugLog(fn))
+}
+
+// AdmissionControl runs every change through a before it is made.
+func AdmissionControl(a Admission) Option {
+	return Option(v1.AdmissionControl(a))
+}
+
+// NetNS runs the commands in the network namespace mounted at path.
+func NetNS(path string) Option {
+	return Option(v1.NetNS(path))
+}
+
+// IPTables is a handle running the iptables binary of one family. It is
+// safe for concurrent use, see the version 1 documentation.
+type IPTables struct {
+	ipt *v1.IPTables
+}
+
+// New returns a handle configured with opts.
+func New(opts ...Option) (*IPTables, error) {
+	ipt, err := v1.New(func(ipt *v1.IPTables) {
+		for _, opt := range opts {
+			opt(ipt)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &IPTables{ipt}, nil
+}
+
+// FromV1 wraps a version 1 handle.
+func FromV1(ipt *v1.IPTables) *IPTables {
+	return &IPTables{ipt}
+}
+
+// V1 returns the version 1 handle the handle wraps.
+func (ipt *IPTables) V1() *v1.IPTables {
+	return ipt.ipt
+}
+
+// Proto returns the family of the handle.
+func (ipt *IPTables) Proto() Protocol {
+	return ipt.ipt.Proto()
+}
+
+// Capabilities returns what the iptables binary of the handle supports.
+func (ipt *IPTables) Capabilities() Capabilities {
+	return ipt.ipt.Capabilities()
+}
+
+// Exists checks if rulespec exists in table/chain.
+func (ipt *IPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	return ipt.ipt.Exists(table, chain, rulespec...)
+}
+
+// Append appends rulespec to table/chain.
+func (ipt *IPTables) Append(table, chain string, rulespec ...string) error {
+	return ipt.ipt.Append(table, chain, rulespec...)
+}
+
+// AppendMany appends every rulespec of rules to table/chain with a single
+// iptables-restore invocation.
+func (ipt *IPTables) AppendMany(table, chain string, rules [][]string) error {
+	return ipt.ipt.AppendMany(table, chain, rules)
+}
+
+// Insert inserts rulespec into table/chain at position pos, starting at 1.
+func (ipt *IPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	return ipt.ipt.Insert(table, chain, pos, rulespec...)
+}
+
+// Replace replaces the rule at position pos of table/chain with rulespec,
+// checking first that the rule exists.
+func (ipt *IPTables) Replace(table, chain string, pos int, rulespec ...string) error {
+	return ipt.ipt.ReplaceById(table, chain, pos, rulespec...)
+}
+
+// EnsureRule makes sure that rulespec is at the given end of table/chain,
+// and reports whether it was present already.
+func (ipt *IPTables) EnsureRule(position RulePosition, table, chain string, rulespec ...string) (bool, error) {
+	return ipt.ipt.EnsureRule(position, table, chain, rulespec...)
+}
+
+// Delete removes rulespec from table/chain. Deleting a rule that doesn't
+// exist is not an error.
+func (ipt *IPTables) Delete(table, chain string, rulespec ...string) error {
+	return ipt.ipt.DeleteIfExists(table, chain, rulespec...)
+}
+
+// DeleteWhere deletes the rules of table/chain selected by filter and
+// returns how many were deleted.
+func (ipt *IPTables) DeleteWhere(table, chain string, filter RuleFilter) (int, error) {
+	return ipt.ipt.DeleteAllMatching(table, chain, filter)
+}
+
+// List returns the rules of table/chain with their positions and
+// counters.
+func (ipt *IPTables) List(table, chain string) ([]NumberedRule, error) {
+	return ipt.ipt.ListWithLineNumbers(table, chain)
+}
+
+// ListWhere returns the rules of table/chain selected by filter.
+func (ipt *IPTables) ListWhere(table, chain string, filter RuleFilter) ([]NumberedRule, error) {
+	return ipt.ipt.ListWhere(table, chain, filter)
+}
+
+// Stats returns the statistics of the rules of table/chain.
+func (ipt *IPTables) Stats(table, chain string) ([]Stat, error) {
+	return ipt.ipt.StructuredStats(table, chain)
+}
+
+// Chains returns the chains of table with their policies, counters and
+// references.
+func (ipt *IPTables) Chains(table string) ([]ChainInfo, error) {
+	return ipt.ipt.ListChainsWithInfo(table)
+}
+
+// ChainExists checks whether table/chain exists.
+func (ipt *IPTables) ChainExists(table, chain string) (bool, error) {
+	return ipt.ipt.ChainExists(table, chain)
+}
+
+// NewChain creates table/chain.
+func (ipt *IPTables) NewChain(table, chain string) error {
+	return ipt.ipt.NewChain(table, chain)
+}
+
+// ClearChain flushes table/chain, creating it if it doesn't exist.
+func (ipt *IPTables) ClearChain(table, chain string) error {
+	return ipt.ipt.ClearChain(table, chain)
+}
+
+// DeleteChain flushes and deletes table/chain. Deleting a chain that
+// doesn't exist is not an error.
+func (ipt *IPTables) DeleteChain(table, chain string) error {
+	return ipt.ipt.ClearAndDeleteChain(table, chain)
+}
+
+// SetPolicy sets the policy of the builtin table/chain.
+func (ipt *IPTables) SetPolicy(table, chain, policy string) error {
+	return ipt.ipt.SetPolicy(table, chain, policy)
+}
+
+// Save returns every chain of table with its policy, rules and counters.
+func (ipt *IPTables) Save(table string) (*Ruleset, error) {
+	return ipt.ipt.SaveRuleset(table)
+}
+
+// Restore replaces the rules of the chains of the tables given in the map,
+// which holds a list of rulespecs per chain of each table, with a single
+// iptables-restore invocation.
+func (ipt *IPTables) Restore(tables map[string]map[string][][]string, opts ...RestoreOption) error {
+	return ipt.ipt.RestoreAll(tables, opts...)
+}
+
+// RestoreChains replaces the rules of the given chains of table, leaving
+// its other chains untouched, for agents sharing a table. Builtin chains
+// are refused.
+func (ipt *IPTables) RestoreChains(table string, chains map[string][][]string, opts ...RestoreOption) error {
+	return ipt.ipt.RestoreChains(table, chains, opts...)
+}
+
+// Interface is the method set of IPTables, for code that wants to accept
+// fakes or decorators instead of a handle.
+type Interface interface {
+	Proto() Protocol
+	Capabilities() Capabilities
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Append(table, chain string, rulespec ...string) error
+	AppendMany(table, chain string, rules [][]string) error
+	Insert(table, chain string, pos int, rulespec ...string) error
+	Replace(table, chain string, pos int, rulespec ...string) error
+	EnsureRule(position RulePosition, table, chain string, rulespec ...string) (bool, error)
+	Delete(table, chain string, rulespec ...string) error
+	DeleteWhere(table, chain string, filter RuleFilter) (int, error)
+	List(table, chain string) ([]NumberedRule, error)
+	ListWhere(table, chain string, filter RuleFilter) ([]NumberedRule, error)
+	Stats(table, chain string) ([]Stat, error)
+	Chains(table string) ([]ChainInfo, error)
+	ChainExists(table, chain string) (bool, error)
+	NewChain(table, chain string) error
+	ClearChain(table, chain string) error
+	DeleteChain(table, chain string) error
+	SetPolicy(table, chain, policy string) error
+	Save(table string) (*Ruleset, error)
+	Restore(tables map[string]map[string][][]string, opts ...RestoreOption) error
+}
+
+var _ Interface = &IPTables{}
@@ -0,0 +1,60 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestV2(t *testing.T) {
+	var commands []string
+	runner := RunnerFunc(func(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		commands = append(commands, strings.Join(args[1:len(args)-1], " "))
+		if args[3] == "-v" {
+			io.WriteString(stdout, "-N AGENT\n-A AGENT -i lo -c 1 60 -j ACCEPT\n-A AGENT -c 0 0 -j DROP\n")
+		}
+		return 0, nil
+	})
+	ipt, err := New(IPFamily(ProtocolIPv6), CommandRunner(runner), CompatibilityProfile("1.8.7-nft"))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if ipt.Proto() != ProtocolIPv6 || ipt.V1().Proto() != ProtocolIPv6 {
+		t.Fatalf("IPFamily was not applied")
+	}
+
+	rules, err := ipt.List("filter", "AGENT")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	expected := []NumberedRule{
+		{Pos: 1, Rule: Rule{Chain: "AGENT", InInterface: "lo", Target: "ACCEPT", Packets: 1, Bytes: 60}},
+		{Pos: 2, Rule: Rule{Chain: "AGENT", Target: "DROP"}},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("List mismatch:\ngot  %+v\nneed %+v", rules, expected)
+	}
+
+	if _, err := ipt.DeleteWhere("filter", "AGENT", FilterTarget("DROP")); err != nil {
+		t.Fatalf("DeleteWhere failed: %v", err)
+	}
+	if last := commands[len(commands)-1]; last != "-t filter -D AGENT 2" {
+		t.Fatalf("unexpected command %q", last)
+	}
+}